@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
+	api "git.aetherial.dev/aeth/keiji/pkg/client"
+	"git.aetherial.dev/aeth/keiji/pkg/mdimport"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+var commands = map[string]command{
+	"login":   {summary: "log in and save the token to the profile", run: loginCmd},
+	"profile": {summary: "manage the saved servers: list, add, remove, use", run: profileCmd},
+	"post":    {summary: "manage posts: list, get, create, update, delete, edit", run: postCmd},
+	"image":   {summary: "manage images: upload, list, edit, delete", run: imageCmd},
+	"export":  {summary: "download an archive of the whole site", run: exportCmd},
+	"import":  {summary: "load a site archive, or a directory of Markdown posts", run: importCmd},
+	"backup":  {summary: "take, list and download backups: create, list, download", run: backupCmd},
+	"asset":   {summary: "upload an asset", run: assetCmd},
+	"nav":     {summary: "add an icon to the navigation bar", run: navCmd},
+	"menu":    {summary: "add a link to the sidebar menu", run: menuCmd},
+	"admin":   {summary: "add a link to one of the admin panel tables", run: adminCmd},
+}
+
+/*
+Run the subcommand named by the first argument
+
+	:param c: the cli state
+	:param name: the name of the parent command, for error messages
+	:param args: the arguments to the parent command
+	:param subs: the subcommands by name
+*/
+func subcommand(c *cli, name string, args []string, subs map[string]func(c *cli, args []string) error) error {
+	names := make([]string, 0, len(subs))
+	for sub := range subs {
+		names = append(names, sub)
+	}
+	sort.Strings(names)
+	if len(args) == 0 {
+		return usagef("%s needs a subcommand, one of: %s", name, strings.Join(names, ", "))
+	}
+	fn, ok := subs[args[0]]
+	if !ok {
+		return usagef("unknown %s subcommand %q, expected one of: %s", name, args[0], strings.Join(names, ", "))
+	}
+	return fn(c, args[1:])
+}
+
+// check a command got exactly as many positional arguments as it wants
+func expectArgs(name string, args []string, want ...string) error {
+	if len(args) != len(want) {
+		return usagef("usage: keiji-ctl %s <%s>", name, strings.Join(want, "> <"))
+	}
+	return nil
+}
+
+func loginCmd(c *cli, args []string) error {
+	if _, err := parse(c.flags("login"), args); err != nil {
+		return err
+	}
+	// always get a fresh token, even if the profile already has one
+	c.profile.Token = ""
+	client, err := c.session()
+	if err != nil {
+		return err
+	}
+	if client.Cookie == "" {
+		if err = c.login(); err != nil {
+			return err
+		}
+	}
+	return c.output(map[string]string{"token": client.Cookie}, func(w io.Writer) {
+		fmt.Fprintln(w, client.Cookie)
+	})
+}
+
+// how a profile is listed, without its secrets
+type profileEntry struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Username string `json:"username,omitempty"`
+	Current  bool   `json:"current"`
+}
+
+func profileCmd(c *cli, args []string) error {
+	return subcommand(c, "profile", args, map[string]func(c *cli, args []string) error{
+		"list":   profileList,
+		"add":    profileAdd,
+		"remove": profileRemove,
+		"use":    profileUse,
+	})
+}
+
+func profileList(c *cli, args []string) error {
+	if _, err := parse(c.flags("profile list"), args); err != nil {
+		return err
+	}
+	entries := []profileEntry{}
+	for _, name := range c.config.names() {
+		p := c.config.Profiles[name]
+		entries = append(entries, profileEntry{Name: name, Address: p.Address, Username: p.Username, Current: name == c.config.Current})
+	}
+	return c.output(entries, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tNAME\tADDRESS\tUSERNAME")
+		for _, e := range entries {
+			current := ""
+			if e.Current {
+				current = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", current, e.Name, e.Address, e.Username)
+		}
+		tw.Flush()
+	})
+}
+
+func profileAdd(c *cli, args []string) error {
+	var p Profile
+	flags := c.flags("profile add")
+	flags.StringVar(&p.Address, "address", "", "the url of the server, i.e. https://aetherial.dev")
+	flags.StringVar(&p.Username, "username", "", "the admin username to log in with")
+	flags.StringVar(&p.Password, "password", "", "the admin password to log in with")
+	flags.StringVar(&p.Token, "token", "", "an auth token to use instead of logging in")
+	use := flags.Bool("use", false, "make this the current profile")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("profile add", pos, "name"); err != nil {
+		return err
+	}
+	if p.Address == "" {
+		return usagef("-address must be set")
+	}
+	name := pos[0]
+	c.config.Profiles[name] = p
+	if *use || c.config.Current == "" {
+		c.config.Current = name
+	}
+	if err = saveConfig(c.configPath, c.config); err != nil {
+		return err
+	}
+	entry := profileEntry{Name: name, Address: p.Address, Username: p.Username, Current: c.config.Current == name}
+	return c.output(entry, func(w io.Writer) {
+		fmt.Fprintf(w, "profile %s saved.\n", name)
+	})
+}
+
+func profileRemove(c *cli, args []string) error {
+	pos, err := parse(c.flags("profile remove"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("profile remove", pos, "name"); err != nil {
+		return err
+	}
+	name := pos[0]
+	if _, ok := c.config.Profiles[name]; !ok {
+		return fmt.Errorf("profile %q: %w", name, storage.ErrNotExists)
+	}
+	delete(c.config.Profiles, name)
+	if c.config.Current == name {
+		c.config.Current = ""
+	}
+	if err = saveConfig(c.configPath, c.config); err != nil {
+		return err
+	}
+	return c.output(map[string]string{"removed": name}, func(w io.Writer) {
+		fmt.Fprintf(w, "profile %s removed.\n", name)
+	})
+}
+
+func profileUse(c *cli, args []string) error {
+	pos, err := parse(c.flags("profile use"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("profile use", pos, "name"); err != nil {
+		return err
+	}
+	name := pos[0]
+	if _, ok := c.config.Profiles[name]; !ok {
+		return fmt.Errorf("profile %q: %w", name, storage.ErrNotExists)
+	}
+	c.config.Current = name
+	if err = saveConfig(c.configPath, c.config); err != nil {
+		return err
+	}
+	return c.output(map[string]string{"current": name}, func(w io.Writer) {
+		fmt.Fprintf(w, "now using profile %s.\n", name)
+	})
+}
+
+func postCmd(c *cli, args []string) error {
+	return subcommand(c, "post", args, map[string]func(c *cli, args []string) error{
+		"list":   postList,
+		"get":    postGet,
+		"create": postCreate,
+		"update": postUpdate,
+		"delete": postDelete,
+		"edit":   postEdit,
+	})
+}
+
+func postList(c *cli, args []string) error {
+	if _, err := parse(c.flags("post list"), args); err != nil {
+		return err
+	}
+	var docs []storage.Document
+	err := c.call(func(client *api.Client) (err error) {
+		docs, err = client.AllDocuments()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(docs, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCATEGORY\tSLUG\tTITLE")
+		for i := range docs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", docs[i].Ident, docs[i].Category, docs[i].Slug, docs[i].Title)
+		}
+		tw.Flush()
+	})
+}
+
+func postGet(c *cli, args []string) error {
+	flags := c.flags("post get")
+	file := flags.String("file", "", "write the post to this file instead of stdout")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("post get", pos, "id"); err != nil {
+		return err
+	}
+	var doc storage.Document
+	err = c.call(func(client *api.Client) (err error) {
+		doc, err = client.GetDocument(storage.Identifier(pos[0]))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if c.json && *file == "" {
+		return c.output(doc, nil)
+	}
+	b, err := mdimport.FormatFile(doc)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		_, err = c.stdout.Write(b)
+		return err
+	}
+	if err = os.WriteFile(*file, b, 0o644); err != nil {
+		return err
+	}
+	return c.output(map[string]string{"id": string(doc.Ident), "file": *file}, func(w io.Writer) {
+		fmt.Fprintf(w, "post %s written to %s.\n", doc.Ident, *file)
+	})
+}
+
+func postCreate(c *cli, args []string) error {
+	pos, err := parse(c.flags("post create"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("post create", pos, "file"); err != nil {
+		return err
+	}
+	doc, err := readPost(pos[0])
+	if err != nil {
+		return err
+	}
+	var id storage.Identifier
+	err = c.call(func(client *api.Client) (err error) {
+		id, err = client.AddDocument(doc)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]string{"id": string(id)}, func(w io.Writer) {
+		fmt.Fprintf(w, "post %s created.\n", id)
+	})
+}
+
+func postUpdate(c *cli, args []string) error {
+	flags := c.flags("post update")
+	id := flags.String("id", "", "the post to update, defaults to the id in the files front matter")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("post update", pos, "file"); err != nil {
+		return err
+	}
+	doc, err := readPost(pos[0])
+	if err != nil {
+		return err
+	}
+	if *id != "" {
+		doc.Ident = storage.Identifier(*id)
+	}
+	if doc.Ident == "" {
+		return usagef("-id must be set, or the file must have an 'id' in its front matter")
+	}
+	err = c.call(func(client *api.Client) error {
+		return client.UpdateDocument(doc)
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]string{"id": string(doc.Ident)}, func(w io.Writer) {
+		fmt.Fprintf(w, "post %s updated.\n", doc.Ident)
+	})
+}
+
+func postDelete(c *cli, args []string) error {
+	pos, err := parse(c.flags("post delete"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("post delete", pos, "id"); err != nil {
+		return err
+	}
+	err = c.call(func(client *api.Client) error {
+		return client.DeleteDocument(storage.Identifier(pos[0]))
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]string{"id": pos[0]}, func(w io.Writer) {
+		fmt.Fprintf(w, "post %s deleted.\n", pos[0])
+	})
+}
+
+func postEdit(c *cli, args []string) error {
+	pos, err := parse(c.flags("post edit"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("post edit", pos, "id"); err != nil {
+		return err
+	}
+	var doc storage.Document
+	err = c.call(func(client *api.Client) (err error) {
+		doc, err = client.GetDocument(storage.Identifier(pos[0]))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	edited, changed, err := editPost(doc)
+	if err != nil {
+		return err
+	}
+	if changed {
+		edited.Ident = doc.Ident
+		err = c.call(func(client *api.Client) error {
+			return client.UpdateDocument(edited)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.output(map[string]any{"id": doc.Ident, "changed": changed}, func(w io.Writer) {
+		if changed {
+			fmt.Fprintf(w, "post %s updated.\n", doc.Ident)
+		} else {
+			fmt.Fprintln(w, "no changes made.")
+		}
+	})
+}
+
+// read a post from a Markdown file with front matter
+func readPost(name string) (storage.Document, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return storage.Document{}, err
+	}
+	doc, err := mdimport.DocumentFromFile(b, strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)))
+	if err != nil {
+		return doc, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return doc, nil
+}
+
+/*
+Open a post in $EDITOR (falling back to vi) and read it back once the editor exits,
+reporting if the file was changed at all
+*/
+func editPost(doc storage.Document) (storage.Document, bool, error) {
+	b, err := mdimport.FormatFile(doc)
+	if err != nil {
+		return doc, false, err
+	}
+	fh, err := os.CreateTemp("", "keiji-post-*.md")
+	if err != nil {
+		return doc, false, err
+	}
+	defer os.Remove(fh.Name())
+	_, err = fh.Write(b)
+	fh.Close()
+	if err != nil {
+		return doc, false, err
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// $EDITOR can carry arguments, i.e. 'code --wait'
+	args := append(strings.Fields(editor), fh.Name())
+	run := exec.Command(args[0], args[1:]...)
+	run.Stdin, run.Stdout, run.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = run.Run(); err != nil {
+		return doc, false, fmt.Errorf("running %s: %w", editor, err)
+	}
+	edited, err := os.ReadFile(fh.Name())
+	if err != nil {
+		return doc, false, err
+	}
+	if bytes.Equal(b, edited) {
+		return doc, false, nil
+	}
+	out, err := mdimport.DocumentFromFile(edited, doc.Slug)
+	return out, true, err
+}
+
+func exportCmd(c *cli, args []string) error {
+	pos, err := parse(c.flags("export"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("export", pos, "archive"); err != nil {
+		return err
+	}
+	var n int64
+	err = c.call(func(client *api.Client) error {
+		fh, err := os.Create(pos[0])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		n, err = client.Export(fh)
+		return err
+	})
+	if err != nil {
+		os.Remove(pos[0])
+		return err
+	}
+	return c.output(map[string]any{"archive": pos[0], "bytes": n}, func(w io.Writer) {
+		fmt.Fprintf(w, "site exported to %s (%v bytes).\n", pos[0], n)
+	})
+}
+
+func importCmd(c *cli, args []string) error {
+	flags := c.flags("import")
+	mode := flags.String("mode", string(storage.IMPORT_MERGE), "how a site archive is loaded, either 'merge' or 'replace'")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("import", pos, "archive or directory"); err != nil {
+		return err
+	}
+	info, err := os.Stat(pos[0])
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		var report mdimport.Report
+		err = c.call(func(client *api.Client) (err error) {
+			report, err = mdimport.ImportDir(pos[0], client)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return c.output(report, func(w io.Writer) {
+			for i := range report.Created {
+				fmt.Fprintf(w, "  created: %s\n", report.Created[i])
+			}
+			for i := range report.Updated {
+				fmt.Fprintf(w, "  updated: %s\n", report.Updated[i])
+			}
+			fmt.Fprintf(w, "%v posts created, %v posts updated, %v images uploaded.\n", len(report.Created), len(report.Updated), report.Images)
+		})
+	}
+	var summary storage.ImportSummary
+	err = c.call(func(client *api.Client) error {
+		fh, err := os.Open(pos[0])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		summary, err = client.Import(fh, storage.ImportMode(*mode))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(summary, func(w io.Writer) {
+		fmt.Fprintln(w, "site imported successfully.")
+		for table, n := range summary.Created {
+			fmt.Fprintf(w, "  %s: %v created\n", table, n)
+		}
+		for table, n := range summary.Updated {
+			fmt.Fprintf(w, "  %s: %v updated\n", table, n)
+		}
+	})
+}
+
+func backupCmd(c *cli, args []string) error {
+	// a bare 'keiji-ctl backup' takes a backup
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return backupCreate(c, args)
+	}
+	return subcommand(c, "backup", args, map[string]func(c *cli, args []string) error{
+		"create":   backupCreate,
+		"list":     backupList,
+		"download": backupDownload,
+	})
+}
+
+func backupCreate(c *cli, args []string) error {
+	flags := c.flags("backup create")
+	download := flags.String("download", "", "download the new backup to this file and verify it")
+	if _, err := parse(flags, args); err != nil {
+		return err
+	}
+	var snap backup.Snapshot
+	err := c.call(func(client *api.Client) (err error) {
+		snap, err = client.Backup()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if *download != "" {
+		if err = c.downloadBackup(snap.Name, *download, snap.Checksum); err != nil {
+			return err
+		}
+	}
+	return c.output(snap, func(w io.Writer) {
+		fmt.Fprintf(w, "backup %s created (%v bytes, sha256 %s).\n", snap.Name, snap.Size, snap.Checksum)
+		if *download != "" {
+			fmt.Fprintf(w, "backup downloaded to %s and verified.\n", *download)
+		}
+	})
+}
+
+func backupList(c *cli, args []string) error {
+	if _, err := parse(c.flags("backup list"), args); err != nil {
+		return err
+	}
+	var snapshots []backup.Snapshot
+	err := c.call(func(client *api.Client) (err error) {
+		snapshots, err = client.ListBackups()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(snapshots, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tCREATED")
+		for _, snap := range snapshots {
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", snap.Name, snap.Size, snap.Created)
+		}
+		tw.Flush()
+	})
+}
+
+func backupDownload(c *cli, args []string) error {
+	pos, err := parse(c.flags("backup download"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("backup download", pos, "name", "file"); err != nil {
+		return err
+	}
+	if err = c.downloadBackup(pos[0], pos[1], ""); err != nil {
+		return err
+	}
+	return c.output(map[string]string{"name": pos[0], "file": pos[1]}, func(w io.Writer) {
+		fmt.Fprintf(w, "backup downloaded to %s and verified.\n", pos[1])
+	})
+}
+
+/*
+Download a backup and check it against its checksum
+
+	:param name: the name of the backup
+	:param file: the file to save it to
+	:param checksum: the expected sha256, empty to use the one the server sends with the download
+*/
+func (c *cli) downloadBackup(name, file, checksum string) error {
+	var sum string
+	err := c.call(func(client *api.Client) error {
+		fh, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		hash := sha256.New()
+		reported, err := client.DownloadBackup(name, io.MultiWriter(fh, hash))
+		if checksum == "" {
+			checksum = reported
+		}
+		sum = hex.EncodeToString(hash.Sum(nil))
+		return err
+	})
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	if sum != checksum {
+		return fmt.Errorf("%w: %s has sha256 %s, the server reported %s", backup.ErrChecksumMismatch, file, sum, checksum)
+	}
+	return nil
+}
+
+func assetCmd(c *cli, args []string) error {
+	pos, err := parse(c.flags("asset"), args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("asset", pos, "file"); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(pos[0])
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(pos[0])
+	err = c.call(func(client *api.Client) error {
+		return client.AddAsset(name, b)
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]string{"name": name}, func(w io.Writer) {
+		fmt.Fprintf(w, "asset %s uploaded successfully.\n", name)
+	})
+}
+
+func navCmd(c *cli, args []string) error {
+	flags := c.flags("nav")
+	redirect := flags.String("redirect", "", "the website the navbar icon links to")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("nav", pos, "png"); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(pos[0])
+	if err != nil {
+		return err
+	}
+	item := storage.NavBarItem{Link: filepath.Base(pos[0]), Redirect: *redirect, Png: b}
+	err = c.call(func(client *api.Client) error {
+		return client.AddNavbarItem(item)
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]string{"link": item.Link, "redirect": item.Redirect}, func(w io.Writer) {
+		fmt.Fprintln(w, "navigation bar item uploaded successfully.")
+	})
+}
+
+func menuCmd(c *cli, args []string) error {
+	flags := c.flags("menu")
+	var item storage.LinkPair
+	flags.StringVar(&item.Text, "text", "", "the text to display on the menu item")
+	flags.StringVar(&item.Link, "redirect", "", "where the menu item links to")
+	if _, err := parse(flags, args); err != nil {
+		return err
+	}
+	if item.Text == "" || item.Link == "" {
+		return usagef("-text and -redirect must both be set")
+	}
+	err := c.call(func(client *api.Client) error {
+		return client.AddMenuItem(item)
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(item, func(w io.Writer) {
+		fmt.Fprintln(w, "menu item added successfully.")
+	})
+}
+
+func adminCmd(c *cli, args []string) error {
+	flags := c.flags("admin")
+	var item storage.TableData
+	col := flags.String("col", "", "the table to add the link under")
+	flags.StringVar(&item.DisplayName, "text", "", "the text to display for the link")
+	flags.StringVar(&item.Link, "redirect", "", "where the link goes")
+	if _, err := parse(flags, args); err != nil {
+		return err
+	}
+	if *col == "" || item.Link == "" {
+		return usagef("-col and -redirect must both be set")
+	}
+	err := c.call(func(client *api.Client) error {
+		return client.AddAdminTableEntry(item, *col)
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(map[string]any{"col": *col, "item": item}, func(w io.Writer) {
+		fmt.Fprintln(w, "admin item added successfully.")
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// the environment variable that overrides where the config file lives
+const CONFIG_ENV = "KEIJI_CTL_CONFIG"
+
+/*
+A server that keiji-ctl can talk to. Either a token (the auth cookie from logging in) or a
+username and password can be saved, when credentials are saved the token is refreshed
+automatically once it expires
+*/
+type Profile struct {
+	Address  string `json:"address"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// The contents of the config file
+type Config struct {
+	Current  string             `json:"current"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+/*
+Work out where the config file is, $KEIJI_CTL_CONFIG if its set and keiji/config.json
+in the users config directory otherwise
+*/
+func defaultConfigPath() string {
+	if p := os.Getenv(CONFIG_ENV); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "keiji-ctl.json"
+	}
+	return filepath.Join(dir, "keiji", "config.json")
+}
+
+/*
+Read the config file, a missing file is an empty config
+
+	:param p: the path to the config file
+*/
+func loadConfig(p string) (Config, error) {
+	cfg := Config{Profiles: map[string]Profile{}}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = map[string]Profile{}
+	}
+	return cfg, nil
+}
+
+/*
+Write the config file, only readable by the current user since it can hold credentials
+
+	:param p: the path to the config file
+	:param cfg: the config to write
+*/
+func saveConfig(p string, cfg Config) error {
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0o600)
+}
+
+// the profile names in a stable order
+func (c Config) names() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
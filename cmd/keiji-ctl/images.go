@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	api "git.aetherial.dev/aeth/keiji/pkg/client"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// keeps track of what was uploaded so an interrupted batch upload can pick up where it left off
+const UploadStateFile = ".keiji-upload.json"
+
+// the file extensions picked up when uploading a directory
+var imageExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".webp": true,
+	".svg":  true,
+	".bmp":  true,
+	".avif": true,
+}
+
+// the extensions of sidecar files, tried in order. JSON is valid YAML so both are read the same way
+var sidecarExtensions = []string{".yaml", ".yml", ".json"}
+
+/*
+The metadata that can be set for an image in a sidecar file next to it, i.e. cat.png.yaml:
+
+	title: a cat
+	description: sitting on a keyboard
+*/
+type imageMeta struct {
+	Title string `yaml:"title"`
+	Desc  string `yaml:"description"`
+}
+
+// The contents of the UploadStateFile
+type uploadState struct {
+	// the sha256 of each uploaded file to its image id, by server address
+	Uploaded map[string]map[string]storage.Identifier `json:"uploaded"`
+}
+
+// What happened to a single file in a batch upload
+type uploadResult struct {
+	File    string             `json:"file"`
+	ID      storage.Identifier `json:"id"`
+	Skipped bool               `json:"skipped"`
+}
+
+func imageCmd(c *cli, args []string) error {
+	return subcommand(c, "image", args, map[string]func(c *cli, args []string) error{
+		"upload": imageUpload,
+		"list":   imageList,
+		"edit":   imageEdit,
+		"delete": imageDelete,
+	})
+}
+
+func imageUpload(c *cli, args []string) error {
+	flags := c.flags("image upload")
+	title := flags.String("title", "", "the title for the images, defaults to the file name")
+	desc := flags.String("desc", "", "the description for the images")
+	statePath := flags.String("state", UploadStateFile, "where to keep track of finished uploads so a batch can be resumed")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) == 0 {
+		return usagef("usage: keiji-ctl image upload [-title] [-desc] <file, glob or directory>...")
+	}
+	files, err := expandImages(pos)
+	if err != nil {
+		return err
+	}
+	client, err := c.session()
+	if err != nil {
+		return err
+	}
+	st, err := loadUploadState(*statePath)
+	if err != nil {
+		return err
+	}
+	done, ok := st.Uploaded[client.Address]
+	if !ok {
+		done = map[string]storage.Identifier{}
+		st.Uploaded[client.Address] = done
+	}
+
+	results := []uploadResult{}
+	for i, file := range files {
+		progress := fmt.Sprintf("[%v/%v] %s", i+1, len(files), file)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		key := hex.EncodeToString(sum[:])
+		if id, ok := done[key]; ok {
+			fmt.Fprintf(c.stderr, "%s: already uploaded as %s\n", progress, id)
+			results = append(results, uploadResult{File: file, ID: id, Skipped: true})
+			continue
+		}
+		meta, err := readSidecar(file)
+		if err != nil {
+			return err
+		}
+		if meta.Title == "" {
+			meta.Title = *title
+		}
+		if meta.Title == "" {
+			meta.Title = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		if meta.Desc == "" {
+			meta.Desc = *desc
+		}
+		var id storage.Identifier
+		err = c.call(func(client *api.Client) (err error) {
+			id, err = client.AddImage(b, meta.Title, meta.Desc)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("uploading %s, run the same command again to resume: %w", file, err)
+		}
+		done[key] = id
+		// saved after every file so an interrupted batch doesnt upload anything twice
+		if err = saveUploadState(*statePath, st); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stderr, "%s: uploaded as %s (%v bytes)\n", progress, id, len(b))
+		results = append(results, uploadResult{File: file, ID: id})
+	}
+	return c.output(results, func(w io.Writer) {
+		skipped := 0
+		for i := range results {
+			if results[i].Skipped {
+				skipped++
+			}
+		}
+		fmt.Fprintf(w, "%v images uploaded, %v already uploaded.\n", len(results)-skipped, skipped)
+	})
+}
+
+func imageList(c *cli, args []string) error {
+	if _, err := parse(c.flags("image list"), args); err != nil {
+		return err
+	}
+	var imgs []storage.Image
+	err := c.call(func(client *api.Client) (err error) {
+		imgs, err = client.AllImages()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(imgs, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTITLE\tCREATED\tDESCRIPTION")
+		for i := range imgs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", imgs[i].Ident, imgs[i].Title, imgs[i].Created, imgs[i].Desc)
+		}
+		tw.Flush()
+	})
+}
+
+func imageEdit(c *cli, args []string) error {
+	flags := c.flags("image edit")
+	title := flags.String("title", "", "the new title")
+	desc := flags.String("desc", "", "the new description")
+	pos, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err = expectArgs("image edit", pos, "id"); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if len(set) == 0 {
+		return usagef("nothing to change, set -title and/or -desc")
+	}
+	var img storage.Image
+	err = c.call(func(client *api.Client) error {
+		img, err = client.GetImage(storage.Identifier(pos[0]))
+		if err != nil {
+			return err
+		}
+		if set["title"] {
+			img.Title = *title
+		}
+		if set["desc"] {
+			img.Desc = *desc
+		}
+		return client.UpdateImage(img)
+	})
+	if err != nil {
+		return err
+	}
+	return c.output(img, func(w io.Writer) {
+		fmt.Fprintf(w, "image %s updated.\n", img.Ident)
+	})
+}
+
+func imageDelete(c *cli, args []string) error {
+	pos, err := parse(c.flags("image delete"), args)
+	if err != nil {
+		return err
+	}
+	if len(pos) == 0 {
+		return usagef("usage: keiji-ctl image delete <id>...")
+	}
+	for _, id := range pos {
+		err = c.call(func(client *api.Client) error {
+			return client.DeleteImage(storage.Identifier(id))
+		})
+		if err != nil {
+			return fmt.Errorf("deleting %s: %w", id, err)
+		}
+		if !c.json {
+			fmt.Fprintf(c.stdout, "image %s deleted.\n", id)
+		}
+	}
+	return c.output(map[string][]string{"deleted": pos}, func(io.Writer) {})
+}
+
+/*
+Turn the arguments to 'image upload' into a list of files. Globs are expanded (for when the
+shell didnt), directories are searched for images and files are taken as they are
+
+	:param args: files, globs and directories
+*/
+func expandImages(args []string) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	for _, arg := range args {
+		matches := []string{arg}
+		globbed := strings.ContainsAny(arg, "*?[")
+		if globbed {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, usagef("bad glob %q: %s", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, usagef("no files match %q", arg)
+			}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				if !globbed || imageExtensions[strings.ToLower(filepath.Ext(match))] {
+					add(match)
+				}
+				continue
+			}
+			err = filepath.WalkDir(match, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(p))] {
+					add(p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+/*
+Read the sidecar file for an image if it has one, an image without one has empty metadata
+
+	:param file: the image file
+*/
+func readSidecar(file string) (imageMeta, error) {
+	var meta imageMeta
+	for _, ext := range sidecarExtensions {
+		b, err := os.ReadFile(file + ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return meta, err
+		}
+		if err = yaml.Unmarshal(b, &meta); err != nil {
+			return meta, fmt.Errorf("parsing %s: %w", file+ext, err)
+		}
+		return meta, nil
+	}
+	return meta, nil
+}
+
+/*
+Read the record of what was already uploaded, empty if there isnt one yet. A record that
+cant be read is an error, starting over would upload everything in it again
+
+	:param p: the path of the UploadStateFile
+*/
+func loadUploadState(p string) (uploadState, error) {
+	st := uploadState{Uploaded: map[string]map[string]storage.Identifier{}}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err = json.Unmarshal(b, &st); err != nil {
+		return st, fmt.Errorf("parsing %s: %w", p, err)
+	}
+	if st.Uploaded == nil {
+		st.Uploaded = map[string]map[string]storage.Identifier{}
+	}
+	return st, nil
+}
+
+func saveUploadState(p string, st uploadState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0o644)
+}
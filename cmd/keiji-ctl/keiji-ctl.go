@@ -1,188 +1,285 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"sort"
+	"strings"
 
-	"git.aetherial.dev/aeth/keiji/pkg/auth"
-	"git.aetherial.dev/aeth/keiji/pkg/controller"
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
+	api "git.aetherial.dev/aeth/keiji/pkg/client"
+	"git.aetherial.dev/aeth/keiji/pkg/env"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-// authenticate and get the cookie needed to make updates
-func authenticate(url, username, password string) *http.Cookie {
-	client := http.Client{}
-	b, _ := json.Marshal(auth.Credentials{Username: username, Password: password})
-	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatal("auth failed: ", err)
+// exit codes, the same failure exits with the same code no matter the command
+const (
+	EXIT_OK             = 0
+	EXIT_ERROR          = 1 // something failed locally, i.e. a file couldnt be read
+	EXIT_USAGE          = 2 // bad flags, arguments or an unknown command
+	EXIT_REQUEST_FAILED = 3 // the server couldnt be reached or returned an error
+	EXIT_NOT_FOUND      = 4 // the post, backup, etc. doesnt exist
+	EXIT_UNAUTHORIZED   = 5 // missing or bad credentials
+	EXIT_VERIFY_FAILED  = 6 // a download didnt match its checksum
+)
+
+type usageError struct {
+	msg string
+}
+
+func (u *usageError) Error() string {
+	return u.msg
+}
+
+func usagef(format string, args ...any) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// A keiji-ctl subcommand
+type command struct {
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+// The state shared between every command
+type cli struct {
+	stdout      io.Writer
+	stderr      io.Writer
+	json        bool
+	configPath  string
+	config      Config
+	profileName string
+	profile     Profile
+	client      *api.Client
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+/*
+Parse the global flags, load the profile and run the command, returning the exit code
+
+	:param args: the command line, without the program name
+	:param stdout: where command output is written
+	:param stderr: where usage and errors are written
+*/
+func run(args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+	flags := flag.NewFlagSet("keiji-ctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&c.configPath, "config", defaultConfigPath(), "the config file profiles are kept in, can also be set with $"+CONFIG_ENV)
+	flags.StringVar(&c.profileName, "profile", "", "the profile to use, defaults to the current profile")
+	address := flags.String("address", "", "the url of the server, overrides the profile")
+	token := flags.String("token", "", "the auth token (cookie) to use, overrides the profile")
+	flags.BoolVar(&c.json, "json", false, "write output as JSON")
+	flags.Usage = func() { printUsage(flags) }
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return EXIT_OK
+		}
+		return EXIT_USAGE
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode > 200 {
-		msg, _ := io.ReadAll(resp.Body)
-		log.Fatal("Invalid credentials or server error: ", string(msg), "\n Status code: ", resp.StatusCode)
+	if flags.NArg() == 0 {
+		printUsage(flags)
+		return EXIT_USAGE
 	}
-	cookies := resp.Cookies()
-	for i := range cookies {
-		if cookies[i].Name == controller.AUTH_COOKIE_NAME {
-			return cookies[i]
-		}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", flags.Arg(0))
+		printUsage(flags)
+		return EXIT_USAGE
 	}
-	log.Fatal("Auth cookie not found.")
-	return nil
-}
 
-// prepare the auth cookie
-func prepareCookie(address string) *http.Cookie {
+	cfg, err := loadConfig(c.configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, "error: reading the config file:", err)
+		return EXIT_ERROR
+	}
+	c.config = cfg
+	if c.profileName == "" {
+		c.profileName = cfg.Current
+	} else if _, ok := cfg.Profiles[c.profileName]; !ok {
+		fmt.Fprintf(stderr, "error: there is no profile named %q\n", c.profileName)
+		return EXIT_USAGE
+	}
+	c.profile = cfg.Profiles[c.profileName]
+	if *address != "" {
+		c.profile.Address = *address
+	}
+	if *token != "" {
+		c.profile.Token = *token
+	}
 
-	parsedAddr, err := url.Parse(address)
-	dn := parsedAddr.Hostname()
+	err = cmd.run(c, flags.Args()[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return EXIT_OK
+	}
 	if err != nil {
-		log.Fatal("unparseable address: ", address, " error: ", err)
+		fmt.Fprintln(stderr, "error:", err)
 	}
-	var preparedCookie *http.Cookie
-	if cookie == "" {
-		log.Fatal("Cookie cannot be empty.")
-	} else {
-		preparedCookie = &http.Cookie{Value: cookie, Name: controller.AUTH_COOKIE_NAME, Domain: dn}
+	return exitCode(err)
+}
+
+func printUsage(flags *flag.FlagSet) {
+	w := flags.Output()
+	fmt.Fprint(w, "usage: keiji-ctl [flags] <command> [arguments]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
-	return preparedCookie
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprint(w, "\nflags:\n")
+	flags.PrintDefaults()
+	fmt.Fprintf(w, "\nexit codes:\n  %v ok, %v error, %v usage, %v request failed, %v not found, %v unauthorized, %v verification failed\n",
+		EXIT_OK, EXIT_ERROR, EXIT_USAGE, EXIT_REQUEST_FAILED, EXIT_NOT_FOUND, EXIT_UNAUTHORIZED, EXIT_VERIFY_FAILED)
 }
 
-var pngFile string
-var redirect string
-var text string
-var col string
-var cmd string
-var address string
-var cookie string
+// map an error from a command to the exit code for that kind of failure
+func exitCode(err error) int {
+	var usage *usageError
+	var failed *api.RequestFailed
+	var unreachable *url.Error
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &usage):
+		return EXIT_USAGE
+	case errors.Is(err, api.ErrUnauthorized):
+		return EXIT_UNAUTHORIZED
+	case errors.Is(err, storage.ErrNotExists):
+		return EXIT_NOT_FOUND
+	case errors.Is(err, backup.ErrChecksumMismatch):
+		return EXIT_VERIFY_FAILED
+	case errors.As(err, &failed), errors.As(err, &unreachable):
+		return EXIT_REQUEST_FAILED
+	default:
+		return EXIT_ERROR
+	}
+}
 
-func main() {
+/*
+Parse a commands flags, allowing them to come before or after its positional arguments
 
-	flag.StringVar(&pngFile, "png", "", "The location of the PNG to upload")
-	flag.StringVar(&redirect, "redirect", "", "the website that the navbar will redirect to")
-	flag.StringVar(&text, "text", "", "the text to display on the menu item")
-	flag.StringVar(&col, "col", "", "the column to add/populate the admin table item under")
-	flag.StringVar(&cmd, "cmd", "", "the 'command' for the seed program to use, currently supports options 'admin', 'menu', and 'asset', 'nav'")
-	flag.StringVar(&address, "address", "https://aetherial.dev", "override the url to contact.")
-	flag.StringVar(&cookie, "cookie", "", "pass a cookie to bypass direct authentication")
-	flag.Parse()
-
-	client := http.Client{}
-
-	switch cmd {
-	case "auth":
-		cookie := authenticate(fmt.Sprintf("%s/login", address), os.Getenv("KEIJI_USERNAME"), os.Getenv("KEIJI_PASSWORD"))
-		fmt.Println(cookie.Value)
-
-	case "asset":
-		b, err := os.ReadFile(pngFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, fileName := path.Split(pngFile)
-		item := storage.Asset{
-			Name: fileName,
-			Data: b,
-		}
-		data, _ := json.Marshal(item)
-		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/admin/asset", address), bytes.NewReader(data))
-		req.AddCookie(prepareCookie(address))
-		req.Header.Add("Content-Type", "application/json")
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Println("There was an error performing the desired request: ", err.Error())
-			os.Exit(1)
+	:param flags: the commands flags
+	:param args: the arguments to the command
+*/
+func parse(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, &usageError{msg: err.Error()}
 		}
-		if resp.StatusCode > 200 {
-			defer resp.Body.Close()
-			b, _ := io.ReadAll(resp.Body)
-			fmt.Println("There was an error performing the desired request: ", string(b))
-			os.Exit(2)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
 		}
-		fmt.Println("navigation bar item upload successfully.")
-		os.Exit(0)
-
-	case "nav":
-		fmt.Println(string(pngFile))
-		b, err := os.ReadFile(pngFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, fileName := path.Split(pngFile)
-		fmt.Println(fileName)
-		item := storage.NavBarItem{
-			Link:     fileName,
-			Redirect: redirect,
-			Png:      b,
-		}
-		data, _ := json.Marshal(item)
-		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/admin/navbar", address), bytes.NewReader(data))
-		req.AddCookie(prepareCookie(address))
-		req.Header.Add("Content-Type", "application/json")
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Println("There was an error performing the desired request: ", err.Error())
-			os.Exit(1)
-		}
-		if resp.StatusCode > 200 {
-			defer resp.Body.Close()
-			b, _ := io.ReadAll(resp.Body)
-			fmt.Println("There was an error performing the desired request: ", string(b))
-			os.Exit(2)
-		}
-		fmt.Println("png item upload successfully.")
-		os.Exit(0)
-	case "menu":
-		b, _ := json.Marshal(storage.LinkPair{Text: text, Link: redirect})
-		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/admin/menu", address), bytes.NewReader(b))
-		req.AddCookie(prepareCookie(address))
-		req.Header.Add("Content-Type", "application/json")
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Println("There was an error performing the desired request: ", err.Error())
-			os.Exit(1)
-		}
-		if resp.StatusCode > 200 {
-			defer resp.Body.Close()
-			b, _ := io.ReadAll(resp.Body)
-			fmt.Println("There was an error performing the desired request: ", string(b))
-			os.Exit(3)
-		}
-		fmt.Println("menu item uploaded successfully.")
-		os.Exit(0)
-	case "admin":
-		tables := make(map[string][]storage.TableData)
-		adminPage := storage.AdminPage{Tables: tables}
-		adminPage.Tables[col] = append(adminPage.Tables[col], storage.TableData{Link: redirect, DisplayName: text})
-		b, _ := json.Marshal(adminPage)
-		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/admin/panel", address), bytes.NewReader(b))
-		req.AddCookie(prepareCookie(address))
-		req.Header.Add("Content-Type", "application/json")
-		resp, err := client.Do(req)
-		if err != nil {
-			fmt.Println("There was an error performing the desired request: ", err.Error())
-			os.Exit(1)
-		}
-		if resp.StatusCode > 200 {
-			defer resp.Body.Close()
-			b, _ := io.ReadAll(resp.Body)
-			fmt.Println("There was an error performing the desired request: ", string(b))
-			os.Exit(4)
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// create the flag set for a command
+func (c *cli) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("keiji-ctl "+name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	return flags
+}
+
+/*
+Write the result of a command, as JSON with -json or with human for people otherwise
+
+	:param v: the value to encode with -json
+	:param human: prints v for people
+*/
+func (c *cli) output(v any, human func(w io.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	human(c.stdout)
+	return nil
+}
+
+// the credentials saved in the profile, or from the environment if the profile has none
+func (c *cli) credentials() (string, string) {
+	if c.profile.Username != "" {
+		return c.profile.Username, c.profile.Password
+	}
+	return os.Getenv(env.KEIJI_USERNAME), os.Getenv(env.KEIJI_PASSWORD)
+}
+
+// get the client for the profiles server, logging in first if theres no token yet
+func (c *cli) session() (*api.Client, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+	if c.profile.Address == "" {
+		return nil, usagef("no server to talk to, pass -address or add a profile with 'keiji-ctl profile add'")
+	}
+	c.client = api.NewClient(strings.TrimSuffix(c.profile.Address, "/"), c.profile.Token)
+	if c.profile.Token == "" {
+		if user, _ := c.credentials(); user != "" {
+			if err := c.login(); err != nil {
+				return nil, err
+			}
 		}
-		fmt.Println("admin item added successfully.")
-		os.Exit(0)
 	}
+	return c.client, nil
+}
 
+// log in with the profiles credentials and save the new token to the profile
+func (c *cli) login() error {
+	user, pass := c.credentials()
+	if user == "" {
+		return usagef("no credentials to log in with, add them to the profile or set %s and %s", env.KEIJI_USERNAME, env.KEIJI_PASSWORD)
+	}
+	if err := c.client.Login(user, pass); err != nil {
+		return err
+	}
+	c.profile.Token = c.client.Cookie
+	saved, ok := c.config.Profiles[c.profileName]
+	if !ok {
+		return nil
+	}
+	// keep the token so the next command doesnt have to log in again
+	saved.Token = c.client.Cookie
+	c.config.Profiles[c.profileName] = saved
+	return saveConfig(c.configPath, c.config)
+}
+
+/*
+Make requests against the server, logging in again and retrying once if the token
+has expired and there are credentials to log in with
+
+	:param fn: makes the requests
+*/
+func (c *cli) call(fn func(client *api.Client) error) error {
+	client, err := c.session()
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !errors.Is(err, api.ErrUnauthorized) {
+		return err
+	}
+	if user, _ := c.credentials(); user == "" {
+		return err
+	}
+	if err = c.login(); err != nil {
+		return err
+	}
+	return fn(client)
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/routes"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAuthSource struct{}
+
+func (testAuthSource) AdminUsername() string { return "admin" }
+func (testAuthSource) AdminPassword() string { return "hunter2" }
+
+// start a server with the real routes in front of an in memory database
+func newTestServer(t *testing.T) (*httptest.Server, *storage.SQLiteRepo) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv(env.KEIJI_USERNAME, "")
+	t.Setenv(env.KEIJI_PASSWORD, "")
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	imageDir := t.TempDir()
+	repo := storage.NewSQLiteRepo(db, storage.FilesystemImageIO{RootDir: imageDir})
+	if err = repo.Migrate(storage.RequiredTables); err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	// the login handler renders the admin page
+	e.SetHTMLTemplate(template.Must(template.New("").Parse(`{{define "admin"}}admin{{end}}`)))
+	c := routes.Register(e, "127.0.0.1", repo, repo.ImageStore(), os.DirFS(t.TempDir()), testAuthSource{}, backup.NewManager(repo, imageDir, t.TempDir(), 0))
+	t.Cleanup(c.Close)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv, repo
+}
+
+// every image in the repo, failing the test if they cant be read
+func allImages(t *testing.T, repo *storage.SQLiteRepo) []storage.Image {
+	imgs, err := repo.GetAllImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imgs
+}
+
+// run keiji-ctl against a config file, returning the exit code and output
+func ctl(t *testing.T, config string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-config", config}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestProfiles(t *testing.T) {
+	srv, _ := newTestServer(t)
+	config := filepath.Join(t.TempDir(), "config.json")
+
+	code, _, _ := ctl(t, config, "post", "list")
+	assert.Equal(t, EXIT_USAGE, code, "no address anywhere")
+
+	code, _, _ = ctl(t, config, "profile", "add", "local", "-address", srv.URL, "-username", "admin", "-password", "hunter2")
+	assert.Equal(t, EXIT_OK, code)
+	code, _, _ = ctl(t, config, "profile", "add", "bad", "-address", srv.URL, "-username", "admin", "-password", "wrong")
+	assert.Equal(t, EXIT_OK, code)
+
+	code, out, _ := ctl(t, config, "-json", "profile", "list")
+	assert.Equal(t, EXIT_OK, code)
+	var entries []profileEntry
+	assert.Nil(t, json.Unmarshal([]byte(out), &entries))
+	assert.Equal(t, []profileEntry{
+		{Name: "bad", Address: srv.URL, Username: "admin"},
+		{Name: "local", Address: srv.URL, Username: "admin", Current: true},
+	}, entries)
+	assert.NotContains(t, out, "hunter2")
+
+	// the first request logs in and saves the token
+	code, _, _ = ctl(t, config, "post", "list")
+	assert.Equal(t, EXIT_OK, code)
+	cfg, err := loadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, cfg.Profiles["local"].Token)
+
+	// an expired token is refreshed with the saved credentials
+	code, _, _ = ctl(t, config, "-token", "expired", "post", "list")
+	assert.Equal(t, EXIT_OK, code)
+
+	code, _, _ = ctl(t, config, "-profile", "bad", "post", "list")
+	assert.Equal(t, EXIT_UNAUTHORIZED, code)
+	code, _, _ = ctl(t, config, "-profile", "missing", "post", "list")
+	assert.Equal(t, EXIT_USAGE, code)
+
+	code, _, _ = ctl(t, config, "profile", "use", "bad")
+	assert.Equal(t, EXIT_OK, code)
+	code, _, _ = ctl(t, config, "profile", "remove", "bad")
+	assert.Equal(t, EXIT_OK, code)
+	cfg, _ = loadConfig(config)
+	assert.Equal(t, "", cfg.Current)
+	assert.Len(t, cfg.Profiles, 1)
+
+	info, err := os.Stat(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestPostCommands(t *testing.T) {
+	srv, repo := newTestServer(t)
+	config := filepath.Join(t.TempDir(), "config.json")
+	ctl(t, config, "profile", "add", "local", "-address", srv.URL, "-username", "admin", "-password", "hunter2")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hello-world.md")
+	os.WriteFile(file, []byte("---\ntitle: Hello\ntags: [a]\n---\nfirst draft\n"), 0o644)
+	code, out, _ := ctl(t, config, "-json", "post", "create", file)
+	assert.Equal(t, EXIT_OK, code)
+	var created map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(out), &created))
+	id := created["id"]
+	doc, err := repo.GetDocument(storage.Identifier(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello-world", doc.Slug)
+
+	code, out, _ = ctl(t, config, "-json", "post", "list")
+	assert.Equal(t, EXIT_OK, code)
+	var docs []storage.Document
+	assert.Nil(t, json.Unmarshal([]byte(out), &docs))
+	assert.Len(t, docs, 1)
+
+	// get then update round trips through the front matter id
+	got := filepath.Join(dir, "got.md")
+	code, _, _ = ctl(t, config, "post", "get", id, "-file", got)
+	assert.Equal(t, EXIT_OK, code)
+	b, _ := os.ReadFile(got)
+	os.WriteFile(got, bytes.Replace(b, []byte("first draft"), []byte("second draft"), 1), 0o644)
+	code, _, _ = ctl(t, config, "post", "update", got)
+	assert.Equal(t, EXIT_OK, code)
+	doc, _ = repo.GetDocument(storage.Identifier(id))
+	assert.Equal(t, "second draft\n", doc.Body)
+	assert.Equal(t, "Hello", doc.Title)
+
+	t.Setenv("EDITOR", "sed -i s/second/third/")
+	code, out, _ = ctl(t, config, "post", "edit", id)
+	assert.Equal(t, EXIT_OK, code, out)
+	doc, _ = repo.GetDocument(storage.Identifier(id))
+	assert.Equal(t, "third draft\n", doc.Body)
+
+	code, _, _ = ctl(t, config, "post", "delete", id)
+	assert.Equal(t, EXIT_OK, code)
+	code, _, _ = ctl(t, config, "post", "get", id)
+	assert.Equal(t, EXIT_NOT_FOUND, code)
+	code, _, _ = ctl(t, config, "post", "delete", id)
+	assert.Equal(t, EXIT_NOT_FOUND, code)
+
+	code, _, _ = ctl(t, config, "post", "get")
+	assert.Equal(t, EXIT_USAGE, code)
+	code, _, _ = ctl(t, config, "post", "publish")
+	assert.Equal(t, EXIT_USAGE, code)
+	code, _, _ = ctl(t, config, "post", "create", filepath.Join(dir, "missing.md"))
+	assert.Equal(t, EXIT_ERROR, code)
+}
+
+func TestSiteCommands(t *testing.T) {
+	srv, repo := newTestServer(t)
+	config := filepath.Join(t.TempDir(), "config.json")
+	ctl(t, config, "profile", "add", "local", "-address", srv.URL, "-username", "admin", "-password", "hunter2")
+	dir := t.TempDir()
+
+	code, _, _ := ctl(t, config, "menu", "-text", "home", "-redirect", "/")
+	assert.Equal(t, EXIT_OK, code)
+	code, _, _ = ctl(t, config, "admin", "-col", "posts", "-text", "all posts", "-redirect", "/admin/posts/all")
+	assert.Equal(t, EXIT_OK, code)
+	os.WriteFile(filepath.Join(dir, "icon.png"), []byte("png"), 0o644)
+	code, _, _ = ctl(t, config, "nav", "-redirect", "https://example.com", filepath.Join(dir, "icon.png"))
+	assert.Equal(t, EXIT_OK, code)
+	menu, err := repo.GetDropdownElements()
+	assert.NoError(t, err)
+	assert.Len(t, menu, 1)
+	navbar, err := repo.GetNavBarLinks()
+	assert.NoError(t, err)
+	assert.Len(t, navbar, 1)
+	tables, err := repo.GetAdminTables()
+	assert.NoError(t, err)
+	assert.Len(t, tables.Tables["posts"], 1)
+
+	archive := filepath.Join(dir, "site.tar.gz")
+	code, _, _ = ctl(t, config, "export", archive)
+	assert.Equal(t, EXIT_OK, code)
+	code, out, _ := ctl(t, config, "-json", "import", "-mode", "replace", archive)
+	assert.Equal(t, EXIT_OK, code)
+	var summary storage.ImportSummary
+	assert.Nil(t, json.Unmarshal([]byte(out), &summary))
+	assert.Equal(t, 1, summary.Created["menu"])
+
+	code, out, _ = ctl(t, config, "-json", "backup", "-download", filepath.Join(dir, "backup.tar.gz"))
+	assert.Equal(t, EXIT_OK, code)
+	var snap backup.Snapshot
+	assert.Nil(t, json.Unmarshal([]byte(out), &snap))
+	_, err = backup.Verify(filepath.Join(dir, "backup.tar.gz"))
+	assert.Nil(t, err)
+	code, out, _ = ctl(t, config, "backup", "list")
+	assert.Equal(t, EXIT_OK, code)
+	assert.True(t, strings.Contains(out, snap.Name), out)
+	code, _, _ = ctl(t, config, "backup", "download", "keiji-backup-missing.tar.gz", filepath.Join(dir, "missing.tar.gz"))
+	assert.Equal(t, EXIT_NOT_FOUND, code)
+
+	code, _, _ = ctl(t, config, "frobnicate")
+	assert.Equal(t, EXIT_USAGE, code)
+}
+
+func TestImageCommands(t *testing.T) {
+	srv, repo := newTestServer(t)
+	config := filepath.Join(t.TempDir(), "config.json")
+	ctl(t, config, "profile", "add", "local", "-address", srv.URL, "-username", "admin", "-password", "hunter2")
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "art", "old"), 0o755)
+	os.WriteFile(filepath.Join(dir, "art", "cat.png"), []byte("\x89PNG\r\n\x1a\ncat"), 0o644)
+	os.WriteFile(filepath.Join(dir, "art", "cat.png.yaml"), []byte("title: a cat\ndescription: on a keyboard\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "art", "old", "dog.JPG"), []byte("\xff\xd8\xff\xe0dog"), 0o644)
+	os.WriteFile(filepath.Join(dir, "art", "notes.txt"), []byte("not an image"), 0o644)
+	state := filepath.Join(dir, "state.json")
+
+	code, out, errOut := ctl(t, config, "-json", "image", "upload", "-state", state, "-desc", "batch", filepath.Join(dir, "art"))
+	assert.Equal(t, EXIT_OK, code, errOut)
+	assert.Contains(t, errOut, "[2/2]")
+	var results []uploadResult
+	assert.Nil(t, json.Unmarshal([]byte(out), &results))
+	assert.Len(t, results, 2)
+	imgs := allImages(t, repo)
+	assert.Len(t, imgs, 2)
+	byTitle := map[string]storage.Image{}
+	for _, img := range imgs {
+		byTitle[img.Title] = img
+	}
+	assert.Equal(t, "on a keyboard", byTitle["a cat"].Desc)
+	assert.Equal(t, "batch", byTitle["dog"].Desc)
+
+	// a rerun, i.e. after an interrupted batch, skips what was already uploaded
+	os.WriteFile(filepath.Join(dir, "art", "bird.gif"), []byte("GIF89abird"), 0o644)
+	code, out, _ = ctl(t, config, "image", "upload", "-state", state, filepath.Join(dir, "art", "*"))
+	assert.Equal(t, EXIT_OK, code)
+	assert.Contains(t, out, "1 images uploaded, 2 already uploaded.")
+	assert.Len(t, allImages(t, repo), 3)
+
+	code, out, _ = ctl(t, config, "-json", "image", "list")
+	assert.Equal(t, EXIT_OK, code)
+	var listed []storage.Image
+	assert.Nil(t, json.Unmarshal([]byte(out), &listed))
+	assert.Len(t, listed, 3)
+	assert.Nil(t, listed[0].Data)
+
+	id := string(byTitle["dog"].Ident)
+	code, _, _ = ctl(t, config, "image", "edit", id, "-title", "a dog")
+	assert.Equal(t, EXIT_OK, code)
+	img, _ := repo.GetImage(storage.Identifier(id))
+	assert.Equal(t, "a dog", img.Title)
+	assert.Equal(t, "batch", img.Desc)
+	code, _, _ = ctl(t, config, "image", "edit", id)
+	assert.Equal(t, EXIT_USAGE, code)
+
+	code, _, _ = ctl(t, config, "image", "delete", id)
+	assert.Equal(t, EXIT_OK, code)
+	assert.Len(t, allImages(t, repo), 2)
+	code, _, _ = ctl(t, config, "image", "delete", id)
+	assert.Equal(t, EXIT_NOT_FOUND, code)
+	// files are checked by their contents, not their names
+	os.WriteFile(filepath.Join(dir, "fake.png"), []byte("not an image"), 0o644)
+	code, _, errOut = ctl(t, config, "image", "upload", "-state", state, filepath.Join(dir, "fake.png"))
+	assert.Equal(t, EXIT_REQUEST_FAILED, code)
+	assert.Contains(t, errOut, "415")
+	assert.Len(t, allImages(t, repo), 2)
+	code, _, _ = ctl(t, config, "image", "upload", filepath.Join(dir, "*.tiff"))
+	assert.Equal(t, EXIT_USAGE, code)
+	// a state file that cant be read would upload everything again, so nothing is uploaded
+	os.WriteFile(state, []byte("{not json"), 0o644)
+	code, _, errOut = ctl(t, config, "image", "upload", "-state", state, filepath.Join(dir, "art"))
+	assert.Equal(t, EXIT_ERROR, code)
+	assert.Contains(t, errOut, "state.json")
+	assert.Len(t, allImages(t, repo), 2)
+}
@@ -6,22 +6,32 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
+	"time"
 
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-gonic/gin"
 
 	"git.aetherial.dev/aeth/keiji/pkg/auth"
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
 	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/metrics"
 	"git.aetherial.dev/aeth/keiji/pkg/routes"
+	"git.aetherial.dev/aeth/keiji/pkg/staticsite"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
 	"git.aetherial.dev/aeth/keiji/pkg/webpages"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const dbfile = "sqlite.db"
+
 var contentMode, envPath string
 var blank bool
 
@@ -29,7 +39,186 @@ func printUsage() string {
 	return "wrong"
 }
 
+/*
+Restore a backup taken by the backup subsystem over the top of the database and image store.
+Run as 'keiji restore -archive <backup>' while the server is stopped
+*/
+func restore(args []string) {
+	cmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	archive := cmd.String("archive", "", "the backup archive to restore")
+	cmd.StringVar(&envPath, "env", ".env", "pass specific ..env file to the program startup")
+	verifyOnly := cmd.Bool("verify", false, "only verify the checksums of the backup, dont restore it")
+	cmd.Parse(args)
+	if *archive == "" {
+		log.Fatal("-archive must be set to the backup to restore")
+	}
+	if *verifyOnly {
+		manifest, err := backup.Verify(*archive)
+		if err != nil {
+			log.Fatal("Backup failed verification: ", err)
+		}
+		fmt.Printf("Backup from %s verified, %v files OK.\n", manifest.Created, len(manifest.Files))
+		os.Exit(0)
+	}
+	err := env.LoadAndVerifyEnv(envPath, map[string]string{env.IMAGE_STORE: env.OPTION_VARS[env.IMAGE_STORE]})
+	if err != nil {
+		log.Fatal("Error when loading env file: ", err)
+	}
+	err = backup.Restore(*archive, dbfile, os.Getenv(env.IMAGE_STORE))
+	if err != nil {
+		log.Fatal("Failed to restore the backup: ", err)
+	}
+	fmt.Printf("Restored %s to %s and %s\n", *archive, dbfile, os.Getenv(env.IMAGE_STORE))
+	os.Exit(0)
+}
+
+/*
+Build the backup manager from the environment, returning nil if backups arent configured
+*/
+func backupManager(src backup.Source) *backup.Manager {
+	dir := os.Getenv(env.BACKUP_DIR)
+	if dir == "" {
+		return nil
+	}
+	retain := 0
+	if os.Getenv(env.BACKUP_RETAIN) != "" {
+		n, err := strconv.Atoi(os.Getenv(env.BACKUP_RETAIN))
+		if err != nil {
+			log.Fatal("Invalid option passed to BACKUP_RETAIN: ", os.Getenv(env.BACKUP_RETAIN))
+		}
+		retain = n
+	}
+	mgr := backup.NewManager(src, os.Getenv(env.IMAGE_STORE), dir, retain)
+	if os.Getenv(env.BACKUP_INTERVAL) != "" {
+		interval, err := time.ParseDuration(os.Getenv(env.BACKUP_INTERVAL))
+		if err != nil {
+			log.Fatal("Invalid option passed to BACKUP_INTERVAL: ", os.Getenv(env.BACKUP_INTERVAL))
+		}
+		// taken by the controller, so they stop with the rest of its workers
+		mgr.Interval = interval
+	}
+	return mgr
+}
+
+var templateNames = []string{
+	"home",
+	"blogpost",
+	"digital_art",
+	"login",
+	"admin",
+	"blogpost_editor",
+	"post_options",
+	"unhandled_error",
+	"upload",
+	"upload_status",
+	"writing",
+	"listing",
+	"albums",
+	"album_editor",
+	"image_picker",
+	"comments",
+	"comment_queue",
+	"followers",
+	"subscription",
+	"webhooks",
+	"analytics",
+}
+
+// Turn the -content flag into a webpages.ServiceOption, exiting if its not a valid option
+func serviceOption(mode string) webpages.ServiceOption {
+	switch mode {
+	case "fs":
+		return webpages.FILESYSTEM
+	case "embed":
+		return webpages.EMBED
+	}
+	printUsage()
+	os.Exit(1)
+	return ""
+}
+
+/*
+Load the HTML templates into the engine. Shared between the server and the static
+exporter so that both render pages identically
+*/
+func loadTemplates(e *gin.Engine, srcOpt webpages.ServiceOption, htmlReader fs.FS) {
+	if srcOpt == webpages.FILESYSTEM {
+		e.LoadHTMLGlob(path.Join(os.Getenv("WEB_ROOT"), "html", "*.html"))
+		return
+	}
+	renderer := multitemplate.NewDynamic()
+	for i := range templateNames {
+		name := templateNames[i]
+		tmpl, err := webpages.ReadToString(htmlReader, path.Join("html", name+".html"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		renderer.AddFromString(name, tmpl)
+	}
+	e.HTMLRender = renderer
+}
+
+// Open and migrate the sqlite database
+func openDatabase() *storage.SQLiteRepo {
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webserverDb := storage.NewSQLiteRepo(db, metrics.InstrumentImages(metrics.Default, storage.FilesystemImageIO{RootDir: os.Getenv(env.IMAGE_STORE)}))
+	err = webserverDb.Migrate(storage.RequiredTables)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = webserverDb.MigrateColumns(storage.RequiredColumns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return webserverDb
+}
+
+/*
+Render every public page of the site into a directory for static hosting.
+Run as 'keiji export-static -content embed -out <dir>'
+*/
+func exportStatic(args []string) {
+	cmd := flag.NewFlagSet("export-static", flag.ExitOnError)
+	cmd.StringVar(&contentMode, "content", "", "pass the option to render using filesystem or embedded html")
+	cmd.StringVar(&envPath, "env", ".env", "pass specific ..env file to the program startup")
+	out := cmd.String("out", "public", "the directory to write the static site to")
+	base := cmd.String("base", "", "a path prefix to put in front of every link, if the site wont be hosted at the root of the domain")
+	cmd.Parse(args)
+	err := env.LoadAndVerifyEnv(envPath, env.REQUIRED_VARS)
+	if err != nil {
+		log.Fatal("Error when loading env file: ", err)
+	}
+	srcOpt := serviceOption(contentMode)
+	htmlReader, err := webpages.NewContentLayer(srcOpt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+	e := gin.New()
+	loadTemplates(e, srcOpt, htmlReader)
+	webserverDb := openDatabase()
+	routes.RegisterPages(e, os.Getenv(env.DOMAIN_NAME), webserverDb, webserverDb.ImageStore(), htmlReader)
+	summary, err := staticsite.NewExporter(e, webserverDb, htmlReader, *base).Export(*out)
+	if err != nil {
+		log.Fatal("Failed to export the site: ", err)
+	}
+	fmt.Printf("Exported %v pages, %v images, %v assets and %v cdn files to %s\n",
+		summary.Pages, summary.Images, summary.Assets, summary.Cdn, *out)
+	os.Exit(0)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+		case "export-static":
+			exportStatic(os.Args[2:])
+		}
+	}
 	flag.StringVar(&contentMode, "content", "", "pass the option to run the webserver using filesystem or embedded html")
 	flag.StringVar(&envPath, "env", ".env", "pass specific ..env file to the program startup")
 	flag.BoolVar(&blank, "blank", false, "create a blank .env template")
@@ -48,57 +237,36 @@ func main() {
 	if err != nil {
 		log.Fatal("Error when loading env file: ", err)
 	}
-	var srcOpt webpages.ServiceOption
-	switch contentMode {
-	case "fs":
-		srcOpt = webpages.FILESYSTEM
-	case "embed":
-		srcOpt = webpages.EMBED
-	default:
-		printUsage()
-		os.Exit(1)
-	}
-	var htmlReader fs.FS
-	htmlReader = webpages.NewContentLayer(srcOpt)
-	renderer := multitemplate.NewDynamic()
-	templateNames := []string{
-		"home",
-		"blogpost",
-		"digital_art",
-		"login",
-		"admin",
-		"blogpost_editor",
-		"post_options",
-		"unhandled_error",
-		"upload",
-		"upload_status",
-		"writing",
-		"listing",
-	}
-	e := gin.Default()
-	if srcOpt == webpages.FILESYSTEM {
-		e.LoadHTMLGlob(path.Join(os.Getenv("WEB_ROOT"), "html", "*.html"))
-	} else {
-		for i := range templateNames {
-			name := templateNames[i]
-			renderer.AddFromString(
-				name,
-				webpages.ReadToString(htmlReader, path.Join("html", name+".html")),
-			)
-		}
-		e.HTMLRender = renderer
-	}
-	dbfile := "sqlite.db"
-	db, err := sql.Open("sqlite3", dbfile)
+	logger, err := logging.FromEnv(os.Stderr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	webserverDb := storage.NewSQLiteRepo(db, storage.FilesystemImageIO{RootDir: os.Getenv(env.IMAGE_STORE)})
-	err = webserverDb.Migrate(storage.RequiredTables)
+	// the standard logger writes through it too, so everything logs the same way
+	slog.SetDefault(logger)
+	srcOpt := serviceOption(contentMode)
+	htmlReader, err := webpages.NewContentLayer(srcOpt)
 	if err != nil {
 		log.Fatal(err)
 	}
-	routes.Register(e, os.Getenv("DOMAIN_NAME"), webserverDb, htmlReader, auth.EnvAuth{})
+	e := gin.New()
+	e.Use(logging.Middleware(logger, os.Stdout), metrics.Middleware(metrics.Default), logging.Recovery())
+	if addr := os.Getenv(env.METRICS_ADDR); addr != "" {
+		// bound up front so a bad address stops startup rather than the metrics going missing
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal("Couldnt listen for metrics on ", addr, ": ", err)
+		}
+		go func() {
+			handler := metrics.Handler(metrics.Default, os.Getenv(env.METRICS_TOKEN))
+			if err := http.Serve(listener, handler); err != nil {
+				slog.Error("serving the metrics failed", "addr", addr, "err", err)
+			}
+		}()
+	}
+	loadTemplates(e, srcOpt, htmlReader)
+	webserverDb := openDatabase()
+	c := routes.Register(e, os.Getenv("DOMAIN_NAME"), webserverDb, webserverDb.ImageStore(), htmlReader, auth.EnvAuth{}, backupManager(webserverDb))
+	c.ExportMetrics(metrics.Default)
 	ssl, err := strconv.ParseBool(os.Getenv("USE_SSL"))
 	if err != nil {
 		log.Fatal("Invalid option passed to USE_SSL: ", os.Getenv("USE_SSL"))
@@ -0,0 +1,617 @@
+package activitypub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	CONTENT_TYPE     = "application/activity+json"
+	LD_CONTENT_TYPE  = `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+	JRD_CONTENT_TYPE = "application/jrd+json"
+	PUBLIC           = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+// the json-ld context of every document the actor serves
+var ldContext = []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+// the activities published for changes to posts
+const (
+	CREATE = "Create"
+	UPDATE = "Update"
+	DELETE = "Delete"
+)
+
+var (
+	ErrNotFound        = errors.New("no such actor here")
+	ErrInvalidActivity = errors.New("the activity isnt valid")
+)
+
+const (
+	// the name the actors private key is stored under
+	keyName = "activitypub"
+	// how many activities a page of the outbox holds
+	pageSize = 20
+	// the biggest document read from another server, or accepted in the inbox
+	maxDocument = 1 << 20
+)
+
+// Where the actor keeps its followers, what it published and its key. storage.FederationIO is one
+type Store interface {
+	AddFollower(follower storage.Follower) error
+	RemoveFollower(actor string) error
+	GetFollowers() ([]storage.Follower, error)
+	AddActivity(activity storage.Activity) error
+	GetActivities(limit, offset int) ([]storage.Activity, int, error)
+	GetSigningKey(name string) (string, error)
+	SaveSigningKey(name, pem string) error
+}
+
+/*
+The site as a single ActivityPub actor, which people on Mastodon and the like can follow
+to get the posts in their timeline. It lives at /actor, and is found through WebFinger as
+@Username@ the host of the site
+*/
+type Actor struct {
+	SiteURL  string
+	Username string
+	Key      *rsa.PrivateKey
+	HTTP     *http.Client
+	store    Store
+}
+
+/*
+Get the username to federate as from ACTIVITYPUB_USER, empty when federation is off
+*/
+func GetUsername() string {
+	return os.Getenv(env.ACTIVITYPUB_USER)
+}
+
+/*
+Load the actor, making its key pair the first time
+
+	:param siteURL: the public url of the site, i.e. 'https://aetherial.dev'
+	:param username: the name it is found under, i.e. 'blog' for @blog@aetherial.dev
+	:param store: where followers, activities and the key are kept
+	:param client: the client to reach other servers with
+*/
+func LoadActor(siteURL, username string, store Store, client *http.Client) (*Actor, error) {
+	a := &Actor{SiteURL: strings.TrimSuffix(siteURL, "/"), Username: username, HTTP: client, store: store}
+	encoded, err := store.GetSigningKey(keyName)
+	if errors.Is(err, storage.ErrNotExists) {
+		a.Key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		block := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(a.Key)})
+		return a, store.SaveSigningKey(keyName, string(block))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("the stored activitypub key isnt PEM encoded")
+	}
+	a.Key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	return a, err
+}
+
+// the id of the actor, which is also where its document is served
+func (a *Actor) ID() string { return a.SiteURL + "/actor" }
+
+// the id of the actors public key, which other servers fetch to check its signatures
+func (a *Actor) KeyID() string { return a.ID() + "#main-key" }
+
+// what people follow the actor as, i.e. '@blog@aetherial.dev'
+func (a *Actor) Handle() string {
+	u, _ := url.Parse(a.SiteURL)
+	return "@" + a.Username + "@" + u.Host
+}
+
+// the url of a post, which is the id of the object it is published as
+func (a *Actor) PostURL(id storage.Identifier) string { return a.SiteURL + "/writing/" + string(id) }
+
+// The public key in an actors document
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// The document describing an actor
+type Person struct {
+	Context           any       `json:"@context,omitempty"`
+	ID                string    `json:"id"`
+	Type              string    `json:"type"`
+	PreferredUsername string    `json:"preferredUsername"`
+	Name              string    `json:"name"`
+	URL               string    `json:"url"`
+	Inbox             string    `json:"inbox"`
+	Outbox            string    `json:"outbox"`
+	Followers         string    `json:"followers"`
+	PublicKey         PublicKey `json:"publicKey"`
+}
+
+// the document to serve at the actors id
+func (a *Actor) Document() (Person, error) {
+	key, err := encodePublicKey(&a.Key.PublicKey)
+	if err != nil {
+		return Person{}, err
+	}
+	u, _ := url.Parse(a.SiteURL)
+	return Person{
+		Context:           ldContext,
+		ID:                a.ID(),
+		Type:              "Service",
+		PreferredUsername: a.Username,
+		Name:              u.Host,
+		URL:               a.SiteURL,
+		Inbox:             a.ID() + "/inbox",
+		Outbox:            a.ID() + "/outbox",
+		Followers:         a.ID() + "/followers",
+		PublicKey:         PublicKey{ID: a.KeyID(), Owner: a.ID(), PublicKeyPem: key},
+	}, nil
+}
+
+// A link in a WebFinger response
+type Link struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+// A WebFinger response, pointing an acct: resource at the actor
+type JRD struct {
+	Subject string   `json:"subject"`
+	Aliases []string `json:"aliases"`
+	Links   []Link   `json:"links"`
+}
+
+/*
+Answer a WebFinger lookup, which is how other servers turn @user@host into the actor.
+Returns ErrNotFound for anybody else
+
+	:param resource: the resource query parameter, i.e. 'acct:blog@aetherial.dev' or the actors id
+*/
+func (a *Actor) WebFinger(resource string) (JRD, error) {
+	acct := "acct:" + strings.TrimPrefix(a.Handle(), "@")
+	if !strings.EqualFold(resource, acct) && resource != a.ID() {
+		return JRD{}, ErrNotFound
+	}
+	return JRD{
+		Subject: acct,
+		Aliases: []string{a.ID()},
+		Links: []Link{
+			{Rel: "self", Type: CONTENT_TYPE, Href: a.ID()},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: a.SiteURL},
+		},
+	}, nil
+}
+
+// A post as an ActivityPub object, or the Tombstone left by one that was deleted
+type Object struct {
+	Context      any      `json:"@context,omitempty"`
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	AttributedTo string   `json:"attributedTo,omitempty"`
+	Name         string   `json:"name,omitempty"`
+	Content      string   `json:"content,omitempty"`
+	URL          string   `json:"url,omitempty"`
+	Published    string   `json:"published,omitempty"`
+	Updated      string   `json:"updated,omitempty"`
+	To           []string `json:"to,omitempty"`
+	Cc           []string `json:"cc,omitempty"`
+}
+
+/*
+Make the Article a post is published as. Links in the content relative to the site, like
+the ones to its images, are made absolute since the content is shown on other servers
+
+	:param doc: the post
+	:param content: the html the post renders to
+*/
+func (a *Actor) Article(doc storage.Document, content string) Object {
+	return Object{
+		ID:           a.PostURL(doc.Ident),
+		Type:         "Article",
+		AttributedTo: a.ID(),
+		Name:         doc.Title,
+		Content:      strings.NewReplacer(` href="/`, ` href="`+a.SiteURL+`/`, ` src="/`, ` src="`+a.SiteURL+`/`).Replace(content),
+		URL:          a.PostURL(doc.Ident),
+		Published:    published(doc),
+		Updated:      timestamp(doc.Updated),
+		To:           []string{PUBLIC},
+		Cc:           []string{a.ID() + "/followers"},
+	}
+}
+
+// posts are dated however the author wrote it, so fall back to when it was last saved
+func published(doc storage.Document) string {
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, strings.TrimSpace(doc.Created)); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return timestamp(doc.Updated)
+}
+
+// the time a post was saved in the format ActivityPub uses, without the fractions of a second
+func timestamp(updated string) string {
+	t, err := time.Parse(time.RFC3339Nano, updated)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// An activity the actor sends, or receives in its inbox
+type Activity struct {
+	Context   any      `json:"@context,omitempty"`
+	ID        string   `json:"id,omitempty"`
+	Type      string   `json:"type"`
+	Actor     string   `json:"actor"`
+	Object    any      `json:"object"`
+	Published string   `json:"published,omitempty"`
+	To        []string `json:"to,omitempty"`
+	Cc        []string `json:"cc,omitempty"`
+}
+
+/*
+Make the activity for a change to a post and save it to the outbox. It still has to be
+sent to the followers with Broadcast
+
+	:param kind: CREATE, UPDATE or DELETE
+	:param doc: the post that changed
+	:param content: the html the post renders to, unused for DELETE
+*/
+func (a *Actor) Publish(kind string, doc storage.Document, content string) (Activity, error) {
+	ident := storage.Identifier(uuid.NewString())
+	now := time.Now().UTC().Format(time.RFC3339)
+	activity := Activity{
+		Context:   ldContext,
+		ID:        a.ID() + "/activities/" + string(ident),
+		Type:      kind,
+		Actor:     a.ID(),
+		Published: now,
+		To:        []string{PUBLIC},
+		Cc:        []string{a.ID() + "/followers"},
+	}
+	switch kind {
+	case CREATE, UPDATE:
+		activity.Object = a.Article(doc, content)
+	case DELETE:
+		activity.Object = Object{ID: a.PostURL(doc.Ident), Type: "Tombstone"}
+	default:
+		return activity, fmt.Errorf("%w: cant publish a %s", ErrInvalidActivity, kind)
+	}
+	payload, err := json.Marshal(activity)
+	if err != nil {
+		return activity, err
+	}
+	return activity, a.store.AddActivity(storage.Activity{
+		Ident: ident, Type: kind, Object: doc.Ident, Published: now, Payload: string(payload),
+	})
+}
+
+// An OrderedCollection, or a page of one
+type Collection struct {
+	Context      any               `json:"@context,omitempty"`
+	ID           string            `json:"id"`
+	Type         string            `json:"type"`
+	TotalItems   int               `json:"totalItems"`
+	First        string            `json:"first,omitempty"`
+	PartOf       string            `json:"partOf,omitempty"`
+	Next         string            `json:"next,omitempty"`
+	OrderedItems []json.RawMessage `json:"orderedItems,omitempty"`
+}
+
+/*
+Get the outbox, the activities the actor published newest first. Without a page it is the
+collection pointing at the first page
+
+	:param page: the page to get, counting from 1, or 0 for the collection
+*/
+func (a *Actor) Outbox(page int) (Collection, error) {
+	outbox := a.ID() + "/outbox"
+	if page < 1 {
+		_, total, err := a.store.GetActivities(0, 0)
+		return Collection{Context: ldContext, ID: outbox, Type: "OrderedCollection", TotalItems: total, First: outbox + "?page=1"}, err
+	}
+	activities, total, err := a.store.GetActivities(pageSize, (page-1)*pageSize)
+	if err != nil {
+		return Collection{}, err
+	}
+	collection := Collection{
+		Context:      ldContext,
+		ID:           fmt.Sprintf("%s?page=%v", outbox, page),
+		Type:         "OrderedCollectionPage",
+		TotalItems:   total,
+		PartOf:       outbox,
+		OrderedItems: []json.RawMessage{},
+	}
+	for _, activity := range activities {
+		collection.OrderedItems = append(collection.OrderedItems, json.RawMessage(activity.Payload))
+	}
+	if page*pageSize < total {
+		collection.Next = fmt.Sprintf("%s?page=%v", outbox, page+1)
+	}
+	return collection, nil
+}
+
+// the followers collection, which only says how many there are
+func (a *Actor) Followers() (Collection, error) {
+	followers, err := a.store.GetFollowers()
+	return Collection{Context: ldContext, ID: a.ID() + "/followers", Type: "OrderedCollection", TotalItems: len(followers)}, err
+}
+
+/*
+Send an activity to every follower. Followers on the same server share an inbox when it has
+one, so each server gets it once. A server that fails doesnt stop the rest, the failures
+are returned together
+
+	:param activity: the activity to send
+*/
+func (a *Actor) Broadcast(activity Activity) error {
+	followers, err := a.store.GetFollowers()
+	if err != nil {
+		return err
+	}
+	sent := map[string]bool{}
+	var errs []error
+	for _, follower := range followers {
+		inbox := follower.Inbox
+		if follower.SharedInbox != "" {
+			inbox = follower.SharedInbox
+		}
+		if sent[inbox] {
+			continue
+		}
+		sent[inbox] = true
+		if err := a.Deliver(inbox, activity); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/*
+Sign and POST an activity to an inbox
+
+	:param inbox: the url of the inbox
+	:param activity: the activity to send
+*/
+func (a *Actor) Deliver(inbox string, activity Activity) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE)
+	if err = a.Sign(req, body); err != nil {
+		return err
+	}
+	resp, err := a.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("delivering to %s: %s", inbox, resp.Status)
+	}
+	return nil
+}
+
+/*
+Tell a follower they were removed, by rejecting their follow. Their server stops showing
+them as following
+
+	:param follower: the follower that was removed
+*/
+func (a *Actor) Reject(follower storage.Follower) error {
+	return a.Deliver(follower.Inbox, Activity{
+		Context: ldContext,
+		ID:      a.ID() + "/rejects/" + uuid.NewString(),
+		Type:    "Reject",
+		Actor:   a.ID(),
+		Object:  Activity{Type: "Follow", Actor: follower.Actor, Object: a.ID()},
+	})
+}
+
+/*
+Another actor, or the key document some servers serve at a keyId instead of the actor.
+Only the fields needed to follow back and check signatures are kept
+*/
+type RemoteActor struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Inbox     string    `json:"inbox"`
+	PublicKey PublicKey `json:"publicKey"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	// set when the document is a key rather than an actor
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+/*
+Fetch another actor with a signed GET, servers running in authorized fetch mode turn away
+unsigned ones
+
+	:param id: the id of the actor
+*/
+func (a *Actor) Fetch(id string) (RemoteActor, error) {
+	var remote RemoteActor
+	req, err := http.NewRequest(http.MethodGet, id, nil)
+	if err != nil {
+		return remote, err
+	}
+	req.Header.Set("Accept", CONTENT_TYPE+", "+LD_CONTENT_TYPE)
+	if err = a.Sign(req, nil); err != nil {
+		return remote, err
+	}
+	resp, err := a.HTTP.Do(req)
+	if err != nil {
+		return remote, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return remote, fmt.Errorf("fetching %s: %s", id, resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxDocument)).Decode(&remote)
+	return remote, err
+}
+
+/*
+Find the key a signature was made with and the actor that owns it. Whatever document the
+keyId points at, the key is only trusted if the document of the actor it names as its owner,
+fetched from that actors own id, lists the same key under the same keyId. Otherwise any
+server could serve a key naming someone else as its owner
+
+	:param keyID: the keyId of the signature, usually the actors id with a #main-key fragment
+*/
+func (a *Actor) publicKey(keyID string) (*rsa.PublicKey, string, error) {
+	doc, _, _ := strings.Cut(keyID, "#")
+	remote, err := a.Fetch(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	if remote.ID != doc && remote.ID != keyID {
+		return nil, "", fmt.Errorf("%s served the document of %s", doc, remote.ID)
+	}
+	// a key document only names its owner, who has to be asked whether the key is theirs
+	if remote.PublicKeyPem != "" && remote.Owner != "" {
+		owner, pem := remote.Owner, remote.PublicKeyPem
+		if remote, err = a.Fetch(owner); err != nil {
+			return nil, "", err
+		}
+		if remote.ID != owner {
+			return nil, "", fmt.Errorf("%s served the document of %s", owner, remote.ID)
+		}
+		if strings.TrimSpace(remote.PublicKey.PublicKeyPem) != strings.TrimSpace(pem) {
+			return nil, "", fmt.Errorf("%s doesnt list the key %s", remote.ID, keyID)
+		}
+	}
+	if remote.PublicKey.ID != keyID || (remote.PublicKey.Owner != "" && remote.PublicKey.Owner != remote.ID) {
+		return nil, "", fmt.Errorf("%s has no key %s", remote.ID, keyID)
+	}
+	key, err := decodePublicKey(remote.PublicKey.PublicKeyPem)
+	return key, remote.ID, err
+}
+
+// an activity received in the inbox, with the object left for the type to decide on
+type incoming struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// An activity to send back to the sender of one received in the inbox, i.e. the Accept of a Follow
+type Reply struct {
+	Inbox    string
+	Activity Activity
+}
+
+/*
+Handle a POST to the actors inbox. The request has to be signed by the actor that sent the
+activity. A Follow of this actor adds the follower and returns the Accept to send back, which
+is left to the caller so that the inbox can answer without waiting on the followers server.
+Undoing a Follow removes them. Everything else is accepted and ignored, replies and likes
+arent kept. Returns ErrBadSignature or ErrInvalidActivity for requests that should be
+turned away
+
+	:param req: the request that was received
+*/
+func (a *Actor) HandleInbox(req *http.Request) (*Reply, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxDocument+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDocument {
+		return nil, fmt.Errorf("%w: it is too big", ErrInvalidActivity)
+	}
+	var activity incoming
+	if err = json.Unmarshal(body, &activity); err != nil || activity.Actor == "" {
+		return nil, ErrInvalidActivity
+	}
+	owner, err := Verify(req, body, a.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if owner != activity.Actor {
+		return nil, fmt.Errorf("%w: it was signed by %s rather than %s", ErrBadSignature, owner, activity.Actor)
+	}
+
+	switch activity.Type {
+	case "Follow":
+		if objectID(activity.Object) != a.ID() {
+			return nil, fmt.Errorf("%w: only %s can be followed", ErrInvalidActivity, a.ID())
+		}
+		remote, err := a.Fetch(activity.Actor)
+		if err != nil {
+			return nil, err
+		}
+		if remote.ID != activity.Actor || remote.Inbox == "" {
+			return nil, fmt.Errorf("%w: %s has no inbox", ErrInvalidActivity, activity.Actor)
+		}
+		err = a.store.AddFollower(storage.Follower{Actor: remote.ID, Inbox: remote.Inbox, SharedInbox: remote.Endpoints.SharedInbox})
+		if err != nil {
+			return nil, err
+		}
+		return &Reply{Inbox: remote.Inbox, Activity: Activity{
+			Context: ldContext,
+			ID:      a.ID() + "/accepts/" + uuid.NewString(),
+			Type:    "Accept",
+			Actor:   a.ID(),
+			Object:  json.RawMessage(body),
+		}}, nil
+	case "Undo":
+		var undone incoming
+		if err = json.Unmarshal(activity.Object, &undone); err != nil {
+			// only the id of the activity, which isnt enough to know it was a follow
+			return nil, nil
+		}
+		if undone.Type == "Follow" && undone.Actor == activity.Actor {
+			err = a.store.RemoveFollower(activity.Actor)
+			if errors.Is(err, storage.ErrNotExists) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// the id of the object of an activity, which is either just the id or the whole object
+func objectID(raw json.RawMessage) string {
+	var id string
+	if json.Unmarshal(raw, &id) == nil {
+		return id
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(raw, &object)
+	return object.ID
+}
@@ -0,0 +1,340 @@
+package activitypub
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Implementing the Store interface in memory
+type memStore struct {
+	followers  []storage.Follower
+	activities []storage.Activity
+	keys       map[string]string
+}
+
+func (m *memStore) AddFollower(follower storage.Follower) error {
+	m.RemoveFollower(follower.Actor)
+	m.followers = append(m.followers, follower)
+	return nil
+}
+
+func (m *memStore) RemoveFollower(actor string) error {
+	i := slices.IndexFunc(m.followers, func(f storage.Follower) bool { return f.Actor == actor })
+	if i < 0 {
+		return storage.ErrNotExists
+	}
+	m.followers = slices.Delete(m.followers, i, i+1)
+	return nil
+}
+
+func (m *memStore) GetFollowers() ([]storage.Follower, error) { return m.followers, nil }
+
+func (m *memStore) AddActivity(activity storage.Activity) error {
+	m.activities = append(m.activities, activity)
+	return nil
+}
+
+func (m *memStore) GetActivities(limit, offset int) ([]storage.Activity, int, error) {
+	newest := slices.Clone(m.activities)
+	slices.Reverse(newest)
+	end := min(offset+limit, len(newest))
+	if offset > end {
+		return []storage.Activity{}, len(newest), nil
+	}
+	return newest[offset:end], len(newest), nil
+}
+
+func (m *memStore) GetSigningKey(name string) (string, error) {
+	key, ok := m.keys[name]
+	if !ok {
+		return "", storage.ErrNotExists
+	}
+	return key, nil
+}
+
+func (m *memStore) SaveSigningKey(name, pem string) error {
+	m.keys[name] = pem
+	return nil
+}
+
+func newTestActor(t *testing.T, siteURL string) (*Actor, *memStore) {
+	store := &memStore{keys: map[string]string{}}
+	actor, err := LoadActor(siteURL, "blog", store, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return actor, store
+}
+
+/*
+Another server on the fediverse, with an actor of its own whose inbox records what it is sent.
+Deliveries have to be signed by the site
+*/
+func newRemote(t *testing.T, site *Actor) (*Actor, chan Activity) {
+	received := make(chan Activity, 4)
+	var remote *Actor
+	mux := http.NewServeMux()
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, r *http.Request) {
+		doc, _ := remote.Document()
+		json.NewEncoder(w).Encode(doc)
+	})
+	mux.HandleFunc("/actor/inbox", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		owner, err := Verify(r, body, func(keyID string) (*rsa.PublicKey, string, error) {
+			if keyID != site.KeyID() {
+				return nil, "", errors.New("unknown key")
+			}
+			return &site.Key.PublicKey, site.ID(), nil
+		})
+		if err != nil || owner != site.ID() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var activity Activity
+		json.Unmarshal(body, &activity)
+		received <- activity
+		w.WriteHeader(http.StatusAccepted)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	remote, _ = newTestActor(t, srv.URL)
+	return remote, received
+}
+
+// a POST to the sites inbox, signed by the remote actor
+func signedPost(t *testing.T, site, signer *Actor, activity any) *http.Request {
+	body, _ := json.Marshal(activity)
+	req, _ := http.NewRequest(http.MethodPost, site.ID()+"/inbox", bytes.NewReader(body))
+	if err := signer.Sign(req, body); err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return req
+}
+
+func TestLoadActor(t *testing.T) {
+	actor, store := newTestActor(t, "https://aetherial.dev/")
+	again, err := LoadActor("https://aetherial.dev", "blog", store, http.DefaultClient)
+	assert.NoError(t, err)
+	assert.True(t, actor.Key.Equal(again.Key))
+	assert.Equal(t, "https://aetherial.dev/actor", actor.ID())
+	assert.Equal(t, "@blog@aetherial.dev", actor.Handle())
+
+	doc, err := actor.Document()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://aetherial.dev/actor/inbox", doc.Inbox)
+	key, err := decodePublicKey(doc.PublicKey.PublicKeyPem)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(&actor.Key.PublicKey))
+}
+
+func TestWebFinger(t *testing.T) {
+	actor, _ := newTestActor(t, "https://aetherial.dev")
+	for _, resource := range []string{"acct:blog@aetherial.dev", "acct:Blog@Aetherial.dev", "https://aetherial.dev/actor"} {
+		jrd, err := actor.WebFinger(resource)
+		assert.NoError(t, err, resource)
+		assert.Equal(t, "acct:blog@aetherial.dev", jrd.Subject)
+		assert.Equal(t, Link{Rel: "self", Type: CONTENT_TYPE, Href: actor.ID()}, jrd.Links[0])
+	}
+	_, err := actor.WebFinger("acct:someone@aetherial.dev")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestPublish(t *testing.T) {
+	actor, store := newTestActor(t, "https://aetherial.dev")
+	doc := storage.Document{Ident: "abc", Title: "hello", Created: "2024-12-31", Updated: "2025-01-01T10:00:00.123Z", Category: storage.BLOG}
+	for _, kind := range []string{CREATE, UPDATE, DELETE} {
+		_, err := actor.Publish(kind, doc, `<p>hello</p><img src="/api/v1/images/a">`)
+		assert.NoError(t, err)
+	}
+	_, err := actor.Publish("Like", doc, "")
+	assert.True(t, errors.Is(err, ErrInvalidActivity))
+	assert.Len(t, store.activities, 3)
+
+	outbox, err := actor.Outbox(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, outbox.TotalItems)
+	assert.Equal(t, actor.ID()+"/outbox?page=1", outbox.First)
+	assert.Empty(t, outbox.OrderedItems)
+
+	page, err := actor.Outbox(1)
+	assert.NoError(t, err)
+	assert.Empty(t, page.Next)
+	if !assert.Len(t, page.OrderedItems, 3) {
+		return
+	}
+	var deleted, created struct {
+		ID     string `json:"id"`
+		Type   string `json:"type"`
+		Object Object `json:"object"`
+	}
+	assert.NoError(t, json.Unmarshal(page.OrderedItems[0], &deleted))
+	assert.NoError(t, json.Unmarshal(page.OrderedItems[2], &created))
+	assert.Equal(t, DELETE, deleted.Type)
+	assert.Equal(t, Object{ID: "https://aetherial.dev/writing/abc", Type: "Tombstone"}, deleted.Object)
+	assert.Equal(t, CREATE, created.Type)
+	assert.True(t, strings.HasPrefix(created.ID, actor.ID()+"/activities/"))
+	assert.Equal(t, "Article", created.Object.Type)
+	assert.Equal(t, "hello", created.Object.Name)
+	assert.Equal(t, `<p>hello</p><img src="https://aetherial.dev/api/v1/images/a">`, created.Object.Content)
+	assert.Equal(t, "2024-12-31T00:00:00Z", created.Object.Published)
+	assert.Equal(t, "2025-01-01T10:00:00Z", created.Object.Updated)
+	assert.Equal(t, []string{PUBLIC}, created.Object.To)
+}
+
+func TestBroadcast(t *testing.T) {
+	site, store := newTestActor(t, "https://aetherial.dev")
+	remote, received := newRemote(t, site)
+	// two followers on the remote server share its inbox, so it only gets the post once
+	store.AddFollower(storage.Follower{Actor: remote.SiteURL + "/users/a", Inbox: remote.SiteURL + "/users/a/inbox", SharedInbox: remote.ID() + "/inbox"})
+	store.AddFollower(storage.Follower{Actor: remote.SiteURL + "/users/b", Inbox: remote.SiteURL + "/users/b/inbox", SharedInbox: remote.ID() + "/inbox"})
+
+	activity, err := site.Publish(CREATE, storage.Document{Ident: "abc", Title: "hello"}, "<p>hello</p>")
+	assert.NoError(t, err)
+	assert.NoError(t, site.Broadcast(activity))
+	assert.Len(t, received, 1)
+	got := <-received
+	assert.Equal(t, activity.ID, got.ID)
+	assert.Equal(t, CREATE, got.Type)
+
+	// a follower whose server is down doesnt keep the others from getting it
+	store.AddFollower(storage.Follower{Actor: "http://127.0.0.1:1/users/c", Inbox: "http://127.0.0.1:1/users/c/inbox"})
+	assert.Error(t, site.Broadcast(activity))
+	assert.Len(t, received, 1)
+}
+
+func TestHandleInbox(t *testing.T) {
+	site, store := newTestActor(t, "https://aetherial.dev")
+	remote, received := newRemote(t, site)
+	follow := Activity{ID: remote.ID() + "/follows/1", Type: "Follow", Actor: remote.ID(), Object: site.ID()}
+	handle := func(req *http.Request) error {
+		reply, err := site.HandleInbox(req)
+		assert.Nil(t, reply)
+		return err
+	}
+
+	reply, err := site.HandleInbox(signedPost(t, site, remote, follow))
+	assert.NoError(t, err)
+	if assert.Len(t, store.followers, 1) {
+		assert.Equal(t, storage.Follower{Actor: remote.ID(), Inbox: remote.ID() + "/inbox"}, store.followers[0])
+	}
+	// the accept is left for the caller to send
+	assert.Len(t, received, 0)
+	if assert.NotNil(t, reply) {
+		assert.Equal(t, remote.ID()+"/inbox", reply.Inbox)
+		assert.NoError(t, site.Deliver(reply.Inbox, reply.Activity))
+	}
+	select {
+	case accept := <-received:
+		assert.Equal(t, "Accept", accept.Type)
+		assert.Equal(t, site.ID(), accept.Actor)
+		assert.Equal(t, follow.ID, accept.Object.(map[string]any)["id"])
+	case <-time.After(time.Second):
+		t.Fatal("the follow wasnt accepted")
+	}
+
+	// following somebody else, or signing for another actor, is turned away
+	other := follow
+	other.Object = site.SiteURL + "/someone"
+	assert.True(t, errors.Is(handle(signedPost(t, site, remote, other)), ErrInvalidActivity))
+	impersonated := follow
+	impersonated.Actor = "https://elsewhere.example/actor"
+	assert.True(t, errors.Is(handle(signedPost(t, site, remote, impersonated)), ErrBadSignature))
+	tampered := signedPost(t, site, remote, follow)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"type":"Follow","actor":"` + remote.ID() + `","object":"` + site.ID() + `","id":"x"}`))
+	assert.True(t, errors.Is(handle(tampered), ErrBadSignature))
+	unsigned := signedPost(t, site, remote, follow)
+	unsigned.Header.Del("Signature")
+	assert.True(t, errors.Is(handle(unsigned), ErrBadSignature))
+
+	// anything else is accepted and ignored
+	like := Activity{ID: remote.ID() + "/likes/1", Type: "Like", Actor: remote.ID(), Object: site.PostURL("abc")}
+	assert.NoError(t, handle(signedPost(t, site, remote, like)))
+
+	undo := Activity{ID: remote.ID() + "/undos/1", Type: "Undo", Actor: remote.ID(), Object: follow}
+	assert.NoError(t, handle(signedPost(t, site, remote, undo)))
+	assert.Empty(t, store.followers)
+	// undoing twice is harmless
+	assert.NoError(t, handle(signedPost(t, site, remote, undo)))
+}
+
+func TestHandleInboxForgedKeyOwner(t *testing.T) {
+	site, store := newTestActor(t, "https://aetherial.dev")
+	victim, _ := newRemote(t, site)
+	victimDoc, _ := victim.Document()
+
+	// a server that signs with its own key while claiming to be the victim
+	docs := map[string]any{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	evil, _ := newTestActor(t, srv.URL)
+	evilDoc, _ := evil.Document()
+	pem := evilDoc.PublicKey.PublicKeyPem
+
+	// a key document naming the victim as its owner
+	docs["/key"] = RemoteActor{ID: srv.URL + "/key", Owner: victim.ID(), PublicKeyPem: pem}
+	// an actor document served from the wrong place, claiming the victims id
+	imposter := evilDoc
+	imposter.ID = victim.ID()
+	imposter.PublicKey = PublicKey{ID: srv.URL + "/imposter#main-key", Owner: victim.ID(), PublicKeyPem: pem}
+	docs["/imposter"] = imposter
+	// a key document naming an owner that serves someone elses document
+	docs["/relay-key"] = RemoteActor{ID: srv.URL + "/relay-key", Owner: srv.URL + "/relay", PublicKeyPem: pem}
+	relay := imposter
+	relay.PublicKey = PublicKey{ID: srv.URL + "/relay-key", Owner: victim.ID(), PublicKeyPem: pem}
+	docs["/relay"] = relay
+	// the victims real document, listing a key it doesnt have
+	docs["/victim-key"] = RemoteActor{ID: srv.URL + "/victim-key", Owner: victim.ID(), PublicKeyPem: victimDoc.PublicKey.PublicKeyPem}
+
+	follow := Activity{ID: victim.ID() + "/follows/1", Type: "Follow", Actor: victim.ID(), Object: site.ID()}
+	for _, keyID := range []string{srv.URL + "/key", srv.URL + "/imposter#main-key", srv.URL + "/relay-key", srv.URL + "/victim-key"} {
+		req := signedPost(t, site, evil, follow)
+		req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), evil.KeyID(), keyID, 1))
+		reply, err := site.HandleInbox(req)
+		assert.True(t, errors.Is(err, ErrBadSignature), keyID)
+		assert.Nil(t, reply, keyID)
+	}
+	assert.Empty(t, store.followers)
+
+	// a key document is fine when its owner lists the key
+	owner := evilDoc
+	owner.PublicKey.ID = srv.URL + "/owned-key"
+	docs["/actor"] = owner
+	docs["/owned-key"] = RemoteActor{ID: srv.URL + "/owned-key", Owner: evil.ID(), PublicKeyPem: pem}
+	req := signedPost(t, site, evil, Activity{ID: evil.ID() + "/follows/1", Type: "Follow", Actor: evil.ID(), Object: site.ID()})
+	req.Header.Set("Signature", strings.Replace(req.Header.Get("Signature"), evil.KeyID(), srv.URL+"/owned-key", 1))
+	reply, err := site.HandleInbox(req)
+	assert.NoError(t, err)
+	assert.NotNil(t, reply)
+	assert.Len(t, store.followers, 1)
+}
+
+func TestReject(t *testing.T) {
+	site, _ := newTestActor(t, "https://aetherial.dev")
+	remote, received := newRemote(t, site)
+	assert.NoError(t, site.Reject(storage.Follower{Actor: remote.ID(), Inbox: remote.ID() + "/inbox"}))
+	reject := <-received
+	assert.Equal(t, "Reject", reject.Type)
+	assert.Equal(t, map[string]any{"type": "Follow", "actor": remote.ID(), "object": site.ID()}, reject.Object)
+}
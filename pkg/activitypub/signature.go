@@ -0,0 +1,147 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrBadSignature = errors.New("the request isnt signed, or the signature doesnt check out")
+
+// how far the Date of a signed request can be from now, servers retry deliveries for a while
+const maxClockSkew = 12 * time.Hour
+
+/*
+Sign a request with the actors key the way Mastodon and most of the fediverse expect, an
+HTTP signature over the request target, host and date, plus the digest of the body when
+there is one
+
+	:param req: the request to sign, its headers are set
+	:param body: the body the request sends, nil for a GET
+*/
+func (a *Actor) Sign(req *http.Request, body []byte) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		headers = append(headers, "digest")
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, req.URL.Host, headers)))
+	sig, err := rsa.SignPKCS1v15(nil, a.Key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		a.KeyID(), strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+/*
+Check the HTTP signature on a request another server sent. The key is looked up by the
+keyId in the signature, and the actor that owns it is returned so the caller can check it
+sent the activity
+
+	:param req: the request that was received
+	:param body: the body of the request, already read
+	:param publicKey: finds the key and its owner for a keyId, usually by fetching it
+*/
+func Verify(req *http.Request, body []byte, publicKey func(keyID string) (*rsa.PublicKey, string, error)) (string, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(req.Header.Get("Signature"), ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found {
+			params[key] = strings.Trim(value, `"`)
+		}
+	}
+	keyID, headers := params["keyId"], strings.Fields(strings.ToLower(params["headers"]))
+	if keyID == "" || params["signature"] == "" {
+		return "", ErrBadSignature
+	}
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	if !slices.Contains(headers, "(request-target)") || !slices.Contains(headers, "date") || (len(body) > 0 && !slices.Contains(headers, "digest")) {
+		return "", fmt.Errorf("%w: it doesnt cover the request target, date and digest", ErrBadSignature)
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > maxClockSkew {
+		return "", fmt.Errorf("%w: the date is missing or too far off", ErrBadSignature)
+	}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		if req.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%w: the digest doesnt match the body", ErrBadSignature)
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	key, owner, err := publicKey(keyID)
+	if err != nil {
+		return "", fmt.Errorf("%w: getting the key %s: %s", ErrBadSignature, keyID, err)
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, req.Host, headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig); err != nil {
+		return "", ErrBadSignature
+	}
+	return owner, nil
+}
+
+// the lines an HTTP signature signs, one per header it covers
+func signingString(req *http.Request, host string, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			lines[i] = h + ": " + host
+		default:
+			lines[i] = h + ": " + strings.Join(req.Header.Values(h), ", ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PEM encode the public half of a key, for the actor document
+func encodePublicKey(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// decode the PEM public key out of another actors document
+func decodePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+	var key any
+	var err error
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("only RSA keys are supported")
+	}
+	return rsaKey, nil
+}
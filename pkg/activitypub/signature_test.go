@@ -0,0 +1,84 @@
+package activitypub
+
+import (
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	signer, _ := newTestActor(t, "https://a.example")
+	other, _ := newTestActor(t, "https://b.example")
+	keyOf := func(actor *Actor) func(string) (*rsa.PublicKey, string, error) {
+		return func(keyID string) (*rsa.PublicKey, string, error) {
+			return &actor.Key.PublicKey, actor.ID(), nil
+		}
+	}
+	body := []byte(`{"type":"Follow"}`)
+	signed := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "https://aetherial.dev/actor/inbox?x=1", strings.NewReader(string(body)))
+		assert.NoError(t, signer.Sign(req, body))
+		return req
+	}
+
+	type testcase struct {
+		name  string
+		req   func() *http.Request
+		body  []byte
+		key   *Actor
+		owner string
+		err   error
+	}
+	for _, tc := range []testcase{
+		{name: "valid", req: signed, body: body, key: signer, owner: signer.ID()},
+		{name: "another key", req: signed, body: body, key: other, err: ErrBadSignature},
+		{name: "another body", req: signed, body: []byte(`{"type":"Undo"}`), key: signer, err: ErrBadSignature},
+		{
+			name: "another path",
+			req: func() *http.Request {
+				req := signed()
+				req.URL.Path = "/elsewhere"
+				return req
+			},
+			body: body, key: signer, err: ErrBadSignature,
+		},
+		{
+			name: "stale",
+			req: func() *http.Request {
+				req := signed()
+				req.Header.Set("Date", time.Now().Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+				return req
+			},
+			body: body, key: signer, err: ErrBadSignature,
+		},
+		{
+			name: "no digest signed",
+			req: func() *http.Request {
+				req, _ := http.NewRequest(http.MethodPost, "https://aetherial.dev/actor/inbox", nil)
+				assert.NoError(t, signer.Sign(req, nil))
+				return req
+			},
+			body: body, key: signer, err: ErrBadSignature,
+		},
+	} {
+		owner, err := Verify(tc.req(), tc.body, keyOf(tc.key))
+		if tc.err != nil {
+			assert.True(t, errors.Is(err, tc.err), tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.owner, owner, tc.name)
+	}
+
+	// a GET has no body to digest
+	req, _ := http.NewRequest(http.MethodGet, "https://aetherial.dev/actor", nil)
+	assert.NoError(t, signer.Sign(req, nil))
+	owner, err := Verify(req, nil, keyOf(signer))
+	assert.NoError(t, err)
+	assert.Equal(t, signer.ID(), owner)
+}
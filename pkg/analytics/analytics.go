@@ -0,0 +1,210 @@
+package analytics
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// the longest path that is recorded, anything longer is cut short
+const maxPath = 200
+
+// user agents that belong to crawlers, link previews and scripts rather than readers
+var botAgents = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|archiver|curl|wget|python|go-http-client|java/|okhttp|libwww|httpclient|headless|lighthouse|preview|facebookexternalhit|feed|monitor|scan`)
+
+// Where the daily rollups are kept, storage.AnalyticsIO satisfies it
+type Store interface {
+	AddPageViews(views []storage.PageView) error
+}
+
+/*
+Counts the page views of readers without cookies or anything that could tell them apart.
+A view is kept as the path, the domain of the site that linked to it and the family of the
+browser, added to a count for the day. Counts are kept in memory and added to the store
+by Run, so a view doesnt cost a write to the database
+*/
+type Recorder struct {
+	Domain string
+	store  Store
+	now    func() time.Time
+	mu     sync.Mutex
+	counts map[storage.PageView]int
+}
+
+/*
+Create a recorder
+
+	:param domain: the domain name of the site, links from its own pages dont count as referrals
+	:param store: where the rollups are added
+*/
+func NewRecorder(domain string, store Store) *Recorder {
+	return &Recorder{
+		Domain: strings.TrimPrefix(strings.ToLower(domain), "www."),
+		store:  store,
+		now:    time.Now,
+		counts: map[storage.PageView]int{},
+	}
+}
+
+/*
+Whether a request came from a bot rather than a reader. Requests without a user agent and
+pages a browser only prefetched are left out too
+
+	:param req: the request for the page
+*/
+func IsBot(req *http.Request) bool {
+	agent := req.UserAgent()
+	if agent == "" || botAgents.MatchString(agent) {
+		return true
+	}
+	return req.Header.Get("Sec-Purpose") == "prefetch" || req.Header.Get("Purpose") == "prefetch"
+}
+
+/*
+The family of the browser in a user agent, i.e. 'Firefox' or 'Chrome mobile'. Nothing more
+specific than that is kept
+
+	:param agent: the user agent
+*/
+func Browser(agent string) string {
+	var family string
+	switch {
+	case strings.Contains(agent, "Edg/"):
+		family = "Edge"
+	case strings.Contains(agent, "OPR/"):
+		family = "Opera"
+	case strings.Contains(agent, "Firefox/"):
+		family = "Firefox"
+	case strings.Contains(agent, "Chrome/") || strings.Contains(agent, "CriOS/"):
+		family = "Chrome"
+	case strings.Contains(agent, "Safari/"):
+		family = "Safari"
+	default:
+		family = "Other"
+	}
+	if strings.Contains(agent, "Mobi") {
+		family += " mobile"
+	}
+	return family
+}
+
+/*
+The domain of the site that linked to a page, without www. Links from the site itself,
+and requests without a referrer, are empty
+
+	:param referer: the Referer header of the request
+*/
+func (r *Recorder) Referrer(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == r.Domain {
+		return ""
+	}
+	return host
+}
+
+/*
+Count a view of a page, unless it was a bot
+
+	:param req: the request for the page
+*/
+func (r *Recorder) Record(req *http.Request) {
+	if IsBot(req) {
+		return
+	}
+	path := req.URL.Path
+	if len(path) > maxPath {
+		path = path[:maxPath]
+	}
+	view := storage.PageView{
+		Day:      r.now().UTC().Format(time.DateOnly),
+		Path:     path,
+		Referrer: r.Referrer(req.Referer()),
+		Agent:    Browser(req.UserAgent()),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[view]++
+}
+
+/*
+Middleware that records the pages a group of routes serves. Only successful GETs of html
+count, so a post asked for as JSON, or a page that wasnt found, isnt a view
+
+	:param skip: paths to leave out, a path ending in * leaves out everything starting with it
+*/
+func (r *Recorder) Middleware(skip ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Next()
+		if ctx.Request.Method != http.MethodGet || ctx.Writer.Status() != http.StatusOK ||
+			!strings.HasPrefix(ctx.Writer.Header().Get("Content-Type"), "text/html") {
+			return
+		}
+		for _, s := range skip {
+			prefix, wildcard := strings.CutSuffix(s, "*")
+			if ctx.FullPath() == s || (wildcard && strings.HasPrefix(ctx.FullPath(), prefix)) {
+				return
+			}
+		}
+		r.Record(ctx.Request)
+	}
+}
+
+// Add the views counted so far to the store, they are kept to try again if that fails
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	counts := r.counts
+	r.counts = map[storage.PageView]int{}
+	r.mu.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+	views := make([]storage.PageView, 0, len(counts))
+	for view, n := range counts {
+		view.Views = n
+		views = append(views, view)
+	}
+	err := r.store.AddPageViews(views)
+	if err != nil {
+		r.mu.Lock()
+		for view, n := range counts {
+			r.counts[view] += n
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+/*
+Flush the views every interval until stop is closed, and once more when it is
+
+	:param interval: how often to add the views to the store
+	:param stop: close it to stop recording
+*/
+func (r *Recorder) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if err := r.Flush(); err != nil {
+				slog.Error("saving the page views failed", "err", err)
+			}
+			return
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				slog.Error("saving the page views failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package analytics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+// Implementing the Store interface in memory
+type memStore struct {
+	views []storage.PageView
+	err   error
+}
+
+func (m *memStore) AddPageViews(views []storage.PageView) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.views = append(m.views, views...)
+	sort.Slice(m.views, func(i, j int) bool { return m.views[i].Path < m.views[j].Path })
+	return nil
+}
+
+func TestBrowser(t *testing.T) {
+	for agent, want := range map[string]string{
+		firefox: "Firefox",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36":                         "Chrome",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0":               "Edge",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1": "Safari mobile",
+		"Lynx/2.9.0": "Other",
+	} {
+		assert.Equal(t, want, Browser(agent), agent)
+	}
+}
+
+func TestIsBot(t *testing.T) {
+	for agent, want := range map[string]bool{
+		firefox: false,
+		"":      true,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": true,
+		"curl/8.5.0":                 true,
+		"python-requests/2.31.0":     true,
+		"Mozilla/5.0 HeadlessChrome": true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("User-Agent", agent)
+		assert.Equal(t, want, IsBot(req), agent)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", firefox)
+	req.Header.Set("Sec-Purpose", "prefetch")
+	assert.True(t, IsBot(req))
+}
+
+func TestReferrer(t *testing.T) {
+	r := NewRecorder("www.aetherial.dev", &memStore{})
+	assert.Equal(t, "news.example", r.Referrer("https://www.news.example/item?id=1"))
+	assert.Equal(t, "", r.Referrer("https://aetherial.dev/blog"))
+	assert.Equal(t, "", r.Referrer(""))
+	assert.Equal(t, "", r.Referrer("android-app://com.example"))
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memStore{}
+	r := NewRecorder("aetherial.dev", store)
+	r.now = func() time.Time { return time.Date(2025, 1, 2, 23, 0, 0, 0, time.UTC) }
+	e := gin.New()
+	web := e.Group("")
+	web.Use(r.Middleware("/writing/:id/comments", "/login*"))
+	page := func(ctx *gin.Context) { ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<p>hi</p>")) }
+	web.GET("/", page)
+	web.GET("/writing/:id", page)
+	web.GET("/writing/:id/comments", page)
+	web.GET("/login", page)
+	web.GET("/api/post", func(ctx *gin.Context) { ctx.JSON(http.StatusOK, map[string]string{}) })
+	web.GET("/missing", func(ctx *gin.Context) { ctx.Data(http.StatusNotFound, "text/html", nil) })
+
+	get := func(path, agent, referer string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("User-Agent", agent)
+		req.Header.Set("Referer", referer)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	get("/", firefox, "")
+	get("/writing/abc", firefox, "https://news.example/")
+	get("/writing/abc", firefox, "https://news.example/other")
+	get("/writing/abc", "Googlebot/2.1", "")
+	get("/writing/abc/comments", firefox, "")
+	get("/login", firefox, "")
+	get("/api/post", firefox, "")
+	get("/missing", firefox, "")
+
+	assert.NoError(t, r.Flush())
+	assert.Equal(t, []storage.PageView{
+		{Day: "2025-01-02", Path: "/", Agent: "Firefox", Views: 1},
+		{Day: "2025-01-02", Path: "/writing/abc", Referrer: "news.example", Agent: "Firefox", Views: 2},
+	}, store.views)
+
+	// nothing new was counted, so there is nothing to add
+	assert.NoError(t, r.Flush())
+	assert.Len(t, store.views, 2)
+}
+
+func TestFlushFailure(t *testing.T) {
+	store := &memStore{err: errors.New("database is locked")}
+	r := NewRecorder("aetherial.dev", store)
+	req := httptest.NewRequest(http.MethodGet, "/blog", nil)
+	req.Header.Set("User-Agent", firefox)
+	r.Record(req)
+	assert.Error(t, r.Flush())
+
+	// the views werent lost, and are added with the next ones
+	r.Record(req)
+	store.err = nil
+	assert.NoError(t, r.Flush())
+	if assert.Len(t, store.views, 1) {
+		assert.Equal(t, 2, store.views[0].Views)
+	}
+}
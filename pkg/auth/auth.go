@@ -45,6 +45,11 @@ func (c *AuthCache) Read(id string) bool {
 	return ok
 }
 
+// How many sessions are in the cache, including expired ones that havent been purged yet
+func (c *AuthCache) Size() int {
+	return c.AuthCookies.ItemCount()
+}
+
 type Source interface {
 	AdminUsername() string
 	AdminPassword() string
@@ -0,0 +1,497 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	databaseFile = "sqlite.db"
+	manifestFile = "manifest.json"
+	imageDir     = "images"
+	namePrefix   = "keiji-backup-"
+	nameSuffix   = ".tar.gz"
+	sumSuffix    = ".sha256"
+	nameLayout   = "20060102-150405.000"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("backup checksum does not match")
+	ErrInvalidBackup    = errors.New("backup is missing required files")
+	ErrUnknownBackup    = errors.New("no backup exists with that name")
+)
+
+/*
+Anything that can copy its database to a standalone sqlite file while the server is running.
+storage.SQLiteRepo implements this with SQLite's online backup API
+*/
+type Source interface {
+	BackupTo(dest string) error
+}
+
+// The manifest stored inside each backup, maps every file in the archive to its sha256
+type Manifest struct {
+	Created string            `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+// A backup archive sitting in the backup directory
+type Snapshot struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Created  string `json:"created"`
+}
+
+type Manager struct {
+	src        Source
+	ImageStore string
+	Dir        string
+	Retain     int
+	// how often the server takes a backup on its own, they are only taken when asked for if it is 0
+	Interval time.Duration
+}
+
+/*
+Create a new backup manager
+
+	:param src: the database to back up
+	:param imageStore: the directory holding the image blobs to bundle with the database
+	:param dir: the directory to write the backups to
+	:param retain: how many backups to keep around, anything less than 1 keeps all of them
+*/
+func NewManager(src Source, imageStore, dir string, retain int) *Manager {
+	return &Manager{
+		src:        src,
+		ImageStore: imageStore,
+		Dir:        dir,
+		Retain:     retain,
+	}
+}
+
+/*
+Take a backup of the database and the image store, write it to the backup directory
+alongside a .sha256 file, and prune anything outside of the retention policy
+*/
+func (m *Manager) Snapshot() (Snapshot, error) {
+	err := os.MkdirAll(m.Dir, 0o750)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	created := time.Now().UTC()
+	name := namePrefix + created.Format(nameLayout) + nameSuffix
+
+	tmpDir, err := os.MkdirTemp("", "keiji-backup")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+	dbCopy := path.Join(tmpDir, databaseFile)
+	err = m.src.BackupTo(dbCopy)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	partial := path.Join(m.Dir, name+".partial")
+	fh, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o640)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	hash := sha256.New()
+	err = writeBackup(io.MultiWriter(fh, hash), dbCopy, m.ImageStore, created)
+	fh.Close()
+	if err != nil {
+		os.Remove(partial)
+		return Snapshot{}, err
+	}
+	final := path.Join(m.Dir, name)
+	if err = os.Rename(partial, final); err != nil {
+		return Snapshot{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	err = os.WriteFile(final+sumSuffix, []byte(fmt.Sprintf("%s  %s\n", sum, name)), 0o640)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	info, err := os.Stat(final)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err = m.Prune(); err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Name: name, Size: info.Size(), Checksum: sum, Created: created.Format(time.RFC3339)}, nil
+}
+
+/*
+List all of the backups in the backup directory, newest first
+*/
+func (m *Manager) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Snapshot{}, nil
+		}
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, entry := range entries {
+		created, ok := parseName(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		sum, _ := readChecksum(path.Join(m.Dir, entry.Name()))
+		snapshots = append(snapshots, Snapshot{
+			Name:     entry.Name(),
+			Size:     info.Size(),
+			Checksum: sum,
+			Created:  created.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name > snapshots[j].Name })
+	return snapshots, nil
+}
+
+/*
+Get the path to a backup in the backup directory, refusing anything that isnt a backup name
+
+	:param name: the file name of the backup, as returned by List()
+*/
+func (m *Manager) Path(name string) (string, error) {
+	if _, ok := parseName(name); !ok || filepath.Base(name) != name {
+		return "", ErrUnknownBackup
+	}
+	p := path.Join(m.Dir, name)
+	if _, err := os.Stat(p); err != nil {
+		return "", ErrUnknownBackup
+	}
+	return p, nil
+}
+
+/*
+Remove the oldest backups until only Retain of them are left
+*/
+func (m *Manager) Prune() error {
+	if m.Retain < 1 {
+		return nil
+	}
+	snapshots, err := m.List()
+	if err != nil {
+		return err
+	}
+	for i := m.Retain; i < len(snapshots); i++ {
+		p := path.Join(m.Dir, snapshots[i].Name)
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		os.Remove(p + sumSuffix)
+	}
+	return nil
+}
+
+/*
+Take a snapshot every interval until stop is closed. Failures are logged and
+retried on the next tick rather than stopping the schedule
+
+	:param interval: how often to take a backup
+	:param stop: close this channel to stop taking backups
+*/
+func (m *Manager) Schedule(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			snap, err := m.Snapshot()
+			if err != nil {
+				slog.Error("scheduled backup failed", "err", err)
+				continue
+			}
+			slog.Info("scheduled backup written", "name", snap.Name, "bytes", snap.Size)
+		}
+	}
+}
+
+/*
+Check a backup against its .sha256 file (if there is one) and every file inside of it
+against the manifest
+
+	:param archive: the path to the backup to verify
+*/
+func Verify(archive string) (Manifest, error) {
+	want, err := readChecksum(archive)
+	if err == nil {
+		fh, err := os.Open(archive)
+		if err != nil {
+			return Manifest{}, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, fh)
+		fh.Close()
+		if err != nil {
+			return Manifest{}, err
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != want {
+			return Manifest{}, fmt.Errorf("%w: %s", ErrChecksumMismatch, path.Base(archive))
+		}
+	}
+	return readBackup(archive, nil)
+}
+
+/*
+Restore a backup over the top of a database file and image store. The server
+should not be running while this happens. Image files the backup doesnt have are removed,
+so the store ends up holding what it held when the backup was taken
+
+	:param archive: the path to the backup to restore
+	:param dbPath: the sqlite file to overwrite
+	:param imageStore: the directory to write the image blobs to
+*/
+func Restore(archive, dbPath, imageStore string) error {
+	if _, err := Verify(archive); err != nil {
+		return err
+	}
+	err := os.MkdirAll(imageStore, 0o750)
+	if err != nil {
+		return err
+	}
+	// everything is written under a temporary name first, and only renamed into place once the whole backup checked out
+	staged := map[string]string{}
+	defer func() {
+		for tmp := range staged {
+			os.Remove(tmp)
+		}
+	}()
+	_, err = readBackup(archive, func(name string, r io.Reader) error {
+		var dest string
+		switch {
+		case name == databaseFile:
+			dest = dbPath
+		case path.Dir(name) == imageDir && !strings.HasPrefix(path.Base(name), "."):
+			dest = path.Join(imageStore, path.Base(name))
+		default:
+			return nil
+		}
+		tmp, err := stageFile(r, dest)
+		if err != nil {
+			return err
+		}
+		staged[tmp] = dest
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	restored := map[string]bool{}
+	for tmp, dest := range staged {
+		if err = os.Rename(tmp, dest); err != nil {
+			return err
+		}
+		delete(staged, tmp)
+		restored[dest] = true
+	}
+	entries, err := os.ReadDir(imageStore)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(imageStore, entry.Name())
+		if entry.Type().IsRegular() && !restored[p] {
+			if err = os.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// write a file next to where it is going under a name starting with a dot, returning the name
+func stageFile(r io.Reader, dest string) (string, error) {
+	fh, err := os.CreateTemp(path.Dir(dest), "."+path.Base(dest)+".*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(fh, r)
+	if err == nil {
+		err = fh.Chmod(0o640)
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", err
+	}
+	return fh.Name(), nil
+}
+
+// write the tarball for a backup, the manifest goes last so it can hold the checksums of everything before it
+func writeBackup(w io.Writer, dbCopy, imageStore string, created time.Time) error {
+	manifest := Manifest{Created: created.Format(time.RFC3339), Files: map[string]string{}}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	addFile := func(name, src string) error {
+		fh, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		info, err := fh.Stat()
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o640, Size: info.Size(), ModTime: created})
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		if _, err = io.CopyN(io.MultiWriter(tw, hash), fh, info.Size()); err != nil {
+			return err
+		}
+		manifest.Files[name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	}
+
+	if err := addFile(databaseFile, dbCopy); err != nil {
+		return err
+	}
+	if imageStore != "" {
+		entries, err := os.ReadDir(imageStore)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, entry := range entries {
+			// names starting with a dot are images still being written
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if err = addFile(path.Join(imageDir, entry.Name()), path.Join(imageStore, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	mb, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: manifestFile, Mode: 0o640, Size: int64(len(mb)), ModTime: created})
+	if err != nil {
+		return err
+	}
+	if _, err = tw.Write(mb); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+/*
+Walk a backup, checking every file against the manifest. The files are streamed to the
+callback as they are read, before the manifest at the end of the backup has been checked,
+so the callback should only stage them until this returns without an error
+*/
+func readBackup(archive string, each func(name string, r io.Reader) error) (Manifest, error) {
+	var manifest Manifest
+	fh, err := os.Open(archive)
+	if err != nil {
+		return manifest, err
+	}
+	defer fh.Close()
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		return manifest, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	sums := map[string]string{}
+	var sawManifest bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		if hdr.Name == manifestFile {
+			if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, err
+			}
+			sawManifest = true
+			continue
+		}
+		hash := sha256.New()
+		r := io.TeeReader(tr, hash)
+		if each != nil {
+			if err = each(hdr.Name, r); err != nil {
+				return manifest, err
+			}
+		}
+		// whatever the callback didnt read still has to be checked
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			return manifest, err
+		}
+		sums[hdr.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	if _, ok := sums[databaseFile]; !sawManifest || !ok {
+		return manifest, ErrInvalidBackup
+	}
+	if len(sums) != len(manifest.Files) {
+		return manifest, fmt.Errorf("%w: manifest lists %v files, archive has %v", ErrChecksumMismatch, len(manifest.Files), len(sums))
+	}
+	for name, sum := range sums {
+		if manifest.Files[name] != sum {
+			return manifest, fmt.Errorf("%w: %s", ErrChecksumMismatch, name)
+		}
+	}
+	return manifest, nil
+}
+
+// read the checksum out of the .sha256 file next to a backup
+func readChecksum(archive string) (string, error) {
+	b, err := os.ReadFile(archive + sumSuffix)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(bytes.TrimSpace(b)))
+	if len(fields) == 0 {
+		return "", ErrInvalidBackup
+	}
+	return fields[0], nil
+}
+
+// pull the creation time out of a backup file name, reporting false if it isnt one
+func parseName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, nameSuffix) {
+		return time.Time{}, false
+	}
+	ts := strings.TrimSuffix(strings.TrimPrefix(name, namePrefix), nameSuffix)
+	created, err := time.Parse(nameLayout, ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return created, true
+}
@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// Implementing the Source interface by copying a sqlite file on disk
+type testSource struct {
+	dbPath string
+}
+
+func (tst testSource) BackupTo(dest string) error {
+	b, err := os.ReadFile(tst.dbPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest, b, 0o640)
+}
+
+/*
+creates a sqlite file with a single row in it and an image store with one image
+
+	:param dir: the directory to create the database and image store in
+*/
+func newTestSite(t *testing.T, dir string) (string, string) {
+	dbPath := path.Join(dir, "source.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE posts(id TEXT NOT NULL); INSERT INTO posts(id) VALUES ('qwerty');")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageStore := path.Join(dir, "images")
+	os.MkdirAll(imageStore, 0o750)
+	os.WriteFile(path.Join(imageStore, "abc123"), []byte("abc123xyz098"), 0o640)
+	return dbPath, imageStore
+}
+
+func TestSnapshotAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, imageStore := newTestSite(t, dir)
+	mgr := NewManager(testSource{dbPath: dbPath}, imageStore, path.Join(dir, "backups"), 0)
+	snap, err := mgr.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := Verify(path.Join(mgr.Dir, snap.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, manifest.Files, 2)
+	assert.Contains(t, manifest.Files, "images/abc123")
+
+	listed, err := mgr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Snapshot{snap}, listed)
+}
+
+func TestVerifyCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, imageStore := newTestSite(t, dir)
+	mgr := NewManager(testSource{dbPath: dbPath}, imageStore, path.Join(dir, "backups"), 0)
+	snap, err := mgr.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := path.Join(mgr.Dir, snap.Name)
+	b, _ := os.ReadFile(archive)
+	b[len(b)/2] ^= 0xff
+	os.WriteFile(archive, b, 0o640)
+	_, err = Verify(archive)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, imageStore := newTestSite(t, dir)
+	mgr := NewManager(testSource{dbPath: dbPath}, imageStore, path.Join(dir, "backups"), 2)
+	var newest Snapshot
+	for i := 0; i < 4; i++ {
+		snap, err := mgr.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		newest = snap
+	}
+	listed, err := mgr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, listed, 2)
+	assert.Equal(t, newest, listed[0])
+}
+
+func TestPath(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, imageStore := newTestSite(t, dir)
+	mgr := NewManager(testSource{dbPath: dbPath}, imageStore, path.Join(dir, "backups"), 0)
+	snap, err := mgr.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testcase struct {
+		input string
+		err   error
+	}
+	for _, tc := range []testcase{
+		{input: snap.Name, err: nil},
+		{input: "../source.db", err: ErrUnknownBackup},
+		{input: "keiji-backup-20240101-000000.000.tar.gz", err: ErrUnknownBackup},
+	} {
+		_, err := mgr.Path(tc.input)
+		assert.Equal(t, tc.err, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, imageStore := newTestSite(t, dir)
+	mgr := NewManager(testSource{dbPath: dbPath}, imageStore, path.Join(dir, "backups"), 0)
+	snap, err := mgr.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredDb := path.Join(dir, "restored.db")
+	restoredImages := path.Join(dir, "restored_images")
+	// images uploaded after the backup was taken dont survive restoring it
+	os.MkdirAll(restoredImages, 0o750)
+	os.WriteFile(path.Join(restoredImages, "abc123"), []byte("changed since"), 0o640)
+	os.WriteFile(path.Join(restoredImages, "def456"), []byte("uploaded since"), 0o640)
+	err = Restore(path.Join(mgr.Dir, snap.Name), restoredDb, restoredImages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path.Join(restoredImages, "abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("abc123xyz098"), b)
+	entries, err := os.ReadDir(restoredImages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+
+	db, err := sql.Open("sqlite3", restoredDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var id string
+	err = db.QueryRow("SELECT id FROM posts").Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "qwerty", id)
+}
+
+func TestSnapshotSkipsPartialImages(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, imageStore := newTestSite(t, dir)
+	os.WriteFile(path.Join(imageStore, ".def456.123"), []byte("half of an ima"), 0o640)
+	mgr := NewManager(testSource{dbPath: dbPath}, imageStore, path.Join(dir, "backups"), 0)
+	snap, err := mgr.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := Verify(path.Join(mgr.Dir, snap.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"images/abc123", databaseFile}, sortedKeys(manifest.Files))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
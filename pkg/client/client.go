@@ -0,0 +1,404 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"git.aetherial.dev/aeth/keiji/pkg/auth"
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
+	"git.aetherial.dev/aeth/keiji/pkg/controller"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+var ErrUnauthorized = errors.New("not logged in, or the session has expired")
+
+type RequestFailed struct {
+	Status int
+	Body   string
+}
+
+func (r *RequestFailed) Error() string {
+	return fmt.Sprintf("Request failed with status code: %v, %s", r.Status, r.Body)
+}
+
+/*
+Talks to the admin JSON api of a running keiji server. The document and image methods
+mirror the ones on storage.DocumentIO so that code written against the database can be
+pointed at a remote server instead
+*/
+type Client struct {
+	Address string
+	Cookie  string
+	http    *http.Client
+}
+
+/*
+Create a new api client
+
+	:param address: the base url of the server, i.e. 'https://aetherial.dev'
+	:param cookie: the auth cookie returned from logging in, empty if Login will be called
+*/
+func NewClient(address, cookie string) *Client {
+	return &Client{
+		Address: address,
+		Cookie:  cookie,
+		// the server redirects to the login page when the cookie is bad, which should be an error not a page
+		http: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+}
+
+/*
+Log in with the admin credentials and keep the auth cookie for later requests
+
+	:param username: the admin username
+	:param password: the admin password
+*/
+func (c *Client) Login(username, password string) error {
+	b, err := json.Marshal(auth.Credentials{Username: username, Password: password})
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(http.MethodPost, "/login", "application/json", bytes.NewReader(b))
+	var failed *RequestFailed
+	if errors.As(err, &failed) && failed.Status == http.StatusBadRequest {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, failed.Body)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == controller.AUTH_COOKIE_NAME {
+			c.Cookie = cookie.Value
+			return nil
+		}
+	}
+	return &RequestFailed{Status: resp.StatusCode, Body: "auth cookie not found in the login response"}
+}
+
+/*
+Get a post by its slug, returns storage.ErrNotExists if no post has that slug
+
+	:param slug: the slug to search for
+*/
+func (c *Client) GetDocumentBySlug(slug string) (storage.Document, error) {
+	var docs []storage.Document
+	err := c.do(http.MethodGet, "/admin/api/posts?slug="+url.QueryEscape(slug), "", nil, &docs)
+	if err != nil {
+		return storage.Document{}, err
+	}
+	if len(docs) == 0 {
+		return storage.Document{}, storage.ErrNotExists
+	}
+	return docs[0], nil
+}
+
+/*
+Get a post by its id, returns storage.ErrNotExists if it isnt there
+
+	:param id: the identifier of the post
+*/
+func (c *Client) GetDocument(id storage.Identifier) (storage.Document, error) {
+	var doc storage.Document
+	err := c.do(http.MethodGet, "/admin/api/posts/"+url.PathEscape(string(id)), "", nil, &doc)
+	return doc, err
+}
+
+/*
+Get every post on the server
+*/
+func (c *Client) AllDocuments() ([]storage.Document, error) {
+	var docs []storage.Document
+	err := c.do(http.MethodGet, "/admin/api/posts", "", nil, &docs)
+	return docs, err
+}
+
+/*
+Create a new post
+
+	:param doc: the post to create, the Ident is assigned by the server
+*/
+func (c *Client) AddDocument(doc storage.Document) (storage.Identifier, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return storage.Identifier(""), err
+	}
+	var resp map[string]string
+	err = c.do(http.MethodPost, "/admin/api/posts", "application/json", b, &resp)
+	return storage.Identifier(resp["id"]), err
+}
+
+/*
+Update an existing post, keyed off of its Ident
+
+	:param doc: the post to update
+*/
+func (c *Client) UpdateDocument(doc storage.Document) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/admin/api/posts/"+url.PathEscape(string(doc.Ident)), "application/json", b, nil)
+}
+
+/*
+Delete a post, returns storage.ErrNotExists if it isnt there
+
+	:param id: the identifier of the post
+*/
+func (c *Client) DeleteDocument(id storage.Identifier) error {
+	return c.do(http.MethodDelete, "/admin/api/posts/"+url.PathEscape(string(id)), "", nil, nil)
+}
+
+/*
+Upload an image to the image store
+
+	:param data: the image file
+	:param title: the title of the image
+	:param desc: the description of the image
+*/
+func (c *Client) AddImage(data []byte, title, desc string) (storage.Identifier, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("title", title)
+	form.WriteField("description", desc)
+	part, err := form.CreateFormFile("file", title)
+	if err != nil {
+		return storage.Identifier(""), err
+	}
+	if _, err = part.Write(data); err != nil {
+		return storage.Identifier(""), err
+	}
+	if err = form.Close(); err != nil {
+		return storage.Identifier(""), err
+	}
+	var resp map[string]string
+	err = c.do(http.MethodPost, "/admin/api/images", form.FormDataContentType(), body.Bytes(), &resp)
+	return storage.Identifier(resp["id"]), err
+}
+
+// Get the metadata of every image on the server, the Data of each image is left empty
+func (c *Client) AllImages() ([]storage.Image, error) {
+	var imgs []storage.Image
+	err := c.do(http.MethodGet, "/admin/api/images", "", nil, &imgs)
+	return imgs, err
+}
+
+/*
+Get the metadata of an image, the Data is left empty
+
+	:param id: the identifier of the image
+*/
+func (c *Client) GetImage(id storage.Identifier) (storage.Image, error) {
+	var img storage.Image
+	err := c.do(http.MethodGet, "/admin/api/images/"+url.PathEscape(string(id)), "", nil, &img)
+	return img, err
+}
+
+/*
+Update the title and description of an image, keyed off of its Ident
+
+	:param img: the image to update
+*/
+func (c *Client) UpdateImage(img storage.Image) error {
+	b, err := json.Marshal(storage.Image{Title: img.Title, Desc: img.Desc})
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/admin/api/images/"+url.PathEscape(string(img.Ident)), "application/json", b, nil)
+}
+
+/*
+Delete an image, returns storage.ErrNotExists if it isnt there
+
+	:param id: the identifier of the image
+*/
+func (c *Client) DeleteImage(id storage.Identifier) error {
+	return c.do(http.MethodDelete, "/admin/api/images/"+url.PathEscape(string(id)), "", nil, nil)
+}
+
+/*
+Add an asset, i.e. an icon or stylesheet, to the site
+
+	:param name: the file name the asset is served under
+	:param data: the contents of the asset
+*/
+func (c *Client) AddAsset(name string, data []byte) error {
+	b, err := json.Marshal(storage.Asset{Name: name, Data: data})
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/admin/asset", "application/json", b, nil)
+}
+
+/*
+Add an icon to the navigation bar
+
+	:param item: the icon and where it links to
+*/
+func (c *Client) AddNavbarItem(item storage.NavBarItem) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/admin/navbar", "application/json", b, nil)
+}
+
+/*
+Add a link to the sidebar menu
+
+	:param item: the text and link of the menu item
+*/
+func (c *Client) AddMenuItem(item storage.LinkPair) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/admin/menu", "application/json", b, nil)
+}
+
+/*
+Add a link to one of the tables on the admin panel
+
+	:param item: the link to add
+	:param category: the table to add it under
+*/
+func (c *Client) AddAdminTableEntry(item storage.TableData, category string) error {
+	b, err := json.Marshal(storage.AdminPage{Tables: map[string][]storage.TableData{category: {item}}})
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/admin/panel", "application/json", b, nil)
+}
+
+/*
+Download an archive of the whole site, returning the number of bytes written
+
+	:param w: where to write the archive to
+*/
+func (c *Client) Export(w io.Writer) (int64, error) {
+	resp, err := c.send(http.MethodGet, "/admin/export", "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+/*
+Load a site archive into the server
+
+	:param archive: the archive created by Export
+	:param mode: merge into or replace the existing site
+*/
+func (c *Client) Import(archive io.Reader, mode storage.ImportMode) (storage.ImportSummary, error) {
+	var summary storage.ImportSummary
+	resp, err := c.send(http.MethodPost, "/admin/import?mode="+url.QueryEscape(string(mode)), "application/gzip", archive)
+	if err != nil {
+		return summary, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	return summary, err
+}
+
+// Take a backup of the server right now
+func (c *Client) Backup() (backup.Snapshot, error) {
+	var snap backup.Snapshot
+	err := c.do(http.MethodPost, "/admin/backup", "", nil, &snap)
+	return snap, err
+}
+
+// List the backups kept on the server, newest first
+func (c *Client) ListBackups() ([]backup.Snapshot, error) {
+	var snapshots []backup.Snapshot
+	err := c.do(http.MethodGet, "/admin/backup", "", nil, &snapshots)
+	return snapshots, err
+}
+
+/*
+Download a backup, returning the checksum the server reported for it
+
+	:param name: the name of the backup
+	:param w: where to write the backup to
+*/
+func (c *Client) DownloadBackup(name string, w io.Writer) (string, error) {
+	resp, err := c.send(http.MethodGet, "/admin/backup/"+url.PathEscape(name), "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return resp.Header.Get("X-Checksum-Sha256"), err
+}
+
+/*
+Send a request to the server and decode the JSON response into out
+
+	:param method: the http method
+	:param p: the path (and query) to send the request to
+	:param ctype: the content type of the body, if there is one
+	:param body: the request body, nil for no body
+	:param out: where to decode the response to, nil to ignore it
+*/
+func (c *Client) do(method, p, ctype string, body []byte, out any) error {
+	var rdr io.Reader
+	if body != nil {
+		rdr = bytes.NewReader(body)
+	}
+	resp, err := c.send(method, p, ctype, rdr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+/*
+Send a request to the server, turning anything but a 200 into an error. The caller
+has to close the response body
+
+	:param method: the http method
+	:param p: the path (and query) to send the request to
+	:param ctype: the content type of the body, if there is one
+	:param body: the request body, nil for no body
+*/
+func (c *Client) send(method, p, ctype string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.Address+p, body)
+	if err != nil {
+		return nil, err
+	}
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if c.Cookie != "" {
+		req.AddCookie(&http.Cookie{Name: controller.AUTH_COOKIE_NAME, Value: c.Cookie})
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusFound, http.StatusUnauthorized:
+		return nil, ErrUnauthorized
+	case http.StatusNotFound:
+		return nil, storage.ErrNotExists
+	}
+	b, _ := io.ReadAll(resp.Body)
+	return nil, &RequestFailed{Status: resp.StatusCode, Body: string(b)}
+}
@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.aetherial.dev/aeth/keiji/pkg/activitypub"
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// respond with an ActivityPub document
+func activityJSON(ctx *gin.Context, contentType string, doc any) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.Data(http.StatusOK, contentType, b)
+}
+
+// whether a request asks for the ActivityPub version of a page rather than the html
+func wantsActivity(ctx *gin.Context) bool {
+	accept := ctx.GetHeader("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
+
+// @Name WebFinger
+// @Summary resolve the acct: resource in the resource query parameter to the sites ActivityPub actor
+// @Tags activitypub
+// @Router /.well-known/webfinger [get]
+func (c *Controller) WebFinger(ctx *gin.Context) {
+	jrd, err := c.Federation.WebFinger(ctx.Query("resource"))
+	if errors.Is(err, activitypub.ErrNotFound) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	activityJSON(ctx, activitypub.JRD_CONTENT_TYPE, jrd)
+}
+
+// @Name ServeActor
+// @Summary serves the document of the sites ActivityPub actor, with its public key
+// @Tags activitypub
+// @Router /actor [get]
+func (c *Controller) ServeActor(ctx *gin.Context) {
+	doc, err := c.Federation.Document()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	activityJSON(ctx, activitypub.CONTENT_TYPE, doc)
+}
+
+// @Name ServeOutbox
+// @Summary serves the activities the actor published newest first, a page at a time with the page query parameter
+// @Tags activitypub
+// @Router /actor/outbox [get]
+func (c *Controller) ServeOutbox(ctx *gin.Context) {
+	page, _ := strconv.Atoi(ctx.Query("page"))
+	outbox, err := c.Federation.Outbox(page)
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	activityJSON(ctx, activitypub.CONTENT_TYPE, outbox)
+}
+
+// @Name ServeFollowerCollection
+// @Summary serves how many followers the actor has, without listing them
+// @Tags activitypub
+// @Router /actor/followers [get]
+func (c *Controller) ServeFollowerCollection(ctx *gin.Context) {
+	followers, err := c.Federation.Followers()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	activityJSON(ctx, activitypub.CONTENT_TYPE, followers)
+}
+
+// @Name ServeActivity
+// @Summary serves an activity the actor published, as it was delivered
+// @Tags activitypub
+// @Router /actor/activities/:id [get]
+func (c *Controller) ServeActivity(ctx *gin.Context) {
+	activity, err := c.federationStore.GetActivity(storage.Identifier(ctx.Param("id")))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.Data(http.StatusOK, activitypub.CONTENT_TYPE, []byte(activity.Payload))
+}
+
+// @Name ActorInbox
+// @Summary receives signed activities from other servers, following and unfollowing the site
+// @Tags activitypub
+// @Router /actor/inbox [post]
+func (c *Controller) ActorInbox(ctx *gin.Context) {
+	logger := logging.FromContext(ctx.Request.Context())
+	reply, err := c.Federation.HandleInbox(ctx.Request)
+	switch {
+	case errors.Is(err, activitypub.ErrBadSignature):
+		ctx.JSON(401, map[string]string{
+			"Error": err.Error(),
+		})
+	case errors.Is(err, activitypub.ErrInvalidActivity):
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+	case err != nil:
+		logger.Warn("handling an activity in the inbox failed", "err", err)
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+	default:
+		// the sender doesnt wait on its own server to be answered, the reply is delivered in the background
+		if reply != nil {
+			c.background(func(<-chan struct{}) {
+				if err := c.Federation.Deliver(reply.Inbox, reply.Activity); err != nil {
+					logger.Warn("delivering the reply to an activity failed", "activity", reply.Activity.Type, "err", err)
+				}
+			})
+		}
+		ctx.Status(http.StatusAccepted)
+	}
+}
+
+/*
+@Name ServeFollowers
+@Summary serves the followers of the site for the admin, with buttons to remove them
+@Tags admin
+@Router /admin/followers [get]
+*/
+func (c *Controller) ServeFollowers(ctx *gin.Context) {
+	followers, err := c.federationStore.GetFollowers()
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	ctx.HTML(200, "followers", gin.H{
+		"Handle":    c.Federation.Handle(),
+		"Followers": followers,
+	})
+}
+
+/*
+@Name RemoveFollower
+@Summary remove the follower in the actor query parameter, their server is sent a Reject of their follow. Responds with nothing so they leave the list
+@Tags admin
+@Router /admin/followers [delete]
+*/
+func (c *Controller) RemoveFollower(ctx *gin.Context) {
+	actor := ctx.Query("actor")
+	followers, err := c.federationStore.GetFollowers()
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	var removed storage.Follower
+	for _, follower := range followers {
+		if follower.Actor == actor {
+			removed = follower
+		}
+	}
+	err = c.federationStore.RemoveFollower(actor)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "No such follower!", "Color": "red"})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	logger := logging.FromContext(ctx.Request.Context())
+	c.background(func(<-chan struct{}) {
+		if err := c.Federation.Reject(removed); err != nil {
+			logger.Warn("telling a removed follower failed", "actor", actor, "err", err)
+		}
+	})
+	ctx.Status(200)
+}
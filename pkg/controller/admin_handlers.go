@@ -1,20 +1,33 @@
 package controller
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"html/template"
 	"net/http"
+	"slices"
 	"time"
 
+	"git.aetherial.dev/aeth/keiji/pkg/activitypub"
 	"git.aetherial.dev/aeth/keiji/pkg/auth"
+	"git.aetherial.dev/aeth/keiji/pkg/events"
+	"git.aetherial.dev/aeth/keiji/pkg/imaging"
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/shortcode"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 const AUTH_COOKIE_NAME = "X-Server-Auth"
 
+// the cookie that keeps the token the draft of a new post is saved under, see newPostDraft
+const NEW_DRAFT_COOKIE = "keiji-new-draft"
+
+// how long a browser keeps the token of its new post draft after last opening the editor
+const newDraftTTL = 30 * 24 * time.Hour
+
 // @Name ServeLogin
 // @Summary serves the HTML login page
 // @Tags admin
@@ -48,20 +61,14 @@ func (c *Controller) Auth(ctx *gin.Context) {
 	}
 	cookie, err := auth.Authorize(&cred, c.Cache, c.AuthSource)
 	if err != nil {
+		c.loginFailures.Inc()
 		ctx.JSON(400, map[string]string{
 			"Error": err.Error(),
 		})
 		return
 	}
 	ctx.SetCookie(AUTH_COOKIE_NAME, cookie, 3600, "/", c.Domain, false, false)
-
-	ctx.HTML(http.StatusOK, "admin", gin.H{
-		"navigation": gin.H{
-			"headers": c.database.GetNavBarLinks(),
-			"menu":    c.database.GetDropdownElements(),
-		},
-		"Tables": c.database.GetAdminTables().Tables,
-	})
+	c.renderAdminPanel(ctx)
 
 }
 
@@ -118,6 +125,7 @@ func (c *Controller) AddMenuItem(ctx *gin.Context) {
 		})
 		return
 	}
+	c.navigation.Flush()
 	ctx.Data(200, "text", []byte("menu item added."))
 }
 
@@ -145,6 +153,8 @@ func (c *Controller) AddNavbarItem(ctx *gin.Context) {
 		return
 	}
 
+	c.navigation.Flush()
+
 	err = c.database.AddAsset(item.Link, item.Png)
 	if err != nil {
 		ctx.JSON(400, map[string]string{
@@ -152,6 +162,7 @@ func (c *Controller) AddNavbarItem(ctx *gin.Context) {
 		})
 		return
 	}
+	c.Events.Publish(events.ASSET_CREATED, map[string]string{"name": item.Link})
 
 	ctx.Data(200, "text", []byte("navbar item added."))
 }
@@ -178,6 +189,7 @@ func (c *Controller) AddAsset(ctx *gin.Context) {
 		})
 		return
 	}
+	c.Events.Publish(events.ASSET_CREATED, map[string]string{"name": item.Name})
 
 }
 
@@ -186,15 +198,40 @@ func (c *Controller) AddAsset(ctx *gin.Context) {
 // @Tags admin
 // @Router /admin/panel [get]
 func (c *Controller) AdminPanel(ctx *gin.Context) {
+	c.renderAdminPanel(ctx)
+}
 
+// render the admin panel, with the links of the admin table
+func (c *Controller) renderAdminPanel(ctx *gin.Context) {
+	navigation, err := c.navigationData()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	tables, err := c.database.GetAdminTables()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
 	ctx.HTML(http.StatusOK, "admin", gin.H{
-		"navigation": gin.H{
-			"headers": c.database.GetNavBarLinks(),
-			"menu":    c.database.GetDropdownElements(),
-		},
-		"Tables": c.database.GetAdminTables().Tables,
+		"navigation": navigation,
+		"Tables":     tables.Tables,
+		"Pending":    c.pendingModeration(ctx.Request.Context()),
+		"Federating": c.Federation != nil,
 	})
+}
 
+// count the comments and webmentions awaiting moderation, for the admin panel
+func (c *Controller) pendingModeration(ctx context.Context) int {
+	comments, err := c.commentStore.GetCommentQueue(storage.COMMENT_PENDING)
+	if err != nil {
+		logging.FromContext(ctx).Error("counting the comments awaiting moderation failed", "err", err)
+	}
+	mentions, err := c.commentStore.GetMentionQueue(storage.COMMENT_PENDING)
+	if err != nil {
+		logging.FromContext(ctx).Error("counting the webmentions awaiting moderation failed", "err", err)
+	}
+	return len(comments) + len(mentions)
 }
 
 /*
@@ -203,7 +240,11 @@ Serves the admin panel with all of the documents in each blog category for editi
 func (c *Controller) ServeBlogDirectory(ctx *gin.Context) {
 	tableData := storage.AdminPage{Tables: map[string][]storage.TableData{}}
 	for i := range storage.Topics {
-		docs := c.database.GetByCategory(storage.Topics[i])
+		docs, err := c.database.GetByCategory(storage.Topics[i])
+		if err != nil {
+			c.unhandledError(ctx, 500, err)
+			return
+		}
 		for z := range docs {
 			tableData.Tables[storage.Topics[i]] = append(tableData.Tables[storage.Topics[i]],
 				storage.TableData{
@@ -214,12 +255,14 @@ func (c *Controller) ServeBlogDirectory(ctx *gin.Context) {
 		}
 	}
 
+	navigation, err := c.navigationData()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
 	ctx.HTML(200, "admin", gin.H{
-		"navigation": gin.H{
-			"menu":    c.database.GetDropdownElements(),
-			"headers": c.database.GetNavBarLinks(),
-		},
-		"Tables": tableData.Tables,
+		"navigation": navigation,
+		"Tables":     tableData.Tables,
 	})
 
 }
@@ -242,18 +285,92 @@ func (c *Controller) GetBlogPostEditor(ctx *gin.Context) {
 		})
 		return
 	}
-	ctx.HTML(200, "blogpost_editor", gin.H{
-		"navigation": gin.H{
-			"menu":    c.database.GetDropdownElements(),
-			"headers": c.database.GetNavBarLinks(),
-		},
+	navigation, err := c.navigationData()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	page := gin.H{
+		"navigation":   navigation,
 		"Ident":        doc.Ident,
 		"Topics":       storage.Topics,
 		"Title":        doc.Title,
 		"DefaultTopic": doc.Category,
 		"Created":      doc.Created,
 		"Body":         doc.Body,
-	})
+		"Slug":         doc.Slug,
+		"Tags":         doc.Tags,
+		"Version":      doc.Version,
+	}
+	c.editorDraft(ctx.Request.Context(), page, doc, doc.Ident, ctx.Query("draft") == "true")
+	page["Missing"] = c.missingImages(page["Body"].(string))
+	ctx.HTML(200, "blogpost_editor", page)
+}
+
+/*
+Put the draft of a post in the editor when it was asked to restore it, otherwise offer to
+restore the draft if it has changes that werent saved. The post keeps its own version, so
+restoring a draft and saving it replaces whatever was saved since the draft was started
+
+	:param ctx: the context of the request for the editor
+	:param page: the template data of the editor, filled in with the saved post
+	:param doc: the saved post, the zero Document for a post that hasnt been created yet
+	:param key: what the draft is saved under, the posts Identifier or newPostDraft
+	:param restore: put the draft in the editor instead of the saved post
+*/
+func (c *Controller) editorDraft(ctx context.Context, page gin.H, doc storage.Document, key storage.Identifier, restore bool) {
+	page["DraftKey"] = key
+	draft, err := c.database.GetDraft(key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExists) {
+			logging.FromContext(ctx).Error("getting the draft of the post failed", "draft", key, "err", err)
+		}
+		return
+	}
+	if restore {
+		page["Title"], page["Body"], page["Slug"], page["Tags"] = draft.Title, draft.Body, draft.Slug, draft.Tags
+		if draft.Category != "" {
+			page["DefaultTopic"] = draft.Category
+		}
+		return
+	}
+	if draft.Title == doc.Title && draft.Body == doc.Body && draft.Category == doc.Category && draft.Slug == doc.Slug && draft.Tags == doc.Tags {
+		return
+	}
+	page["Draft"] = draft
+	page["DraftStale"] = doc.Ident != "" && draft.Version != doc.Version
+}
+
+/*
+The key the draft of a post that hasnt been created yet is saved under. Its token is kept
+in a cookie, made the first time the editor is opened, so it stays the same however the
+id in the form is edited and each browser gets its own draft
+
+	:param ctx: the request for the editor, or one of the requests it makes
+*/
+func (c *Controller) newPostDraft(ctx *gin.Context) storage.Identifier {
+	token, err := ctx.Cookie(NEW_DRAFT_COOKIE)
+	if err != nil || token == "" {
+		token = uuid.NewString()
+	}
+	// set again every time so it lasts as long after the editor was last used
+	ctx.SetCookie(NEW_DRAFT_COOKIE, token, int(newDraftTTL.Seconds()), "/admin", c.Domain, false, true)
+	return storage.Identifier("new:" + token)
+}
+
+/*
+The identifiers of the images a post references with shortcodes that dont exist anymore
+
+	:param body: the markdown body of the post
+*/
+func (c *Controller) missingImages(body string) []string {
+	var missing []string
+	for _, ref := range shortcode.Find([]byte(body)) {
+		if _, err := c.database.GetImageInfo(storage.Identifier(ref.ID)); errors.Is(err, storage.ErrNotExists) {
+			missing = append(missing, ref.ID)
+		}
+	}
+	return missing
 }
 
 /*
@@ -268,30 +385,108 @@ func (c *Controller) UpdateBlogPost(ctx *gin.Context) {
 		return
 	}
 	err = c.database.UpdateDocument(doc)
+	if errors.Is(err, storage.ErrConflict) {
+		ctx.HTML(409, "upload_status", gin.H{
+			"UpdateMessage": "Not saved, this post was saved somewhere else since you opened it. Your autosaved draft is kept, reopen the post to restore it.",
+			"Color":         "red",
+		})
+		return
+	}
 	if err != nil {
 		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": "Update Failed!", "Color": "red"})
 		return
 	}
-	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Update Successful!", "Color": "green"})
+	c.Rendered.Invalidate(doc.Ident)
+	// the editor saves against the new version from now on
+	saved, err := c.database.GetDocument(doc.Ident)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	c.federate(ctx.Request.Context(), activitypub.UPDATE, saved)
+	c.documentEvent(ctx.Request.Context(), events.DOCUMENT_UPDATED, saved)
+	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Update Successful!", "Color": "green", "Version": saved.Version})
 
 }
 
 /*
-Serving the new blogpost page. Serves the editor with the method to POST a new document
+@Name SaveDraft
+@Summary autosave the post in the editor as a draft, without touching the post itself
+@Tags admin
+@Router /admin/drafts [put]
 */
-func (c *Controller) ServeNewBlogPage(ctx *gin.Context) {
+func (c *Controller) SaveDraft(ctx *gin.Context) {
+	var draft storage.Draft
+	err := ctx.ShouldBind(&draft)
+	if err != nil || draft.Post == "" {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": "Autosave Failed!", "Color": "red"})
+		return
+	}
+	err = c.database.SaveDraft(draft)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": "Autosave Failed!", "Color": "red"})
+		return
+	}
+	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Draft saved at " + time.Now().Format(time.TimeOnly), "Color": "gray"})
+}
+
+/*
+@Name DeleteDraft
+@Summary discard the draft of a post, the id query parameter is the post or the draft key the editor of a new post was given
+@Tags admin
+@Router /admin/drafts [delete]
+*/
+func (c *Controller) DeleteDraft(ctx *gin.Context) {
+	err := c.database.DeleteDraft(storage.Identifier(ctx.Query("id")))
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	ctx.Status(200)
+}
 
-	ctx.HTML(200, "blogpost_editor", gin.H{
-		"navigation": gin.H{
-			"menu":    c.database.GetDropdownElements(),
-			"headers": c.database.GetNavBarLinks(),
-		},
-		"Post":    true,
-		"Topics":  storage.Topics,
-		"Created": time.Now().UTC().String(),
+/*
+@Name PreviewBlogPost
+@Summary render the post in the editor the way it would be served, without saving it
+@Tags admin
+@Router /admin/posts/preview [post]
+*/
+func (c *Controller) PreviewBlogPost(ctx *gin.Context) {
+	var doc storage.Document
+	err := ctx.ShouldBind(&doc)
+	if err != nil {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": "Preview Failed!", "Color": "red"})
+		return
+	}
+	// not through the render cache, the post may not exist and the body isnt saved yet
+	ctx.HTML(200, "blogpost", gin.H{
+		"Title":   doc.Title,
+		"Ident":   doc.Ident,
+		"Created": doc.Created,
+		"Body":    template.HTML(c.renderMarkdown(ctx.Request.Context(), doc.Body)),
 	})
 }
 
+/*
+Serving the new blogpost page. Serves the editor with the method to POST a new document
+*/
+func (c *Controller) ServeNewBlogPage(ctx *gin.Context) {
+	navigation, err := c.navigationData()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	page := gin.H{
+		"navigation": navigation,
+		"Post":       true,
+		"Topics":     storage.Topics,
+		"Created":    time.Now().UTC().String(),
+		"Body":       "",
+	}
+	c.editorDraft(ctx.Request.Context(), page, storage.Document{}, c.newPostDraft(ctx), ctx.Query("draft") == "true")
+	ctx.HTML(200, "blogpost_editor", page)
+}
+
 /*
 Reciever for the ServeNewBlogPage UI screen. Adds a new document to the database
 */
@@ -302,11 +497,18 @@ func (c *Controller) MakeBlogPost(ctx *gin.Context) {
 		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": "Update Failed!", "Color": "red"})
 		return
 	}
-	_, err = c.database.AddDocument(doc)
+	doc.Ident, err = c.database.AddDocument(doc)
 	if err != nil {
 		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": "Update Failed!", "Color": "red"})
 		return
 	}
+	c.sendWebmentions(ctx.Request.Context(), doc)
+	c.federate(ctx.Request.Context(), activitypub.CREATE, doc)
+	c.emailSubscribers(ctx.Request.Context(), doc)
+	c.documentEvent(ctx.Request.Context(), events.DOCUMENT_CREATED, doc)
+	if err = c.database.DeleteDraft(c.newPostDraft(ctx)); err != nil {
+		logging.FromContext(ctx.Request.Context()).Error("discarding the draft of the new post failed", "err", err)
+	}
 	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Update Successful!", "Color": "green"})
 
 }
@@ -315,12 +517,12 @@ func (c *Controller) MakeBlogPost(ctx *gin.Context) {
 Serves the HTML page for a new visual media post
 */
 func (c *Controller) ServeFileUpload(ctx *gin.Context) {
-	ctx.HTML(200, "upload", gin.H{
-		"navigation": gin.H{
-			"menu":    c.database.GetDropdownElements(),
-			"headers": c.database.GetNavBarLinks(),
-		},
-	})
+	navigation, err := c.navigationData()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	ctx.HTML(200, "upload", gin.H{"navigation": navigation})
 }
 
 /*
@@ -338,32 +540,51 @@ func (c *Controller) SaveFile(ctx *gin.Context) {
 		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
 		return
 	}
-	fh, err := file.Open()
+	fb, code, err := readImageUpload(file)
 	if err != nil {
-		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		ctx.HTML(code, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
 		return
 	}
-	fb := make([]byte, file.Size)
-	var output bytes.Buffer
-	for {
-		n, err := fh.Read(fb)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatal(err)
-		}
-		output.Write(fb[:n])
-	}
-	_, err = c.database.AddImage(fb, img.Title, img.Desc)
+	id, err := c.database.AddImage(fb, img.Title, img.Desc)
 	if err != nil {
-		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		ctx.HTML(addImageStatus(err), "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
 		return
 	}
+	c.generateVariants(ctx.Request.Context(), id)
+	c.imageEvent(ctx.Request.Context(), events.IMAGE_CREATED, storage.Image{Ident: id})
 
 	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Update Successful!", "Color": "green"})
 }
 
+// An image in the post editors image picker, with the shortcode that embeds it
+type pickerImage struct {
+	storage.Image
+	Shortcode string
+}
+
+// @Name ServeImagePicker
+// @Summary serve the image picker for the post editor, clicking an image inserts its shortcode into the post
+// @Tags admin
+// @Router /admin/images/picker [get]
+func (c *Controller) ServeImagePicker(ctx *gin.Context) {
+	imgs, err := c.database.ListImages()
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	picks := make([]pickerImage, len(imgs))
+	for i := range imgs {
+		picks[i] = pickerImage{
+			Image:     imgs[i],
+			Shortcode: shortcode.Format(shortcode.Image{ID: string(imgs[i].Ident), Alt: imgs[i].Title}),
+		}
+	}
+	ctx.HTML(200, "image_picker", gin.H{
+		"images": picks,
+		"thumb":  imaging.ThumbnailParam,
+	})
+}
+
 // Serve the document deletion template
 func (c *Controller) PostOptions(ctx *gin.Context) {
 	id, found := ctx.Params.Get("id")
@@ -372,10 +593,124 @@ func (c *Controller) PostOptions(ctx *gin.Context) {
 		return
 	}
 
+	c.renderPostOptions(ctx, storage.Identifier(id))
+}
+
+// serve the options of a post, which include opening or closing it for comments
+func (c *Controller) renderPostOptions(ctx *gin.Context, id storage.Identifier) {
+	doc, err := c.database.GetDocument(id)
+	if err != nil {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "No such post!", "Color": "red"})
+		return
+	}
 	ctx.HTML(200, "post_options", gin.H{
-		"Link": fmt.Sprintf("/admin/posts/%s", id),
+		"Link":           fmt.Sprintf("/admin/posts/%s", id),
+		"CommentsClosed": doc.CommentsClosed,
 	})
+}
+
+/*
+@Name SetPostComments
+@Summary open or close a post for comments with the closed query parameter, responds with the posts options
+@Tags admin
+@Router /admin/posts/{id}/comments [put]
+*/
+func (c *Controller) SetPostComments(ctx *gin.Context) {
+	id := storage.Identifier(ctx.Param("id"))
+	err := c.commentStore.SetCommentsClosed(id, ctx.Query("closed") == "true")
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "No such post!", "Color": "red"})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	c.renderPostOptions(ctx, id)
+}
 
+// A comment in the moderation queue
+type queuedComment struct {
+	storage.Comment
+	HTML template.HTML
+}
+
+/*
+@Name ServeCommentQueue
+@Summary serves the comments and webmentions with the status query parameter for moderation, the ones awaiting it by default
+@Tags admin
+@Router /admin/comments [get]
+*/
+func (c *Controller) ServeCommentQueue(ctx *gin.Context) {
+	status := storage.CommentStatus(ctx.DefaultQuery("status", string(storage.COMMENT_PENDING)))
+	comments, err := c.commentStore.GetCommentQueue(status)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	mentions, err := c.commentStore.GetMentionQueue(status)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	queue := make([]queuedComment, len(comments))
+	for i := range comments {
+		queue[i] = queuedComment{Comment: comments[i], HTML: template.HTML(c.Comments.Render([]byte(comments[i].Body)))}
+	}
+	ctx.HTML(200, "comment_queue", gin.H{
+		"Status":   status,
+		"Statuses": storage.CommentStatuses,
+		"Comments": queue,
+		"Mentions": mentions,
+	})
+}
+
+/*
+@Name ModerateComment
+@Summary move a comment to the status in the status query parameter, i.e. approve it. Responds with nothing so the comment leaves the queue
+@Tags admin
+@Router /admin/comments/{id} [put]
+*/
+func (c *Controller) ModerateComment(ctx *gin.Context) {
+	status := storage.CommentStatus(ctx.Query("status"))
+	if !slices.Contains(storage.CommentStatuses, status) {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": fmt.Sprintf("%q isnt a comment status", status), "Color": "red"})
+		return
+	}
+	err := c.commentStore.SetCommentStatus(storage.Identifier(ctx.Param("id")), status)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "No such comment!", "Color": "red"})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	ctx.Status(200)
+}
+
+/*
+@Name ModerateMention
+@Summary move a webmention to the status in the status query parameter, i.e. approve it. Responds with nothing so the mention leaves the queue
+@Tags admin
+@Router /admin/mentions/{id} [put]
+*/
+func (c *Controller) ModerateMention(ctx *gin.Context) {
+	status := storage.CommentStatus(ctx.Query("status"))
+	if !slices.Contains(storage.CommentStatuses, status) {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": fmt.Sprintf("%q isnt a comment status", status), "Color": "red"})
+		return
+	}
+	err := c.commentStore.SetMentionStatus(storage.Identifier(ctx.Param("id")), status)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "No such webmention!", "Color": "red"})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	ctx.Status(200)
 }
 
 /*
@@ -388,11 +723,288 @@ func (c *Controller) DeleteDocument(ctx *gin.Context) {
 		return
 
 	}
+	doc, getErr := c.database.GetDocument(storage.Identifier(id))
 	err := c.database.DeleteDocument(storage.Identifier(id))
 	if err != nil {
 		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": "Delete Failed!", "Color": "red"})
 		return
 	}
+	c.Rendered.Invalidate(storage.Identifier(id))
+	if getErr == nil {
+		c.federate(ctx.Request.Context(), activitypub.DELETE, doc)
+		c.documentEvent(ctx.Request.Context(), events.DOCUMENT_DELETED, doc)
+	}
 	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Delete Successful!", "Color": "green"})
 
 }
+
+/*
+@Name ExportSite
+@Summary download an archive of the entire site
+@Tags admin
+@Router /admin/export [get]
+*/
+func (c *Controller) ExportSite(ctx *gin.Context) {
+	schema, err := c.database.ExtractAll()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.Header("Content-Type", "application/gzip")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=keiji-export-%s.tar.gz", time.Now().UTC().Format("20060102-150405")))
+	err = storage.WriteArchive(ctx.Writer, schema)
+	if err != nil {
+		ctx.Error(err)
+	}
+}
+
+/*
+@Name ImportSite
+@Summary load an archive created by ExportSite, merging by default or replacing with ?mode=replace
+@Tags admin
+@Router /admin/import [post]
+*/
+func (c *Controller) ImportSite(ctx *gin.Context) {
+	mode := storage.ImportMode(ctx.DefaultQuery("mode", string(storage.IMPORT_MERGE)))
+	body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, storage.GetMaxImportBytes())
+	summary, err := c.database.ImportArchive(body, mode)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"Error": fmt.Sprintf("the archive is larger than the %v byte limit", tooLarge.Limit),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	// an import can replace any post, menu or navbar entry
+	c.Rendered.Purge()
+	c.navigation.Flush()
+	// and the variants of the images it wrote were made from what was there before
+	for _, id := range summary.Images {
+		if err = c.Images.Purge(id); err != nil {
+			logging.FromContext(ctx.Request.Context()).Warn("removing the variants of an imported image failed", "image", id, "err", err)
+		}
+	}
+	ctx.JSON(200, summary)
+}
+
+/*
+@Name ListBackups
+@Summary list the backups in the backup directory
+@Tags admin
+@Router /admin/backup [get]
+*/
+func (c *Controller) ListBackups(ctx *gin.Context) {
+	if c.Backups == nil {
+		ctx.JSON(404, map[string]string{
+			"Error": "backups are not configured on this server",
+		})
+		return
+	}
+	snapshots, err := c.Backups.List()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, snapshots)
+}
+
+/*
+@Name TriggerBackup
+@Summary take a backup of the database and image store right now
+@Tags admin
+@Router /admin/backup [post]
+*/
+func (c *Controller) TriggerBackup(ctx *gin.Context) {
+	if c.Backups == nil {
+		ctx.JSON(404, map[string]string{
+			"Error": "backups are not configured on this server",
+		})
+		return
+	}
+	snap, err := c.Backups.Snapshot()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, snap)
+}
+
+/*
+@Name DownloadBackup
+@Summary download a backup from the backup directory
+@Tags admin
+@Router /admin/backup/{name} [get]
+*/
+func (c *Controller) DownloadBackup(ctx *gin.Context) {
+	if c.Backups == nil {
+		ctx.JSON(404, map[string]string{
+			"Error": "backups are not configured on this server",
+		})
+		return
+	}
+	name, _ := ctx.Params.Get("name")
+	p, err := c.Backups.Path(name)
+	if err != nil {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	snapshots, _ := c.Backups.List()
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			ctx.Header("X-Checksum-Sha256", snapshots[i].Checksum)
+		}
+	}
+	ctx.FileAttachment(p, name)
+}
+
+// @Name ServeAlbums
+// @Summary serve the album list, where albums are created and put in order
+// @Tags admin
+// @Router /admin/albums [get]
+func (c *Controller) ServeAlbums(ctx *gin.Context) {
+	c.renderAlbums(ctx, 200, "", "")
+}
+
+// render the album list with an optional status message
+func (c *Controller) renderAlbums(ctx *gin.Context, code int, message, color string) {
+	albums, err := c.database.GetAlbums()
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	ctx.HTML(code, "albums", gin.H{
+		"albums":  albums,
+		"Message": message,
+		"Color":   color,
+	})
+}
+
+// @Name MakeAlbum
+// @Summary create an album from the album list form, responds with the updated album list
+// @Tags admin
+// @Router /admin/albums [post]
+func (c *Controller) MakeAlbum(ctx *gin.Context) {
+	var album storage.Album
+	err := ctx.ShouldBind(&album)
+	if err != nil {
+		c.renderAlbums(ctx, 400, err.Error(), "red")
+		return
+	}
+	albums, err := c.database.GetAlbums()
+	if err != nil {
+		c.renderAlbums(ctx, 500, err.Error(), "red")
+		return
+	}
+	// new albums go on the end
+	album.Position = len(albums)
+	_, err = c.database.AddAlbum(album)
+	if errors.Is(err, storage.ErrDuplicate) {
+		c.renderAlbums(ctx, 409, "an album with that slug already exists", "red")
+		return
+	}
+	if err != nil {
+		c.renderAlbums(ctx, 500, err.Error(), "red")
+		return
+	}
+	c.renderAlbums(ctx, 200, "Album created!", "green")
+}
+
+// @Name ServeAlbumEditor
+// @Summary serve the page for editing an album and arranging its images
+// @Tags admin
+// @Router /admin/albums/:id [get]
+func (c *Controller) ServeAlbumEditor(ctx *gin.Context) {
+	album, err := c.database.GetAlbum(storage.Identifier(ctx.Param("id")))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "no such album", "Color": "red"})
+		return
+	}
+	var members []storage.Image
+	if err == nil {
+		members, err = c.database.GetAlbumImages(album.Ident)
+	}
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	in := map[storage.Identifier]bool{}
+	for i := range members {
+		in[members[i].Ident] = true
+	}
+	all, err := c.database.ListImages()
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	others := []storage.Image{}
+	for _, img := range all {
+		if !in[img.Ident] {
+			others = append(others, img)
+		}
+	}
+	ctx.HTML(200, "album_editor", gin.H{
+		"album":   album,
+		"members": members,
+		"others":  others,
+		"thumb":   imaging.ThumbnailParam,
+	})
+}
+
+// @Name PatchAlbum
+// @Summary update the name, slug, description and cover of an album from the album editor
+// @Tags admin
+// @Router /admin/albums/:id [patch]
+func (c *Controller) PatchAlbum(ctx *gin.Context) {
+	var update storage.Album
+	err := ctx.ShouldBind(&update)
+	if err != nil {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	album, err := c.database.GetAlbum(storage.Identifier(ctx.Param("id")))
+	if err == nil {
+		album.Name, album.Slug, album.Desc, album.Cover = update.Name, update.Slug, update.Desc, update.Cover
+		err = c.database.UpdateAlbum(album)
+	}
+	switch {
+	case errors.Is(err, storage.ErrNotExists):
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "no such album", "Color": "red"})
+	case errors.Is(err, storage.ErrDuplicate):
+		ctx.HTML(409, "upload_status", gin.H{"UpdateMessage": "an album with that slug already exists", "Color": "red"})
+	case err != nil:
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+	default:
+		ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Update Successful!", "Color": "green"})
+	}
+}
+
+// @Name DeleteAlbum
+// @Summary delete an album, leaving its images alone. Responds with the album list
+// @Tags admin
+// @Router /admin/albums/:id [delete]
+func (c *Controller) DeleteAlbum(ctx *gin.Context) {
+	err := c.database.DeleteAlbum(storage.Identifier(ctx.Param("id")))
+	if errors.Is(err, storage.ErrNotExists) {
+		c.renderAlbums(ctx, 404, "no such album", "red")
+		return
+	}
+	if err != nil {
+		c.renderAlbums(ctx, 500, err.Error(), "red")
+		return
+	}
+	c.renderAlbums(ctx, 200, "Album deleted.", "green")
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// how many days the dashboard covers when it isnt asked for another range
+	defaultAnalyticsDays = 30
+	// the longest range the dashboard covers
+	maxAnalyticsDays = 365
+	// how many pages, referrers and browsers are listed
+	analyticsTopSize = 20
+)
+
+// the views of a day on the dashboard, Percent being how tall its bar is next to the busiest day
+type dailyViews struct {
+	Day     string
+	Views   int
+	Percent int
+}
+
+/*
+Fill in the days between from and to that had no views, so the chart doesnt skip them
+
+	:param counts: the views of the days that had any, oldest first
+	:param from: the first day
+	:param days: how many days there are from the first
+*/
+func fillDays(counts []storage.ViewCount, from time.Time, days int) ([]dailyViews, int) {
+	views := make(map[string]int, len(counts))
+	most := 0
+	for _, count := range counts {
+		views[count.Key] = count.Views
+		most = max(most, count.Views)
+	}
+	daily := make([]dailyViews, days)
+	total := 0
+	for i := range daily {
+		day := from.AddDate(0, 0, i).Format(time.DateOnly)
+		daily[i] = dailyViews{Day: day, Views: views[day]}
+		if most > 0 {
+			daily[i].Percent = views[day] * 100 / most
+		}
+		total += views[day]
+	}
+	return daily, total
+}
+
+// @Name ServeAnalytics
+// @Summary serve the page views of the last days, with the most read pages, the sites that sent readers and the browsers they used. The number of days is the days query parameter, 30 by default
+// @Tags admin
+// @Router /admin/analytics [get]
+func (c *Controller) ServeAnalytics(ctx *gin.Context) {
+	days := defaultAnalyticsDays
+	if d := ctx.Query("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 {
+			ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": "days has to be a positive number", "Color": "red"})
+			return
+		}
+		days = min(n, maxAnalyticsDays)
+	}
+	// views that are still only counted in memory show up right away
+	if err := c.Analytics.Flush(); err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, 1-days)
+	first, last := from.Format(time.DateOnly), to.Format(time.DateOnly)
+
+	counts, err := c.analyticsStore.GetDailyViews(first, last)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	pages, err := c.analyticsStore.GetTopPages(first, last, analyticsTopSize)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	referrers, err := c.analyticsStore.GetTopReferrers(first, last, analyticsTopSize)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	agents, err := c.analyticsStore.GetTopAgents(first, last, analyticsTopSize)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	daily, total := fillDays(counts, from, days)
+	ctx.HTML(200, "analytics", gin.H{
+		"Days":      days,
+		"Ranges":    []int{7, 30, 90, 365},
+		"Total":     total,
+		"Daily":     daily,
+		"Pages":     pages,
+		"Referrers": referrers,
+		"Agents":    agents,
+	})
+}
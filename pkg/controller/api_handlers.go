@@ -0,0 +1,530 @@
+package controller
+
+import (
+	"errors"
+
+	"git.aetherial.dev/aeth/keiji/pkg/activitypub"
+	"git.aetherial.dev/aeth/keiji/pkg/events"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+@Name ApiGetPosts
+@Summary list all posts as JSON, or just the post with a matching ?slug=
+@Tags api
+@Router /admin/api/posts [get]
+*/
+func (c *Controller) ApiGetPosts(ctx *gin.Context) {
+	slug, filtered := ctx.GetQuery("slug")
+	if !filtered {
+		docs, err := c.database.AllDocuments()
+		if err != nil {
+			ctx.JSON(500, map[string]string{
+				"Error": err.Error(),
+			})
+			return
+		}
+		ctx.JSON(200, docs)
+		return
+	}
+	doc, err := c.database.GetDocumentBySlug(slug)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(200, []storage.Document{})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, []storage.Document{doc})
+}
+
+/*
+@Name ApiGetPost
+@Summary get a single post as JSON
+@Tags api
+@Router /admin/api/posts/{id} [get]
+*/
+func (c *Controller) ApiGetPost(ctx *gin.Context) {
+	id, _ := ctx.Params.Get("id")
+	doc, err := c.database.GetDocument(storage.Identifier(id))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, doc)
+}
+
+/*
+@Name ApiCreatePost
+@Summary create a post from JSON, responds with the new posts id
+@Tags api
+@Router /admin/api/posts [post]
+*/
+func (c *Controller) ApiCreatePost(ctx *gin.Context) {
+	var doc storage.Document
+	err := ctx.ShouldBindJSON(&doc)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	id, err := c.database.AddDocument(doc)
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	doc.Ident = id
+	c.sendWebmentions(ctx.Request.Context(), doc)
+	c.federate(ctx.Request.Context(), activitypub.CREATE, doc)
+	c.emailSubscribers(ctx.Request.Context(), doc)
+	c.documentEvent(ctx.Request.Context(), events.DOCUMENT_CREATED, doc)
+	ctx.JSON(200, map[string]string{
+		"id": string(id),
+	})
+}
+
+/*
+@Name ApiUpdatePost
+@Summary replace the title, body, category, slug and tags of a post from JSON. A version other than 0 has to match the posts, 409 otherwise
+@Tags api
+@Router /admin/api/posts/{id} [put]
+*/
+func (c *Controller) ApiUpdatePost(ctx *gin.Context) {
+	var doc storage.Document
+	err := ctx.ShouldBindJSON(&doc)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	id, _ := ctx.Params.Get("id")
+	doc.Ident = storage.Identifier(id)
+	err = c.database.UpdateDocument(doc)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		ctx.JSON(409, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	c.Rendered.Invalidate(doc.Ident)
+	c.federate(ctx.Request.Context(), activitypub.UPDATE, doc)
+	c.documentEvent(ctx.Request.Context(), events.DOCUMENT_UPDATED, doc)
+	ctx.JSON(200, map[string]string{
+		"id": id,
+	})
+}
+
+/*
+@Name ApiDeletePost
+@Summary delete a post, 404 if it doesnt exist
+@Tags api
+@Router /admin/api/posts/{id} [delete]
+*/
+func (c *Controller) ApiDeletePost(ctx *gin.Context) {
+	id, _ := ctx.Params.Get("id")
+	doc, err := c.database.GetDocument(storage.Identifier(id))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err == nil {
+		err = c.database.DeleteDocument(storage.Identifier(id))
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	c.Rendered.Invalidate(storage.Identifier(id))
+	c.federate(ctx.Request.Context(), activitypub.DELETE, doc)
+	c.documentEvent(ctx.Request.Context(), events.DOCUMENT_DELETED, doc)
+	ctx.JSON(200, map[string]string{
+		"id": id,
+	})
+}
+
+/*
+@Name ApiUploadImage
+@Summary upload an image from a multipart form, responds with the new images id
+@Tags api
+@Router /admin/api/images [post]
+*/
+func (c *Controller) ApiUploadImage(ctx *gin.Context) {
+	var img storage.Image
+	err := ctx.ShouldBind(&img)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	b, code, err := readImageUpload(file)
+	if err != nil {
+		ctx.JSON(code, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	id, err := c.database.AddImage(b, img.Title, img.Desc)
+	if err != nil {
+		ctx.JSON(addImageStatus(err), map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	c.generateVariants(ctx.Request.Context(), id)
+	c.imageEvent(ctx.Request.Context(), events.IMAGE_CREATED, storage.Image{Ident: id})
+	ctx.JSON(200, map[string]string{
+		"id": string(id),
+	})
+}
+
+/*
+@Name ApiGetImages
+@Summary list the metadata of every image as JSON, without the image data
+@Tags api
+@Router /admin/api/images [get]
+*/
+func (c *Controller) ApiGetImages(ctx *gin.Context) {
+	imgs, err := c.database.ListImages()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, imgs)
+}
+
+/*
+@Name ApiGetImage
+@Summary get the metadata of a single image as JSON, without the image data
+@Tags api
+@Router /admin/api/images/{id} [get]
+*/
+func (c *Controller) ApiGetImage(ctx *gin.Context) {
+	id, _ := ctx.Params.Get("id")
+	img, err := c.database.GetImageInfo(storage.Identifier(id))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, img)
+}
+
+/*
+@Name ApiUpdateImage
+@Summary replace the title and description of an image from JSON
+@Tags api
+@Router /admin/api/images/{id} [put]
+*/
+func (c *Controller) ApiUpdateImage(ctx *gin.Context) {
+	var img storage.Image
+	err := ctx.ShouldBindJSON(&img)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	id, _ := ctx.Params.Get("id")
+	img.Ident = storage.Identifier(id)
+	err = c.database.UpdateImage(img)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	var refs []storage.ImageReference
+	if err == nil {
+		refs, err = c.database.GetImageReferences(img.Ident)
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	// the posts embedding the image render its new title and dimensions
+	c.invalidateReferences(refs)
+	c.imageEvent(ctx.Request.Context(), events.IMAGE_UPDATED, img)
+	ctx.JSON(200, map[string]string{
+		"id": id,
+	})
+}
+
+/*
+@Name ApiDeleteImage
+@Summary delete an image from the database and the image store, listing the posts whose shortcodes it breaks
+@Tags api
+@Router /admin/api/images/{id} [delete]
+*/
+func (c *Controller) ApiDeleteImage(ctx *gin.Context) {
+	id, _ := ctx.Params.Get("id")
+	// kept for the event saying it was deleted
+	img, _ := c.database.GetImageInfo(storage.Identifier(id))
+	img.Ident = storage.Identifier(id)
+	refs, err := c.database.GetImageReferences(storage.Identifier(id))
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	err = c.database.DeleteImage(storage.Identifier(id))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	c.invalidateReferences(refs)
+	// its variants are removed when the event is handled
+	c.imageEvent(ctx.Request.Context(), events.IMAGE_DELETED, img)
+	ctx.JSON(200, gin.H{
+		"id":     id,
+		"broken": refs,
+	})
+}
+
+/*
+@Name ApiGetBrokenImages
+@Summary list the image shortcodes in posts that reference images that dont exist
+@Tags api
+@Router /admin/api/images/broken [get]
+*/
+func (c *Controller) ApiGetBrokenImages(ctx *gin.Context) {
+	refs, err := c.database.GetBrokenImageReferences()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(200, refs)
+}
+
+/*
+@Name ApiGetRenderCache
+@Summary the hits, misses and hit rate of the rendered post cache
+@Tags api
+@Router /admin/api/cache [get]
+*/
+func (c *Controller) ApiGetRenderCache(ctx *gin.Context) {
+	ctx.JSON(200, c.Rendered.Stats())
+}
+
+/*
+@Name ApiGetAlbums
+@Summary list every album as JSON, in order, with the identifiers of their images
+@Tags api
+@Router /admin/api/albums [get]
+*/
+func (c *Controller) ApiGetAlbums(ctx *gin.Context) {
+	albums, err := c.database.GetAlbums()
+	if err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, albums)
+}
+
+/*
+@Name ApiGetAlbum
+@Summary get a single album as JSON
+@Tags api
+@Router /admin/api/albums/{id} [get]
+*/
+func (c *Controller) ApiGetAlbum(ctx *gin.Context) {
+	album, err := c.database.GetAlbum(storage.Identifier(ctx.Param("id")))
+	if err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, album)
+}
+
+/*
+@Name ApiCreateAlbum
+@Summary create an album from JSON, responds with the new albums id
+@Tags api
+@Router /admin/api/albums [post]
+*/
+func (c *Controller) ApiCreateAlbum(ctx *gin.Context) {
+	var album storage.Album
+	err := ctx.ShouldBindJSON(&album)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	id, err := c.database.AddAlbum(album)
+	if err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, map[string]string{
+		"id": string(id),
+	})
+}
+
+/*
+@Name ApiUpdateAlbum
+@Summary replace the name, slug, description, cover and position of an album from JSON
+@Tags api
+@Router /admin/api/albums/{id} [put]
+*/
+func (c *Controller) ApiUpdateAlbum(ctx *gin.Context) {
+	var album storage.Album
+	err := ctx.ShouldBindJSON(&album)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	album.Ident = storage.Identifier(ctx.Param("id"))
+	if err = c.database.UpdateAlbum(album); err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, map[string]string{
+		"id": string(album.Ident),
+	})
+}
+
+/*
+@Name ApiDeleteAlbum
+@Summary delete an album, the images in it are kept
+@Tags api
+@Router /admin/api/albums/{id} [delete]
+*/
+func (c *Controller) ApiDeleteAlbum(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if err := c.database.DeleteAlbum(storage.Identifier(id)); err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, map[string]string{
+		"id": id,
+	})
+}
+
+/*
+@Name ApiSetAlbumImages
+@Summary replace the images in an album with {"images": [...]}, in the order given
+@Tags api
+@Router /admin/api/albums/{id}/images [put]
+*/
+func (c *Controller) ApiSetAlbumImages(ctx *gin.Context) {
+	var body struct {
+		Images []storage.Identifier `json:"images"`
+	}
+	err := ctx.ShouldBindJSON(&body)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	id := ctx.Param("id")
+	if err = c.database.SetAlbumImages(storage.Identifier(id), body.Images); err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, map[string]string{
+		"id": id,
+	})
+}
+
+/*
+@Name ApiReorderAlbums
+@Summary put the albums in the order of {"albums": [...]}
+@Tags api
+@Router /admin/api/albums/order [put]
+*/
+func (c *Controller) ApiReorderAlbums(ctx *gin.Context) {
+	var body struct {
+		Albums []storage.Identifier `json:"albums"`
+	}
+	err := ctx.ShouldBindJSON(&body)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if err = c.database.ReorderAlbums(body.Albums); err != nil {
+		albumError(ctx, err)
+		return
+	}
+	ctx.JSON(200, body)
+}
+
+// respond to a failed album operation with the status code for the kind of failure
+func albumError(ctx *gin.Context, err error) {
+	code := 500
+	switch {
+	case errors.Is(err, storage.ErrNotExists):
+		code = 404
+	case errors.Is(err, storage.ErrDuplicate):
+		code = 409
+	}
+	ctx.JSON(code, map[string]string{
+		"Error": err.Error(),
+	})
+}
@@ -1,19 +1,22 @@
 package controller
 
 import (
-	"fmt"
+	"errors"
 	"io"
+	"io/fs"
 	"net/http"
-	"os"
 	"path"
+	"strconv"
 	"strings"
 
+	"git.aetherial.dev/aeth/keiji/pkg/imaging"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
 )
 
 // @Name ServeImage
-// @Summary serves image from the image store
+// @Summary serves image from the image store, ?w= picks a width variant and ?w=thumb the thumbnail
 // @Tags cdn
 // @Router /images/{file} [get]
 func (c *Controller) ServeImage(ctx *gin.Context) {
@@ -22,16 +25,86 @@ func (c *Controller) ServeImage(ctx *gin.Context) {
 		ctx.JSON(404, map[string]string{
 			"Error": "the requested file could not be found",
 		})
+		return
+	}
+	if w, sized := ctx.GetQuery("w"); sized {
+		c.serveImageVariant(ctx, storage.Identifier(f), w)
+		return
+	}
+	img, err := c.database.GetImage(storage.Identifier(f))
+	if errors.Is(err, storage.ErrNotExists) || errors.Is(err, fs.ErrNotExist) {
+		ctx.JSON(404, map[string]string{
+			"Error": "the requested file could not be found",
+		})
+		return
 	}
-	css := fmt.Sprintf("%s/%s", storage.GetImageStore(), f)
-	b, err := os.ReadFile(css)
 	if err != nil {
 		ctx.JSON(500, map[string]string{
 			"Error": "Could not serve the requested file",
 			"msg":   err.Error(),
 		})
+		return
 	}
-	ctx.Data(200, "image/jpeg", b)
+	mime := img.Mime
+	if mime == "" {
+		// uploaded before the type was recorded
+		mime = mimetype.Detect(img.Data).String()
+	}
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	if mime == "image/svg+xml" {
+		// an svg can carry scripts, which shouldnt run when one is opened directly
+		ctx.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	}
+	ctx.Data(200, mime, img.Data)
+}
+
+// serve a width variant or the thumbnail of an image, making it first if it doesnt exist yet
+func (c *Controller) serveImageVariant(ctx *gin.Context, id storage.Identifier, w string) {
+	// a variant being made while its image was deleted can outlive it, so the image has to still be there
+	_, err := c.database.GetImageInfo(id)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.JSON(404, map[string]string{
+			"Error": "the requested file could not be found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": "Could not serve the requested file",
+			"msg":   err.Error(),
+		})
+		return
+	}
+	var b []byte
+	if w == imaging.ThumbnailParam {
+		b, err = c.Images.Thumbnail(id)
+	} else {
+		width, perr := strconv.Atoi(w)
+		if perr != nil || width < 1 {
+			ctx.JSON(400, map[string]string{
+				"Error": "w must be a positive width or '" + imaging.ThumbnailParam + "'",
+			})
+			return
+		}
+		b, err = c.Images.Variant(id, width)
+	}
+	if errors.Is(err, imaging.ErrInvalidIdentifier) || errors.Is(err, fs.ErrNotExist) {
+		ctx.JSON(404, map[string]string{
+			"Error": "the requested file could not be found",
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": "Could not serve the requested file",
+			"msg":   err.Error(),
+		})
+		return
+	}
+	// variants never change once they are made
+	ctx.Header("Cache-Control", "public, max-age=31536000, immutable")
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	ctx.Data(200, mimetype.Detect(b).String(), b)
 }
 
 // @Name ServeAsset
@@ -46,7 +119,13 @@ func (c *Controller) ServeAsset(ctx *gin.Context) {
 		})
 		return
 	}
-	assets := c.database.GetAssets()
+	assets, err := c.database.GetAssets()
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
 	for i := range assets {
 		if strings.Contains(assets[i].Name, f) {
 			ctx.Data(200, "image/png", assets[i].Data)
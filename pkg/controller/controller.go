@@ -1,26 +1,506 @@
 package controller
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"git.aetherial.dev/aeth/keiji/pkg/activitypub"
+	"git.aetherial.dev/aeth/keiji/pkg/analytics"
 	"git.aetherial.dev/aeth/keiji/pkg/auth"
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/events"
+	"git.aetherial.dev/aeth/keiji/pkg/exif"
+	"git.aetherial.dev/aeth/keiji/pkg/imaging"
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/metrics"
+	"git.aetherial.dev/aeth/keiji/pkg/newsletter"
+	"git.aetherial.dev/aeth/keiji/pkg/render"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"git.aetherial.dev/aeth/keiji/pkg/webhook"
+	"git.aetherial.dev/aeth/keiji/pkg/webmention"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
 )
 
 type Controller struct {
-	Domain     string
-	database   storage.DocumentIO
-	Cache      *auth.AuthCache
-	AuthSource auth.Source
-	FileIO     fs.FS
+	Domain      string
+	SiteURL     string
+	Webmentions *webmention.Client
+	Federation  *activitypub.Actor
+	Newsletter  *newsletter.Newsletter
+	Events      *events.Bus
+	Webhooks    *webhook.Dispatcher
+	Analytics   *analytics.Recorder
+	database    storage.DocumentIO
+	Cache       *auth.AuthCache
+	AuthSource  auth.Source
+	FileIO      fs.FS
+	Backups     *backup.Manager
+	Images      *imaging.Processor
+	Markdown    render.Renderer
+	Comments    render.Renderer
+	Rendered    *render.Cache
+	navigation  *cache.Cache
+	// each feature keeps its part of the database to itself
+	commentStore    storage.CommentIO
+	federationStore storage.FederationIO
+	newsletterStore storage.NewsletterIO
+	webhookStore    storage.WebhookIO
+	analyticsStore  storage.AnalyticsIO
+	// received webmentions waiting to be verified
+	mentions *webmention.Queue
+	// how many times each client subscribed in the current window, by ip
+	subscribes *cache.Cache
+
+	// logins that were turned away, for the metrics
+	loginFailures *metrics.Counter
+
+	// closed by Close to stop the background workers, which workers waits on
+	stop      chan struct{}
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+}
+
+// how long the navbar and menu are cached for on public pages, changing them clears it sooner
+const navigationTTL = 5 * time.Minute
+
+// how long fetching another sites page for a webmention gets
+const webmentionTimeout = 10 * time.Second
+
+// how many received webmentions are verified at once, and how many can wait to be
+const (
+	webmentionWorkers = 4
+	webmentionQueue   = 256
+)
+
+// how often the outbox queue is checked for emails to send
+const newsletterInterval = time.Minute
+
+// how many times a client can subscribe an address in a window before it is turned away
+const (
+	subscribeLimit  = 5
+	subscribeWindow = time.Hour
+)
+
+// how long a webhook gets to answer a delivery
+const webhookTimeout = 10 * time.Second
+
+// how often deliveries that failed are checked for being due to be tried again
+const webhookInterval = 15 * time.Second
+
+// how often the page views counted in memory are added to the database
+const analyticsInterval = time.Minute
+
+func NewController(domain string, database storage.SiteIO, images storage.ImageIO, files fs.FS, authSrc auth.Source) *Controller {
+	c := newController(domain, database, images, files, metrics.Default)
+	c.AuthSource = authSrc
+	c.Events.Subscribe(c.Webhooks.Handle)
+	c.Events.Subscribe(c.purgeVariants)
+	c.background(func(stop <-chan struct{}) { c.Webhooks.Run(webhookInterval, stop) })
+	c.background(func(stop <-chan struct{}) { c.Analytics.Run(analyticsInterval, stop) })
+	c.background(c.Images.Run)
+	c.background(func(stop <-chan struct{}) { c.mentions.Run(webmentionWorkers, c.verifyMention, stop) })
+	var err error
+	if user := activitypub.GetUsername(); user != "" {
+		c.Federation, err = activitypub.LoadActor(c.SiteURL, user, c.federationStore, c.Webmentions.HTTP)
+		if err != nil {
+			slog.Error("loading the ActivityPub actor failed, the site wont federate", "err", err)
+			c.Federation = nil
+		}
+	}
+	cfg, err := newsletter.GetConfig(domain)
+	if err != nil {
+		slog.Warn("email subscriptions are off", "err", err)
+	} else if cfg.Host != "" {
+		c.Newsletter = newsletter.New(c.SiteURL, cfg, c.newsletterStore)
+		c.background(func(stop <-chan struct{}) { c.Newsletter.Run(newsletterInterval, stop) })
+	}
+	return c
+}
+
+/*
+Create a controller that only renders the pages of the site, for exporting it. It starts no
+background workers, doesnt load the ActivityPub actor or send email, and counts its queries
+in a registry of its own, so nothing it does outlives the export or shows up in the metrics
+of a running site. Page views arent saved either
+
+	:param domain: the domain name the site is served on
+	:param database: the database the site is served out of
+	:param images: the image store the files of the databases images are kept in
+	:param files: the web content filesystem holding the cdn directory
+*/
+func NewRenderController(domain string, database storage.SiteIO, images storage.ImageIO, files fs.FS) *Controller {
+	return newController(domain, database, images, files, metrics.NewRegistry())
+}
+
+// the parts of a controller both kinds share, without any of the workers
+func newController(domain string, site storage.SiteIO, images storage.ImageIO, files fs.FS, reg *metrics.Registry) *Controller {
+	md, err := render.FromEnv()
+	if err != nil {
+		// a typo in the config shouldnt take the site down, the defaults still sanitize
+		slog.Warn("using the default markdown renderer", "err", err)
+		md = render.New(render.DefaultExtensions, render.SANITIZE_STRICT)
+	}
+	database := metrics.InstrumentStore(reg, site)
+	c := &Controller{
+		Cache:       auth.NewCache(),
+		Domain:      domain,
+		SiteURL:     siteURL(domain),
+		Webmentions: webmention.NewClient(webmentionTimeout, false),
+		database:    database,
+		FileIO:      files,
+		Images:      imaging.NewProcessor(images, imaging.DefaultWidths),
+		Markdown:    md,
+		Comments:    render.NewComments(),
+		Rendered:    render.NewCache(render.GetCacheMode(), database),
+		Events:      events.NewBus(),
+		Webhooks:    webhook.NewDispatcher(database, webhookTimeout),
+		Analytics:   analytics.NewRecorder(domain, database),
+		navigation:  cache.New(navigationTTL, 2*navigationTTL),
+		subscribes:  cache.New(subscribeWindow, subscribeWindow),
+		mentions:    webmention.NewQueue(webmentionQueue),
+
+		commentStore:    database,
+		federationStore: database,
+		newsletterStore: database,
+		webhookStore:    database,
+		analyticsStore:  database,
+	}
+	c.stop = make(chan struct{})
+	c.loginFailures = reg.NewCounter("keiji_login_failures_total", "Logins to the admin panel that were turned away.")
+	return c
+}
+
+/*
+Export the sizes of the controllers caches to a registry. The registry reads them from
+whichever controller exported them last, so only the controller serving the site should
+
+	:param reg: the registry to export them to
+*/
+func (c *Controller) ExportMetrics(reg *metrics.Registry) {
+	reg.NewGaugeFunc("keiji_auth_sessions", "Admin sessions in the auth cache.", func() float64 { return float64(c.Cache.Size()) })
+	reg.NewGaugeFunc("keiji_render_cache_entries", "Rendered posts in the render cache.", func() float64 { return float64(c.Rendered.Stats().Entries) })
+	reg.NewCounterFunc("keiji_render_cache_hits_total", "Posts served from the render cache, in memory or persisted.", func() float64 {
+		stats := c.Rendered.Stats()
+		return float64(stats.Hits + stats.PersistedHits)
+	})
+	reg.NewCounterFunc("keiji_render_cache_misses_total", "Posts that had to be rendered.", func() float64 { return float64(c.Rendered.Stats().Misses) })
+}
+
+/*
+Take a backup with the controllers backup manager every interval, until the controller is closed
+
+	:param interval: how often to take a backup
+*/
+func (c *Controller) ScheduleBackups(interval time.Duration) {
+	c.background(func(stop <-chan struct{}) { c.Backups.Schedule(interval, stop) })
+}
+
+// start a background worker that runs until the controller is closed
+func (c *Controller) background(run func(stop <-chan struct{})) {
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		run(c.stop)
+	}()
+}
+
+/*
+Stop the background workers of the controller and wait for them to finish, which saves
+the page views counted since they were last saved. Calling it again does nothing
+*/
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+	c.workers.Wait()
+}
+
+// the public url of the site, from SITE_URL or else https and the domain name
+func siteURL(domain string) string {
+	if u := os.Getenv(env.SITE_URL); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "https://" + domain
+}
+
+/*
+Get the navbar links and the dropdown menu for a page, which every page shows but
+which rarely change, from the cache
+*/
+func (c *Controller) siteNavigation() ([]storage.NavBarItem, []storage.LinkPair, error) {
+	headers, found := c.navigation.Get("headers")
+	if !found {
+		links, err := c.database.GetNavBarLinks()
+		if err != nil {
+			return nil, nil, err
+		}
+		headers = links
+		c.navigation.SetDefault("headers", headers)
+	}
+	menu, found := c.navigation.Get("menu")
+	if !found {
+		items, err := c.database.GetDropdownElements()
+		if err != nil {
+			return nil, nil, err
+		}
+		menu = items
+		c.navigation.SetDefault("menu", menu)
+	}
+	return headers.([]storage.NavBarItem), menu.([]storage.LinkPair), nil
+}
+
+// the navbar and menu as the templates take them, under "navigation"
+func (c *Controller) navigationData() (gin.H, error) {
+	headers, menu, err := c.siteNavigation()
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{"headers": headers, "menu": menu}, nil
+}
+
+// what the unhandled_error page tells visitors for a status, anything else gets its status text
+var publicReasons = map[int]string{
+	http.StatusNotFound:            "the page you asked for doesnt exist",
+	http.StatusInternalServerError: "something went wrong on our end, try again later",
+}
+
+/*
+Render the unhandled_error page for a request that failed on something other than what it
+asked for, i.e. the database, logging why with the request. The page is public, so it only
+says what the status means and gives the request ID to find the logged error by
+
+	:param ctx: the request that failed
+	:param code: the status to answer with
+	:param err: why it failed
+*/
+func (c *Controller) unhandledError(ctx *gin.Context, code int, err error) {
+	level := slog.LevelInfo
+	if code >= 500 {
+		level = slog.LevelError
+	}
+	logging.FromContext(ctx.Request.Context()).Log(ctx.Request.Context(), level, "handling the request failed", "status", code, "err", err)
+	reason, ok := publicReasons[code]
+	if !ok {
+		reason = strings.ToLower(http.StatusText(code))
+	}
+	ctx.HTML(code, "unhandled_error", gin.H{
+		"StatusCode": code,
+		"Reason":     reason,
+		"RequestID":  ctx.Writer.Header().Get(logging.REQUEST_ID_HEADER),
+	})
+}
+
+/*
+Drop the rendered html of posts that embed an image, after it changed or was deleted
+
+	:param refs: the posts that reference the image
+*/
+func (c *Controller) invalidateReferences(refs []storage.ImageReference) {
+	for _, ref := range refs {
+		c.Rendered.Invalidate(ref.Post)
+	}
+}
+
+/*
+Send webmentions to the other sites a newly published post links to. Each link means
+fetching the page it points to, so they are sent in the background and failures are only
+logged. Pages that dont take webmentions are skipped quietly
+
+	:param ctx: the context of the request that published it
+	:param doc: the post that was published
+*/
+func (c *Controller) sendWebmentions(ctx context.Context, doc storage.Document) {
+	if doc.Category == storage.CONFIGURATION {
+		return
+	}
+	source := c.SiteURL + "/writing/" + string(doc.Ident)
+	links := webmention.Links(c.renderMarkdown(ctx, doc.Body), source)
+	logger := logging.FromContext(ctx)
+	c.background(func(<-chan struct{}) {
+		for _, target := range links {
+			err := c.Webmentions.Send(source, target)
+			if err != nil && !errors.Is(err, webmention.ErrNoEndpoint) {
+				logger.Warn("sending a webmention failed", "target", target, "err", err)
+			}
+		}
+	})
+}
+
+/*
+Publish a change to a post to the sites followers, when it federates. The activity goes into
+the outbox straight away and is delivered in the background, failed deliveries are logged
+
+	:param ctx: the context of the request that changed it
+	:param kind: activitypub.CREATE, UPDATE or DELETE
+	:param doc: the post that changed, a deleted one as it was before it was deleted
+*/
+func (c *Controller) federate(ctx context.Context, kind string, doc storage.Document) {
+	if c.Federation == nil {
+		return
+	}
+	logger := logging.FromContext(ctx).With("post", doc.Ident)
+	var content string
+	if kind != activitypub.DELETE {
+		saved, err := c.database.GetDocument(doc.Ident)
+		if err != nil {
+			logger.Error("federating the post failed", "err", err)
+			return
+		}
+		doc, content = saved, string(c.renderPost(ctx, saved))
+	}
+	if doc.Category == storage.CONFIGURATION {
+		return
+	}
+	activity, err := c.Federation.Publish(kind, doc, content)
+	if err != nil {
+		logger.Error("federating the post failed", "err", err)
+		return
+	}
+	c.background(func(<-chan struct{}) {
+		if err := c.Federation.Broadcast(activity); err != nil {
+			logger.Warn("delivering the activity failed", "activity", kind, "err", err)
+		}
+	})
+}
+
+/*
+Queue a newly published post to be emailed to the subscribers, when there are email
+subscriptions. The queue sends it in the background, failures are only logged
+
+	:param ctx: the context of the request that published it
+	:param doc: the post that was published
+*/
+func (c *Controller) emailSubscribers(ctx context.Context, doc storage.Document) {
+	if c.Newsletter == nil || doc.Category == storage.CONFIGURATION {
+		return
+	}
+	logger := logging.FromContext(ctx).With("post", doc.Ident)
+	saved, err := c.database.GetDocument(doc.Ident)
+	if err != nil {
+		logger.Error("emailing the post to subscribers failed", "err", err)
+		return
+	}
+	c.background(func(<-chan struct{}) {
+		if _, err := c.Newsletter.Publish(saved, string(c.renderPost(ctx, saved))); err != nil {
+			logger.Error("emailing the post to subscribers failed", "err", err)
+		}
+	})
+}
+
+/*
+Emit an event about a post that changed on the event bus, with the post as it was saved
+
+	:param ctx: the context of the request that changed it
+	:param kind: events.DOCUMENT_CREATED, UPDATED or DELETED
+	:param doc: the post that changed, a deleted one as it was before it was deleted
+*/
+func (c *Controller) documentEvent(ctx context.Context, kind events.Type, doc storage.Document) {
+	if kind != events.DOCUMENT_DELETED {
+		saved, err := c.database.GetDocument(doc.Ident)
+		if err != nil {
+			logging.FromContext(ctx).Error("emitting the event failed", "event", kind, "post", doc.Ident, "err", err)
+			return
+		}
+		doc = saved
+	}
+	c.Events.Publish(kind, doc)
+}
+
+/*
+Emit an event about an image that changed on the event bus, with its metadata but not its data
+
+	:param ctx: the context of the request that changed it
+	:param kind: events.IMAGE_CREATED, UPDATED or DELETED
+	:param img: the image that changed, a deleted one as it was before it was deleted
+*/
+func (c *Controller) imageEvent(ctx context.Context, kind events.Type, img storage.Image) {
+	if kind != events.IMAGE_DELETED {
+		saved, err := c.database.GetImageInfo(img.Ident)
+		if err != nil {
+			logging.FromContext(ctx).Error("emitting the event failed", "event", kind, "image", img.Ident, "err", err)
+			return
+		}
+		img = saved
+	}
+	img.Data = nil
+	img.File = nil
+	c.Events.Publish(kind, img)
+}
+
+/*
+Remove the variants of an image once it has been deleted, whatever deleted it
+
+	:param event: an event from the bus, anything other than IMAGE_DELETED is ignored
+*/
+func (c *Controller) purgeVariants(event events.Event) {
+	img, ok := event.Data.(storage.Image)
+	if event.Type != events.IMAGE_DELETED || !ok {
+		return
+	}
+	if err := c.Images.Purge(img.Ident); err != nil {
+		slog.Warn("removing the variants of a deleted image failed", "image", img.Ident, "err", err)
+	}
+}
+
+/*
+Queue making the thumbnail and width variants of a freshly uploaded image, so the upload
+doesnt wait on the resizing. A full queue only means the variants get made on the first
+request for them instead, so it is logged rather than returned
+
+	:param ctx: the context of the request that uploaded it
+	:param id: the identifier of the uploaded image
+*/
+func (c *Controller) generateVariants(ctx context.Context, id storage.Identifier) {
+	if !c.Images.Enqueue(id) {
+		logging.FromContext(ctx).Info("the image variant queue is full, they are made when first asked for", "image", id)
+	}
+}
+
+/*
+Read an uploaded image, returning the HTTP status to fail the upload with if it is bigger
+than the configured limit (413) or isnt an image (415)
+
+	:param file: the file from the multipart form
+*/
+func readImageUpload(file *multipart.FileHeader) ([]byte, int, error) {
+	limit := storage.GetMaxImageBytes()
+	tooLarge := fmt.Errorf("the image is larger than the %v byte limit", limit)
+	if file.Size > limit {
+		return nil, http.StatusRequestEntityTooLarge, tooLarge
+	}
+	fh, err := file.Open()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defer fh.Close()
+	// the header size comes from the client, so dont read more than the limit either way
+	b, err := io.ReadAll(io.LimitReader(fh, limit+1))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if int64(len(b)) > limit {
+		return nil, http.StatusRequestEntityTooLarge, tooLarge
+	}
+	if _, err = storage.DetectImageType(b); err != nil {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+	return b, http.StatusOK, nil
 }
 
-func NewController(domain string, database storage.DocumentIO, files fs.FS, authSrc auth.Source) *Controller {
-	return &Controller{
-		Cache:      auth.NewCache(),
-		AuthSource: authSrc,
-		Domain:     domain,
-		database:   database,
-		FileIO:     files,
+// the status to fail an upload with when the image cant be added, 415 if its metadata cant be stripped
+func addImageStatus(err error) int {
+	if errors.Is(err, exif.ErrUnsupported) {
+		return http.StatusUnsupportedMediaType
 	}
+	return http.StatusInternalServerError
 }
@@ -1,31 +1,127 @@
 package controller
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode/utf8"
 
+	"git.aetherial.dev/aeth/keiji/pkg/activitypub"
+	"git.aetherial.dev/aeth/keiji/pkg/imaging"
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/render"
+	"git.aetherial.dev/aeth/keiji/pkg/shortcode"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"git.aetherial.dev/aeth/keiji/pkg/webmention"
 	"github.com/gin-gonic/gin"
-	"github.com/gomarkdown/markdown"
-	"github.com/gomarkdown/markdown/html"
-	"github.com/gomarkdown/markdown/parser"
 )
 
+// An image on the digital art page, with the urls of its resized variants
+type galleryImage struct {
+	storage.Image
+	Full   string
+	Src    string
+	Srcset string
+}
+
+// An album on the digital art page, linking to the albums own page
+type albumCard struct {
+	storage.Album
+	Link  string
+	Thumb string
+}
+
+// A comment under a post, with the replies to it
+type commentThread struct {
+	storage.Comment
+	HTML    template.HTML
+	Closed  bool // the post is closed for comments, so there is no replying
+	Replies []*commentThread
+}
+
+// The form to comment on a post, or to reply to a comment on it
+type commentForm struct {
+	Post   storage.Identifier
+	Parent storage.Identifier
+}
+
+// the form to reply to the comment with
+func (t *commentThread) ReplyForm() commentForm {
+	return commentForm{Post: t.Post, Parent: t.Ident}
+}
+
+// the limits on what a reader can post, so that a comment cant fill the database
+const (
+	maxCommentName = 80
+	maxCommentBody = 5000
+)
+
+/*
+Render the body of a post through the render cache. Posts are only rendered again once
+they are updated or the renderer is reconfigured
+
+	:param ctx: the context of the request its rendered for, images that fail to resolve are logged with it
+	:param doc: the post to render
+*/
+func (c *Controller) renderPost(ctx context.Context, doc storage.Document) template.HTML {
+	key := render.CacheKey(doc.Updated, c.Markdown.Version())
+	return template.HTML(c.Rendered.Get(ctx, doc.Ident, key, func() []byte {
+		return c.renderMarkdown(ctx, doc.Body)
+	}))
+}
+
 /*
-convert markdown to html
+Render markdown the way posts are, resolving its image shortcodes to the images in the
+image store before converting it to html. The renderer sanitizes the result (unless
+MARKDOWN_SANITIZE is 'none'), which is what makes it safe to mark as template.HTML
 
-	:param md: the byte array containing the Markdown to convert
+	:param ctx: the context of the request its rendered for, images that fail to resolve are logged with it
+	:param body: the markdown to render
 */
-func MdToHTML(md []byte) []byte {
-	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
-	p := parser.NewWithExtensions(extensions)
-	doc := p.Parse(md)
+func (c *Controller) renderMarkdown(ctx context.Context, body string) []byte {
+	return c.Markdown.Render(shortcode.Expand([]byte(body), func(ref shortcode.Image) shortcode.Figure {
+		return c.resolveImage(ctx, ref)
+	}))
+}
 
-	htmlFlags := html.CommonFlags | html.HrefTargetBlank
-	opts := html.RendererOptions{Flags: htmlFlags}
-	renderer := html.NewRenderer(opts)
+/*
+Look up the image an image shortcode references, falling back to its title for the alt
+text. An image that doesnt exist is rendered as a placeholder
 
-	return markdown.Render(doc, renderer)
+	:param ctx: the context of the request the post is rendered for
+	:param ref: the shortcode to resolve
+*/
+func (c *Controller) resolveImage(ctx context.Context, ref shortcode.Image) shortcode.Figure {
+	img, err := c.database.GetImageInfo(storage.Identifier(ref.ID))
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotExists) {
+			logging.FromContext(ctx).Error("resolving an image shortcode failed", "image", ref.ID, "err", err)
+		}
+		return shortcode.Figure{Missing: true, ID: ref.ID}
+	}
+	route := "/api/v1/images/" + string(img.Ident)
+	width := c.Images.Widths[len(c.Images.Widths)-1]
+	if ref.Width > 0 {
+		width = ref.Width
+	}
+	fig := shortcode.Figure{
+		Full:    route,
+		Src:     fmt.Sprintf("%s?w=%v", route, width),
+		Srcset:  c.Images.Srcset(route),
+		Alt:     ref.Alt,
+		Caption: ref.Caption,
+		Width:   img.Width,
+		Height:  img.Height,
+	}
+	if fig.Alt == "" {
+		fig.Alt = img.Title
+	}
+	return fig
 }
 
 // @Name ServePost
@@ -41,25 +137,38 @@ func (c *Controller) ServePost(ctx *gin.Context) {
 		return
 	}
 	doc, err := c.database.GetDocument(storage.Identifier(post))
+	if errors.Is(err, storage.ErrNotExists) || (err == nil && doc.Category == storage.CONFIGURATION) {
+		c.unhandledError(ctx, 404, errors.New("the requested post could not be found"))
+		return
+	}
 	if err != nil {
-		ctx.JSON(500, map[string]string{
-			"Error": err.Error(),
-		})
+		c.unhandledError(ctx, 500, err)
 		return
 	}
-	if doc.Category == storage.CONFIGURATION {
-		ctx.Status(404)
+	// fediverse servers look posts up by their url
+	if c.Federation != nil && wantsActivity(ctx) {
+		article := c.Federation.Article(doc, string(c.renderPost(ctx.Request.Context(), doc)))
+		article.Context = "https://www.w3.org/ns/activitystreams"
+		activityJSON(ctx, activitypub.CONTENT_TYPE, article)
+		return
+	}
+	headers, menu, err := c.siteNavigation()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
 		return
 	}
+	ctx.Header("Link", fmt.Sprintf("<%s/webmention>; rel=\"webmention\"", c.SiteURL))
 	ctx.HTML(http.StatusOK, "blogpost", gin.H{
 		"navigation": gin.H{
-			"headers": c.database.GetNavBarLinks(),
+			"headers": headers,
 		},
-		"Title":   doc.Title,
-		"Ident":   doc.Ident,
-		"Created": doc.Created,
-		"Body":    template.HTML(MdToHTML([]byte(doc.Body))),
-		"menu":    c.database.GetDropdownElements(),
+		"Title":     doc.Title,
+		"Ident":     doc.Ident,
+		"Created":   doc.Created,
+		"Body":      c.renderPost(ctx.Request.Context(), doc),
+		"menu":      menu,
+		"Comments":  true,
+		"Subscribe": c.Newsletter != nil,
 	})
 
 }
@@ -69,7 +178,11 @@ func (c *Controller) ServePost(ctx *gin.Context) {
 // @Tags webpages
 // @Router / [get]
 func (c *Controller) ServeHome(ctx *gin.Context) {
-	home := c.database.GetByCategory(storage.HOMEPAGE)
+	home, err := c.database.GetByCategory(storage.HOMEPAGE)
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
 	var content storage.Document
 	if len(home) == 0 {
 		content = storage.Document{
@@ -78,11 +191,16 @@ func (c *Controller) ServeHome(ctx *gin.Context) {
 	} else {
 		content = home[0]
 	}
+	headers, menu, err := c.siteNavigation()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
 	ctx.HTML(http.StatusOK, "home", gin.H{
 		"navigation": gin.H{
-			"headers": c.database.GetNavBarLinks(),
+			"headers": headers,
 		},
-		"menu":    c.database.GetDropdownElements(),
+		"menu":    menu,
 		"default": content,
 	})
 }
@@ -92,7 +210,7 @@ func (c *Controller) ServeHome(ctx *gin.Context) {
 // @Tags webpages
 // @Router /blog [get]
 func (c *Controller) ServeBlog(ctx *gin.Context) {
-	ctx.HTML(http.StatusOK, "writing", c.database.GetByCategory(storage.BLOG))
+	c.serveListing(ctx, storage.BLOG)
 }
 
 // @Name ServeCreative
@@ -100,7 +218,17 @@ func (c *Controller) ServeBlog(ctx *gin.Context) {
 // @Tags webpages
 // @Router /creative [get]
 func (c *Controller) ServeCreative(ctx *gin.Context) {
-	ctx.HTML(http.StatusOK, "writing", c.database.GetByCategory(storage.CREATIVE))
+	c.serveListing(ctx, storage.CREATIVE)
+}
+
+// serve the listing of the posts in a category
+func (c *Controller) serveListing(ctx *gin.Context, category string) {
+	docs, err := c.database.GetByCategory(category)
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	ctx.HTML(http.StatusOK, "writing", docs)
 }
 
 // @Name ServeDigitalArt
@@ -108,12 +236,291 @@ func (c *Controller) ServeCreative(ctx *gin.Context) {
 // @Tags webpages
 // @Router /digital [get]
 func (c *Controller) ServeDigitalArt(ctx *gin.Context) {
-	images := c.database.GetAllImages()
+	albums, err := c.database.GetAlbums()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	cards := make([]albumCard, len(albums))
+	for i := range albums {
+		cards[i] = albumCard{Album: albums[i], Link: "/digital/" + albums[i].Slug}
+		cover := albums[i].Cover
+		if cover == "" && len(albums[i].Images) > 0 {
+			cover = albums[i].Images[0]
+		}
+		if cover != "" {
+			cards[i].Thumb = fmt.Sprintf("/api/v1/images/%s?w=%s", cover, imaging.ThumbnailParam)
+		}
+	}
+	imgs, err := c.database.ListImages()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	headers, menu, err := c.siteNavigation()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
 	ctx.HTML(http.StatusOK, "digital_art", gin.H{
 		"navigation": gin.H{
-			"headers": c.database.GetNavBarLinks(),
+			"headers": headers,
 		},
-		"images": images,
-		"menu":   c.database.GetDropdownElements(),
+		"albums": cards,
+		"images": c.gallery(imgs),
+		"menu":   menu,
 	})
 }
+
+// @Name ServeAlbum
+// @Summary serves the digital art page for a single album, its images in the albums order
+// @Tags webpages
+// @Router /digital/:album [get]
+func (c *Controller) ServeAlbum(ctx *gin.Context) {
+	album, err := c.database.GetAlbumBySlug(ctx.Param("album"))
+	if errors.Is(err, storage.ErrNotExists) {
+		c.unhandledError(ctx, 404, errors.New("the requested album could not be found"))
+		return
+	}
+	var imgs []storage.Image
+	if err == nil {
+		imgs, err = c.database.GetAlbumImages(album.Ident)
+	}
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	headers, menu, err := c.siteNavigation()
+	if err != nil {
+		c.unhandledError(ctx, 500, err)
+		return
+	}
+	ctx.HTML(http.StatusOK, "digital_art", gin.H{
+		"navigation": gin.H{
+			"headers": headers,
+		},
+		"album":  album,
+		"images": c.gallery(imgs),
+		"menu":   menu,
+	})
+}
+
+// @Name ServeComments
+// @Summary serves the approved comments and webmentions of a post, with the form to leave a comment. Loaded under the post
+// @Tags webpages
+// @Router /writing/:id/comments [get]
+func (c *Controller) ServeComments(ctx *gin.Context) {
+	doc, err := c.database.GetDocument(storage.Identifier(ctx.Param("id")))
+	if errors.Is(err, storage.ErrNotExists) || doc.Category == storage.CONFIGURATION {
+		ctx.Status(404)
+		return
+	}
+	var comments []storage.Comment
+	var mentions []storage.Mention
+	if err == nil {
+		comments, err = c.commentStore.GetComments(doc.Ident, storage.COMMENT_APPROVED)
+	}
+	if err == nil {
+		mentions, err = c.commentStore.GetMentions(doc.Ident, storage.COMMENT_APPROVED)
+	}
+	if err != nil {
+		ctx.JSON(500, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	ctx.HTML(http.StatusOK, "comments", gin.H{
+		"Threads":  c.threads(comments, doc.CommentsClosed),
+		"Count":    len(comments),
+		"Mentions": mentions,
+		"Closed":   doc.CommentsClosed,
+		"Form":     commentForm{Post: doc.Ident},
+	})
+}
+
+// @Name ReceiveWebmention
+// @Summary accept a webmention of a post. Responds 202 straight away, the source is fetched in the background to verify it links to the post before it goes into the moderation queue. Responds 429 when too many are waiting to be verified
+// @Tags webpages
+// @Router /webmention [post]
+func (c *Controller) ReceiveWebmention(ctx *gin.Context) {
+	source, target := ctx.PostForm("source"), ctx.PostForm("target")
+	_, err := c.mentionedPost(source, target)
+	if err != nil {
+		ctx.JSON(400, map[string]string{
+			"Error": err.Error(),
+		})
+		return
+	}
+	if !c.mentions.Enqueue(webmention.Received{Source: source, Target: target, Logger: logging.FromContext(ctx.Request.Context())}) {
+		ctx.JSON(http.StatusTooManyRequests, map[string]string{
+			"Error": "too many webmentions are waiting to be verified, try again later",
+		})
+		return
+	}
+	ctx.JSON(http.StatusAccepted, map[string]string{
+		"Message": "the webmention will be verified and then moderated",
+	})
+}
+
+/*
+Check the urls of a received webmention, the source has to be another page on the web
+and the target has to be one of the posts on this site. Returns the post that was mentioned
+
+	:param source: the url of the page that mentions the post
+	:param target: the url of the post
+*/
+func (c *Controller) mentionedPost(source, target string) (storage.Identifier, error) {
+	src, err := url.Parse(source)
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		return "", errors.New("the source has to be an http or https url")
+	}
+	if source == target {
+		return "", errors.New("the source and target cant be the same page")
+	}
+	site, err := url.Parse(c.SiteURL)
+	if err != nil {
+		return "", err
+	}
+	tgt, err := url.Parse(target)
+	if err != nil || !strings.EqualFold(tgt.Host, site.Host) || !strings.HasPrefix(tgt.Path, "/writing/") {
+		return "", errors.New("the target isnt a post on this site")
+	}
+	doc, err := c.database.GetDocument(storage.Identifier(strings.TrimPrefix(tgt.Path, "/writing/")))
+	if err != nil || doc.Category == storage.CONFIGURATION {
+		return "", errors.New("the target isnt a post on this site")
+	}
+	return doc.Ident, nil
+}
+
+/*
+Fetch the source of a received webmention and save it for moderation if it links to the
+post. A source that was deleted or no longer links to the post takes down the mention it
+sent before, which is how a site retracts a webmention. Run by the workers of the queue
+
+	:param mention: the webmention that was received
+*/
+func (c *Controller) verifyMention(mention webmention.Received) {
+	source, target := mention.Source, mention.Target
+	// the post is looked up again, it may have been deleted while the mention waited
+	post, err := c.mentionedPost(source, target)
+	if err != nil {
+		mention.Logger.Info("dropping a webmention", "source", source, "target", target, "err", err)
+		return
+	}
+	found, err := c.Webmentions.Verify(source, target)
+	switch {
+	case errors.Is(err, webmention.ErrNoLink) || errors.Is(err, webmention.ErrGone):
+		err = c.commentStore.DeleteMention(source, target)
+	case err == nil:
+		err = c.commentStore.SaveMention(storage.Mention{Post: post, Source: source, Target: target, Title: found.Title})
+	}
+	if err != nil {
+		mention.Logger.Warn("verifying a webmention failed", "source", source, "err", err)
+	}
+}
+
+/*
+Arrange comments into threads of replies. A reply to a comment that isnt in the list, i.e.
+one that wasnt approved, is left out along with the comment it replied to
+
+	:param comments: the comments, each after the one it replies to
+	:param closed: whether the post is closed for comments
+*/
+func (c *Controller) threads(comments []storage.Comment, closed bool) []*commentThread {
+	byID := map[storage.Identifier]*commentThread{}
+	roots := []*commentThread{}
+	for i := range comments {
+		thread := &commentThread{Comment: comments[i], HTML: template.HTML(c.Comments.Render([]byte(comments[i].Body))), Closed: closed}
+		// never put a commenters email on the page
+		thread.Email = ""
+		if comments[i].Parent == "" {
+			roots = append(roots, thread)
+		} else if parent, ok := byID[comments[i].Parent]; ok {
+			parent.Replies = append(parent.Replies, thread)
+		} else {
+			continue
+		}
+		byID[thread.Ident] = thread
+	}
+	return roots
+}
+
+// @Name PostComment
+// @Summary leave a comment on a post, or a reply to one of its comments. It is shown once a moderator approves it
+// @Tags webpages
+// @Router /writing/:id/comments [post]
+func (c *Controller) PostComment(ctx *gin.Context) {
+	var comment storage.Comment
+	err := ctx.ShouldBind(&comment)
+	if err == nil {
+		err = validateComment(&comment)
+	}
+	if err != nil {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	// readers dont get to pick the status of their comment
+	comment.Post = storage.Identifier(ctx.Param("id"))
+	comment.Status = storage.COMMENT_PENDING
+	// the honeypot field is hidden from people, only bots fill it in
+	if ctx.PostForm("nickname") != "" {
+		comment.Status = storage.COMMENT_SPAM
+	}
+	_, err = c.commentStore.AddComment(comment)
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "upload_status", gin.H{"UpdateMessage": "This post isnt taking comments", "Color": "red"})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": "Your comment couldnt be saved, try again later", "Color": "red"})
+		return
+	}
+	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Thanks! Your comment shows up once it has been approved.", "Color": "green"})
+}
+
+/*
+Check the fields of a comment a reader posted, trimming the spaces around them
+
+	:param comment: the posted comment
+*/
+func validateComment(comment *storage.Comment) error {
+	comment.Name = strings.TrimSpace(comment.Name)
+	comment.Email = strings.TrimSpace(comment.Email)
+	comment.URL = strings.TrimSpace(comment.URL)
+	comment.Body = strings.TrimSpace(comment.Body)
+	switch {
+	case comment.Name == "" || comment.Body == "":
+		return errors.New("a comment needs a name and a body")
+	case utf8.RuneCountInString(comment.Name) > maxCommentName:
+		return fmt.Errorf("names are at most %v characters long", maxCommentName)
+	case utf8.RuneCountInString(comment.Body) > maxCommentBody:
+		return fmt.Errorf("comments are at most %v characters long", maxCommentBody)
+	}
+	if comment.Email != "" {
+		if _, err := mail.ParseAddress(comment.Email); err != nil {
+			return errors.New("that email address isnt valid")
+		}
+	}
+	if comment.URL != "" {
+		u, err := url.Parse(comment.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("websites have to be http or https urls")
+		}
+	}
+	return nil
+}
+
+// build the gallery entries for a list of images, pointing them at their resized variants
+func (c *Controller) gallery(imgs []storage.Image) []galleryImage {
+	images := make([]galleryImage, len(imgs))
+	for i := range imgs {
+		route := "/api/v1/images/" + string(imgs[i].Ident)
+		images[i] = galleryImage{
+			Image:  imgs[i],
+			Full:   route,
+			Src:    fmt.Sprintf("%s?w=%v", route, c.Images.Widths[len(c.Images.Widths)-1]),
+			Srcset: c.Images.Srcset(route),
+		}
+	}
+	return images
+}
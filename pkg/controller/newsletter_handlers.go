@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/newsletter"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+)
+
+// @Name Subscribe
+// @Summary subscribe the email address in the form to new posts, once they confirm it from the email they are sent
+// @Tags webpages
+// @Router /subscribe [post]
+func (c *Controller) Subscribe(ctx *gin.Context) {
+	// the honeypot field is hidden from people, only bots fill it in
+	if ctx.PostForm("nickname") != "" {
+		ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Check your inbox to confirm your subscription.", "Color": "green"})
+		return
+	}
+	if !c.allowSubscribe(ctx.ClientIP()) {
+		ctx.HTML(http.StatusTooManyRequests, "upload_status", gin.H{"UpdateMessage": "Too many subscriptions from here, try again later", "Color": "red"})
+		return
+	}
+	err := c.Newsletter.Subscribe(ctx.PostForm("email"))
+	if errors.Is(err, newsletter.ErrInvalidAddress) {
+		ctx.HTML(400, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx.Request.Context()).Error("subscribing a reader failed", "err", err)
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": "You couldnt be subscribed, try again later", "Color": "red"})
+		return
+	}
+	ctx.HTML(200, "upload_status", gin.H{"UpdateMessage": "Check your inbox to confirm your subscription.", "Color": "green"})
+}
+
+/*
+Count a subscription from a client, returning whether it is still under subscribeLimit for
+the window. The window starts with its first subscription, so it is reset every
+subscribeWindow rather than sliding
+
+	:param ip: the address of the client
+*/
+func (c *Controller) allowSubscribe(ip string) bool {
+	if c.subscribes.Add(ip, 1, cache.DefaultExpiration) == nil {
+		return true
+	}
+	n, err := c.subscribes.IncrementInt(ip, 1)
+	return err != nil || n <= subscribeLimit
+}
+
+// @Name ConfirmSubscription
+// @Summary confirm the subscription with the token query parameter, from the link in the confirmation email
+// @Tags webpages
+// @Router /subscribe/confirm [get]
+func (c *Controller) ConfirmSubscription(ctx *gin.Context) {
+	err := c.Newsletter.Confirm(ctx.Query("token"))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "subscription", gin.H{"Message": "That link has expired, or you already unsubscribed."})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "subscription", gin.H{"Message": "Your subscription couldnt be confirmed, try again later."})
+		return
+	}
+	ctx.HTML(http.StatusOK, "subscription", gin.H{"Message": "Thanks! New posts will be sent to you."})
+}
+
+// @Name ServeUnsubscribe
+// @Summary serves the page the unsubscribe link in an email leads to, with a button to unsubscribe. Following the link doesnt unsubscribe on its own, so mail scanners that follow links dont unsubscribe anybody
+// @Tags webpages
+// @Router /unsubscribe [get]
+func (c *Controller) ServeUnsubscribe(ctx *gin.Context) {
+	ctx.HTML(http.StatusOK, "subscription", gin.H{
+		"Message": "Stop getting new posts by email?",
+		"Token":   ctx.Query("token"),
+	})
+}
+
+// @Name Unsubscribe
+// @Summary unsubscribe the subscriber with the token query parameter, from the unsubscribe page or a mail clients one click unsubscribe
+// @Tags webpages
+// @Router /unsubscribe [post]
+func (c *Controller) Unsubscribe(ctx *gin.Context) {
+	err := c.Newsletter.Unsubscribe(ctx.Query("token"))
+	if errors.Is(err, storage.ErrNotExists) {
+		ctx.HTML(404, "subscription", gin.H{"Message": "You arent subscribed anymore."})
+		return
+	}
+	if err != nil {
+		ctx.HTML(500, "subscription", gin.H{"Message": "You couldnt be unsubscribed, try again later."})
+		return
+	}
+	ctx.HTML(http.StatusOK, "subscription", gin.H{"Message": "You have been unsubscribed and wont get any more emails."})
+}
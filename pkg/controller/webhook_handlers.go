@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"errors"
+	"slices"
+
+	"git.aetherial.dev/aeth/keiji/pkg/events"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"git.aetherial.dev/aeth/keiji/pkg/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+// how many of the newest deliveries the admin panel shows
+const deliveryLogSize = 50
+
+// @Name ServeWebhooks
+// @Summary serve the webhooks, where they are added and removed, along with the log of their latest deliveries
+// @Tags admin
+// @Router /admin/webhooks [get]
+func (c *Controller) ServeWebhooks(ctx *gin.Context) {
+	c.renderWebhooks(ctx, 200, "", "")
+}
+
+// render the webhooks and the delivery log with an optional status message
+func (c *Controller) renderWebhooks(ctx *gin.Context, code int, message, color string) {
+	hooks, err := c.webhookStore.GetWebhooks()
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	deliveries, err := c.webhookStore.GetDeliveries(deliveryLogSize)
+	if err != nil {
+		ctx.HTML(500, "upload_status", gin.H{"UpdateMessage": err, "Color": "red"})
+		return
+	}
+	ctx.HTML(code, "webhooks", gin.H{
+		"Webhooks":   hooks,
+		"Deliveries": deliveries,
+		"Events":     events.Types,
+		"Message":    message,
+		"Color":      color,
+	})
+}
+
+// @Name MakeWebhook
+// @Summary add a webhook from the url and events in the form, a webhook without events gets all of them. Responds with the updated webhooks
+// @Tags admin
+// @Router /admin/webhooks [post]
+func (c *Controller) MakeWebhook(ctx *gin.Context) {
+	hook := storage.Webhook{URL: ctx.PostForm("url"), Events: ctx.PostFormArray("events")}
+	if err := webhook.ValidateURL(hook.URL); err != nil {
+		c.renderWebhooks(ctx, 400, err.Error(), "red")
+		return
+	}
+	for _, event := range hook.Events {
+		if !slices.Contains(events.Types, events.Type(event)) {
+			c.renderWebhooks(ctx, 400, "there is no "+event+" event", "red")
+			return
+		}
+	}
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		c.renderWebhooks(ctx, 500, err.Error(), "red")
+		return
+	}
+	hook.Secret = secret
+	if _, err := c.webhookStore.AddWebhook(hook); err != nil {
+		c.renderWebhooks(ctx, 500, err.Error(), "red")
+		return
+	}
+	c.renderWebhooks(ctx, 200, "Webhook added! Check the "+webhook.SIGNATURE_HEADER+" header of its deliveries with its secret.", "green")
+}
+
+// @Name DeleteWebhook
+// @Summary remove a webhook, along with its deliveries. Responds with the updated webhooks
+// @Tags admin
+// @Router /admin/webhooks/:id [delete]
+func (c *Controller) DeleteWebhook(ctx *gin.Context) {
+	err := c.webhookStore.DeleteWebhook(storage.Identifier(ctx.Param("id")))
+	if errors.Is(err, storage.ErrNotExists) {
+		c.renderWebhooks(ctx, 404, "No such webhook!", "red")
+		return
+	}
+	if err != nil {
+		c.renderWebhooks(ctx, 500, err.Error(), "red")
+		return
+	}
+	c.renderWebhooks(ctx, 200, "Webhook removed!", "green")
+}
@@ -20,12 +20,52 @@ const HOST_ADDR = "HOST_ADDR"
 const USE_SSL = "USE_SSL"
 const CHAIN = "CHAIN"
 const KEY = "KEY"
+const BACKUP_DIR = "BACKUP_DIR"
+const BACKUP_INTERVAL = "BACKUP_INTERVAL"
+const BACKUP_RETAIN = "BACKUP_RETAIN"
+const IMAGE_MAX_BYTES = "IMAGE_MAX_BYTES"
+const IMPORT_MAX_BYTES = "IMPORT_MAX_BYTES"
+const EXIF_STRIP = "EXIF_STRIP"
+const MARKDOWN_EXTENSIONS = "MARKDOWN_EXTENSIONS"
+const MARKDOWN_SANITIZE = "MARKDOWN_SANITIZE"
+const RENDER_CACHE = "RENDER_CACHE"
+const SITE_URL = "SITE_URL"
+const ACTIVITYPUB_USER = "ACTIVITYPUB_USER"
+const SMTP_HOST = "SMTP_HOST"
+const SMTP_PORT = "SMTP_PORT"
+const SMTP_USERNAME = "SMTP_USERNAME"
+const SMTP_PASSWORD = "SMTP_PASSWORD"
+const SMTP_FROM = "SMTP_FROM"
+const LOG_LEVEL = "LOG_LEVEL"
+const LOG_FORMAT = "LOG_FORMAT"
+const METRICS_ADDR = "METRICS_ADDR"
+const METRICS_TOKEN = "METRICS_TOKEN"
 
 var OPTION_VARS = map[string]string{
-	IMAGE_STORE: "#the location for keiji to store the images uploaded (string)",
-	WEB_ROOT:    "#the location to pull HTML and various web assets from. Only if using 'keiji -content fs' (string)",
-	CHAIN:       "#the path to the SSL public key chain (string)",
-	KEY:         "#the path to the SSL private key (string)",
+	IMAGE_STORE:         "#the location for keiji to store the images uploaded (string)",
+	WEB_ROOT:            "#the location to pull HTML and various web assets from. Only if using 'keiji -content fs' (string)",
+	CHAIN:               "#the path to the SSL public key chain (string)",
+	KEY:                 "#the path to the SSL private key (string)",
+	BACKUP_DIR:          "#the directory to write backups of the database and image store to, backups are disabled if unset (string)",
+	BACKUP_INTERVAL:     "#how often to take a scheduled backup, i.e. '24h'. Scheduled backups are disabled if unset (duration)",
+	BACKUP_RETAIN:       "#how many backups to keep before deleting the oldest, keeps all of them if unset (int)",
+	IMAGE_MAX_BYTES:     "#the largest image that can be uploaded in bytes, defaults to 20971520 (20MiB) if unset (int)",
+	IMPORT_MAX_BYTES:    "#the largest site archive that can be imported in bytes, defaults to 1073741824 (1GiB) if unset (int)",
+	EXIF_STRIP:          "#the metadata to remove from uploaded images: 'gps' for location and serial numbers (the default), 'all' or 'none'. HEIC, AVIF and JPEG XL uploads are refused unless it is 'none' since their metadata cant be stripped (string)",
+	MARKDOWN_EXTENSIONS: "#comma separated markdown extensions out of footnotes, highlight, math, toc and anchors. Defaults to footnotes, highlight and anchors if unset. math only marks the TeX up, the site has to load MathJax or KaTeX to typeset it (string)",
+	MARKDOWN_SANITIZE:   "#how to sanitize the HTML rendered from posts: 'strict' (the default) or 'none' to trust every post (string)",
+	RENDER_CACHE:        "#where to cache rendered posts: 'memory' (the default), 'persist' to keep them in the database across restarts, or 'off' (string)",
+	ACTIVITYPUB_USER:    "#the username the site federates as over ActivityPub, i.e. 'blog' to be followed as @blog@DOMAIN_NAME. Federation is off if unset (string)",
+	SMTP_HOST:           "#the SMTP server to send email through, i.e. 'smtp.aetherial.dev'. Email subscriptions are off if unset (string)",
+	SMTP_PORT:           "#the port of the SMTP server, defaults to 587 if unset (int)",
+	SMTP_USERNAME:       "#the username to log in to the SMTP server with, sends without logging in if unset (string)",
+	SMTP_PASSWORD:       "#the password to log in to the SMTP server with (string)",
+	SMTP_FROM:           "#the address emails are sent from, i.e. 'keiji <blog@aetherial.dev>'. Defaults to noreply@ and DOMAIN_NAME if unset (string)",
+	LOG_LEVEL:           "#the least severe logs to write: 'debug', 'info' (the default), 'warn' or 'error' (string)",
+	LOG_FORMAT:          "#how to write logs: 'text' (the default) or 'json'. Access logs are always json (string)",
+	METRICS_ADDR:        "#the address to serve /metrics on instead of the main listener, i.e. '127.0.0.1:9100'. Served with the site if unset (string)",
+	METRICS_TOKEN:       "#the bearer token Prometheus has to send to scrape /metrics. Anyone can scrape it if unset (string)",
+	SITE_URL:            "#the public url of the site for links sent to other sites, i.e. webmentions. Defaults to https:// and DOMAIN_NAME if unset (string)",
 }
 
 var REQUIRED_VARS = map[string]string{
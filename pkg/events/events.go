@@ -0,0 +1,77 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// What changed on the site
+type Type string
+
+const (
+	DOCUMENT_CREATED = Type("document.created")
+	DOCUMENT_UPDATED = Type("document.updated")
+	DOCUMENT_DELETED = Type("document.deleted")
+	IMAGE_CREATED    = Type("image.created")
+	IMAGE_UPDATED    = Type("image.updated")
+	IMAGE_DELETED    = Type("image.deleted")
+	ASSET_CREATED    = Type("asset.created")
+)
+
+// every event, in the order the admin panel offers them
+var Types = []Type{DOCUMENT_CREATED, DOCUMENT_UPDATED, DOCUMENT_DELETED, IMAGE_CREATED, IMAGE_UPDATED, IMAGE_DELETED, ASSET_CREATED}
+
+/*
+Something that changed on the site. Data is what it happened to, i.e. the post that was
+created, and is what gets marshalled for anybody listening outside of the site
+*/
+type Event struct {
+	ID      string `json:"id"`
+	Type    Type   `json:"type"`
+	Created string `json:"created"`
+	Data    any    `json:"data"`
+}
+
+/*
+Passes the events the site emits on to everything that subscribed to them. Handlers are
+called in the order they subscribed, on the goroutine that published the event, so a
+handler with slow work to do should hand it off rather than hold up the request
+*/
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+/*
+Call a function with every event published from now on
+
+	:param handler: the function to call
+*/
+func (b *Bus) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+/*
+Emit an event to every subscriber, returning the event that was sent
+
+	:param kind: what happened
+	:param data: what it happened to
+*/
+func (b *Bus) Publish(kind Type, data any) Event {
+	event := Event{ID: uuid.NewString(), Type: kind, Created: time.Now().UTC().Format(time.RFC3339), Data: data}
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return event
+}
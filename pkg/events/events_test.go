@@ -0,0 +1,27 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	// publishing with nobody listening is fine
+	bus.Publish(ASSET_CREATED, nil)
+
+	var first, second []Event
+	bus.Subscribe(func(e Event) { first = append(first, e) })
+	bus.Subscribe(func(e Event) { second = append(second, e) })
+	sent := bus.Publish(DOCUMENT_CREATED, map[string]string{"id": "abc"})
+	assert.NotEmpty(t, sent.ID)
+	assert.NotEmpty(t, sent.Created)
+	assert.Equal(t, DOCUMENT_CREATED, sent.Type)
+	assert.Equal(t, []Event{sent}, first)
+	assert.Equal(t, []Event{sent}, second)
+
+	another := bus.Publish(DOCUMENT_DELETED, nil)
+	assert.NotEqual(t, sent.ID, another.ID)
+	assert.Len(t, first, 2)
+}
@@ -0,0 +1,494 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"strings"
+	"time"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// How much metadata to remove from an uploaded image
+type StripMode string
+
+const (
+	STRIP_GPS  = StripMode("gps")  // location and serial numbers, the default
+	STRIP_ALL  = StripMode("all")  // every EXIF and XMP block
+	STRIP_NONE = StripMode("none") // keep the file byte-for-byte
+)
+
+var (
+	ErrMalformed   = errors.New("malformed exif data")
+	ErrUnsupported = errors.New("the metadata of this image format cant be stripped")
+)
+
+// tags read or stripped, from the EXIF 2.32 spec
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagDateTime         = 0x0132
+	tagXMP              = 0x02BC
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOwnerName        = 0xA430
+	tagBodySerial       = 0xA431
+	tagLensSerial       = 0xA435
+)
+
+// tags in the EXIF IFD that can identify the owner or the camera they own
+var sensitiveTags = map[uint16]bool{
+	tagOwnerName:  true,
+	tagBodySerial: true,
+	tagLensSerial: true,
+}
+
+// the size in bytes of each TIFF field type, by type number
+var typeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+const exifLayout = "2006:01:02 15:04:05"
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+	xmpKeyword = []byte("XML:com.adobe.xmp\x00")
+	tiffII     = []byte("II\x2a\x00")
+	tiffMM     = []byte("MM\x00\x2a")
+)
+
+// the flags in a WebP VP8X chunk saying that the file has EXIF or XMP chunks
+const (
+	vp8xXMP  = 0x04
+	vp8xEXIF = 0x08
+)
+
+// The metadata pulled out of an image
+type Info struct {
+	Width  int
+	Height int
+	Camera string // the make and model, i.e. 'FUJIFILM X-T30'
+	Taken  string // when the photo was taken, as '2006-01-02 15:04:05'
+	HasGPS bool
+}
+
+/*
+Read the dimensions of an image and the camera and date out of its EXIF data. Anything
+that cant be read is left empty, an image without EXIF only gets its dimensions
+
+	:param data: the image file
+*/
+func Read(data []byte) Info {
+	var info Info
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	raw := findTiff(data)
+	if raw == nil {
+		return info
+	}
+	t, err := parse(raw)
+	if err != nil {
+		return info
+	}
+	maker := t.ascii(t.ifd0, tagMake)
+	model := t.ascii(t.ifd0, tagModel)
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		maker = ""
+	}
+	info.Camera = strings.TrimSpace(maker + " " + model)
+	taken := t.ascii(t.exif, tagDateTimeOriginal)
+	if taken == "" {
+		taken = t.ascii(t.ifd0, tagDateTime)
+	}
+	if ts, err := time.Parse(exifLayout, taken); err == nil {
+		info.Taken = ts.Format("2006-01-02 15:04:05")
+	}
+	info.HasGPS = len(t.gps) > 0
+	return info
+}
+
+/*
+Remove metadata from a JPEG, PNG, WebP or TIFF. STRIP_GPS blanks the location and serial
+number fields in place, leaving the orientation, camera and everything else alone, and
+drops XMP since it can carry a location too. EXIF that cant be parsed is dropped entirely
+rather than risk leaving a location in it. Formats without EXIF, like GIF, BMP and SVG,
+are returned as they are, while ones that can carry it but arent handled here, like HEIC,
+AVIF and JPEG XL, return ErrUnsupported
+
+	:param data: the image file
+	:param mode: how much to remove
+*/
+func Strip(data []byte, mode StripMode) ([]byte, error) {
+	if mode == STRIP_NONE {
+		return data, nil
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return stripJpeg(data, mode), nil
+	case bytes.HasPrefix(data, pngHeader):
+		return stripPng(data, mode), nil
+	case isWebp(data):
+		return stripWebp(data, mode), nil
+	case bytes.HasPrefix(data, tiffII) || bytes.HasPrefix(data, tiffMM):
+		return stripTiff(data, mode)
+	// an ISO base media file, i.e. HEIC or AVIF, or a JPEG XL codestream or container
+	case len(data) >= 12 && string(data[4:8]) == "ftyp",
+		bytes.HasPrefix(data, []byte{0xFF, 0x0A}),
+		bytes.HasPrefix(data, []byte("\x00\x00\x00\x0cJXL \r\n\x87\x0a")):
+		return nil, ErrUnsupported
+	}
+	return data, nil
+}
+
+// walk the segments of a JPEG, rewriting or dropping the metadata ones
+func stripJpeg(data []byte, mode StripMode) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		// the image data starts here and runs to the end of the file
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		if marker == 0xFF || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			break
+		}
+		seg := data[i:end]
+		i = end
+		if marker != 0xE1 {
+			out.Write(seg)
+			continue
+		}
+		payload := seg[4:]
+		if bytes.HasPrefix(payload, xmpHeader) {
+			continue
+		}
+		if !bytes.HasPrefix(payload, exifHeader) {
+			out.Write(seg)
+			continue
+		}
+		if mode == STRIP_ALL {
+			continue
+		}
+		seg = append([]byte(nil), seg...)
+		if blank(seg[4+len(exifHeader):]) != nil {
+			continue
+		}
+		out.Write(seg)
+	}
+	out.Write(data[i:])
+	return out.Bytes()
+}
+
+// walk the chunks of a PNG, rewriting or dropping the metadata ones
+func stripPng(data []byte, mode StripMode) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngHeader)
+	i := len(pngHeader)
+	for i+12 <= len(data) {
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			break
+		}
+		chunk := data[i:end]
+		i = end
+		kind := string(chunk[4:8])
+		body := chunk[8 : len(chunk)-4]
+		if kind == "iTXt" && bytes.HasPrefix(body, xmpKeyword) {
+			continue
+		}
+		if kind != "eXIf" {
+			out.Write(chunk)
+			continue
+		}
+		if mode == STRIP_ALL {
+			continue
+		}
+		chunk = append([]byte(nil), chunk...)
+		if blank(chunk[8:len(chunk)-4]) != nil {
+			continue
+		}
+		binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(chunk[4:len(chunk)-4]))
+		out.Write(chunk)
+	}
+	out.Write(data[i:])
+	return out.Bytes()
+}
+
+// whether the file is a RIFF container holding a WebP
+func isWebp(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// walk the chunks of a WebP, rewriting or dropping the metadata ones
+func stripWebp(data []byte, mode StripMode) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	var dropped byte
+	i := 12
+	for i+8 <= len(data) {
+		size := uint64(binary.LittleEndian.Uint32(data[i+4:]))
+		end := uint64(i) + 8 + size
+		if end > uint64(len(data)) {
+			break
+		}
+		// the padding byte after an odd sized chunk is sometimes missing from the last one
+		if size%2 == 1 && end < uint64(len(data)) {
+			end++
+		}
+		chunk := data[i:end]
+		i = int(end)
+		switch string(chunk[:4]) {
+		case "XMP ":
+			dropped |= vp8xXMP
+			continue
+		case "EXIF":
+			if mode == STRIP_ALL {
+				dropped |= vp8xEXIF
+				continue
+			}
+			chunk = append([]byte(nil), chunk...)
+			// some writers put the JPEG style header in front of the TIFF structure
+			if blank(bytes.TrimPrefix(chunk[8:8+size], exifHeader)) != nil {
+				dropped |= vp8xEXIF
+				continue
+			}
+		}
+		out.Write(chunk)
+	}
+	// a chunk cut short is left off rather than risk it being a piece of the metadata
+	b := out.Bytes()
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	// the extended header says which chunks there are, it has to stop naming the dropped ones
+	if len(b) >= 21 && string(b[12:16]) == "VP8X" {
+		b[20] &^= dropped
+	}
+	return b
+}
+
+/*
+Blank the metadata of a TIFF, which is one TIFF structure so nothing can be dropped from it.
+XMP is zeroed out where it is, and STRIP_ALL empties the EXIF IFD as well. A TIFF that cant
+be parsed returns ErrMalformed since it cant be stored without its location
+*/
+func stripTiff(data []byte, mode StripMode) ([]byte, error) {
+	b := append([]byte(nil), data...)
+	if err := blank(b); err != nil {
+		return nil, err
+	}
+	t, err := parse(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.ifd0 {
+		if e.tag == tagXMP {
+			clear(b[e.offset : e.offset+e.size])
+		}
+	}
+	if mode == STRIP_ALL {
+		t.empty(t.exifAt, t.exif)
+	}
+	return b, nil
+}
+
+// find the TIFF structure holding the EXIF data in a JPEG, PNG, WebP or TIFF
+func findTiff(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+			marker := data[i+1]
+			if marker == 0xDA || marker == 0xD9 {
+				return nil
+			}
+			end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+			if end > len(data) {
+				return nil
+			}
+			if marker == 0xE1 && bytes.HasPrefix(data[i+4:end], exifHeader) {
+				return data[i+4+len(exifHeader) : end]
+			}
+			i = end
+		}
+		return nil
+	}
+	if bytes.HasPrefix(data, pngHeader) {
+		for i := len(pngHeader); i+12 <= len(data); {
+			end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+			if end > len(data) || end < i {
+				return nil
+			}
+			if string(data[i+4:i+8]) == "eXIf" {
+				return data[i+8 : end-4]
+			}
+			i = end
+		}
+		return nil
+	}
+	if isWebp(data) {
+		for i := 12; i+8 <= len(data); {
+			size := uint64(binary.LittleEndian.Uint32(data[i+4:]))
+			end := uint64(i) + 8 + size
+			if end > uint64(len(data)) {
+				return nil
+			}
+			if string(data[i:i+4]) == "EXIF" {
+				return bytes.TrimPrefix(data[i+8:end], exifHeader)
+			}
+			i = int(end + size%2)
+		}
+		return nil
+	}
+	if bytes.HasPrefix(data, tiffII) || bytes.HasPrefix(data, tiffMM) {
+		return data
+	}
+	return nil
+}
+
+// A single IFD entry, with where its value lives in the TIFF structure
+type entry struct {
+	tag    uint16
+	kind   uint16
+	count  uint32
+	offset uint32 // of the value, which is inside the entry for values of 4 bytes or less
+	size   uint32
+	at     uint32 // of the entry itself
+}
+
+// A parsed TIFF structure, the entries of the IFDs that matter here
+type tiff struct {
+	b      []byte
+	order  binary.ByteOrder
+	ifd0   []entry
+	exif   []entry
+	gps    []entry
+	exifAt uint32
+	gpsAt  uint32
+}
+
+func parse(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, ErrMalformed
+	}
+	t := &tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrMalformed
+	}
+	var err error
+	if t.ifd0, err = t.ifd(t.order.Uint32(b[4:])); err != nil {
+		return nil, err
+	}
+	for _, e := range t.ifd0 {
+		switch e.tag {
+		case tagExifIFD:
+			t.exifAt = t.order.Uint32(b[e.offset:])
+			if t.exif, err = t.ifd(t.exifAt); err != nil {
+				return nil, err
+			}
+		case tagGPSIFD:
+			t.gpsAt = t.order.Uint32(b[e.offset:])
+			if t.gps, err = t.ifd(t.gpsAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// read the entries of the IFD at an offset, checking that every value is in bounds
+func (t *tiff) ifd(at uint32) ([]entry, error) {
+	if uint64(at)+2 > uint64(len(t.b)) {
+		return nil, ErrMalformed
+	}
+	n := uint32(t.order.Uint16(t.b[at:]))
+	if uint64(at)+2+uint64(n)*12 > uint64(len(t.b)) {
+		return nil, ErrMalformed
+	}
+	entries := make([]entry, n)
+	for i := uint32(0); i < n; i++ {
+		e := entry{at: at + 2 + i*12}
+		e.tag = t.order.Uint16(t.b[e.at:])
+		e.kind = t.order.Uint16(t.b[e.at+2:])
+		e.count = t.order.Uint32(t.b[e.at+4:])
+		e.offset = e.at + 8
+		size := uint64(typeSizes[e.kind]) * uint64(e.count)
+		if size > 4 {
+			e.offset = t.order.Uint32(t.b[e.at+8:])
+		}
+		if uint64(e.offset)+size > uint64(len(t.b)) || ((e.tag == tagExifIFD || e.tag == tagGPSIFD) && size < 4) {
+			return nil, ErrMalformed
+		}
+		e.size = uint32(size)
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// the value of an ASCII entry, empty if the IFD doesnt have it
+func (t *tiff) ascii(ifd []entry, tag uint16) string {
+	for _, e := range ifd {
+		if e.tag == tag && e.kind == 2 {
+			return strings.TrimSpace(strings.TrimRight(string(t.b[e.offset:e.offset+e.size]), "\x00"))
+		}
+	}
+	return ""
+}
+
+/*
+Zero out the GPS IFD and the sensitive EXIF fields of a TIFF structure in place, so
+nothing around them has to move. The GPS IFD is left with no entries
+
+	:param b: the TIFF structure, modified in place
+*/
+func blank(b []byte) error {
+	t, err := parse(b)
+	if err != nil {
+		return err
+	}
+	t.empty(t.gpsAt, t.gps)
+	for _, e := range t.exif {
+		if sensitiveTags[e.tag] {
+			clear(b[e.offset : e.offset+e.size])
+		}
+	}
+	return nil
+}
+
+// zero out the values of an IFD and the IFD itself, leaving it with no entries
+func (t *tiff) empty(at uint32, ifd []entry) {
+	if ifd == nil {
+		return
+	}
+	for _, e := range ifd {
+		clear(t.b[e.offset : e.offset+e.size])
+	}
+	// the entry count, every entry and the next IFD offset
+	end := uint64(at) + 2 + uint64(len(ifd))*12 + 4
+	if end > uint64(len(t.b)) {
+		end = uint64(len(t.b))
+	}
+	clear(t.b[at:end])
+}
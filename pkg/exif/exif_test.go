@@ -0,0 +1,339 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	tiffimage "golang.org/x/image/tiff"
+)
+
+type field struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+func ascii(tag uint16, s string) field {
+	return field{tag: tag, kind: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+/*
+Append a first IFD pointing at an EXIF and a GPS IFD, then those two IFDs, then every value
+too big to fit in its entry. Offsets are from the start of b, which is where the TIFF header is
+*/
+func appendIFDs(b []byte, o binary.AppendByteOrder, ifd0, exifIFD, gps []field) []byte {
+	size := func(f []field) uint32 { return uint32(2 + 12*len(f) + 4) }
+	ifd0 = append(ifd0, field{tag: tagExifIFD, kind: 4, count: 1}, field{tag: tagGPSIFD, kind: 4, count: 1})
+	exifAt := uint32(len(b)) + size(ifd0)
+	gpsAt := exifAt + size(exifIFD)
+	dataAt := gpsAt + size(gps)
+	ifd0[len(ifd0)-2].value = o.AppendUint32(nil, exifAt)
+	ifd0[len(ifd0)-1].value = o.AppendUint32(nil, gpsAt)
+
+	var data []byte
+	for _, ifd := range [][]field{ifd0, exifIFD, gps} {
+		b = o.AppendUint16(b, uint16(len(ifd)))
+		for _, f := range ifd {
+			b = o.AppendUint16(b, f.tag)
+			b = o.AppendUint16(b, f.kind)
+			b = o.AppendUint32(b, f.count)
+			if len(f.value) <= 4 {
+				b = append(b, append(f.value, make([]byte, 4-len(f.value))...)...)
+				continue
+			}
+			b = o.AppendUint32(b, dataAt+uint32(len(data)))
+			data = append(data, f.value...)
+		}
+		b = o.AppendUint32(b, 0)
+	}
+	return append(b, data...)
+}
+
+// build a big endian TIFF structure with an EXIF and a GPS IFD
+func buildTiff(ifd0, exifIFD, gps []field) []byte {
+	return appendIFDs([]byte("MM\x00\x2a\x00\x00\x00\x08"), binary.BigEndian, ifd0, exifIFD, gps)
+}
+
+var (
+	testExifIFD = []field{ascii(tagDateTimeOriginal, "2024:05:01 12:30:00"), ascii(tagBodySerial, "SERIAL123456")}
+	testGPS     = []field{
+		{tag: 0x0001, kind: 2, count: 2, value: []byte("N\x00")},
+		{tag: 0x0002, kind: 5, count: 3, value: []byte("LATITUDE-RATIONALS-24BYTE")[:24]},
+	}
+	testTiff = buildTiff(
+		[]field{ascii(tagMake, "Canon"), ascii(tagModel, "Canon EOS R5"), ascii(tagDateTime, "2024:06:01 09:00:00")},
+		testExifIFD,
+		testGPS,
+	)
+)
+
+func testImage() image.Image {
+	return image.NewRGBA(image.Rect(0, 0, 8, 4))
+}
+
+// a JPEG with an EXIF segment and an XMP segment
+func testJpeg(t *testing.T, tiff []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(payload []byte) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(payload)+2)), payload...)
+	}
+	out := append([]byte{}, buf.Bytes()[:2]...)
+	out = append(out, segment(append(append([]byte{}, exifHeader...), tiff...))...)
+	out = append(out, segment(append(append([]byte{}, xmpHeader...), []byte("<exif:GPSLatitude>1</exif:GPSLatitude>")...))...)
+	return append(out, buf.Bytes()[2:]...)
+}
+
+// a PNG with an eXIf chunk right after the header chunk
+func testPng(t *testing.T, tiff []byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+	chunk = append(chunk, "eXIf"...)
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	ihdrEnd := len(pngHeader) + 25
+	out := append([]byte{}, buf.Bytes()[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, buf.Bytes()[ihdrEnd:]...)
+}
+
+// the VP8 chunk of an opaque 8 x 4 WebP
+var vp8Chunk = []byte("VP8 \x16\x00\x00\x00\x10\x01\x00\x9d\x01*\b\x00\x04\x00\x03\x002\x00\x000=\xd8\xfe\xfb\xd8\x00")
+
+// a WebP with an extended header, the image, an EXIF chunk and an XMP chunk
+func testWebp(exif []byte) []byte {
+	chunk := func(kind string, payload []byte) []byte {
+		c := binary.LittleEndian.AppendUint32([]byte(kind), uint32(len(payload)))
+		c = append(c, payload...)
+		if len(payload)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	// the EXIF and XMP flags, then the canvas size less one
+	body := chunk("VP8X", []byte{vp8xEXIF | vp8xXMP, 0, 0, 0, 7, 0, 0, 3, 0, 0})
+	body = append(body, vp8Chunk...)
+	body = append(body, chunk("EXIF", exif)...)
+	body = append(body, chunk("XMP ", []byte("<exif:GPSLatitude>1</exif:GPSLatitude>"))...)
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)+4))
+	out = append(out, "WEBP"...)
+	return append(out, body...)
+}
+
+// a TIFF image with the pointers to an EXIF and a GPS IFD added to a copy of its first IFD
+func testTiffImage(t *testing.T, exifIFD, gps []field) []byte {
+	var buf bytes.Buffer
+	if err := tiffimage.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	o := binary.LittleEndian
+	at := o.Uint32(b[4:])
+	var ifd0 []field
+	for i := uint32(0); i < uint32(o.Uint16(b[at:])); i++ {
+		e := b[at+2+i*12:]
+		// the value or its offset is copied as it is, the old IFD and its values stay where they are
+		ifd0 = append(ifd0, field{tag: o.Uint16(e), kind: o.Uint16(e[2:]), count: o.Uint32(e[4:]), value: e[8:12]})
+	}
+	xmp := []byte("<exif:GPSLatitude>1</exif:GPSLatitude>")
+	ifd0 = append(ifd0, field{tag: tagXMP, kind: 1, count: uint32(len(xmp)), value: xmp})
+	o.PutUint32(b[4:], uint32(len(b)))
+	return appendIFDs(b, o, ifd0, exifIFD, gps)
+}
+
+func testGif(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	type testcase struct {
+		name string
+		data []byte
+		want Info
+	}
+	for _, tc := range []testcase{
+		{
+			name: "jpeg",
+			data: testJpeg(t, testTiff),
+			want: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00", HasGPS: true},
+		},
+		{
+			name: "png",
+			data: testPng(t, testTiff),
+			want: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00", HasGPS: true},
+		},
+		{
+			name: "webp",
+			data: testWebp(testTiff),
+			want: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00", HasGPS: true},
+		},
+		{
+			name: "tiff",
+			data: testTiffImage(t, testExifIFD, testGPS),
+			want: Info{Width: 8, Height: 4, Taken: "2024-05-01 12:30:00", HasGPS: true},
+		},
+		{
+			name: "malformed exif still has dimensions",
+			data: testJpeg(t, []byte("MM\x00\x2a\xff\xff\xff\xff")),
+			want: Info{Width: 8, Height: 4},
+		},
+		{
+			name: "not an image",
+			data: []byte("hello"),
+			want: Info{},
+		},
+	} {
+		assert.Equal(t, tc.want, Read(tc.data), tc.name)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	type testcase struct {
+		name     string
+		data     []byte
+		mode     StripMode
+		wantInfo Info
+		gone     []string
+		kept     []string
+	}
+	for _, tc := range []testcase{
+		{
+			name:     "jpeg gps",
+			data:     testJpeg(t, testTiff),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00"},
+			gone:     []string{"LATITUDE", "SERIAL123456", "GPSLatitude"},
+			kept:     []string{"Exif\x00\x00"},
+		},
+		{
+			name:     "jpeg all",
+			data:     testJpeg(t, testTiff),
+			mode:     STRIP_ALL,
+			wantInfo: Info{Width: 8, Height: 4},
+			gone:     []string{"Exif\x00\x00", "GPSLatitude"},
+		},
+		{
+			name:     "jpeg none",
+			data:     testJpeg(t, testTiff),
+			mode:     STRIP_NONE,
+			wantInfo: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00", HasGPS: true},
+			kept:     []string{"LATITUDE", "SERIAL123456", "GPSLatitude"},
+		},
+		{
+			name:     "jpeg with malformed exif drops it",
+			data:     testJpeg(t, []byte("MM\x00\x2a\xff\xff\xff\xffLATITUDE")),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4},
+			gone:     []string{"LATITUDE", "Exif\x00\x00"},
+		},
+		{
+			name:     "png gps",
+			data:     testPng(t, testTiff),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00"},
+			gone:     []string{"LATITUDE", "SERIAL123456"},
+			kept:     []string{"eXIf"},
+		},
+		{
+			name:     "png all",
+			data:     testPng(t, testTiff),
+			mode:     STRIP_ALL,
+			wantInfo: Info{Width: 8, Height: 4},
+			gone:     []string{"eXIf", "LATITUDE"},
+		},
+		{
+			name:     "webp gps",
+			data:     testWebp(testTiff),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00"},
+			gone:     []string{"LATITUDE", "SERIAL123456", "GPSLatitude", "XMP "},
+			kept:     []string{"EXIF"},
+		},
+		{
+			name:     "webp with a jpeg style exif header",
+			data:     testWebp(append(append([]byte{}, exifHeader...), testTiff...)),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4, Camera: "Canon EOS R5", Taken: "2024-05-01 12:30:00"},
+			gone:     []string{"LATITUDE", "SERIAL123456"},
+			kept:     []string{"EXIF"},
+		},
+		{
+			name:     "webp all",
+			data:     testWebp(testTiff),
+			mode:     STRIP_ALL,
+			wantInfo: Info{Width: 8, Height: 4},
+			gone:     []string{"EXIF", "LATITUDE", "XMP "},
+		},
+		{
+			name:     "webp with malformed exif drops it",
+			data:     testWebp([]byte("MM\x00\x2a\xff\xff\xff\xffLATITUDE")),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4},
+			gone:     []string{"LATITUDE", "EXIF"},
+		},
+		{
+			name:     "tiff gps",
+			data:     testTiffImage(t, testExifIFD, testGPS),
+			mode:     STRIP_GPS,
+			wantInfo: Info{Width: 8, Height: 4, Taken: "2024-05-01 12:30:00"},
+			gone:     []string{"LATITUDE", "SERIAL123456", "GPSLatitude"},
+		},
+		{
+			name:     "tiff all",
+			data:     testTiffImage(t, testExifIFD, testGPS),
+			mode:     STRIP_ALL,
+			wantInfo: Info{Width: 8, Height: 4},
+			gone:     []string{"LATITUDE", "SERIAL123456", "GPSLatitude", "2024:05:01"},
+		},
+		{
+			name:     "gif has nothing to strip",
+			data:     testGif(t),
+			mode:     STRIP_ALL,
+			wantInfo: Info{Width: 8, Height: 4},
+		},
+	} {
+		got, err := Strip(tc.data, tc.mode)
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, tc.wantInfo, Read(got), tc.name)
+		for _, s := range tc.gone {
+			assert.NotContains(t, string(got), s, tc.name)
+		}
+		for _, s := range tc.kept {
+			assert.Contains(t, string(got), s, tc.name)
+		}
+		// whatever was stripped, the image itself has to survive
+		_, _, err = image.Decode(bytes.NewReader(got))
+		assert.NoError(t, err, tc.name)
+	}
+
+	// an image format that can carry a location but cant be stripped is refused
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	_, err := Strip(heic, STRIP_GPS)
+	assert.ErrorIs(t, err, ErrUnsupported)
+	got, err := Strip(heic, STRIP_NONE)
+	assert.NoError(t, err)
+	assert.Equal(t, heic, got)
+
+	// as is a TIFF whose EXIF cant be parsed, since it cant be dropped from one
+	_, err = Strip([]byte("MM\x00\x2a\xff\xff\xff\xffLATITUDE"), STRIP_GPS)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
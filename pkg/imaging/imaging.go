@@ -0,0 +1,392 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	_ "image/gif"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+// the widths variants are generated at by default, for srcset
+var DefaultWidths = []int{320, 640, 1280}
+
+// the edge length of the square thumbnails
+const ThumbnailSize = 256
+
+// the value of ?w= that asks for the thumbnail instead of a width
+const ThumbnailParam = "thumb"
+
+const jpegQuality = 85
+
+// how many uploads can wait for their variants to be made before more are dropped
+const queueSize = 64
+
+/*
+the most pixels an image can have to be resized, about 50 megapixels. A file can claim
+any size in its header, decoding one that claims too much would take gigabytes
+*/
+const maxPixels = 50_000_000
+
+var (
+	ErrUnsupportedFormat = errors.New("image format can not be resized")
+	ErrInvalidIdentifier = errors.New("invalid image identifier")
+	ErrTooLarge          = errors.New("image has too many pixels to be resized")
+)
+
+/*
+Encoders for the formats variants can be written in, keyed by the name image.Decode reports.
+Variants are written in the same format as the original, so anything missing here (gif, so
+animations arent flattened, and anything the standard library cant decode like webp or svg)
+is served at its original size. No webp or avif copies are made either, neither format has
+an encoder in the standard library or x/image
+*/
+var encoders = map[string]func(w io.Writer, img image.Image) error{
+	"jpeg": func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	},
+	"png": png.Encode,
+}
+
+/*
+Generates resized copies of the images in an image store and keeps them next to the
+originals, under the identifiers from VariantID and ThumbnailID
+*/
+type Processor struct {
+	store  storage.ImageIO
+	Widths []int
+	mu     sync.Mutex
+	queue  chan storage.Identifier
+}
+
+/*
+Create a new image processor
+
+	:param store: the image store holding the originals, variants are written to it too
+	:param widths: the widths to generate variants at, smallest first
+*/
+func NewProcessor(store storage.ImageIO, widths []int) *Processor {
+	return &Processor{store: store, Widths: widths, queue: make(chan storage.Identifier, queueSize)}
+}
+
+/*
+The identifier a width variant is stored under
+
+	:param id: the identifier of the original image
+	:param width: the width of the variant
+*/
+func VariantID(id storage.Identifier, width int) storage.Identifier {
+	return storage.Identifier(fmt.Sprintf("%s.w%v", id, width))
+}
+
+/*
+The identifier the thumbnail is stored under
+
+	:param id: the identifier of the original image
+*/
+func ThumbnailID(id storage.Identifier) storage.Identifier {
+	return storage.Identifier(string(id) + "." + ThumbnailParam)
+}
+
+/*
+Build the srcset attribute for an image, pointing each width at the ?w= query of the image route
+
+	:param route: the route the image is served from, i.e. /api/v1/images/<id>
+*/
+func (p *Processor) Srcset(route string) string {
+	entries := make([]string, len(p.Widths))
+	for i, w := range p.Widths {
+		entries[i] = fmt.Sprintf("%s?w=%v %vw", route, w, w)
+	}
+	return strings.Join(entries, ", ")
+}
+
+/*
+Queue an image to have its variants generated in the background by Run. The queue is
+dropped from when it is full, Variant and Thumbnail make anything missing when it is
+first asked for, so it returns whether the image was queued
+
+	:param id: the identifier of the original image
+*/
+func (p *Processor) Enqueue(id storage.Identifier) bool {
+	select {
+	case p.queue <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Generate the variants of the images queued by Enqueue, one at a time, until stop is closed
+
+	:param stop: closing it stops the worker, whatever is still queued is left to be made lazily
+*/
+func (p *Processor) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case id := <-p.queue:
+			data, err := p.store.Get(id)
+			if err == nil {
+				_, err = p.Generate(id, data)
+			}
+			if err != nil && !errors.Is(err, ErrUnsupportedFormat) {
+				slog.Warn("generating the variants of an image failed", "id", id, "err", err)
+			}
+		}
+	}
+}
+
+/*
+Generate the thumbnail and every width variant narrower than the original, returning the
+identifiers written. Variant and Thumbnail fill in anything missing later, they wait for
+this to finish rather than write the same variants
+
+	:param id: the identifier of the original image
+	:param data: the original image
+*/
+func (p *Processor) Generate(id storage.Identifier, data []byte) ([]storage.Identifier, error) {
+	src, format, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var written []storage.Identifier
+	for _, w := range p.Widths {
+		if w >= src.Bounds().Dx() {
+			break
+		}
+		if err = p.put(VariantID(id, w), Resize(src, w), format); err != nil {
+			return written, err
+		}
+		written = append(written, VariantID(id, w))
+	}
+	if err = p.put(ThumbnailID(id), Thumbnail(src, ThumbnailSize), format); err != nil {
+		return written, err
+	}
+	return append(written, ThumbnailID(id)), nil
+}
+
+/*
+Get the smallest variant at least as wide as requested, generating it if it doesnt exist
+yet. Falls back to the original when it is narrower than the requested width, wider than
+every variant, in a format that cant be resized or has too many pixels to be
+
+	:param id: the identifier of the original image
+	:param width: the width the browser asked for
+*/
+func (p *Processor) Variant(id storage.Identifier, width int) ([]byte, error) {
+	if err := validate(id); err != nil {
+		return nil, err
+	}
+	target := 0
+	for _, w := range p.Widths {
+		if w >= width {
+			target = w
+			break
+		}
+	}
+	if target == 0 {
+		return p.store.Get(id)
+	}
+	return p.lazy(id, VariantID(id, target), target, func(src image.Image) image.Image {
+		return Resize(src, target)
+	})
+}
+
+/*
+Get the square thumbnail of an image, generating it if it doesnt exist yet
+
+	:param id: the identifier of the original image
+*/
+func (p *Processor) Thumbnail(id storage.Identifier) ([]byte, error) {
+	if err := validate(id); err != nil {
+		return nil, err
+	}
+	return p.lazy(id, ThumbnailID(id), 0, func(src image.Image) image.Image {
+		return Thumbnail(src, ThumbnailSize)
+	})
+}
+
+/*
+Remove every variant of an image from the store
+
+	:param id: the identifier of the original image
+*/
+func (p *Processor) Purge(id storage.Identifier) error {
+	if err := validate(id); err != nil {
+		return err
+	}
+	for _, w := range p.Widths {
+		if err := p.store.Delete(VariantID(id, w)); err != nil {
+			return err
+		}
+	}
+	return p.store.Delete(ThumbnailID(id))
+}
+
+/*
+Return a stored variant, or make it from the original and store it. The store writes
+variants whole, so one that is there can be read without taking the lock
+
+	:param id: the identifier of the original image
+	:param variant: the identifier the variant is stored under
+	:param minWidth: serve the original as-is if it isnt wider than this
+	:param resize: makes the variant out of the original
+*/
+func (p *Processor) lazy(id, variant storage.Identifier, minWidth int, resize func(src image.Image) image.Image) ([]byte, error) {
+	if b, err := p.store.Get(variant); err == nil {
+		return b, nil
+	}
+	orig, err := p.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(orig))
+	if _, ok := encoders[format]; err != nil || !ok || cfg.Width <= minWidth || tooLarge(cfg) {
+		return orig, nil
+	}
+	// two requests for the same missing variant shouldnt both write it
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, err := p.store.Get(variant); err == nil {
+		return b, nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(orig))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = encoders[format](&buf, resize(src)); err != nil {
+		return nil, err
+	}
+	if err = p.store.Put(buf.Bytes(), variant); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode an image and write it to the store
+func (p *Processor) put(id storage.Identifier, img image.Image, format string) error {
+	var buf bytes.Buffer
+	if err := encoders[format](&buf, img); err != nil {
+		return err
+	}
+	return p.store.Put(buf.Bytes(), id)
+}
+
+/*
+decode an image, failing with ErrUnsupportedFormat if there is no encoder for its format and
+ErrTooLarge if it has more pixels than can be resized
+*/
+func decode(data []byte) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if _, ok := encoders[format]; !ok {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if tooLarge(cfg) {
+		return nil, "", ErrTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	return src, format, err
+}
+
+// whether an image has more pixels than can be decoded to resize it
+func tooLarge(cfg image.Config) bool {
+	return int64(cfg.Width)*int64(cfg.Height) > maxPixels
+}
+
+// identifiers end up in file names, so they cant be allowed to walk the filesystem
+func validate(id storage.Identifier) error {
+	if id == "" || strings.ContainsAny(string(id), `/\`) || strings.HasPrefix(string(id), ".") {
+		return ErrInvalidIdentifier
+	}
+	return nil
+}
+
+/*
+Scale an image down to a width, keeping its aspect ratio. Each destination pixel is the
+average of the source pixels it covers, which is good for shrinking but the image is
+never enlarged, a width wider than the source returns it at its own size
+
+	:param src: the image to scale
+	:param width: the width to scale to
+*/
+func Resize(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if width >= b.Dx() {
+		return src
+	}
+	height := (b.Dy()*width + b.Dx()/2) / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return scale(src, b, width, height)
+}
+
+/*
+Crop the center square out of an image and scale it down to size
+
+	:param src: the image to make a thumbnail of
+	:param size: the edge length of the thumbnail
+*/
+func Thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	edge := b.Dx()
+	if b.Dy() < edge {
+		edge = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-edge)/2
+	y0 := b.Min.Y + (b.Dy()-edge)/2
+	crop := image.Rect(x0, y0, x0+edge, y0+edge)
+	if size > edge {
+		size = edge
+	}
+	return scale(src, crop, size, size)
+}
+
+// area average the pixels of a region of src into a width x height image
+func scale(src image.Image, region image.Rectangle, width, height int) image.Image {
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	sw, sh := region.Dx(), region.Dy()
+	for y := 0; y < height; y++ {
+		y0 := region.Min.Y + y*sh/height
+		y1 := region.Min.Y + (y+1)*sh/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0 := region.Min.X + x*sw/width
+			x1 := region.Min.X + (x+1)*sw/width
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
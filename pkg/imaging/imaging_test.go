@@ -0,0 +1,226 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// a w x h png, red on the left half and blue on the right
+func testPng(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// a tiny png whose header claims it is w x h
+func claimedPng(t *testing.T, w, h uint32) []byte {
+	b := testPng(t, 1, 1)
+	// the IHDR chunk follows the 8 byte signature, its data starts after the length and type
+	binary.BigEndian.PutUint32(b[16:], w)
+	binary.BigEndian.PutUint32(b[20:], h)
+	binary.BigEndian.PutUint32(b[29:], crc32.ChecksumIEEE(b[12:29]))
+	return b
+}
+
+func decodeSize(t *testing.T, b []byte) (int, int, string) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width, cfg.Height, format
+}
+
+func TestResize(t *testing.T) {
+	type testcase struct {
+		desc  string
+		w, h  int
+		width int
+		wantW int
+		wantH int
+	}
+	for _, tc := range []testcase{
+		{desc: "halved", w: 200, h: 100, width: 100, wantW: 100, wantH: 50},
+		{desc: "rounds the height", w: 300, h: 100, width: 100, wantW: 100, wantH: 33},
+		{desc: "never enlarges", w: 50, h: 50, width: 100, wantW: 50, wantH: 50},
+		{desc: "keeps at least a pixel", w: 1000, h: 1, width: 10, wantW: 10, wantH: 1},
+	} {
+		src := image.NewRGBA(image.Rect(0, 0, tc.w, tc.h))
+		got := Resize(src, tc.width).Bounds()
+		assert.Equal(t, tc.wantW, got.Dx(), tc.desc)
+		assert.Equal(t, tc.wantH, got.Dy(), tc.desc)
+	}
+
+	src, _, _ := image.Decode(bytes.NewReader(testPng(t, 40, 20)))
+	got := Resize(src, 4)
+	r, _, b, _ := got.At(0, 0).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	assert.Equal(t, uint32(0), b)
+	r, _, b, _ = got.At(3, 0).RGBA()
+	assert.Equal(t, uint32(0), r)
+	assert.Equal(t, uint32(0xffff), b)
+}
+
+func TestThumbnail(t *testing.T) {
+	src, _, _ := image.Decode(bytes.NewReader(testPng(t, 400, 200)))
+	thumb := Thumbnail(src, 100)
+	assert.Equal(t, image.Rect(0, 0, 100, 100), thumb.Bounds())
+	// the center crop has both halves in it
+	r, _, _, _ := thumb.At(0, 50).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	_, _, b, _ := thumb.At(99, 50).RGBA()
+	assert.Equal(t, uint32(0xffff), b)
+
+	small := Thumbnail(src, 1000)
+	assert.Equal(t, image.Rect(0, 0, 200, 200), small.Bounds())
+}
+
+func TestGenerate(t *testing.T) {
+	store := storage.FilesystemImageIO{RootDir: t.TempDir()}
+	p := NewProcessor(store, []int{100, 200, 800})
+	id := storage.Identifier("abc123")
+	data := testPng(t, 500, 250)
+	store.Put(data, id)
+
+	written, err := p.Generate(id, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []storage.Identifier{"abc123.w100", "abc123.w200", "abc123.thumb"}, written)
+	b, err := store.Get("abc123.w200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h, format := decodeSize(t, b)
+	assert.Equal(t, []any{200, 100, "png"}, []any{w, h, format})
+
+	_, err = p.Generate(id, []byte("not an image"))
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestRun(t *testing.T) {
+	store := storage.FilesystemImageIO{RootDir: t.TempDir()}
+	p := NewProcessor(store, []int{100})
+	store.Put(testPng(t, 500, 250), "abc123")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.Run(stop)
+		close(done)
+	}()
+	assert.True(t, p.Enqueue("abc123"))
+	assert.Eventually(t, func() bool {
+		_, err := store.Get("abc123.thumb")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	close(stop)
+	<-done
+
+	// nothing takes from a full queue once the worker has stopped
+	for i := 0; i < queueSize; i++ {
+		assert.True(t, p.Enqueue("abc123"))
+	}
+	assert.False(t, p.Enqueue("abc123"))
+}
+
+func TestVariant(t *testing.T) {
+	store := storage.FilesystemImageIO{RootDir: t.TempDir()}
+	p := NewProcessor(store, []int{100, 200, 800})
+	id := storage.Identifier("abc123")
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 500, 250)), nil)
+	data := buf.Bytes()
+	store.Put(data, id)
+
+	type testcase struct {
+		desc  string
+		width int
+		wantW int
+	}
+	for _, tc := range []testcase{
+		{desc: "exact width", width: 100, wantW: 100},
+		{desc: "rounds up to the next variant", width: 150, wantW: 200},
+		{desc: "variant wider than the original", width: 700, wantW: 500},
+		{desc: "wider than every variant", width: 5000, wantW: 500},
+	} {
+		b, err := p.Variant(id, tc.width)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, _, format := decodeSize(t, b)
+		assert.Equal(t, tc.wantW, w, tc.desc)
+		assert.Equal(t, "jpeg", format, tc.desc)
+	}
+	// made lazily and kept for next time
+	_, err := store.Get("abc123.w200")
+	assert.Nil(t, err)
+	_, err = store.Get("abc123.w800")
+	assert.NotNil(t, err)
+
+	thumb, err := p.Thumbnail(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h, _ := decodeSize(t, thumb)
+	assert.Equal(t, []int{250, 250}, []int{w, h})
+
+	store.Put([]byte("<svg></svg>"), "vector")
+	b, err := p.Variant("vector", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("<svg></svg>"), b)
+
+	_, err = p.Variant("../etc/passwd", 100)
+	assert.Equal(t, ErrInvalidIdentifier, err)
+
+	assert.Nil(t, p.Purge(id))
+	_, err = store.Get("abc123.w200")
+	assert.NotNil(t, err)
+	_, err = store.Get(id)
+	assert.Nil(t, err)
+}
+
+func TestTooLarge(t *testing.T) {
+	store := storage.FilesystemImageIO{RootDir: t.TempDir()}
+	p := NewProcessor(store, []int{100})
+	data := claimedPng(t, 100000, 100000)
+	w, h, _ := decodeSize(t, data)
+	assert.Equal(t, []int{100000, 100000}, []int{w, h})
+	store.Put(data, "bomb")
+
+	_, err := p.Generate("bomb", data)
+	assert.Equal(t, ErrTooLarge, err)
+	b, err := p.Variant("bomb", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	b, err = p.Thumbnail("bomb")
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	_, err = store.Get("bomb.thumb")
+	assert.NotNil(t, err)
+}
+
+func TestSrcset(t *testing.T) {
+	p := NewProcessor(nil, []int{320, 640})
+	assert.Equal(t, "/api/v1/images/abc?w=320 320w, /api/v1/images/abc?w=640 640w", p.Srcset("/api/v1/images/abc"))
+}
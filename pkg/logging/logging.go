@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// the header a request ID is read from, when a proxy in front of the site set one, and answered with
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+const (
+	TEXT = "text"
+	JSON = "json"
+)
+
+// request IDs from a proxy are only trusted when they look like one
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type contextKey struct{}
+
+/*
+Create a logger
+
+	:param w: where the logs are written
+	:param level: the least severe level that is logged
+	:param format: TEXT or JSON
+*/
+func New(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case TEXT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT has to be '%s' or '%s', not '%s'", TEXT, JSON, format)
+}
+
+/*
+Create the logger the environment asks for, LOG_LEVEL defaulting to info and LOG_FORMAT to text
+
+	:param w: where the logs are written
+*/
+func FromEnv(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if l := os.Getenv(env.LOG_LEVEL); l != "" {
+		if err := level.UnmarshalText([]byte(l)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL has to be debug, info, warn or error, not '%s'", l)
+		}
+	}
+	format := strings.ToLower(os.Getenv(env.LOG_FORMAT))
+	if format == "" {
+		format = TEXT
+	}
+	return New(w, level, format)
+}
+
+/*
+Add a logger to a context, so that whatever it is handed to logs with it
+
+	:param ctx: the context
+	:param logger: the logger, usually with the request ID attached
+*/
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+/*
+Get the logger of a request from its context, or the default logger if it doesnt have one
+
+	:param ctx: the context of the request
+*/
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+/*
+Middleware that gives every request an ID and a logger that logs it, then writes an access
+log of the request in JSON once it is handled. The ID comes from the X-Request-ID header when
+a proxy already set one, and is sent back in it either way
+
+	:param logger: the logger requests log with
+	:param access: where the access logs are written
+*/
+func Middleware(logger *slog.Logger, access io.Writer) gin.HandlerFunc {
+	accessLog := slog.New(slog.NewJSONHandler(access, nil))
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		id := ctx.GetHeader(REQUEST_ID_HEADER)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		ctx.Header(REQUEST_ID_HEADER, id)
+		ctx.Request = ctx.Request.WithContext(WithLogger(ctx.Request.Context(), logger.With("request_id", id)))
+		ctx.Next()
+		attrs := []any{
+			"request_id", id,
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"status", ctx.Writer.Status(),
+			"bytes", max(ctx.Writer.Size(), 0),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", ctx.ClientIP(),
+			"user_agent", ctx.Request.UserAgent(),
+		}
+		if len(ctx.Errors) > 0 {
+			attrs = append(attrs, "error", ctx.Errors.String())
+		}
+		accessLog.Info("request", attrs...)
+	}
+}
+
+/*
+Middleware that recovers from a panic in a handler, logging it with the stack and the request
+ID of the request that caused it and answering with a 500. Goes after Middleware so that the
+access log records the 500
+*/
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(ctx *gin.Context, err any) {
+		FromContext(ctx.Request.Context()).Error("handler panicked", "panic", err, "stack", string(debug.Stack()))
+		ctx.AbortWithStatus(500)
+	})
+}
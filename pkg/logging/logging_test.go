@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromEnv(t *testing.T) {
+	var out bytes.Buffer
+	t.Setenv(env.LOG_LEVEL, "")
+	t.Setenv(env.LOG_FORMAT, "")
+	logger, err := FromEnv(&out)
+	assert.NoError(t, err)
+	logger.Debug("hidden")
+	logger.Info("shown", "post", "abc")
+	assert.Contains(t, out.String(), "level=INFO msg=shown post=abc")
+	assert.NotContains(t, out.String(), "hidden")
+
+	out.Reset()
+	t.Setenv(env.LOG_LEVEL, "debug")
+	t.Setenv(env.LOG_FORMAT, "JSON")
+	logger, err = FromEnv(&out)
+	assert.NoError(t, err)
+	logger.Debug("shown", "post", "abc")
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "DEBUG", line["level"])
+	assert.Equal(t, "abc", line["post"])
+
+	t.Setenv(env.LOG_LEVEL, "loud")
+	_, err = FromEnv(&out)
+	assert.Error(t, err)
+	t.Setenv(env.LOG_LEVEL, "")
+	t.Setenv(env.LOG_FORMAT, "xml")
+	_, err = FromEnv(&out)
+	assert.Error(t, err)
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Equal(t, slog.Default(), FromContext(context.Background()))
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	assert.Equal(t, logger, FromContext(WithLogger(context.Background(), logger)))
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var logs, access bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	e := gin.New()
+	e.Use(Middleware(logger, &access))
+	e.GET("/writing/:id", func(ctx *gin.Context) {
+		FromContext(ctx.Request.Context()).Info("rendering")
+		ctx.String(http.StatusOK, "hello")
+	})
+
+	get := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/writing/abc", nil)
+		req.Header.Set("User-Agent", "test")
+		if requestID != "" {
+			req.Header.Set(REQUEST_ID_HEADER, requestID)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get("")
+	id := rec.Header().Get(REQUEST_ID_HEADER)
+	assert.Len(t, id, 36)
+
+	// the logs of the handler and the access log share the request ID
+	var line, entry map[string]any
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &line))
+	assert.Equal(t, id, line["request_id"])
+	assert.NoError(t, json.Unmarshal(access.Bytes(), &entry))
+	assert.Equal(t, id, entry["request_id"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/writing/abc", entry["path"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes"])
+	assert.Equal(t, "test", entry["user_agent"])
+
+	// an ID from a proxy is kept, unless it doesnt look like one
+	assert.Equal(t, "from-the-proxy.1", get("from-the-proxy.1").Header().Get(REQUEST_ID_HEADER))
+	assert.Len(t, get("not an id\n").Header().Get(REQUEST_ID_HEADER), 36)
+}
@@ -0,0 +1,331 @@
+package mdimport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// keeps track of what images were already uploaded so re-runs dont upload them twice
+const StateFile = ".keiji-import.json"
+
+// the url images in the image store are served from
+const imageRoute = "/api/v1/images/"
+
+var (
+	yamlFence = []byte("---")
+	tomlFence = []byte("+++")
+	// matches ![alt](link "optional title")
+	imageLink = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)((?:\s+"[^"]*")?)\)`)
+)
+
+var ErrUnterminatedFrontMatter = errors.New("front matter is missing its closing fence")
+
+/*
+The parts of the storage.DocumentIO interface the importer needs. Satisfied by both
+storage.SQLiteRepo and client.Client, so posts can be imported locally or over the api
+*/
+type Target interface {
+	GetDocumentBySlug(slug string) (storage.Document, error)
+	AddDocument(doc storage.Document) (storage.Identifier, error)
+	UpdateDocument(doc storage.Document) error
+	AddImage(data []byte, title, desc string) (storage.Identifier, error)
+}
+
+type FrontMatter struct {
+	ID       string   `yaml:"id,omitempty" toml:"id"`
+	Title    string   `yaml:"title" toml:"title"`
+	Category string   `yaml:"category" toml:"category"`
+	Created  any      `yaml:"created" toml:"created"`
+	Tags     []string `yaml:"tags,omitempty" toml:"tags"`
+	Slug     string   `yaml:"slug" toml:"slug"`
+}
+
+// What an import did, post lists hold the slugs
+type Report struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Images  int      `json:"images"`
+}
+
+// the contents of the StateFile
+type state struct {
+	Images map[string]storage.Identifier `json:"images"`
+}
+
+/*
+Split a Markdown file into its front matter and body. YAML front matter is fenced with
+'---' and TOML front matter with '+++', files without front matter return an empty FrontMatter
+
+	:param b: the contents of the Markdown file
+*/
+func ParseFile(b []byte) (FrontMatter, []byte, error) {
+	var fm FrontMatter
+	b = bytes.TrimPrefix(b, []byte("\ufeff"))
+	var fence []byte
+	switch {
+	case bytes.HasPrefix(b, yamlFence):
+		fence = yamlFence
+	case bytes.HasPrefix(b, tomlFence):
+		fence = tomlFence
+	default:
+		return fm, b, nil
+	}
+	rest := b[len(fence):]
+	nl := bytes.IndexByte(rest, '\n')
+	if nl == -1 || len(bytes.TrimSpace(rest[:nl])) != 0 {
+		return fm, b, nil
+	}
+	rest = rest[nl+1:]
+	var header, body []byte
+	for {
+		nl = bytes.IndexByte(rest, '\n')
+		line := rest
+		if nl != -1 {
+			line = rest[:nl]
+		}
+		if bytes.Equal(bytes.TrimSpace(line), fence) {
+			if nl != -1 {
+				body = rest[nl+1:]
+			}
+			break
+		}
+		if nl == -1 {
+			return fm, nil, ErrUnterminatedFrontMatter
+		}
+		header = append(header, rest[:nl+1]...)
+		rest = rest[nl+1:]
+	}
+	var err error
+	if bytes.Equal(fence, yamlFence) {
+		err = yaml.Unmarshal(header, &fm)
+	} else {
+		err = toml.Unmarshal(header, &fm)
+	}
+	return fm, body, err
+}
+
+/*
+Build a post out of a Markdown file, filling in anything the front matter leaves out.
+The slug and title default to the file name, the category to blog and the creation time to now
+
+	:param b: the contents of the Markdown file
+	:param name: the file name, without the extension
+*/
+func DocumentFromFile(b []byte, name string) (storage.Document, error) {
+	fm, body, err := ParseFile(b)
+	if err != nil {
+		return storage.Document{}, err
+	}
+	doc := storage.Document{
+		Ident:    storage.Identifier(fm.ID),
+		Title:    fm.Title,
+		Category: fm.Category,
+		Created:  createdString(fm.Created),
+		Body:     string(body),
+		Slug:     fm.Slug,
+		Tags:     strings.Join(fm.Tags, ","),
+	}
+	if doc.Slug == "" {
+		doc.Slug = name
+	}
+	if doc.Title == "" {
+		doc.Title = name
+	}
+	if doc.Category == "" {
+		doc.Category = storage.BLOG
+	}
+	if doc.Created == "" {
+		doc.Created = time.Now().UTC().String()
+	}
+	return doc, nil
+}
+
+/*
+Write a post out as a Markdown file with YAML front matter, the inverse of DocumentFromFile
+
+	:param doc: the post to write out
+*/
+func FormatFile(doc storage.Document) ([]byte, error) {
+	fm := FrontMatter{
+		ID:       string(doc.Ident),
+		Title:    doc.Title,
+		Category: doc.Category,
+		Created:  doc.Created,
+		Slug:     doc.Slug,
+	}
+	for _, tag := range strings.Split(doc.Tags, ",") {
+		if strings.TrimSpace(tag) != "" {
+			fm.Tags = append(fm.Tags, strings.TrimSpace(tag))
+		}
+	}
+	header, err := yaml.Marshal(fm)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write(yamlFence)
+	out.WriteByte('\n')
+	out.Write(header)
+	out.Write(yamlFence)
+	out.WriteByte('\n')
+	out.WriteString(doc.Body)
+	return out.Bytes(), nil
+}
+
+/*
+Import every Markdown file in a directory (and its subdirectories) as a post. Posts are
+matched to existing ones by slug, so re-running an import updates posts instead of duplicating them
+
+	:param dir: the directory to import
+	:param target: where to create the posts and upload the images to
+*/
+func ImportDir(dir string, target Target) (Report, error) {
+	report := Report{Created: []string{}, Updated: []string{}}
+	st := loadState(dir)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if ext != ".md" && ext != ".markdown" {
+			return nil
+		}
+		slug, created, err := importFile(p, target, &st, &report)
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", p, err)
+		}
+		if created {
+			report.Created = append(report.Created, slug)
+		} else {
+			report.Updated = append(report.Updated, slug)
+		}
+		return nil
+	})
+	if serr := saveState(dir, st); err == nil {
+		err = serr
+	}
+	return report, err
+}
+
+// import a single Markdown file, reporting the slug it was saved under and if it was a new post
+func importFile(p string, target Target, st *state, report *Report) (string, bool, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", false, err
+	}
+	doc, err := DocumentFromFile(b, strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)))
+	if err != nil {
+		return "", false, err
+	}
+	body, err := uploadImages(filepath.Dir(p), []byte(doc.Body), target, st, report)
+	if err != nil {
+		return "", false, err
+	}
+	doc.Body = string(body)
+
+	existing, err := target.GetDocumentBySlug(doc.Slug)
+	if errors.Is(err, storage.ErrNotExists) {
+		_, err = target.AddDocument(doc)
+		return doc.Slug, true, err
+	}
+	if err != nil {
+		return "", false, err
+	}
+	doc.Ident = existing.Ident
+	return doc.Slug, false, target.UpdateDocument(doc)
+}
+
+// upload every local image the body links to and point the links at the image store
+func uploadImages(dir string, body []byte, target Target, st *state, report *Report) ([]byte, error) {
+	var uploadErr error
+	out := imageLink.ReplaceAllFunc(body, func(match []byte) []byte {
+		groups := imageLink.FindSubmatch(match)
+		alt, link, title := string(groups[1]), string(groups[2]), string(groups[3])
+		if uploadErr != nil || !isLocal(link) {
+			return match
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(link)))
+		if err != nil {
+			uploadErr = err
+			return match
+		}
+		sum := sha256.Sum256(data)
+		key := hex.EncodeToString(sum[:])
+		id, ok := st.Images[key]
+		if !ok {
+			imgTitle := alt
+			if imgTitle == "" {
+				imgTitle = filepath.Base(link)
+			}
+			id, err = target.AddImage(data, imgTitle, "")
+			if err != nil {
+				uploadErr = err
+				return match
+			}
+			st.Images[key] = id
+			report.Images++
+		}
+		return []byte(fmt.Sprintf("![%s](%s%s%s)", alt, imageRoute, id, title))
+	})
+	return out, uploadErr
+}
+
+// report if a link points at a file next to the Markdown rather than somewhere on the web
+func isLocal(link string) bool {
+	return !strings.Contains(link, "://") && !strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "data:")
+}
+
+// front matter dates come back as different types depending on the format and quoting
+func createdString(created any) string {
+	switch v := created.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.UTC().String()
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func loadState(dir string) state {
+	st := state{Images: map[string]storage.Identifier{}}
+	b, err := os.ReadFile(filepath.Join(dir, StateFile))
+	if err != nil {
+		return st
+	}
+	json.Unmarshal(b, &st)
+	if st.Images == nil {
+		st.Images = map[string]storage.Identifier{}
+	}
+	return st
+}
+
+func saveState(dir string, st state) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, StateFile), b, 0o644)
+}
@@ -0,0 +1,150 @@
+package mdimport
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRepo(t *testing.T) *storage.SQLiteRepo {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	repo := storage.NewSQLiteRepo(db, storage.FilesystemImageIO{RootDir: t.TempDir()})
+	if err = repo.Migrate(storage.RequiredTables); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestParseFile(t *testing.T) {
+	type testcase struct {
+		desc     string
+		input    string
+		wantFm   FrontMatter
+		wantBody string
+		err      error
+	}
+	for _, tc := range []testcase{
+		{
+			desc:     "yaml front matter",
+			input:    "---\ntitle: abc 123\ncategory: creative\ncreated: 2024-12-31\ntags: [go, htmx]\nslug: abc-123\n---\n# body\n",
+			wantFm:   FrontMatter{Title: "abc 123", Category: "creative", Created: time.Date(2024, time.December, 31, 0, 0, 0, 0, time.UTC), Tags: []string{"go", "htmx"}, Slug: "abc-123"},
+			wantBody: "# body\n",
+		},
+		{
+			desc:     "toml front matter",
+			input:    "+++\ntitle = \"abc 123\"\ntags = [\"go\"]\n+++\nbody",
+			wantFm:   FrontMatter{Title: "abc 123", Tags: []string{"go"}},
+			wantBody: "body",
+		},
+		{
+			desc:     "no front matter",
+			input:    "just a body\n---\n",
+			wantBody: "just a body\n---\n",
+		},
+		{
+			desc:  "unterminated",
+			input: "---\ntitle: abc\n",
+			err:   ErrUnterminatedFrontMatter,
+		},
+	} {
+		fm, body, err := ParseFile([]byte(tc.input))
+		assert.Equal(t, tc.err, err, tc.desc)
+		if tc.err != nil {
+			continue
+		}
+		assert.Equal(t, tc.wantFm, fm, tc.desc)
+		assert.Equal(t, tc.wantBody, string(body), tc.desc)
+	}
+}
+
+func TestImportDir(t *testing.T) {
+	repo := newTestRepo(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "first-post.md"), []byte("---\ntitle: First\ntags: [a, b]\n---\nhello ![a cat](img/cat.png \"cat\")\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "second.markdown"), []byte("no front matter, ![remote](https://example.com/x.png)"), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not markdown"), 0o644)
+	os.MkdirAll(filepath.Join(dir, "img"), 0o755)
+	os.WriteFile(filepath.Join(dir, "img", "cat.png"), []byte("\x89PNG\r\n\x1a\n"), 0o644)
+
+	report, err := ImportDir(dir, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"first-post", "second"}, report.Created)
+	assert.Empty(t, report.Updated)
+	assert.Equal(t, 1, report.Images)
+
+	doc, err := repo.GetDocumentBySlug("first-post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "First", doc.Title)
+	assert.Equal(t, storage.BLOG, doc.Category)
+	assert.Equal(t, "a,b", doc.Tags)
+	imgs, err := repo.GetAllImages()
+	assert.NoError(t, err)
+	assert.Len(t, imgs, 1)
+	assert.True(t, strings.Contains(doc.Body, "![a cat](/api/v1/images/"+string(imgs[0].Ident)+` "cat")`), doc.Body)
+
+	// re-running should update in place and not upload the image again
+	os.WriteFile(filepath.Join(dir, "first-post.md"), []byte("---\ntitle: First, edited\n---\nhello ![a cat](img/cat.png)\n"), 0o644)
+	report, err = ImportDir(dir, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, report.Created)
+	assert.ElementsMatch(t, []string{"first-post", "second"}, report.Updated)
+	assert.Equal(t, 0, report.Images)
+	imgs, err = repo.GetAllImages()
+	assert.NoError(t, err)
+	assert.Len(t, imgs, 1)
+	docs, err := repo.AllDocuments()
+	assert.NoError(t, err)
+	assert.Len(t, docs, 2)
+	doc, _ = repo.GetDocumentBySlug("first-post")
+	assert.Equal(t, "First, edited", doc.Title)
+}
+
+func TestImportDirMissingImage(t *testing.T) {
+	repo := newTestRepo(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "post.md"), []byte("![gone](missing.png)"), 0o644)
+	_, err := ImportDir(dir, repo)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	docs, err := repo.AllDocuments()
+	assert.NoError(t, err)
+	assert.Empty(t, docs)
+}
+
+func TestFormatFileRoundTrip(t *testing.T) {
+	doc := storage.Document{
+		Ident:    storage.Identifier("abc-123"),
+		Title:    "a title: with a colon",
+		Category: storage.CREATIVE,
+		Created:  "2024-12-31 00:00:00 +0000 UTC",
+		Body:     "# heading\n\n---\nsome body\n",
+		Slug:     "a-title",
+		Tags:     "go, htmx",
+	}
+	b, err := FormatFile(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DocumentFromFile(b, "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.Tags = "go,htmx"
+	assert.Equal(t, doc, got)
+}
@@ -0,0 +1,381 @@
+package metrics
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the content type of the Prometheus text format
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// the buckets request and query durations are counted in, in seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/*
+The registry the server exports. Metrics are made with it where they are counted, making
+one that already exists returns the existing one so that every controller counts into it
+*/
+var Default = NewRegistry()
+
+// a metric in the registry
+type metric interface {
+	describe() (name, help, kind string)
+	write(w io.Writer)
+}
+
+/*
+A set of metrics, written out in the Prometheus text format
+*/
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+/*
+Add a metric, or get the one already registered under its name. Registering two kinds of
+metric under one name is a mistake in the code, so it panics
+
+	:param name: the name of the metric
+	:param m: the metric to add if there isnt one
+*/
+func (r *Registry) register(name string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.metrics[name]; ok {
+		_, _, kind := m.describe()
+		if _, _, existingKind := existing.describe(); existingKind != kind || fmt.Sprintf("%T", existing) != fmt.Sprintf("%T", m) {
+			panic("metrics: " + name + " is already registered as another kind of metric")
+		}
+		return existing
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Write out every metric in the Prometheus text format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, kind)
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+/*
+Serve the metrics to Prometheus
+
+	:param reg: the metrics to serve
+	:param token: the bearer token scrapes have to send, anyone can scrape them if empty
+*/
+func Handler(reg *Registry, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !bearer || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "the metrics need a bearer token", http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		reg.WriteTo(w)
+	})
+}
+
+// the name, help and label names shared by every kind of metric
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+/*
+A value that only goes up, i.e. how many requests there were, counted separately for each
+combination of its labels
+*/
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+/*
+Make a counter, or get the one with the name if it was already made. One without labels
+starts out at 0 rather than missing
+
+	:param name: the name of the metric, i.e. keiji_login_failures_total
+	:param help: what it counts
+	:param labels: the names of its labels, their values are given when it is counted
+*/
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, series: map[string]*counterSeries{}}
+	if len(labels) == 0 {
+		c.series[""] = &counterSeries{}
+	}
+	return r.register(name, c).(*Counter)
+}
+
+func (c *Counter) describe() (string, string, string) { return c.name, c.help, "counter" }
+
+/*
+Add to the counter
+
+	:param v: how much to add, counters never go down so it is ignored if negative
+	:param labels: the values of the counters labels, in the order they were named
+*/
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey(c.labels, labels)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labels: slices.Clone(labels)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// Add one to the counter
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+/*
+Counts values into buckets, i.e. how long requests took, so that Prometheus can work out
+their quantiles
+*/
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+/*
+Make a histogram, or get the one with the name if it was already made
+
+	:param name: the name of the metric, i.e. keiji_http_request_duration_seconds
+	:param help: what it measures
+	:param buckets: the upper bounds of its buckets, in increasing order
+	:param labels: the names of its labels, their values are given when a value is observed
+*/
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return r.register(name, &Histogram{desc: desc{name, help, labels}, buckets: buckets, series: map[string]*histogramSeries{}}).(*Histogram)
+}
+
+func (h *Histogram) describe() (string, string, string) { return h.name, h.help, "histogram" }
+
+/*
+Count a value into the histogram
+
+	:param v: the value, i.e. a duration in seconds
+	:param labels: the values of the histograms labels, in the order they were named
+*/
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(h.labels, labels)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: slices.Clone(labels), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := append(slices.Clone(h.labels), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %v\n", h.name, formatLabels(names, append(slices.Clone(s.labels), formatFloat(bound))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %v\n", h.name, formatLabels(names, append(slices.Clone(s.labels), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %v\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+/*
+A metric whose value is read when the metrics are scraped, for values something else
+already keeps, i.e. the size of a cache
+*/
+type valueFunc struct {
+	desc
+	kind  string
+	mu    sync.Mutex
+	value func() float64
+}
+
+func (f *valueFunc) describe() (string, string, string) { return f.name, f.help, f.kind }
+
+func (f *valueFunc) write(w io.Writer) {
+	f.mu.Lock()
+	value := f.value
+	f.mu.Unlock()
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(value()))
+}
+
+// register a valueFunc, replacing the function of one that is already registered
+func (r *Registry) registerFunc(kind, name, help string, value func() float64) {
+	f := r.register(name, &valueFunc{desc: desc{name: name, help: help}, kind: kind, value: value}).(*valueFunc)
+	f.mu.Lock()
+	f.value = value
+	f.mu.Unlock()
+}
+
+/*
+Export a value that goes up and down, read when the metrics are scraped. Making one with
+a name that was already used replaces the function it reads
+
+	:param name: the name of the metric, i.e. keiji_auth_sessions
+	:param help: what it measures
+	:param value: reads the value
+*/
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.registerFunc("gauge", name, help, value)
+}
+
+/*
+Export a count something else keeps, read when the metrics are scraped. Making one with
+a name that was already used replaces the function it reads
+
+	:param name: the name of the metric, i.e. keiji_render_cache_hits_total
+	:param help: what it counts
+	:param value: reads the count
+*/
+func (r *Registry) NewCounterFunc(name, help string, value func() float64) {
+	r.registerFunc("counter", name, help, value)
+}
+
+// the key of the series of a set of label values, panicking if there are too many or too few
+func seriesKey(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metrics: expected %v label values, got %v", len(names), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write labels as {name="value",...}, or nothing if there arent any
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counts what is written, keeping the first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/gin-gonic/gin"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func exposition(t *testing.T, reg *Registry) string {
+	var out bytes.Buffer
+	_, err := reg.WriteTo(&out)
+	assert.NoError(t, err)
+	return out.String()
+}
+
+func TestWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	logins := reg.NewCounter("logins_total", "Logins.", "result")
+	logins.Inc("failed")
+	logins.Add(2, "failed")
+	logins.Add(-1, "failed")
+	logins.Inc(`a "quoted"` + "\nvalue")
+	assert.Equal(t, logins, reg.NewCounter("logins_total", "Logins.", "result"))
+	reg.NewGaugeFunc("sessions", "Sessions.", func() float64 { return 1 })
+	reg.NewGaugeFunc("sessions", "Sessions.", func() float64 { return 3 })
+	took := reg.NewHistogram("took_seconds", "How long.", []float64{0.1, 1}, "method")
+	took.Observe(0.05, "GET")
+	took.Observe(0.5, "GET")
+	took.Observe(5, "GET")
+
+	assert.Equal(t, `# HELP logins_total Logins.
+# TYPE logins_total counter
+logins_total{result="a \"quoted\"\nvalue"} 1
+logins_total{result="failed"} 3
+# HELP sessions Sessions.
+# TYPE sessions gauge
+sessions 3
+# HELP took_seconds How long.
+# TYPE took_seconds histogram
+took_seconds_bucket{method="GET",le="0.1"} 1
+took_seconds_bucket{method="GET",le="1"} 2
+took_seconds_bucket{method="GET",le="+Inf"} 3
+took_seconds_sum{method="GET"} 5.55
+took_seconds_count{method="GET"} 3
+`, exposition(t, reg))
+
+	assert.Panics(t, func() { logins.Inc() })
+	assert.Panics(t, func() { reg.NewHistogram("logins_total", "Logins.", DefaultBuckets) })
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("logins_total", "Logins.").Inc()
+	scrape := func(handler http.Handler, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := scrape(Handler(reg, ""), "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, CONTENT_TYPE, rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "logins_total 1\n")
+
+	secured := Handler(reg, "s3cret")
+	assert.Equal(t, http.StatusUnauthorized, scrape(secured, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, scrape(secured, "Bearer wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, scrape(secured, "s3cret").Code)
+	assert.Equal(t, http.StatusOK, scrape(secured, "Bearer s3cret").Code)
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	reg := NewRegistry()
+	e := gin.New()
+	e.Use(Middleware(reg))
+	e.GET("/writing/:id", func(ctx *gin.Context) { ctx.String(http.StatusOK, "hello") })
+	for _, path := range []string{"/writing/a", "/writing/b", "/nope"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	out := exposition(t, reg)
+	// every post is counted under the route, not its own path
+	assert.Contains(t, out, `keiji_http_requests_total{method="GET",route="/writing/:id",status="200"} 2`)
+	assert.Contains(t, out, `keiji_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, out, `keiji_http_request_duration_seconds_count{method="GET",route="/writing/:id"} 2`)
+	assert.NotContains(t, out, "/writing/a")
+}
+
+func TestInstrumentStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	repo := storage.NewSQLiteRepo(db, storage.FilesystemImageIO{RootDir: t.TempDir()})
+	if err := repo.Migrate(storage.RequiredTables); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.MigrateColumns(storage.RequiredColumns); err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry()
+	store := InstrumentStore(reg, repo)
+
+	id, err := store.AddDocument(storage.Document{Title: "hello", Category: storage.BLOG})
+	assert.NoError(t, err)
+	doc, err := store.GetDocument(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", doc.Title)
+	// a post that doesnt exist is timed but isnt an error of the store
+	_, err = store.GetDocument("nope")
+	assert.ErrorIs(t, err, storage.ErrNotExists)
+	db.Close()
+	_, err = store.GetDocument(id)
+	assert.Error(t, err)
+
+	out := exposition(t, reg)
+	assert.Contains(t, out, `keiji_storage_query_duration_seconds_count{method="AddDocument"} 1`)
+	assert.Contains(t, out, `keiji_storage_query_duration_seconds_count{method="GetDocument"} 3`)
+	assert.Contains(t, out, `keiji_storage_errors_total{method="GetDocument"} 1`)
+	assert.NotContains(t, out, `keiji_storage_errors_total{method="AddDocument"}`)
+}
+
+func TestInstrumentImages(t *testing.T) {
+	reg := NewRegistry()
+	images := InstrumentImages(reg, storage.FilesystemImageIO{RootDir: t.TempDir()})
+	assert.NoError(t, images.Put([]byte("12345"), "a"))
+	b, err := images.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("12345"), b)
+	_, err = images.Get("missing")
+	assert.Error(t, err)
+	assert.NoError(t, images.Delete("a"))
+
+	out := exposition(t, reg)
+	assert.Contains(t, out, "keiji_image_store_read_bytes_total 5\n")
+	assert.Contains(t, out, "keiji_image_store_written_bytes_total 5\n")
+}
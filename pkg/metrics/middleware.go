@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Middleware that counts requests and times them by the route that handled them, i.e.
+/writing/:id rather than every post, so that the number of series stays small. Requests
+that no route matched are counted as 'unmatched'
+
+	:param reg: the registry the metrics are kept in
+*/
+func Middleware(reg *Registry) gin.HandlerFunc {
+	requests := reg.NewCounter("keiji_http_requests_total", "HTTP requests, by method, route and status.", "method", "route", "status")
+	duration := reg.NewHistogram("keiji_http_request_duration_seconds", "How long HTTP requests took to handle, by method and route.", DefaultBuckets, "method", "route")
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		duration.Observe(time.Since(start).Seconds(), ctx.Request.Method, route)
+		requests.Inc(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status()))
+	}
+}
@@ -0,0 +1,505 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+var _ storage.SiteIO = (*Store)(nil)
+
+/*
+A DocumentIO that times every query it passes on to the one it wraps, and counts the
+ones that failed. Posts and images that dont exist arent counted as failures
+*/
+type Store struct {
+	store    storage.SiteIO
+	duration *Histogram
+	errors   *Counter
+}
+
+/*
+Wrap a DocumentIO so that its queries are timed
+
+	:param reg: the registry the metrics are kept in
+	:param store: the DocumentIO to time
+*/
+func InstrumentStore(reg *Registry, store storage.SiteIO) *Store {
+	return &Store{
+		store:    store,
+		duration: reg.NewHistogram("keiji_storage_query_duration_seconds", "How long storage queries took, by DocumentIO method.", DefaultBuckets, "method"),
+		errors:   reg.NewCounter("keiji_storage_errors_total", "Storage queries that failed, by DocumentIO method.", "method"),
+	}
+}
+
+// record how long a query took and whether it failed, deferred by every method
+func (s *Store) observe(method string, start time.Time, err *error) {
+	s.duration.Observe(time.Since(start).Seconds(), method)
+	if err != nil && *err != nil && !errors.Is(*err, storage.ErrNotExists) {
+		s.errors.Inc(method)
+	}
+}
+
+func (s *Store) GetDocument(id storage.Identifier) (_ storage.Document, err error) {
+	defer s.observe("GetDocument", time.Now(), &err)
+	return s.store.GetDocument(id)
+}
+
+func (s *Store) GetDocumentBySlug(slug string) (_ storage.Document, err error) {
+	defer s.observe("GetDocumentBySlug", time.Now(), &err)
+	return s.store.GetDocumentBySlug(slug)
+}
+
+func (s *Store) GetImage(id storage.Identifier) (_ storage.Image, err error) {
+	defer s.observe("GetImage", time.Now(), &err)
+	return s.store.GetImage(id)
+}
+
+func (s *Store) GetImageInfo(id storage.Identifier) (_ storage.Image, err error) {
+	defer s.observe("GetImageInfo", time.Now(), &err)
+	return s.store.GetImageInfo(id)
+}
+
+func (s *Store) ListImages() (_ []storage.Image, err error) {
+	defer s.observe("ListImages", time.Now(), &err)
+	return s.store.ListImages()
+}
+
+func (s *Store) GetAllImages() (_ []storage.Image, err error) {
+	defer s.observe("GetAllImages", time.Now(), &err)
+	return s.store.GetAllImages()
+}
+
+func (s *Store) UpdateDocument(doc storage.Document) (err error) {
+	defer s.observe("UpdateDocument", time.Now(), &err)
+	return s.store.UpdateDocument(doc)
+}
+
+func (s *Store) DeleteDocument(id storage.Identifier) (err error) {
+	defer s.observe("DeleteDocument", time.Now(), &err)
+	return s.store.DeleteDocument(id)
+}
+
+func (s *Store) AddDocument(doc storage.Document) (_ storage.Identifier, err error) {
+	defer s.observe("AddDocument", time.Now(), &err)
+	return s.store.AddDocument(doc)
+}
+
+func (s *Store) AddImage(data []byte, title string, desc string) (_ storage.Identifier, err error) {
+	defer s.observe("AddImage", time.Now(), &err)
+	return s.store.AddImage(data, title, desc)
+}
+
+func (s *Store) UpdateImage(img storage.Image) (err error) {
+	defer s.observe("UpdateImage", time.Now(), &err)
+	return s.store.UpdateImage(img)
+}
+
+func (s *Store) DeleteImage(id storage.Identifier) (err error) {
+	defer s.observe("DeleteImage", time.Now(), &err)
+	return s.store.DeleteImage(id)
+}
+
+func (s *Store) GetRenderedHTML(id storage.Identifier) (_ string, _ string, err error) {
+	defer s.observe("GetRenderedHTML", time.Now(), &err)
+	return s.store.GetRenderedHTML(id)
+}
+
+func (s *Store) SetRenderedHTML(id storage.Identifier, key string, html string) (err error) {
+	defer s.observe("SetRenderedHTML", time.Now(), &err)
+	return s.store.SetRenderedHTML(id, key, html)
+}
+
+func (s *Store) GetDraft(post storage.Identifier) (_ storage.Draft, err error) {
+	defer s.observe("GetDraft", time.Now(), &err)
+	return s.store.GetDraft(post)
+}
+
+func (s *Store) SaveDraft(draft storage.Draft) (err error) {
+	defer s.observe("SaveDraft", time.Now(), &err)
+	return s.store.SaveDraft(draft)
+}
+
+func (s *Store) DeleteDraft(post storage.Identifier) (err error) {
+	defer s.observe("DeleteDraft", time.Now(), &err)
+	return s.store.DeleteDraft(post)
+}
+
+func (s *Store) AddComment(comment storage.Comment) (_ storage.Identifier, err error) {
+	defer s.observe("AddComment", time.Now(), &err)
+	return s.store.AddComment(comment)
+}
+
+func (s *Store) GetComment(id storage.Identifier) (_ storage.Comment, err error) {
+	defer s.observe("GetComment", time.Now(), &err)
+	return s.store.GetComment(id)
+}
+
+func (s *Store) GetComments(post storage.Identifier, status storage.CommentStatus) (_ []storage.Comment, err error) {
+	defer s.observe("GetComments", time.Now(), &err)
+	return s.store.GetComments(post, status)
+}
+
+func (s *Store) GetCommentQueue(status storage.CommentStatus) (_ []storage.Comment, err error) {
+	defer s.observe("GetCommentQueue", time.Now(), &err)
+	return s.store.GetCommentQueue(status)
+}
+
+func (s *Store) SetCommentStatus(id storage.Identifier, status storage.CommentStatus) (err error) {
+	defer s.observe("SetCommentStatus", time.Now(), &err)
+	return s.store.SetCommentStatus(id, status)
+}
+
+func (s *Store) SetCommentsClosed(post storage.Identifier, closed bool) (err error) {
+	defer s.observe("SetCommentsClosed", time.Now(), &err)
+	return s.store.SetCommentsClosed(post, closed)
+}
+
+func (s *Store) SaveMention(mention storage.Mention) (err error) {
+	defer s.observe("SaveMention", time.Now(), &err)
+	return s.store.SaveMention(mention)
+}
+
+func (s *Store) DeleteMention(source string, target string) (err error) {
+	defer s.observe("DeleteMention", time.Now(), &err)
+	return s.store.DeleteMention(source, target)
+}
+
+func (s *Store) GetMentions(post storage.Identifier, status storage.CommentStatus) (_ []storage.Mention, err error) {
+	defer s.observe("GetMentions", time.Now(), &err)
+	return s.store.GetMentions(post, status)
+}
+
+func (s *Store) GetMentionQueue(status storage.CommentStatus) (_ []storage.Mention, err error) {
+	defer s.observe("GetMentionQueue", time.Now(), &err)
+	return s.store.GetMentionQueue(status)
+}
+
+func (s *Store) SetMentionStatus(id storage.Identifier, status storage.CommentStatus) (err error) {
+	defer s.observe("SetMentionStatus", time.Now(), &err)
+	return s.store.SetMentionStatus(id, status)
+}
+
+func (s *Store) AddFollower(follower storage.Follower) (err error) {
+	defer s.observe("AddFollower", time.Now(), &err)
+	return s.store.AddFollower(follower)
+}
+
+func (s *Store) RemoveFollower(actor string) (err error) {
+	defer s.observe("RemoveFollower", time.Now(), &err)
+	return s.store.RemoveFollower(actor)
+}
+
+func (s *Store) GetFollowers() (_ []storage.Follower, err error) {
+	defer s.observe("GetFollowers", time.Now(), &err)
+	return s.store.GetFollowers()
+}
+
+func (s *Store) AddActivity(activity storage.Activity) (err error) {
+	defer s.observe("AddActivity", time.Now(), &err)
+	return s.store.AddActivity(activity)
+}
+
+func (s *Store) GetActivity(id storage.Identifier) (_ storage.Activity, err error) {
+	defer s.observe("GetActivity", time.Now(), &err)
+	return s.store.GetActivity(id)
+}
+
+func (s *Store) GetActivities(limit int, offset int) (_ []storage.Activity, _ int, err error) {
+	defer s.observe("GetActivities", time.Now(), &err)
+	return s.store.GetActivities(limit, offset)
+}
+
+func (s *Store) GetSigningKey(name string) (_ string, err error) {
+	defer s.observe("GetSigningKey", time.Now(), &err)
+	return s.store.GetSigningKey(name)
+}
+
+func (s *Store) SaveSigningKey(name string, pem string) (err error) {
+	defer s.observe("SaveSigningKey", time.Now(), &err)
+	return s.store.SaveSigningKey(name, pem)
+}
+
+func (s *Store) AddSubscriber(email string) (_ storage.Subscriber, err error) {
+	defer s.observe("AddSubscriber", time.Now(), &err)
+	return s.store.AddSubscriber(email)
+}
+
+func (s *Store) MarkConfirmationSent(email string, now time.Time, cooldown time.Duration) (_ bool, err error) {
+	defer s.observe("MarkConfirmationSent", time.Now(), &err)
+	return s.store.MarkConfirmationSent(email, now, cooldown)
+}
+
+func (s *Store) ConfirmSubscriber(token string) (err error) {
+	defer s.observe("ConfirmSubscriber", time.Now(), &err)
+	return s.store.ConfirmSubscriber(token)
+}
+
+func (s *Store) RemoveSubscriber(token string) (err error) {
+	defer s.observe("RemoveSubscriber", time.Now(), &err)
+	return s.store.RemoveSubscriber(token)
+}
+
+func (s *Store) GetSubscribers(confirmed bool) (_ []storage.Subscriber, err error) {
+	defer s.observe("GetSubscribers", time.Now(), &err)
+	return s.store.GetSubscribers(confirmed)
+}
+
+func (s *Store) QueueEmail(email storage.Email) (_ storage.Identifier, err error) {
+	defer s.observe("QueueEmail", time.Now(), &err)
+	return s.store.QueueEmail(email)
+}
+
+func (s *Store) GetDueEmails(now time.Time, limit int) (_ []storage.Email, err error) {
+	defer s.observe("GetDueEmails", time.Now(), &err)
+	return s.store.GetDueEmails(now, limit)
+}
+
+func (s *Store) UpdateEmail(email storage.Email) (err error) {
+	defer s.observe("UpdateEmail", time.Now(), &err)
+	return s.store.UpdateEmail(email)
+}
+
+func (s *Store) AddWebhook(hook storage.Webhook) (_ storage.Identifier, err error) {
+	defer s.observe("AddWebhook", time.Now(), &err)
+	return s.store.AddWebhook(hook)
+}
+
+func (s *Store) GetWebhook(id storage.Identifier) (_ storage.Webhook, err error) {
+	defer s.observe("GetWebhook", time.Now(), &err)
+	return s.store.GetWebhook(id)
+}
+
+func (s *Store) GetWebhooks() (_ []storage.Webhook, err error) {
+	defer s.observe("GetWebhooks", time.Now(), &err)
+	return s.store.GetWebhooks()
+}
+
+func (s *Store) DeleteWebhook(id storage.Identifier) (err error) {
+	defer s.observe("DeleteWebhook", time.Now(), &err)
+	return s.store.DeleteWebhook(id)
+}
+
+func (s *Store) QueueDelivery(delivery storage.Delivery) (_ storage.Identifier, err error) {
+	defer s.observe("QueueDelivery", time.Now(), &err)
+	return s.store.QueueDelivery(delivery)
+}
+
+func (s *Store) GetDueDeliveries(now time.Time, limit int) (_ []storage.Delivery, err error) {
+	defer s.observe("GetDueDeliveries", time.Now(), &err)
+	return s.store.GetDueDeliveries(now, limit)
+}
+
+func (s *Store) UpdateDelivery(delivery storage.Delivery) (err error) {
+	defer s.observe("UpdateDelivery", time.Now(), &err)
+	return s.store.UpdateDelivery(delivery)
+}
+
+func (s *Store) GetDeliveries(limit int) (_ []storage.Delivery, err error) {
+	defer s.observe("GetDeliveries", time.Now(), &err)
+	return s.store.GetDeliveries(limit)
+}
+
+func (s *Store) AddPageViews(views []storage.PageView) (err error) {
+	defer s.observe("AddPageViews", time.Now(), &err)
+	return s.store.AddPageViews(views)
+}
+
+func (s *Store) GetDailyViews(from string, to string) (_ []storage.ViewCount, err error) {
+	defer s.observe("GetDailyViews", time.Now(), &err)
+	return s.store.GetDailyViews(from, to)
+}
+
+func (s *Store) GetTopPages(from string, to string, limit int) (_ []storage.ViewCount, err error) {
+	defer s.observe("GetTopPages", time.Now(), &err)
+	return s.store.GetTopPages(from, to, limit)
+}
+
+func (s *Store) GetTopReferrers(from string, to string, limit int) (_ []storage.ViewCount, err error) {
+	defer s.observe("GetTopReferrers", time.Now(), &err)
+	return s.store.GetTopReferrers(from, to, limit)
+}
+
+func (s *Store) GetTopAgents(from string, to string, limit int) (_ []storage.ViewCount, err error) {
+	defer s.observe("GetTopAgents", time.Now(), &err)
+	return s.store.GetTopAgents(from, to, limit)
+}
+
+func (s *Store) GetImageReferences(id storage.Identifier) (_ []storage.ImageReference, err error) {
+	defer s.observe("GetImageReferences", time.Now(), &err)
+	return s.store.GetImageReferences(id)
+}
+
+func (s *Store) GetBrokenImageReferences() (_ []storage.ImageReference, err error) {
+	defer s.observe("GetBrokenImageReferences", time.Now(), &err)
+	return s.store.GetBrokenImageReferences()
+}
+
+func (s *Store) GetAlbums() (_ []storage.Album, err error) {
+	defer s.observe("GetAlbums", time.Now(), &err)
+	return s.store.GetAlbums()
+}
+
+func (s *Store) GetAlbum(id storage.Identifier) (_ storage.Album, err error) {
+	defer s.observe("GetAlbum", time.Now(), &err)
+	return s.store.GetAlbum(id)
+}
+
+func (s *Store) GetAlbumBySlug(slug string) (_ storage.Album, err error) {
+	defer s.observe("GetAlbumBySlug", time.Now(), &err)
+	return s.store.GetAlbumBySlug(slug)
+}
+
+func (s *Store) GetAlbumImages(id storage.Identifier) (_ []storage.Image, err error) {
+	defer s.observe("GetAlbumImages", time.Now(), &err)
+	return s.store.GetAlbumImages(id)
+}
+
+func (s *Store) AddAlbum(album storage.Album) (_ storage.Identifier, err error) {
+	defer s.observe("AddAlbum", time.Now(), &err)
+	return s.store.AddAlbum(album)
+}
+
+func (s *Store) UpdateAlbum(album storage.Album) (err error) {
+	defer s.observe("UpdateAlbum", time.Now(), &err)
+	return s.store.UpdateAlbum(album)
+}
+
+func (s *Store) DeleteAlbum(id storage.Identifier) (err error) {
+	defer s.observe("DeleteAlbum", time.Now(), &err)
+	return s.store.DeleteAlbum(id)
+}
+
+func (s *Store) SetAlbumImages(id storage.Identifier, images []storage.Identifier) (err error) {
+	defer s.observe("SetAlbumImages", time.Now(), &err)
+	return s.store.SetAlbumImages(id, images)
+}
+
+func (s *Store) ReorderAlbums(ids []storage.Identifier) (err error) {
+	defer s.observe("ReorderAlbums", time.Now(), &err)
+	return s.store.ReorderAlbums(ids)
+}
+
+func (s *Store) AddAsset(name string, data []byte) (err error) {
+	defer s.observe("AddAsset", time.Now(), &err)
+	return s.store.AddAsset(name, data)
+}
+
+func (s *Store) AddAdminTableEntry(table storage.TableData, category string) (err error) {
+	defer s.observe("AddAdminTableEntry", time.Now(), &err)
+	return s.store.AddAdminTableEntry(table, category)
+}
+
+func (s *Store) AddNavbarItem(item storage.NavBarItem) (err error) {
+	defer s.observe("AddNavbarItem", time.Now(), &err)
+	return s.store.AddNavbarItem(item)
+}
+
+func (s *Store) AddMenuItem(link storage.LinkPair) (err error) {
+	defer s.observe("AddMenuItem", time.Now(), &err)
+	return s.store.AddMenuItem(link)
+}
+
+func (s *Store) GetByCategory(category string) (_ []storage.Document, err error) {
+	defer s.observe("GetByCategory", time.Now(), &err)
+	return s.store.GetByCategory(category)
+}
+
+func (s *Store) AllDocuments() (_ []storage.Document, err error) {
+	defer s.observe("AllDocuments", time.Now(), &err)
+	return s.store.AllDocuments()
+}
+
+func (s *Store) GetDropdownElements() (_ []storage.LinkPair, err error) {
+	defer s.observe("GetDropdownElements", time.Now(), &err)
+	return s.store.GetDropdownElements()
+}
+
+func (s *Store) GetNavBarLinks() (_ []storage.NavBarItem, err error) {
+	defer s.observe("GetNavBarLinks", time.Now(), &err)
+	return s.store.GetNavBarLinks()
+}
+
+func (s *Store) GetAssets() (_ []storage.Asset, err error) {
+	defer s.observe("GetAssets", time.Now(), &err)
+	return s.store.GetAssets()
+}
+
+func (s *Store) GetAdminTables() (_ storage.AdminPage, err error) {
+	defer s.observe("GetAdminTables", time.Now(), &err)
+	return s.store.GetAdminTables()
+}
+
+func (s *Store) ExtractAll() (_ storage.DatabaseSchema, err error) {
+	defer s.observe("ExtractAll", time.Now(), &err)
+	return s.store.ExtractAll()
+}
+
+func (s *Store) ImportArchive(r io.Reader, mode storage.ImportMode) (_ storage.ImportSummary, err error) {
+	defer s.observe("ImportArchive", time.Now(), &err)
+	return s.store.ImportArchive(r, mode)
+}
+
+/*
+An ImageIO that counts the bytes read from and written to the image store it wraps
+*/
+type ImageStore struct {
+	store   storage.ImageIO
+	read    *Counter
+	written *Counter
+}
+
+/*
+Wrap an ImageIO so that what it reads and writes is counted
+
+	:param reg: the registry the metrics are kept in
+	:param store: the image store to count
+*/
+func InstrumentImages(reg *Registry, store storage.ImageIO) *ImageStore {
+	return &ImageStore{
+		store:   store,
+		read:    reg.NewCounter("keiji_image_store_read_bytes_total", "Bytes read from the image store."),
+		written: reg.NewCounter("keiji_image_store_written_bytes_total", "Bytes written to the image store."),
+	}
+}
+
+func (i *ImageStore) Put(b []byte, id storage.Identifier) error {
+	err := i.store.Put(b, id)
+	if err == nil {
+		i.written.Add(float64(len(b)))
+	}
+	return err
+}
+
+func (i *ImageStore) Get(id storage.Identifier) ([]byte, error) {
+	b, err := i.store.Get(id)
+	i.read.Add(float64(len(b)))
+	return b, err
+}
+
+func (i *ImageStore) Delete(id storage.Identifier) error {
+	return i.store.Delete(id)
+}
+
+func (i *ImageStore) Stage(r io.Reader, id storage.Identifier) (storage.StagedImage, error) {
+	cr := &countingReader{r: r}
+	staged, err := i.store.Stage(cr, id)
+	if err == nil {
+		i.written.Add(float64(cr.n))
+	}
+	return staged, err
+}
+
+// counts what is read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
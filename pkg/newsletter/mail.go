@@ -0,0 +1,167 @@
+package newsletter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+)
+
+// the submission port, used when SMTP_PORT isnt set
+const defaultPort = 587
+
+// how long a conversation with the SMTP server gets before it is given up on
+const smtpTimeout = 30 * time.Second
+
+// How to reach the SMTP server emails are sent through
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+/*
+Get the SMTP configuration from SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and
+SMTP_FROM. Host is empty when SMTP_HOST isnt set, which turns subscriptions off
+
+	:param domain: the domain name of the site, emails come from noreply@ it when SMTP_FROM isnt set
+*/
+func GetConfig(domain string) (Config, error) {
+	cfg := Config{
+		Host:     os.Getenv(env.SMTP_HOST),
+		Port:     defaultPort,
+		Username: os.Getenv(env.SMTP_USERNAME),
+		Password: os.Getenv(env.SMTP_PASSWORD),
+		From:     os.Getenv(env.SMTP_FROM),
+	}
+	if port := os.Getenv(env.SMTP_PORT); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return cfg, fmt.Errorf("%s is not a port: %q", env.SMTP_PORT, port)
+		}
+		cfg.Port = p
+	}
+	if cfg.From == "" {
+		cfg.From = "noreply@" + domain
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return cfg, fmt.Errorf("%s is not an email address: %q", env.SMTP_FROM, cfg.From)
+	}
+	return cfg, nil
+}
+
+// Something that delivers a composed email, SMTP does over the network
+type Mailer interface {
+	Send(from, to string, msg []byte) error
+}
+
+/*
+Sends email through an SMTP server, upgrading to TLS when the server offers it and
+logging in when there is a username. Errors the server answers with are *textproto.Error,
+so a rejected recipient can be told apart from the server being down
+*/
+type SMTP struct {
+	Config
+}
+
+/*
+Send an email
+
+	:param from: the envelope sender
+	:param to: the envelope recipient
+	:param msg: the email with its headers, as Message.Bytes composes it
+*/
+func (s SMTP) Send(from, to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// An email ready to be composed, the body is html
+type Message struct {
+	ID          string
+	From        string
+	To          string
+	Subject     string
+	Date        time.Time
+	HTML        string
+	Unsubscribe string
+}
+
+/*
+Compose the email, quoted-printable so long lines and non-ASCII text survive any server.
+When there is an unsubscribe link it goes in the List-Unsubscribe headers too, so mail
+clients can offer a one click unsubscribe button
+*/
+func (m Message) Bytes() []byte {
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", m.From},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", m.Date.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + m.ID + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `text/html; charset="utf-8"`},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	if m.Unsubscribe != "" {
+		headers = append(headers,
+			[2]string{"List-Unsubscribe", "<" + m.Unsubscribe + ">"},
+			[2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(m.HTML))
+	qp.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,259 @@
+package newsletter
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+var ErrInvalidAddress = errors.New("that email address isnt valid")
+
+//go:embed templates
+var templateFS embed.FS
+
+var templates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+const (
+	// how many times an email is tried before it is given up on
+	DefaultMaxAttempts = 5
+	// how long to wait after the first failed attempt, it doubles after every one after that
+	DefaultBackoff = time.Minute
+	// how long after a confirmation email another can be sent to the same address
+	DefaultResendAfter = time.Hour
+	// how many due emails are sent each time the queue is processed
+	batchSize = 50
+)
+
+// Where subscribers and the outbox queue are kept, storage.NewsletterIO satisfies it
+type Store interface {
+	AddSubscriber(email string) (storage.Subscriber, error)
+	ConfirmSubscriber(token string) error
+	MarkConfirmationSent(email string, now time.Time, cooldown time.Duration) (bool, error)
+	RemoveSubscriber(token string) error
+	GetSubscribers(confirmed bool) ([]storage.Subscriber, error)
+	QueueEmail(email storage.Email) (storage.Identifier, error)
+	GetDueEmails(now time.Time, limit int) ([]storage.Email, error)
+	UpdateEmail(email storage.Email) error
+}
+
+/*
+Emails new posts to the readers that subscribed to them. Nothing is sent right away,
+emails are rendered into the outbox queue and Run sends them in the background, retrying
+the ones that fail with a backoff
+*/
+type Newsletter struct {
+	SiteURL     string
+	From        string
+	Mailer      Mailer
+	MaxAttempts int
+	Backoff     time.Duration
+	ResendAfter time.Duration
+	store       Store
+	now         func() time.Time
+}
+
+/*
+Create a newsletter that sends through the configured SMTP server
+
+	:param siteURL: the public url of the site, for the links in the emails
+	:param cfg: the SMTP configuration from GetConfig
+	:param store: where the subscribers and the queue are kept
+*/
+func New(siteURL string, cfg Config, store Store) *Newsletter {
+	return &Newsletter{
+		SiteURL:     strings.TrimSuffix(siteURL, "/"),
+		From:        cfg.From,
+		Mailer:      SMTP{Config: cfg},
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		ResendAfter: DefaultResendAfter,
+		store:       store,
+		now:         time.Now,
+	}
+}
+
+// the link that confirms a subscription
+func (n *Newsletter) confirmURL(token string) string {
+	return n.SiteURL + "/subscribe/confirm?token=" + url.QueryEscape(token)
+}
+
+// the link that unsubscribes a subscriber
+func (n *Newsletter) unsubscribeURL(token string) string {
+	return n.SiteURL + "/unsubscribe?token=" + url.QueryEscape(token)
+}
+
+/*
+Subscribe an address, queueing the email that asks them to confirm it. An address that
+already confirmed isnt sent anything, so subscribing somebody else cant tell whether
+they already are, and one that hasnt is only sent another once ResendAfter has passed
+
+	:param address: the address the reader gave
+*/
+func (n *Newsletter) Subscribe(address string) error {
+	addr, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return ErrInvalidAddress
+	}
+	sub, err := n.store.AddSubscriber(strings.ToLower(addr.Address))
+	if err != nil {
+		return err
+	}
+	if sub.Confirmed {
+		return nil
+	}
+	send, err := n.store.MarkConfirmationSent(sub.Email, n.now(), n.ResendAfter)
+	if err != nil || !send {
+		return err
+	}
+	var body bytes.Buffer
+	err = templates.ExecuteTemplate(&body, "confirm", map[string]string{"Site": n.SiteURL, "Confirm": n.confirmURL(sub.Token)})
+	if err != nil {
+		return err
+	}
+	_, err = n.store.QueueEmail(storage.Email{Recipient: sub.Email, Subject: "Confirm your subscription to " + n.SiteURL, Body: body.String()})
+	return err
+}
+
+/*
+Confirm a subscription, returning storage.ErrNotExists for a token nobody has
+
+	:param token: the token from the confirmation link
+*/
+func (n *Newsletter) Confirm(token string) error {
+	return n.store.ConfirmSubscriber(token)
+}
+
+/*
+End a subscription, returning storage.ErrNotExists for a token nobody has
+
+	:param token: the token from the unsubscribe link
+*/
+func (n *Newsletter) Unsubscribe(token string) error {
+	return n.store.RemoveSubscriber(token)
+}
+
+/*
+Queue a newly published post for every confirmed subscriber, returning how many it was
+queued for. Each one gets their own unsubscribe link
+
+	:param doc: the post that was published
+	:param content: the rendered html of the post
+*/
+func (n *Newsletter) Publish(doc storage.Document, content string) (int, error) {
+	subscribers, err := n.store.GetSubscribers(true)
+	if err != nil {
+		return 0, err
+	}
+	// the email is read somewhere else, so links to the site need its url
+	content = strings.NewReplacer(` href="/`, ` href="`+n.SiteURL+`/`, ` src="/`, ` src="`+n.SiteURL+`/`).Replace(content)
+	queued := 0
+	for _, sub := range subscribers {
+		var body bytes.Buffer
+		err := templates.ExecuteTemplate(&body, "post", map[string]any{
+			"Site":        n.SiteURL,
+			"Title":       doc.Title,
+			"URL":         n.SiteURL + "/writing/" + string(doc.Ident),
+			"Content":     template.HTML(content),
+			"Unsubscribe": n.unsubscribeURL(sub.Token),
+		})
+		if err != nil {
+			return queued, err
+		}
+		_, err = n.store.QueueEmail(storage.Email{Recipient: sub.Email, Subject: doc.Title, Body: body.String(), Unsubscribe: n.unsubscribeURL(sub.Token)})
+		if err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+/*
+Send the emails in the queue that are due, returning how many were sent along with why
+the others werent. An email that fails is tried again after the backoff, which doubles
+each time, until it has been tried MaxAttempts times. One the server refuses outright,
+i.e. an address that doesnt exist, is given up on straight away
+*/
+func (n *Newsletter) Process() (int, error) {
+	now := n.now()
+	due, err := n.store.GetDueEmails(now, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	envelope, err := mail.ParseAddress(n.From)
+	if err != nil {
+		return 0, err
+	}
+	site, err := url.Parse(n.SiteURL)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	var failures []error
+	for _, email := range due {
+		msg := Message{
+			ID:          string(email.Ident) + "@" + site.Hostname(),
+			From:        n.From,
+			To:          email.Recipient,
+			Subject:     email.Subject,
+			Date:        now,
+			HTML:        email.Body,
+			Unsubscribe: email.Unsubscribe,
+		}
+		email.Attempts++
+		sendErr := n.Mailer.Send(envelope.Address, email.Recipient, msg.Bytes())
+		var refused *textproto.Error
+		switch {
+		case sendErr == nil:
+			email.Status, email.LastError = storage.EMAIL_SENT, ""
+			sent++
+		case email.Attempts >= n.MaxAttempts || (errors.As(sendErr, &refused) && refused.Code >= 500):
+			email.Status, email.LastError = storage.EMAIL_FAILED, sendErr.Error()
+		default:
+			email.LastError = sendErr.Error()
+			email.NextAttempt = now.Add(n.Backoff << (email.Attempts - 1)).UTC().Format(time.RFC3339)
+		}
+		if sendErr != nil {
+			failures = append(failures, fmt.Errorf("emailing %s: %w", email.Recipient, sendErr))
+		}
+		if err := n.store.UpdateEmail(email); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return sent, errors.Join(failures...)
+}
+
+/*
+Process the queue every interval until stop is closed
+
+	:param interval: how often to check for emails that are due
+	:param stop: close it to stop sending
+*/
+func (n *Newsletter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sent, err := n.Process()
+			if err != nil {
+				slog.Error("sending queued emails failed", "err", err)
+			}
+			if sent > 0 {
+				slog.Info("sent queued emails", "sent", sent)
+			}
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package newsletter
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// Implementing the Store interface in memory
+type memStore struct {
+	subscribers []storage.Subscriber
+	emails      []storage.Email
+	lastSent    map[string]time.Time
+}
+
+func (m *memStore) AddSubscriber(email string) (storage.Subscriber, error) {
+	for _, sub := range m.subscribers {
+		if sub.Email == email {
+			return sub, nil
+		}
+	}
+	sub := storage.Subscriber{Email: email, Token: uuid.NewString()}
+	m.subscribers = append(m.subscribers, sub)
+	return sub, nil
+}
+
+func (m *memStore) ConfirmSubscriber(token string) error {
+	i := slices.IndexFunc(m.subscribers, func(s storage.Subscriber) bool { return s.Token == token })
+	if i < 0 {
+		return storage.ErrNotExists
+	}
+	m.subscribers[i].Confirmed = true
+	return nil
+}
+
+func (m *memStore) MarkConfirmationSent(email string, now time.Time, cooldown time.Duration) (bool, error) {
+	i := slices.IndexFunc(m.subscribers, func(s storage.Subscriber) bool { return s.Email == email })
+	if i < 0 || m.subscribers[i].Confirmed || now.Sub(m.lastSent[email]) < cooldown {
+		return false, nil
+	}
+	if m.lastSent == nil {
+		m.lastSent = map[string]time.Time{}
+	}
+	m.lastSent[email] = now
+	return true, nil
+}
+
+func (m *memStore) RemoveSubscriber(token string) error {
+	i := slices.IndexFunc(m.subscribers, func(s storage.Subscriber) bool { return s.Token == token })
+	if i < 0 {
+		return storage.ErrNotExists
+	}
+	m.subscribers = slices.Delete(m.subscribers, i, i+1)
+	return nil
+}
+
+func (m *memStore) GetSubscribers(confirmed bool) ([]storage.Subscriber, error) {
+	subscribers := []storage.Subscriber{}
+	for _, sub := range m.subscribers {
+		if sub.Confirmed == confirmed {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	return subscribers, nil
+}
+
+func (m *memStore) QueueEmail(email storage.Email) (storage.Identifier, error) {
+	email.Ident = storage.Identifier(uuid.NewString())
+	email.Status = storage.EMAIL_QUEUED
+	email.NextAttempt = time.Now().UTC().Format(time.RFC3339)
+	m.emails = append(m.emails, email)
+	return email.Ident, nil
+}
+
+func (m *memStore) GetDueEmails(now time.Time, limit int) ([]storage.Email, error) {
+	due := []storage.Email{}
+	for _, email := range m.emails {
+		if email.Status == storage.EMAIL_QUEUED && email.NextAttempt <= now.UTC().Format(time.RFC3339) && len(due) < limit {
+			due = append(due, email)
+		}
+	}
+	return due, nil
+}
+
+func (m *memStore) UpdateEmail(email storage.Email) error {
+	i := slices.IndexFunc(m.emails, func(e storage.Email) bool { return e.Ident == email.Ident })
+	if i < 0 {
+		return storage.ErrNotExists
+	}
+	m.emails[i] = email
+	return nil
+}
+
+// an email the stand in SMTP server accepted
+type delivery struct {
+	from, to string
+	msg      *mail.Message
+	body     string
+}
+
+/*
+A local stand in for an SMTP server that speaks just enough of the protocol for net/smtp,
+turning away recipients with the reply in reject when it is set
+*/
+type smtpServer struct {
+	addr      string
+	mu        sync.Mutex
+	reject    string
+	delivered []delivery
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	srv := &smtpServer{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ready")
+	var d delivery
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// the address is the first argument, any parameters after it are ignored
+		cmd, arg := fields[0], ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case "MAIL":
+			d.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.reject
+			s.mu.Unlock()
+			if reject != "" {
+				reply(reject)
+				continue
+			}
+			d.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			d.msg, _ = mail.ReadMessage(strings.NewReader(data.String()))
+			body, _ := io.ReadAll(quotedprintable.NewReader(d.msg.Body))
+			d.body = string(body)
+			s.mu.Lock()
+			s.delivered = append(s.delivered, d)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpServer) setReject(reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = reply
+}
+
+func (s *smtpServer) deliveries() []delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.delivered)
+}
+
+func newTestNewsletter(t *testing.T, srv *smtpServer) (*Newsletter, *memStore) {
+	host, port, _ := net.SplitHostPort(srv.addr)
+	p, _ := strconv.Atoi(port)
+	store := &memStore{}
+	return New("https://aetherial.dev/", Config{Host: host, Port: p, From: "keiji <blog@aetherial.dev>"}, store), store
+}
+
+func TestGetConfig(t *testing.T) {
+	t.Setenv(env.SMTP_HOST, "smtp.aetherial.dev")
+	cfg, err := GetConfig("aetherial.dev")
+	assert.NoError(t, err)
+	assert.Equal(t, Config{Host: "smtp.aetherial.dev", Port: 587, From: "noreply@aetherial.dev"}, cfg)
+
+	t.Setenv(env.SMTP_PORT, "25")
+	t.Setenv(env.SMTP_FROM, "keiji <blog@aetherial.dev>")
+	cfg, err = GetConfig("aetherial.dev")
+	assert.NoError(t, err)
+	assert.Equal(t, 25, cfg.Port)
+	assert.Equal(t, "keiji <blog@aetherial.dev>", cfg.From)
+
+	t.Setenv(env.SMTP_PORT, "smtp")
+	_, err = GetConfig("aetherial.dev")
+	assert.Error(t, err)
+	t.Setenv(env.SMTP_PORT, "")
+	t.Setenv(env.SMTP_FROM, "not an address")
+	_, err = GetConfig("aetherial.dev")
+	assert.Error(t, err)
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := newSMTPServer(t)
+	news, store := newTestNewsletter(t, srv)
+	assert.Equal(t, ErrInvalidAddress, news.Subscribe("not an address"))
+	assert.NoError(t, news.Subscribe(" Reader <Reader@Example.com> "))
+	if !assert.Len(t, store.subscribers, 1) {
+		return
+	}
+	sub := store.subscribers[0]
+	assert.Equal(t, "reader@example.com", sub.Email)
+
+	sent, err := news.Process()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	delivered := srv.deliveries()
+	if !assert.Len(t, delivered, 1) {
+		return
+	}
+	assert.Equal(t, "blog@aetherial.dev", delivered[0].from)
+	assert.Equal(t, "reader@example.com", delivered[0].to)
+	assert.Contains(t, delivered[0].body, `href="https://aetherial.dev/subscribe/confirm?token=`+sub.Token+`"`)
+	// nothing to unsubscribe from before confirming
+	assert.Empty(t, delivered[0].msg.Header.Get("List-Unsubscribe"))
+
+	// subscribing again straight away doesnt send another confirmation, only once the cooldown is over
+	assert.NoError(t, news.Subscribe("reader@example.com"))
+	assert.Len(t, store.emails, 1)
+	now := time.Now()
+	news.now = func() time.Time { return now.Add(news.ResendAfter) }
+	assert.NoError(t, news.Subscribe("reader@example.com"))
+	assert.Len(t, store.emails, 2)
+	news.now = time.Now
+
+	// posts only go to confirmed subscribers
+	post := storage.Document{Ident: "abc", Title: "hello ✨"}
+	queued, err := news.Publish(post, "<p>hello</p>")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queued)
+	assert.NoError(t, news.Confirm(sub.Token))
+	assert.Equal(t, storage.ErrNotExists, news.Confirm("missing"))
+	// subscribing again once confirmed doesnt send another confirmation
+	news.now = func() time.Time { return now.Add(2 * news.ResendAfter) }
+	assert.NoError(t, news.Subscribe("reader@example.com"))
+	assert.Len(t, store.emails, 2)
+
+	assert.NoError(t, news.Unsubscribe(sub.Token))
+	assert.Equal(t, storage.ErrNotExists, news.Unsubscribe(sub.Token))
+	assert.Empty(t, store.subscribers)
+}
+
+func TestPublish(t *testing.T) {
+	srv := newSMTPServer(t)
+	news, store := newTestNewsletter(t, srv)
+	for _, address := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		news.Subscribe(address)
+	}
+	news.Process()
+	store.ConfirmSubscriber(store.subscribers[0].Token)
+	store.ConfirmSubscriber(store.subscribers[1].Token)
+
+	queued, err := news.Publish(storage.Document{Ident: "abc", Title: "hello ✨"}, `<p>hello</p><img src="/api/v1/images/a">`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queued)
+	sent, err := news.Process()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+
+	delivered := srv.deliveries()[3:]
+	if !assert.Len(t, delivered, 2) {
+		return
+	}
+	for i, d := range delivered {
+		sub := store.subscribers[i]
+		assert.Equal(t, sub.Email, d.to)
+		subject, err := new(mime.WordDecoder).DecodeHeader(d.msg.Header.Get("Subject"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello ✨", subject)
+		assert.Equal(t, "keiji <blog@aetherial.dev>", d.msg.Header.Get("From"))
+		assert.Equal(t, "<https://aetherial.dev/unsubscribe?token="+sub.Token+">", d.msg.Header.Get("List-Unsubscribe"))
+		assert.Equal(t, "List-Unsubscribe=One-Click", d.msg.Header.Get("List-Unsubscribe-Post"))
+		assert.True(t, strings.HasSuffix(d.msg.Header.Get("Message-ID"), "@aetherial.dev>"))
+		assert.Contains(t, d.body, `<a href="https://aetherial.dev/writing/abc">hello ✨</a>`)
+		assert.Contains(t, d.body, `<img src="https://aetherial.dev/api/v1/images/a">`)
+		assert.Contains(t, d.body, `href="https://aetherial.dev/unsubscribe?token=`+sub.Token+`"`)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	srv := newSMTPServer(t)
+	news, store := newTestNewsletter(t, srv)
+	news.MaxAttempts = 3
+	clock := time.Now()
+	news.now = func() time.Time { return clock }
+	news.Subscribe("a@example.com")
+
+	// the server is busy, so the email waits a minute, then two
+	srv.setReject("451 try again later")
+	for i, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		sent, err := news.Process()
+		assert.Error(t, err)
+		assert.Equal(t, 0, sent)
+		email := store.emails[0]
+		assert.Equal(t, storage.EMAIL_QUEUED, email.Status)
+		assert.Equal(t, i+1, email.Attempts)
+		assert.Contains(t, email.LastError, "try again later")
+		assert.Equal(t, clock.Add(wait).UTC().Format(time.RFC3339), email.NextAttempt)
+
+		// it isnt tried again before then
+		sent, err = news.Process()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, sent)
+		assert.Equal(t, i+1, store.emails[0].Attempts)
+		clock = clock.Add(wait)
+	}
+	// the third attempt is the last
+	news.Process()
+	assert.Equal(t, storage.EMAIL_FAILED, store.emails[0].Status)
+	assert.Equal(t, 3, store.emails[0].Attempts)
+
+	// once the server is back the next email goes out
+	srv.setReject("")
+	news.Subscribe("b@example.com")
+	sent, err := news.Process()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, storage.EMAIL_SENT, store.emails[1].Status)
+
+	// an address the server refuses is given up on straight away
+	srv.setReject("550 no such user")
+	news.Subscribe("c@example.com")
+	news.Process()
+	assert.Equal(t, storage.EMAIL_FAILED, store.emails[2].Status)
+	assert.Equal(t, 1, store.emails[2].Attempts)
+
+	// a server that isnt there is tried again later
+	news.Mailer = SMTP{Config: Config{Host: "127.0.0.1", Port: 1}}
+	news.Subscribe("d@example.com")
+	_, err = news.Process()
+	assert.Error(t, err)
+	assert.Equal(t, storage.EMAIL_QUEUED, store.emails[3].Status)
+}
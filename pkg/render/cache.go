@@ -0,0 +1,176 @@
+package render
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/logging"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+// Where rendered posts are kept, picked with RENDER_CACHE
+type CacheMode string
+
+const (
+	CACHE_MEMORY  = CacheMode("memory")  // in memory, lost on restart. The default
+	CACHE_PERSIST = CacheMode("persist") // in memory, and in the database so a restart starts warm
+	CACHE_OFF     = CacheMode("off")     // render every post on every request
+)
+
+/*
+Get the cache mode from RENDER_CACHE, falling back to CACHE_MEMORY for anything that isnt
+a mode
+*/
+func GetCacheMode() CacheMode {
+	switch mode := CacheMode(os.Getenv(env.RENDER_CACHE)); mode {
+	case CACHE_PERSIST, CACHE_OFF:
+		return mode
+	default:
+		return CACHE_MEMORY
+	}
+}
+
+// The counters of a Cache, served by the admin api
+type CacheStats struct {
+	Mode          CacheMode `json:"mode"`
+	Entries       int       `json:"entries"`
+	Hits          uint64    `json:"hits"`
+	PersistedHits uint64    `json:"persisted_hits"`
+	Misses        uint64    `json:"misses"`
+	HitRate       float64   `json:"hit_rate"`
+}
+
+type cached struct {
+	key  string
+	html []byte
+}
+
+// Where CACHE_PERSIST keeps rendered posts, storage.DocumentIO satisfies it
+type Store interface {
+	GetRenderedHTML(id storage.Identifier) (string, string, error)
+	SetRenderedHTML(id storage.Identifier, key, html string) error
+}
+
+/*
+Keeps the html posts were rendered to, by post id. Each entry carries the key it was
+rendered under, made from when the post was last updated and the renderer Version, so
+an edited post or a reconfigured renderer misses instead of serving the old html
+*/
+type Cache struct {
+	Mode          CacheMode
+	store         Store
+	mu            sync.RWMutex
+	entries       map[storage.Identifier]cached
+	hits          atomic.Uint64
+	persistedHits atomic.Uint64
+	misses        atomic.Uint64
+}
+
+/*
+Create a new render cache
+
+	:param mode: where to keep rendered posts, CACHE_OFF renders every time
+	:param store: where to persist rendered posts with CACHE_PERSIST
+*/
+func NewCache(mode CacheMode, store Store) *Cache {
+	return &Cache{Mode: mode, store: store, entries: map[storage.Identifier]cached{}}
+}
+
+/*
+Build the key a post is cached under
+
+	:param updated: when the post was last changed
+	:param version: the Version of the renderer
+*/
+func CacheKey(updated, version string) string {
+	return updated + "/" + version
+}
+
+/*
+Get the html of a post from memory, then from the store with CACHE_PERSIST, and only
+render it when neither has it under the same key. Failing to persist a render is logged,
+the post was still rendered
+
+	:param ctx: the context of the request the post is served for, failures are logged with it
+	:param id: the identifier of the post
+	:param key: the key from CacheKey
+	:param render: renders the post
+*/
+func (c *Cache) Get(ctx context.Context, id storage.Identifier, key string, render func() []byte) []byte {
+	if c.Mode == CACHE_OFF {
+		c.misses.Add(1)
+		return render()
+	}
+	c.mu.RLock()
+	entry, ok := c.entries[id]
+	c.mu.RUnlock()
+	if ok && entry.key == key {
+		c.hits.Add(1)
+		return entry.html
+	}
+	if c.Mode == CACHE_PERSIST {
+		stored, html, err := c.store.GetRenderedHTML(id)
+		if err == nil && stored == key {
+			c.persistedHits.Add(1)
+			c.put(id, key, []byte(html))
+			return []byte(html)
+		}
+	}
+	c.misses.Add(1)
+	html := render()
+	c.put(id, key, html)
+	if c.Mode == CACHE_PERSIST {
+		if err := c.store.SetRenderedHTML(id, key, string(html)); err != nil {
+			logging.FromContext(ctx).Error("persisting the rendered html failed", "post", id, "err", err)
+		}
+	}
+	return html
+}
+
+func (c *Cache) put(id storage.Identifier, key string, html []byte) {
+	c.mu.Lock()
+	c.entries[id] = cached{key: key, html: html}
+	c.mu.Unlock()
+}
+
+/*
+Drop the html of posts, i.e. ones that were deleted or embed an image that changed. The
+database clears its own copy when they change
+
+	:param ids: the identifiers of the posts
+*/
+func (c *Cache) Invalidate(ids ...storage.Identifier) {
+	c.mu.Lock()
+	for _, id := range ids {
+		delete(c.entries, id)
+	}
+	c.mu.Unlock()
+}
+
+// Drop every cached post, i.e. after an import replaced them
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
+
+// Get the counters of the cache
+func (c *Cache) Stats() CacheStats {
+	c.mu.RLock()
+	entries := len(c.entries)
+	c.mu.RUnlock()
+	stats := CacheStats{
+		Mode:          c.Mode,
+		Entries:       entries,
+		Hits:          c.hits.Load(),
+		PersistedHits: c.persistedHits.Load(),
+		Misses:        c.misses.Load(),
+	}
+	if total := stats.Hits + stats.PersistedHits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits+stats.PersistedHits) / float64(total)
+	}
+	return stats
+}
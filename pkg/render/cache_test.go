@@ -0,0 +1,81 @@
+package render
+
+import (
+	"context"
+	"testing"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStore map[storage.Identifier][2]string
+
+func (f fakeStore) GetRenderedHTML(id storage.Identifier) (string, string, error) {
+	entry, ok := f[id]
+	if !ok {
+		return "", "", storage.ErrNotExists
+	}
+	return entry[0], entry[1], nil
+}
+
+func (f fakeStore) SetRenderedHTML(id storage.Identifier, key, html string) error {
+	f[id] = [2]string{key, html}
+	return nil
+}
+
+func TestGetCacheMode(t *testing.T) {
+	for input, want := range map[string]CacheMode{
+		"":        CACHE_MEMORY,
+		"memory":  CACHE_MEMORY,
+		"persist": CACHE_PERSIST,
+		"off":     CACHE_OFF,
+		"disk":    CACHE_MEMORY,
+	} {
+		t.Setenv("RENDER_CACHE", input)
+		assert.Equal(t, want, GetCacheMode(), input)
+	}
+}
+
+func TestCache(t *testing.T) {
+	renders := 0
+	render := func(html string) func() []byte {
+		return func() []byte {
+			renders++
+			return []byte(html)
+		}
+	}
+
+	c := NewCache(CACHE_MEMORY, fakeStore{})
+	assert.Equal(t, "<p>a</p>", string(c.Get(context.Background(), "post", "k1", render("<p>a</p>"))))
+	assert.Equal(t, "<p>a</p>", string(c.Get(context.Background(), "post", "k1", render("<p>b</p>"))))
+	assert.Equal(t, 1, renders)
+	// an updated post has a new key
+	assert.Equal(t, "<p>b</p>", string(c.Get(context.Background(), "post", "k2", render("<p>b</p>"))))
+	assert.Equal(t, 2, renders)
+	c.Invalidate("post")
+	c.Get(context.Background(), "post", "k2", render("<p>b</p>"))
+	assert.Equal(t, 3, renders)
+	assert.Equal(t, CacheStats{Mode: CACHE_MEMORY, Entries: 1, Hits: 1, Misses: 3, HitRate: 0.25}, c.Stats())
+	c.Purge()
+	assert.Equal(t, 0, c.Stats().Entries)
+
+	renders = 0
+	store := fakeStore{"warm": {"k1", "<p>stored</p>"}}
+	c = NewCache(CACHE_PERSIST, store)
+	assert.Equal(t, "<p>stored</p>", string(c.Get(context.Background(), "warm", "k1", render("<p>new</p>"))))
+	assert.Equal(t, "<p>new</p>", string(c.Get(context.Background(), "cold", "k1", render("<p>new</p>"))))
+	assert.Equal(t, [2]string{"k1", "<p>new</p>"}, store["cold"])
+	c.Get(context.Background(), "warm", "k1", render("<p>new</p>"))
+	assert.Equal(t, 1, renders)
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.PersistedHits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	renders = 0
+	c = NewCache(CACHE_OFF, nil)
+	c.Get(context.Background(), "post", "k1", render("<p>a</p>"))
+	c.Get(context.Background(), "post", "k1", render("<p>a</p>"))
+	assert.Equal(t, 2, renders)
+	assert.Equal(t, CacheStats{Mode: CACHE_OFF, Misses: 2}, c.Stats())
+}
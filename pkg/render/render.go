@@ -0,0 +1,289 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// An optional feature of the markdown renderer, picked with MARKDOWN_EXTENSIONS
+type Extension string
+
+const (
+	EXT_FOOTNOTES = Extension("footnotes") // pandoc style footnotes, 'a claim[^1]' and '[^1]: the source'
+	EXT_HIGHLIGHT = Extension("highlight") // syntax highlighting of fenced code blocks that name their language
+	EXT_MATH      = Extension("math")      // $inline$ and $$display$$ math, marked up for a MathJax or KaTeX the site loads to typeset
+	EXT_TOC       = Extension("toc")       // a table of contents linking to each heading, above the post
+	EXT_ANCHORS   = Extension("anchors")   // a '#' link next to each heading pointing at itself
+)
+
+// every extension, in the order they are documented
+var Extensions = []Extension{EXT_FOOTNOTES, EXT_HIGHLIGHT, EXT_MATH, EXT_TOC, EXT_ANCHORS}
+
+/*
+the extensions used when MARKDOWN_EXTENSIONS isnt set. math is left out since keiji doesnt
+ship a typesetter, a site that turns it on has to load MathJax or KaTeX in its templates
+*/
+var DefaultExtensions = []Extension{EXT_FOOTNOTES, EXT_HIGHLIGHT, EXT_ANCHORS}
+
+// How much of the HTML in a post the sanitizer lets through
+type Policy string
+
+const (
+	SANITIZE_STRICT = Policy("strict") // formatting, links and images only, no scripts, styles, iframes or forms. The default
+	SANITIZE_NONE   = Policy("none")   // trust every post and pass the HTML in it through untouched
+)
+
+// the chroma style the stylesheet served at /api/v1/cdn/highlight.css was generated from
+const HighlightStyle = "monokai"
+
+var (
+	// the class names the renderer, the image shortcode and chroma put on elements
+	classPattern = regexp.MustCompile(`^[\w -]+$`)
+	// srcset urls have to be relative to the site or http(s), like any other image url
+	srcsetPattern = regexp.MustCompile(`^(?:/|https?://)[^\s,"'<>]+ \d+w(?:, (?:/|https?://)[^\s,"'<>]+ \d+w)*$`)
+)
+
+// Turns the markdown body of a post into HTML that is safe to put in a page
+type Renderer interface {
+	Render(md []byte) []byte
+	// identifies what the renderer outputs, it changes whenever the extensions or policy do
+	Version() string
+}
+
+/*
+The markdown renderer posts are shown with, built on gomarkdown. Every post goes through
+the HTML sanitizer after rendering unless the policy is SANITIZE_NONE, so markdown
+that came from an imported archive cant put a script on the page
+*/
+type Markdown struct {
+	version    string
+	extensions map[Extension]bool
+	sanitizer  *bluemonday.Policy
+	formatter  *chromahtml.Formatter
+}
+
+/*
+Create a markdown renderer
+
+	:param exts: the extensions to turn on
+	:param policy: how strictly to sanitize the rendered HTML
+*/
+func New(exts []Extension, policy Policy) *Markdown {
+	m := &Markdown{
+		extensions: map[Extension]bool{},
+		formatter:  chromahtml.New(chromahtml.WithClasses(true)),
+	}
+	for _, ext := range exts {
+		m.extensions[ext] = true
+	}
+	if policy != SANITIZE_NONE {
+		m.sanitizer = Sanitizer()
+	}
+	// the same extensions in any order render the same
+	enabled := []string{}
+	for _, ext := range Extensions {
+		if m.extensions[ext] {
+			enabled = append(enabled, string(ext))
+		}
+	}
+	m.version = fmt.Sprintf("%s:%s", strings.Join(enabled, ","), policy)
+	return m
+}
+
+// The extensions and policy the renderer was created with, i.e. 'footnotes,toc:strict'
+func (m *Markdown) Version() string {
+	return m.version
+}
+
+/*
+Create a markdown renderer configured from MARKDOWN_EXTENSIONS and MARKDOWN_SANITIZE,
+returning an error for anything in them it doesnt recognize
+*/
+func FromEnv() (*Markdown, error) {
+	exts := DefaultExtensions
+	if v, set := os.LookupEnv(env.MARKDOWN_EXTENSIONS); set {
+		var err error
+		if exts, err = ParseExtensions(v); err != nil {
+			return nil, err
+		}
+	}
+	policy := Policy(os.Getenv(env.MARKDOWN_SANITIZE))
+	switch policy {
+	case "":
+		policy = SANITIZE_STRICT
+	case SANITIZE_STRICT, SANITIZE_NONE:
+	default:
+		return nil, fmt.Errorf("unknown %s policy %q, expected '%s' or '%s'", env.MARKDOWN_SANITIZE, policy, SANITIZE_STRICT, SANITIZE_NONE)
+	}
+	return New(exts, policy), nil
+}
+
+/*
+Parse a comma separated list of extensions, i.e. 'footnotes,toc'. An empty list turns
+every extension off
+
+	:param list: the extensions to parse
+*/
+func ParseExtensions(list string) ([]Extension, error) {
+	exts := []Extension{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, ext := range Extensions {
+			if Extension(name) == ext {
+				known = true
+				exts = append(exts, ext)
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown markdown extension %q", name)
+		}
+	}
+	return exts, nil
+}
+
+/*
+The sanitizer policy for SANITIZE_STRICT. It starts from bluemondays policy for user
+generated content and allows what the renderer and the image shortcode produce on top of
+it: class names for highlighting and footnotes, the figures and srcsets of embedded
+images, and the nav of the table of contents
+*/
+func Sanitizer() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(classPattern).Globally()
+	p.AllowElements("figure", "figcaption", "nav")
+	p.AllowAttrs("srcset").Matching(srcsetPattern).OnElements("img")
+	p.AllowAttrs("sizes").Matching(regexp.MustCompile(`^[\w\s(),:.-]+$`)).OnElements("img")
+	p.AllowAttrs("loading").Matching(regexp.MustCompile(`^(lazy|eager)$`)).OnElements("img")
+	// links in posts are the authors own, they shouldnt be marked nofollow
+	p.RequireNoFollowOnLinks(false)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+/*
+The sanitizer policy for comments left by readers, which are never trusted whatever
+MARKDOWN_SANITIZE says. Only text formatting, code and links make it through, and links
+are marked nofollow so that a comment isnt worth spamming for its links
+*/
+func CommentSanitizer() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowStandardURLs()
+	p.AllowElements("p", "br", "em", "strong", "del", "code", "pre", "blockquote", "ul", "ol", "li")
+	p.AllowAttrs("href").OnElements("a")
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// Create the renderer for comments, plain markdown sanitized with CommentSanitizer
+func NewComments() *Markdown {
+	m := New(nil, SANITIZE_STRICT)
+	m.sanitizer = CommentSanitizer()
+	m.version = "comments"
+	return m
+}
+
+/*
+Render markdown to HTML with the configured extensions, sanitizing the result
+
+	:param md: the markdown to render
+*/
+func (m *Markdown) Render(md []byte) []byte {
+	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
+	if m.extensions[EXT_FOOTNOTES] {
+		extensions |= parser.Footnotes
+	}
+	if !m.extensions[EXT_MATH] {
+		extensions &^= parser.MathJax
+	}
+	p := parser.NewWithExtensions(extensions)
+	doc := p.Parse(md)
+
+	flags := html.CommonFlags | html.HrefTargetBlank
+	if m.extensions[EXT_TOC] {
+		flags |= html.TOC
+	}
+	if m.extensions[EXT_FOOTNOTES] {
+		flags |= html.FootnoteReturnLinks
+	}
+	renderer := html.NewRenderer(html.RendererOptions{Flags: flags, RenderNodeHook: m.renderNode})
+	out := markdown.Render(doc, renderer)
+	if m.sanitizer == nil {
+		return out
+	}
+	return m.sanitizer.SanitizeBytes(out)
+}
+
+// the hook gomarkdown calls for each node, for the extensions that change how nodes are written
+func (m *Markdown) renderNode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch n := node.(type) {
+	case *ast.CodeBlock:
+		if m.extensions[EXT_HIGHLIGHT] {
+			return ast.GoToNext, m.highlight(w, n)
+		}
+	case *ast.Heading:
+		// the anchor goes inside of the heading, right before the closing tag
+		if m.extensions[EXT_ANCHORS] && !entering && n.HeadingID != "" {
+			fmt.Fprintf(w, ` <a class="anchor" href="#%s">#</a>`, template.HTMLEscapeString(n.HeadingID))
+		}
+	}
+	return ast.GoToNext, false
+}
+
+/*
+Write a fenced code block with syntax highlighting, returning false to fall back to a
+plain code block when it doesnt name a language chroma knows
+
+	:param w: where to write the block
+	:param block: the code block
+*/
+func (m *Markdown) highlight(w io.Writer, block *ast.CodeBlock) bool {
+	lang := strings.Fields(string(block.Info))
+	if len(lang) == 0 {
+		return false
+	}
+	lexer := lexers.Get(lang[0])
+	if lexer == nil {
+		return false
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, string(block.Literal))
+	if err != nil {
+		return false
+	}
+	var buf bytes.Buffer
+	if err = m.formatter.Format(&buf, styles.Get(HighlightStyle), tokens); err != nil {
+		return false
+	}
+	w.Write(buf.Bytes())
+	return true
+}
+
+/*
+Write the stylesheet for the classes highlighted code blocks use, which is kept in the
+cdn directory as highlight.css
+
+	:param w: where to write the stylesheet
+*/
+func WriteHighlightCSS(w io.Writer) error {
+	return chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(w, styles.Get(HighlightStyle))
+}
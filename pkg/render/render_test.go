@@ -0,0 +1,170 @@
+package render
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExtensions(t *testing.T) {
+	type testcase struct {
+		input   string
+		want    []Extension
+		wantErr bool
+	}
+	for _, tc := range []testcase{
+		{input: "footnotes,toc", want: []Extension{EXT_FOOTNOTES, EXT_TOC}},
+		{input: " Highlight , math ,", want: []Extension{EXT_HIGHLIGHT, EXT_MATH}},
+		{input: "", want: []Extension{}},
+		{input: "footnotes,emoji", wantErr: true},
+	} {
+		got, err := ParseExtensions(tc.input)
+		if tc.wantErr {
+			assert.Error(t, err, tc.input)
+			continue
+		}
+		assert.NoError(t, err, tc.input)
+		assert.Equal(t, tc.want, got, tc.input)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MARKDOWN_EXTENSIONS", "toc")
+	t.Setenv("MARKDOWN_SANITIZE", "")
+	md, err := FromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, map[Extension]bool{EXT_TOC: true}, md.extensions)
+	assert.NotNil(t, md.sanitizer)
+
+	t.Setenv("MARKDOWN_SANITIZE", "none")
+	md, err = FromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, md.sanitizer)
+
+	t.Setenv("MARKDOWN_SANITIZE", "loose")
+	_, err = FromEnv()
+	assert.Error(t, err)
+}
+
+func TestRender(t *testing.T) {
+	type testcase struct {
+		name     string
+		exts     []Extension
+		policy   Policy
+		input    string
+		contains []string
+		missing  []string
+	}
+	for _, tc := range []testcase{
+		{
+			name:     "scripts and handlers are stripped",
+			policy:   SANITIZE_STRICT,
+			input:    "hi <script>alert(1)</script>\n\n<img src=\"x.png\" onerror=\"alert(1)\">\n\n[click](javascript:alert(1)) <iframe src=\"https://example.com\"></iframe>",
+			contains: []string{"<p>hi", `<img src="x.png">`},
+			missing:  []string{"<script", "onerror", "javascript:", "<iframe"},
+		},
+		{
+			name:     "nothing is stripped without sanitizing",
+			policy:   SANITIZE_NONE,
+			input:    "hi <script>alert(1)</script>",
+			contains: []string{"<script>alert(1)</script>"},
+		},
+		{
+			name:     "external links open in a new tab",
+			policy:   SANITIZE_STRICT,
+			input:    "[out](https://example.com) and [in](/blog)",
+			contains: []string{`href="https://example.com"`, `target="_blank"`, `<a href="/blog">in</a>`},
+			missing:  []string{"nofollow"},
+		},
+		{
+			name:     "embedded image figures survive",
+			policy:   SANITIZE_STRICT,
+			input:    "<figure class=\"post-image\"><img src=\"/api/v1/images/abc?w=640\" srcset=\"/api/v1/images/abc?w=320 320w, /api/v1/images/abc?w=640 640w\" sizes=\"(max-width: 768px) 95vw, 768px\" loading=\"lazy\"><figcaption>cat</figcaption></figure>\n",
+			contains: []string{`<figure class="post-image">`, `srcset="/api/v1/images/abc?w=320 320w, /api/v1/images/abc?w=640 640w"`, `sizes="(max-width: 768px) 95vw, 768px"`, `loading="lazy"`, "<figcaption>cat</figcaption>"},
+		},
+		{
+			name:    "srcsets with other schemes are dropped",
+			policy:  SANITIZE_STRICT,
+			input:   "<img src=\"/a.png\" srcset=\"javascript:alert(1) 320w\">\n",
+			missing: []string{"srcset"},
+		},
+		{
+			name:     "footnotes",
+			exts:     []Extension{EXT_FOOTNOTES},
+			policy:   SANITIZE_STRICT,
+			input:    "a claim[^1]\n\n[^1]: the source\n",
+			contains: []string{`class="footnote-ref"`, `<div class="footnotes">`, "the source", `class="footnote-return"`},
+		},
+		{
+			name:     "no footnotes",
+			policy:   SANITIZE_STRICT,
+			input:    "a claim[^1]\n\n[^1]: the source\n",
+			missing:  []string{"footnote-ref"},
+			contains: []string{"[^1]"},
+		},
+		{
+			name:     "highlighting",
+			exts:     []Extension{EXT_HIGHLIGHT},
+			policy:   SANITIZE_STRICT,
+			input:    "```go\nfunc main() {}\n```\n",
+			contains: []string{`<pre class="chroma">`, `<span class="kd">func</span>`},
+		},
+		{
+			name:     "unknown languages arent highlighted",
+			exts:     []Extension{EXT_HIGHLIGHT},
+			policy:   SANITIZE_STRICT,
+			input:    "```notalanguage\n<b>x</b>\n```\n",
+			contains: []string{`<code class="language-notalanguage">&lt;b&gt;x&lt;/b&gt;`},
+			missing:  []string{"chroma"},
+		},
+		{
+			name:     "math",
+			exts:     []Extension{EXT_MATH},
+			policy:   SANITIZE_STRICT,
+			input:    "where $x < y$ holds\n",
+			contains: []string{`<span class="math inline">\(x &lt; y\)</span>`},
+		},
+		{
+			name:     "no math",
+			policy:   SANITIZE_STRICT,
+			input:    "costs $5 or $6\n",
+			contains: []string{"costs $5 or $6"},
+		},
+		{
+			name:     "table of contents and anchors",
+			exts:     []Extension{EXT_TOC, EXT_ANCHORS},
+			policy:   SANITIZE_STRICT,
+			input:    "# First\n\n## Second\n",
+			contains: []string{"<nav>", `<a href="#first">First</a>`, `<h1 id="first">First <a class="anchor" href="#first">#</a></h1>`},
+		},
+	} {
+		got := string(New(tc.exts, tc.policy).Render([]byte(tc.input)))
+		for _, s := range tc.contains {
+			assert.Contains(t, got, s, tc.name)
+		}
+		for _, s := range tc.missing {
+			assert.NotContains(t, got, s, tc.name)
+		}
+	}
+}
+
+func TestRenderComments(t *testing.T) {
+	got := string(NewComments().Render([]byte("# Loud\n\n**nice** post, see [mine](https://example.com)\n\n![x](/a.png) <script>alert(1)</script> <b onclick=\"x\">hi</b>\n\n```\ncode\n```\n")))
+	for _, s := range []string{"<strong>nice</strong>", `rel="nofollow noopener"`, `target="_blank"`, "<pre><code>code", "Loud"} {
+		assert.Contains(t, got, s)
+	}
+	for _, s := range []string{"<h1", "<img", "<script", "onclick", "<b>"} {
+		assert.NotContains(t, got, s)
+	}
+}
+
+// the stylesheet in the cdn directory has to match the style the code is highlighted with
+func TestHighlightCSS(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteHighlightCSS(&buf))
+	committed, err := os.ReadFile("../webpages/cdn/highlight.css")
+	assert.NoError(t, err)
+	assert.Equal(t, buf.String(), string(committed))
+}
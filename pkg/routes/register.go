@@ -2,28 +2,66 @@ package routes
 
 import (
 	"io/fs"
+	"os"
 
 	"git.aetherial.dev/aeth/keiji/pkg/auth"
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
 	"git.aetherial.dev/aeth/keiji/pkg/controller"
+	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/metrics"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
 	"github.com/gin-gonic/gin"
 )
 
-func Register(e *gin.Engine, domain string, database storage.DocumentIO, files fs.FS, authSrc auth.Source) {
-	c := controller.NewController(domain, database, files, authSrc)
+/*
+Register every route of the site on an engine, returning the controller serving them. Its
+background workers run until it is closed
+
+	:param e: the engine to register the routes on
+	:param domain: the domain name the site is served on
+	:param database: the database the site is served out of
+	:param images: the image store the files of the databases images are kept in
+	:param files: the web content filesystem holding the cdn directory
+	:param authSrc: checks the credentials of logins to the admin panel
+	:param backups: takes the backups the admin panel lists, and on its Interval if it has one. They are off if nil
+*/
+func Register(e *gin.Engine, domain string, database storage.SiteIO, images storage.ImageIO, files fs.FS, authSrc auth.Source, backups *backup.Manager) *controller.Controller {
+	c := controller.NewController(domain, database, images, files, authSrc)
+	c.Backups = backups
+	if backups != nil && backups.Interval > 0 {
+		c.ScheduleBackups(backups.Interval)
+	}
+	// with METRICS_ADDR set they are served on their own listener instead
+	if os.Getenv(env.METRICS_ADDR) == "" {
+		e.GET("/metrics", gin.WrapH(metrics.Handler(metrics.Default, os.Getenv(env.METRICS_TOKEN))))
+	}
 	web := e.Group("")
-	web.GET("/", c.ServeHome)
-	web.GET("/blog", c.ServeBlog)
-	web.GET("/digital", c.ServeDigitalArt)
-	web.GET("/creative", c.ServeCreative)
-	web.GET("/writing/:id", c.ServePost)
+	// the comment thread is loaded into the post its on, so only the post counts as a view
+	web.Use(c.Analytics.Middleware("/writing/:id/comments", "/login", "/subscribe*", "/unsubscribe"))
+	pageRoutes(web, c)
+	web.POST("/writing/:id/comments", c.PostComment)
+	web.POST("/webmention", c.ReceiveWebmention)
 	web.GET("/login", c.ServeLogin)
 	web.POST("/login", c.Auth)
 
-	cdn := e.Group("/api/v1")
-	cdn.GET("/images/:file", c.ServeImage)
-	cdn.GET("/cdn/:file", c.ServeGeneric)
-	cdn.GET("assets/:file", c.ServeAsset)
+	if c.Newsletter != nil {
+		web.POST("/subscribe", c.Subscribe)
+		web.GET("/subscribe/confirm", c.ConfirmSubscription)
+		web.GET("/unsubscribe", c.ServeUnsubscribe)
+		web.POST("/unsubscribe", c.Unsubscribe)
+	}
+
+	if c.Federation != nil {
+		e.GET("/.well-known/webfinger", c.WebFinger)
+		fed := e.Group("/actor")
+		fed.GET("", c.ServeActor)
+		fed.GET("/outbox", c.ServeOutbox)
+		fed.GET("/followers", c.ServeFollowerCollection)
+		fed.GET("/activities/:id", c.ServeActivity)
+		fed.POST("/inbox", c.ActorInbox)
+	}
+
+	fileRoutes(e.Group("/api/v1"), c)
 
 	priv := e.Group("/admin")
 	priv.Use(c.IsAuthenticated)
@@ -35,12 +73,95 @@ func Register(e *gin.Engine, domain string, database storage.DocumentIO, files f
 	priv.POST("/menu", c.AddMenuItem)
 	priv.POST("/navbar", c.AddNavbarItem)
 	priv.POST("/images/upload", c.SaveFile)
+	priv.GET("/images/picker", c.ServeImagePicker)
 	priv.GET("/posts/:id", c.GetBlogPostEditor)
 	priv.GET("/options/:id", c.PostOptions)
 	priv.POST("/posts", c.MakeBlogPost)
 	priv.GET("/posts/all", c.ServeBlogDirectory)
 	priv.GET("/posts", c.ServeNewBlogPage)
 	priv.PATCH("/posts", c.UpdateBlogPost)
+	priv.POST("/posts/preview", c.PreviewBlogPost)
+	priv.PUT("/posts/:id/comments", c.SetPostComments)
+	priv.GET("/comments", c.ServeCommentQueue)
+	priv.PUT("/comments/:id", c.ModerateComment)
+	priv.PUT("/mentions/:id", c.ModerateMention)
+	if c.Federation != nil {
+		priv.GET("/followers", c.ServeFollowers)
+		priv.DELETE("/followers", c.RemoveFollower)
+	}
+	priv.GET("/webhooks", c.ServeWebhooks)
+	priv.POST("/webhooks", c.MakeWebhook)
+	priv.DELETE("/webhooks/:id", c.DeleteWebhook)
+	priv.GET("/analytics", c.ServeAnalytics)
+	priv.PUT("/drafts", c.SaveDraft)
+	priv.DELETE("/drafts", c.DeleteDraft)
 	priv.DELETE("/posts/:id", c.DeleteDocument)
+	priv.GET("/export", c.ExportSite)
+	priv.POST("/import", c.ImportSite)
+	priv.GET("/backup", c.ListBackups)
+	priv.POST("/backup", c.TriggerBackup)
+	priv.GET("/backup/:name", c.DownloadBackup)
+	priv.GET("/albums", c.ServeAlbums)
+	priv.POST("/albums", c.MakeAlbum)
+	priv.GET("/albums/:id", c.ServeAlbumEditor)
+	priv.PATCH("/albums/:id", c.PatchAlbum)
+	priv.DELETE("/albums/:id", c.DeleteAlbum)
+
+	api := priv.Group("/api")
+	api.GET("/posts", c.ApiGetPosts)
+	api.GET("/posts/:id", c.ApiGetPost)
+	api.POST("/posts", c.ApiCreatePost)
+	api.PUT("/posts/:id", c.ApiUpdatePost)
+	api.DELETE("/posts/:id", c.ApiDeletePost)
+	api.GET("/images", c.ApiGetImages)
+	api.GET("/images/broken", c.ApiGetBrokenImages)
+	api.GET("/cache", c.ApiGetRenderCache)
+	api.GET("/images/:id", c.ApiGetImage)
+	api.POST("/images", c.ApiUploadImage)
+	api.PUT("/images/:id", c.ApiUpdateImage)
+	api.DELETE("/images/:id", c.ApiDeleteImage)
+	api.GET("/albums", c.ApiGetAlbums)
+	api.POST("/albums", c.ApiCreateAlbum)
+	api.PUT("/albums/order", c.ApiReorderAlbums)
+	api.GET("/albums/:id", c.ApiGetAlbum)
+	api.PUT("/albums/:id", c.ApiUpdateAlbum)
+	api.DELETE("/albums/:id", c.ApiDeleteAlbum)
+	api.PUT("/albums/:id/images", c.ApiSetAlbumImages)
+	return c
+}
 
+/*
+Register only the public pages of the site and the files they link to, on a controller
+made with NewRenderController, for rendering the site out to static files. Nothing it
+returns has to be closed
+
+	:param e: the engine to register the routes on
+	:param domain: the domain name the site is served on
+	:param database: the database the site is served out of
+	:param images: the image store the files of the databases images are kept in
+	:param files: the web content filesystem holding the cdn directory
+*/
+func RegisterPages(e *gin.Engine, domain string, database storage.SiteIO, images storage.ImageIO, files fs.FS) *controller.Controller {
+	c := controller.NewRenderController(domain, database, images, files)
+	pageRoutes(e.Group(""), c)
+	fileRoutes(e.Group("/api/v1"), c)
+	return c
+}
+
+// the pages anyone can read
+func pageRoutes(web *gin.RouterGroup, c *controller.Controller) {
+	web.GET("/", c.ServeHome)
+	web.GET("/blog", c.ServeBlog)
+	web.GET("/digital", c.ServeDigitalArt)
+	web.GET("/digital/:album", c.ServeAlbum)
+	web.GET("/creative", c.ServeCreative)
+	web.GET("/writing/:id", c.ServePost)
+	web.GET("/writing/:id/comments", c.ServeComments)
+}
+
+// the images, cdn files and assets the pages link to
+func fileRoutes(cdn *gin.RouterGroup, c *controller.Controller) {
+	cdn.GET("/images/:file", c.ServeImage)
+	cdn.GET("/cdn/:file", c.ServeGeneric)
+	cdn.GET("assets/:file", c.ServeAsset)
 }
@@ -1,15 +1,38 @@
 package routes
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"git.aetherial.dev/aeth/keiji/pkg/auth"
+	"git.aetherial.dev/aeth/keiji/pkg/backup"
+	"git.aetherial.dev/aeth/keiji/pkg/env"
 	"git.aetherial.dev/aeth/keiji/pkg/storage"
 	"git.aetherial.dev/aeth/keiji/pkg/webpages"
 	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRegister(t *testing.T) {
 	e := gin.Default()
-	Register(e, "localhost", &storage.SQLiteRepo{}, webpages.FilesystemWebpages{}, auth.EnvAuth{})
+	backups := backup.NewManager(nil, t.TempDir(), t.TempDir(), 0)
+	backups.Interval = time.Hour
+	c := Register(e, "localhost", &storage.SQLiteRepo{}, storage.FilesystemImageIO{RootDir: t.TempDir()}, webpages.FilesystemWebpages{}, auth.EnvAuth{}, backups)
+	// waits on the backup schedule along with the other workers
+	c.Close()
+}
+
+func TestRegisterPages(t *testing.T) {
+	// the render controller doesnt load an actor, the empty repo would fail to
+	t.Setenv(env.ACTIVITYPUB_USER, "blog")
+	e := gin.New()
+	c := RegisterPages(e, "localhost", &storage.SQLiteRepo{}, storage.FilesystemImageIO{RootDir: t.TempDir()}, webpages.FilesystemWebpages{})
+	assert.Nil(t, c.Federation)
+	assert.Nil(t, c.Newsletter)
+	for _, route := range e.Routes() {
+		assert.Equal(t, "GET", route.Method, route.Path)
+		assert.False(t, strings.HasPrefix(route.Path, "/admin"), route.Path)
+		assert.NotEqual(t, "/metrics", route.Path)
+	}
 }
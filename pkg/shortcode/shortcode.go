@@ -0,0 +1,213 @@
+package shortcode
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Shortcodes let a post reference an image from the image store by its identifier, and are
+resolved to the images url, srcset and caption when the post is rendered:
+
+	{{< image id="<identifier>" alt="a cat" caption="sitting on a keyboard" width="640" >}}
+
+Only id is required. Shortcodes inside of code blocks and code spans are left alone so
+that a post can show how to write one
+*/
+var shortcodePattern = regexp.MustCompile(`\{\{<\s*image\s+((?:[^>]|>[^}])*?)\s*>\}\}`)
+
+var attrPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// An image shortcode found in a post
+type Image struct {
+	ID      string
+	Alt     string
+	Caption string
+	Width   int // the width of the variant to show, the largest when 0
+	start   int
+	end     int
+}
+
+/*
+The HTML an image shortcode is replaced with. Missing is set when the image the shortcode
+references doesnt exist, so it renders as a placeholder instead of a broken image
+*/
+type Figure struct {
+	Full    string // the url of the original, which the image links to
+	Src     string
+	Srcset  string
+	Alt     string
+	Caption string
+	Width   int
+	Height  int
+	Missing bool
+	ID      string
+}
+
+var figureTemplate = template.Must(template.New("figure").Parse(
+	`{{ if .Missing }}<figure class="post-image post-image-missing"><figcaption>missing image {{ .ID }}</figcaption></figure>` +
+		`{{ else }}<figure class="post-image"><a href="{{ .Full }}">` +
+		`<img src="{{ .Src }}"{{ with .Srcset }} srcset="{{ . }}" sizes="(max-width: 768px) 95vw, 768px"{{ end }} alt="{{ .Alt }}"` +
+		`{{ if .Width }} width="{{ .Width }}" height="{{ .Height }}"{{ end }} loading="lazy" class="img-fluid"></a>` +
+		`{{ with .Caption }}<figcaption>{{ . }}</figcaption>{{ end }}</figure>{{ end }}`))
+
+/*
+Render a figure as a single line of HTML
+
+	:param f: the figure to render
+*/
+func (f Figure) HTML() string {
+	var b strings.Builder
+	if err := figureTemplate.Execute(&b, f); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+/*
+Write the shortcode for an image, i.e. for the image picker in the post editor
+
+	:param img: the image to reference, only the set fields are written
+*/
+func Format(img Image) string {
+	s := fmt.Sprintf(`{{< image id="%s"`, img.ID)
+	if img.Alt != "" {
+		s += fmt.Sprintf(` alt="%s"`, quote(img.Alt))
+	}
+	if img.Caption != "" {
+		s += fmt.Sprintf(` caption="%s"`, quote(img.Caption))
+	}
+	if img.Width != 0 {
+		s += fmt.Sprintf(` width="%v"`, img.Width)
+	}
+	return s + " >}}"
+}
+
+// attribute values cant hold a double quote, so they are swapped for single ones
+func quote(s string) string {
+	return strings.ReplaceAll(s, `"`, "'")
+}
+
+/*
+Find every image shortcode in a post that isnt in a code block, in the order they appear.
+Shortcodes without an id are skipped
+
+	:param md: the markdown of the post
+*/
+func Find(md []byte) []Image {
+	code := codeRanges(md)
+	var imgs []Image
+	for _, loc := range shortcodePattern.FindAllSubmatchIndex(md, -1) {
+		if inRanges(code, loc[0]) {
+			continue
+		}
+		img := Image{start: loc[0], end: loc[1]}
+		for _, attr := range attrPattern.FindAllSubmatch(md[loc[2]:loc[3]], -1) {
+			val := string(attr[2])
+			switch string(attr[1]) {
+			case "id":
+				img.ID = strings.TrimSpace(val)
+			case "alt":
+				img.Alt = val
+			case "caption":
+				img.Caption = val
+			case "width":
+				img.Width, _ = strconv.Atoi(val)
+			}
+		}
+		if img.ID != "" {
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs
+}
+
+/*
+Replace every image shortcode in a post with the figure resolve returns for it. The figure
+is put on its own line so the markdown renderer passes it through as an HTML block
+
+	:param md: the markdown of the post
+	:param resolve: looks up the image a shortcode references
+*/
+func Expand(md []byte, resolve func(img Image) Figure) []byte {
+	imgs := Find(md)
+	if len(imgs) == 0 {
+		return md
+	}
+	var out bytes.Buffer
+	last := 0
+	for _, img := range imgs {
+		out.Write(md[last:img.start])
+		out.WriteString("\n\n")
+		out.WriteString(resolve(img).HTML())
+		out.WriteString("\n\n")
+		last = img.end
+	}
+	out.Write(md[last:])
+	return out.Bytes()
+}
+
+// the byte ranges of the fenced code blocks and code spans in a post
+func codeRanges(md []byte) [][2]int {
+	var ranges [][2]int
+	fence := ""
+	fenceStart := 0
+	pos := 0
+	for _, line := range bytes.SplitAfter(md, []byte("\n")) {
+		trimmed := strings.TrimLeft(string(line), " ")
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				ranges = append(ranges, [2]int{fenceStart, pos + len(line)})
+				fence = ""
+			}
+		} else if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			fenceStart = pos
+		} else {
+			ranges = append(ranges, codeSpans(line, pos)...)
+		}
+		pos += len(line)
+	}
+	if fence != "" {
+		// an unclosed fence runs to the end of the post
+		ranges = append(ranges, [2]int{fenceStart, len(md)})
+	}
+	return ranges
+}
+
+// the code spans on a line, a run of backticks closed by a run of the same length
+func codeSpans(line []byte, offset int) [][2]int {
+	var ranges [][2]int
+	for i := 0; i < len(line); {
+		if line[i] != '`' {
+			i++
+			continue
+		}
+		n := 0
+		for i+n < len(line) && line[i+n] == '`' {
+			n++
+		}
+		closing := bytes.Index(line[i+n:], bytes.Repeat([]byte("`"), n))
+		if closing < 0 {
+			i += n
+			continue
+		}
+		end := i + n + closing + n
+		ranges = append(ranges, [2]int{offset + i, offset + end})
+		i = end
+	}
+	return ranges
+}
+
+func inRanges(ranges [][2]int, at int) bool {
+	for _, r := range ranges {
+		if at >= r[0] && at < r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package shortcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFind(t *testing.T) {
+	type testcase struct {
+		name  string
+		input string
+		want  []Image
+	}
+	for _, tc := range []testcase{
+		{
+			name:  "every attribute",
+			input: `before {{< image id="abc" alt="a cat" caption="on a keyboard" width="640" >}} after`,
+			want:  []Image{{ID: "abc", Alt: "a cat", Caption: "on a keyboard", Width: 640}},
+		},
+		{
+			name:  "just an id, no spaces",
+			input: "{{<image id=\"abc\">}}\n{{< image id=\"def\" >}}",
+			want:  []Image{{ID: "abc"}, {ID: "def"}},
+		},
+		{
+			name:  "no id",
+			input: `{{< image alt="nothing" >}}`,
+		},
+		{
+			name:  "inside of a fenced code block",
+			input: "```\n{{< image id=\"abc\" >}}\n```\n{{< image id=\"def\" >}}",
+			want:  []Image{{ID: "def"}},
+		},
+		{
+			name:  "inside of an unclosed fence",
+			input: "~~~\n{{< image id=\"abc\" >}}",
+		},
+		{
+			name:  "inside of a code span",
+			input: "write `{{< image id=\"abc\" >}}` to get {{< image id=\"def\" >}}",
+			want:  []Image{{ID: "def"}},
+		},
+		{
+			name:  "not a shortcode",
+			input: `{{ image id="abc" }}`,
+		},
+	} {
+		got := Find([]byte(tc.input))
+		for i := range got {
+			got[i].start, got[i].end = 0, 0
+		}
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	img := Image{ID: "abc", Alt: `the "best" cat`, Caption: "on a keyboard", Width: 320}
+	code := Format(img)
+	assert.Equal(t, `{{< image id="abc" alt="the 'best' cat" caption="on a keyboard" width="320" >}}`, code)
+	img.Alt = "the 'best' cat"
+	found := Find([]byte(code))
+	assert.Len(t, found, 1)
+	found[0].start, found[0].end = 0, 0
+	assert.Equal(t, img, found[0])
+	assert.Equal(t, `{{< image id="abc" >}}`, Format(Image{ID: "abc"}))
+}
+
+func TestExpand(t *testing.T) {
+	md := "intro\n{{< image id=\"abc\" caption=\"<b>bold</b>\" >}}\n{{< image id=\"gone\" >}}\n`{{< image id=\"abc\" >}}`"
+	got := string(Expand([]byte(md), func(img Image) Figure {
+		if img.ID == "gone" {
+			return Figure{Missing: true, ID: img.ID}
+		}
+		return Figure{Full: "/img/abc", Src: "/img/abc?w=640", Srcset: "/img/abc?w=320 320w", Alt: "a cat", Caption: img.Caption, Width: 10, Height: 5}
+	}))
+	assert.True(t, strings.HasPrefix(got, "intro\n\n\n<figure class=\"post-image\">"), got)
+	assert.Contains(t, got, `<img src="/img/abc?w=640" srcset="/img/abc?w=320 320w"`)
+	assert.Contains(t, got, `alt="a cat" width="10" height="5"`)
+	assert.Contains(t, got, "<figcaption>&lt;b&gt;bold&lt;/b&gt;</figcaption>")
+	assert.Contains(t, got, `<figure class="post-image post-image-missing"><figcaption>missing image gone</figcaption></figure>`)
+	assert.True(t, strings.HasSuffix(got, "`{{< image id=\"abc\" >}}`"), got)
+
+	unchanged := []byte("no shortcodes here")
+	assert.Equal(t, unchanged, Expand(unchanged, nil))
+}
@@ -0,0 +1,267 @@
+package staticsite
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.aetherial.dev/aeth/keiji/pkg/imaging"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+// the pages that exist regardless of what is in the database, mapped to the file they are written to
+var staticPages = map[string]string{
+	"/":         "index.html",
+	"/blog":     "blog.html",
+	"/creative": "creative.html",
+	"/digital":  "digital.html",
+}
+
+// the api prefixes served out of the database/filesystem, mapped to the directory they are written to
+var fileRoutes = map[string]string{
+	"/api/v1/cdn/":    "cdn",
+	"/api/v1/assets/": "assets",
+	"/api/v1/images/": "images",
+}
+
+// matches any attribute that could hold a link to somewhere else on the site
+var linkAttr = regexp.MustCompile(`(srcset|src|href|hx-get)="([^"]*)"`)
+
+type PageRenderFailed struct {
+	Page   string
+	Status int
+}
+
+func (p *PageRenderFailed) Error() string {
+	return fmt.Sprintf("Rendering '%s' failed with status code: %v", p.Page, p.Status)
+}
+
+// What an export wrote out
+type Summary struct {
+	Pages  int
+	Images int
+	Assets int
+	Cdn    int
+}
+
+type Exporter struct {
+	handler  http.Handler
+	database storage.DocumentIO
+	files    fs.FS
+	BasePath string
+	// resized images the pages link to, by route, mapped to the file they are written to
+	variants map[string]string
+}
+
+/*
+Create a new static site exporter
+
+	:param handler: the engine with the sites routes registered, every page is rendered through it
+	:param database: the database to pull the post listing, images and assets from
+	:param files: the web content filesystem holding the cdn directory
+	:param basePath: a path prefix for every link, for hosting the site somewhere other than the root of a domain
+*/
+func NewExporter(handler http.Handler, database storage.DocumentIO, files fs.FS, basePath string) *Exporter {
+	return &Exporter{
+		handler:  handler,
+		database: database,
+		files:    files,
+		BasePath: strings.TrimSuffix(basePath, "/"),
+		variants: map[string]string{},
+	}
+}
+
+/*
+Render every public page and copy every file they depend on into a directory that
+can be uploaded to any static host as-is
+
+	:param outDir: the directory to write the site to
+*/
+func (x *Exporter) Export(outDir string) (Summary, error) {
+	var summary Summary
+	pages := map[string]string{}
+	for route, file := range staticPages {
+		pages[route] = file
+	}
+	docs, err := x.database.AllDocuments()
+	if err != nil {
+		return summary, err
+	}
+	for _, doc := range docs {
+		if doc.Category == storage.CONFIGURATION {
+			continue
+		}
+		pages["/writing/"+string(doc.Ident)] = path.Join("writing", string(doc.Ident)+".html")
+		// the comments a post loads under itself, as they were when the site was exported
+		pages["/writing/"+string(doc.Ident)+"/comments"] = path.Join("writing", string(doc.Ident), "comments.html")
+	}
+	albums, err := x.database.GetAlbums()
+	if err != nil {
+		return summary, err
+	}
+	for _, album := range albums {
+		pages["/digital/"+album.Slug] = path.Join("digital", album.Slug+".html")
+	}
+	for route, file := range pages {
+		b, err := x.render(route)
+		if err != nil {
+			return summary, err
+		}
+		if err = writeFile(path.Join(outDir, file), x.RewriteLinks(b)); err != nil {
+			return summary, err
+		}
+		summary.Pages++
+	}
+
+	imgs, err := x.database.GetAllImages()
+	if err != nil {
+		return summary, err
+	}
+	for _, img := range imgs {
+		if err := writeFile(path.Join(outDir, "images", string(img.Ident)), img.Data); err != nil {
+			return summary, err
+		}
+		summary.Images++
+	}
+	for route, file := range x.variants {
+		b, err := x.render(route)
+		if err != nil {
+			return summary, err
+		}
+		if err = writeFile(path.Join(outDir, "images", file), b); err != nil {
+			return summary, err
+		}
+		summary.Images++
+	}
+	assets, err := x.database.GetAssets()
+	if err != nil {
+		return summary, err
+	}
+	for _, asset := range assets {
+		if err := writeFile(path.Join(outDir, "assets", path.Base(asset.Name)), asset.Data); err != nil {
+			return summary, err
+		}
+		summary.Assets++
+	}
+	err = fs.WalkDir(x.files, "cdn", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(x.files, p)
+		if err != nil {
+			return err
+		}
+		summary.Cdn++
+		return writeFile(path.Join(outDir, p), b)
+	})
+	return summary, err
+}
+
+/*
+Point every internal link in a rendered page at the file it was exported to
+
+	:param page: the rendered HTML
+*/
+func (x *Exporter) RewriteLinks(page []byte) []byte {
+	return linkAttr.ReplaceAllFunc(page, func(match []byte) []byte {
+		groups := linkAttr.FindSubmatch(match)
+		if string(groups[1]) == "srcset" {
+			return []byte(fmt.Sprintf(`srcset="%s"`, x.rewriteSrcset(string(groups[2]))))
+		}
+		return []byte(fmt.Sprintf(`%s="%s"`, groups[1], x.rewrite(string(groups[2]))))
+	})
+}
+
+// map a single link to where it lives in the exported tree
+func (x *Exporter) rewrite(link string) string {
+	if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+		return link
+	}
+	for prefix, dir := range fileRoutes {
+		if strings.HasPrefix(link, prefix) {
+			name := strings.TrimPrefix(link, prefix)
+			if dir == "images" {
+				name = x.imageVariant(link, name)
+			}
+			return x.BasePath + "/" + dir + "/" + name
+		}
+	}
+	if file, ok := staticPages[link]; ok {
+		if link == "/" {
+			return x.BasePath + "/"
+		}
+		return x.BasePath + "/" + file
+	}
+	if strings.HasPrefix(link, "/writing/") || strings.HasPrefix(link, "/digital/") {
+		return x.BasePath + link + ".html"
+	}
+	return x.BasePath + link
+}
+
+// rewrite every url in a srcset, i.e. "/a.png?w=320 320w, /a.png?w=640 640w"
+func (x *Exporter) rewriteSrcset(srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i := range candidates {
+		fields := strings.Fields(candidates[i])
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = x.rewrite(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+/*
+Static hosts ignore query strings, so images asked for with ?w= are exported as their own
+file named like the variant in the image store, and queued to be rendered by Export
+
+	:param link: the link to the image
+	:param name: the link with the image route trimmed off
+*/
+func (x *Exporter) imageVariant(link, name string) string {
+	id, query, found := strings.Cut(name, "?")
+	if !found {
+		return name
+	}
+	values, _ := url.ParseQuery(query)
+	var file storage.Identifier
+	if w := values.Get("w"); w == imaging.ThumbnailParam {
+		file = imaging.ThumbnailID(storage.Identifier(id))
+	} else if width, err := strconv.Atoi(w); err == nil && width > 0 {
+		file = imaging.VariantID(storage.Identifier(id), width)
+	} else {
+		return id
+	}
+	if x.variants == nil {
+		x.variants = map[string]string{}
+	}
+	x.variants[link] = string(file)
+	return string(file)
+}
+
+// render a page by sending it through the handler like a browser would
+func (x *Exporter) render(route string) ([]byte, error) {
+	req := httptest.NewRequest(http.MethodGet, route, nil)
+	rec := httptest.NewRecorder()
+	x.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, &PageRenderFailed{Page: route, Status: rec.Code}
+	}
+	return rec.Body.Bytes(), nil
+}
+
+func writeFile(p string, data []byte) error {
+	err := os.MkdirAll(path.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o644)
+}
@@ -0,0 +1,115 @@
+package staticsite
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteLinks(t *testing.T) {
+	type testcase struct {
+		base  string
+		input string
+		want  string
+	}
+	for _, tc := range []testcase{
+		{
+			input: `<link rel="stylesheet" href="/api/v1/cdn/custom.css">`,
+			want:  `<link rel="stylesheet" href="/cdn/custom.css">`,
+		},
+		{
+			input: `<img src="/api/v1/images/abc123" loading="lazy">`,
+			want:  `<img src="/images/abc123" loading="lazy">`,
+		},
+		{
+			input: `<img src="/api/v1/images/abc123?w=1280" srcset="/api/v1/images/abc123?w=320 320w, /api/v1/images/abc123?w=thumb 256w">`,
+			want:  `<img src="/images/abc123.w1280" srcset="/images/abc123.w320 320w, /images/abc123.thumb 256w">`,
+		},
+		{
+			input: `<button hx-get="/writing/qwerty" hx-target="#main">`,
+			want:  `<button hx-get="/writing/qwerty.html" hx-target="#main">`,
+		},
+		{
+			input: `<button hx-get="/blog"><a href="/">home</a>`,
+			want:  `<button hx-get="/blog.html"><a href="/">home</a>`,
+		},
+		{
+			base:  "/mirror/",
+			input: `<img src="/api/v1/assets/git.png"/><a href="/digital">`,
+			want:  `<img src="/mirror/assets/git.png"/><a href="/mirror/digital.html">`,
+		},
+		{
+			input: `<a href="/digital/ink-paper">`,
+			want:  `<a href="/digital/ink-paper.html">`,
+		},
+		{
+			input: `<a href="https://git.aetherial.dev/aeth" target="_blank"><a href="//cdn.example.com/x.js">`,
+			want:  `<a href="https://git.aetherial.dev/aeth" target="_blank"><a href="//cdn.example.com/x.js">`,
+		},
+	} {
+		x := NewExporter(nil, nil, nil, tc.base)
+		assert.Equal(t, tc.want, string(x.RewriteLinks([]byte(tc.input))))
+	}
+}
+
+func TestExport(t *testing.T) {
+	imageStore := t.TempDir()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := storage.NewSQLiteRepo(db, storage.FilesystemImageIO{RootDir: imageStore})
+	if err = repo.Migrate(storage.RequiredTables); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := repo.AddDocument(storage.Document{Title: "abc 123", Body: "body", Created: "2024-12-31", Category: storage.BLOG})
+	repo.AddDocument(storage.Document{Title: "hidden", Body: "body", Created: "2024-12-31", Category: storage.CONFIGURATION})
+	imgId, _ := repo.AddImage([]byte("\x89PNG\r\n\x1a\nabc123xyz098"), "title", "desc")
+	repo.AddAsset("menu.png", []byte("pngdata"))
+	repo.AddAlbum(storage.Album{Name: "Ink & Paper", Images: []storage.Identifier{imgId}})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<a hx-get="/writing/%s">%s</a>`, id, r.URL.Path)
+	})
+	files := fstest.MapFS{"cdn/custom.css": &fstest.MapFile{Data: []byte("body {}")}}
+	out := t.TempDir()
+	summary, err := NewExporter(handler, repo, files, "").Export(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Summary{Pages: 7, Images: 1, Assets: 1, Cdn: 1}, summary)
+
+	b, err := os.ReadFile(path.Join(out, "writing", string(id)+".html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf(`<a hx-get="/writing/%s.html">/writing/%s</a>`, id, id), string(b))
+	for _, file := range []string{"index.html", "blog.html", "creative.html", "digital.html", "digital/ink-paper.html", "writing/" + string(id) + "/comments.html", "cdn/custom.css", "assets/menu.png", "images/" + string(imgId)} {
+		_, err := os.Stat(path.Join(out, file))
+		assert.NoError(t, err, file)
+	}
+}
+
+func TestExportRenderFailed(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := storage.NewSQLiteRepo(db, storage.FilesystemImageIO{RootDir: t.TempDir()})
+	if err = repo.Migrate(storage.RequiredTables); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	_, err = NewExporter(handler, repo, fstest.MapFS{}, "").Export(t.TempDir())
+	assert.IsType(t, &PageRenderFailed{}, err)
+}
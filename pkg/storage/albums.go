@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A named, ordered collection of images in the digital art section. Images can be in any number of albums
+type Album struct {
+	Ident    Identifier   `json:"identifier"`
+	Name     string       `json:"name" form:"name"`
+	Slug     string       `json:"slug" form:"slug"`
+	Desc     string       `json:"description" form:"description"`
+	Cover    Identifier   `json:"cover" form:"cover"`
+	Position int          `json:"position" form:"position"`
+	Created  string       `json:"created"`
+	Images   []Identifier `json:"images"`
+}
+
+/*
+Make a url safe slug out of a name, i.e. 'Ink & Paper, 2024' becomes 'ink-paper-2024'
+
+	:param name: the name to slugify
+*/
+func Slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+/*
+Get every album, in the order they are shown on the digital art page
+*/
+func (s *SQLiteRepo) GetAlbums() ([]Album, error) {
+	rows, err := s.db.Query("SELECT " + albumColumns + " FROM albums ORDER BY position, row")
+	if err != nil {
+		return nil, err
+	}
+	albums := []Album{}
+	for rows.Next() {
+		album, err := scanAlbum(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		albums = append(albums, album)
+	}
+	rows.Close()
+	for i := range albums {
+		if albums[i].Images, err = s.albumMembers(albums[i].Ident); err != nil {
+			return nil, err
+		}
+	}
+	return albums, nil
+}
+
+/*
+Get an album and the identifiers of its images
+
+	:param id: the Identifier of the album
+*/
+func (s *SQLiteRepo) GetAlbum(id Identifier) (Album, error) {
+	return s.getAlbum("SELECT "+albumColumns+" FROM albums WHERE id = ?", id)
+}
+
+/*
+Get an album by the slug it is served under
+
+	:param slug: the slug of the album
+*/
+func (s *SQLiteRepo) GetAlbumBySlug(slug string) (Album, error) {
+	if slug == "" {
+		return Album{}, ErrNotExists
+	}
+	return s.getAlbum("SELECT "+albumColumns+" FROM albums WHERE slug = ?", slug)
+}
+
+func (s *SQLiteRepo) getAlbum(query string, arg any) (Album, error) {
+	album, err := scanAlbum(s.db.QueryRow(query, arg))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Album{}, ErrNotExists
+		}
+		return Album{}, err
+	}
+	album.Images, err = s.albumMembers(album.Ident)
+	return album, err
+}
+
+/*
+Get the images in an album, in order, without their data
+
+	:param id: the Identifier of the album
+*/
+func (s *SQLiteRepo) GetAlbumImages(id Identifier) ([]Image, error) {
+	if _, err := s.GetAlbum(id); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+prefixColumns("images", imageColumns)+` FROM album_images
+		JOIN images ON images.id = album_images.image WHERE album_images.album = ? ORDER BY album_images.position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imgs := []Image{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
+}
+
+/*
+Create an album, its slug is made from the name if it doesnt have one. Returns
+ErrDuplicate if another album already has the slug
+
+	:param album: the album to create, the images are added in the order given
+*/
+func (s *SQLiteRepo) AddAlbum(album Album) (Identifier, error) {
+	if album.Slug == "" {
+		album.Slug = Slugify(album.Name)
+	}
+	id := newIdentifier()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Identifier(""), err
+	}
+	_, err = tx.Exec("INSERT INTO albums (id, name, slug, desc, cover, position, created) VALUES (?,?,?,?,?,?,?)",
+		id, album.Name, album.Slug, album.Desc, album.Cover, album.Position, time.Now().String())
+	if err != nil {
+		tx.Rollback()
+		return Identifier(""), uniqueErr(err)
+	}
+	if err = setMembers(tx, id, album.Images); err != nil {
+		tx.Rollback()
+		return Identifier(""), err
+	}
+	return id, tx.Commit()
+}
+
+/*
+Update the name, slug, description, cover and position of an album, keyed off of its
+Identifier. The images in it are changed with SetAlbumImages
+
+	:param album: the album to update
+*/
+func (s *SQLiteRepo) UpdateAlbum(album Album) error {
+	if album.Slug == "" {
+		album.Slug = Slugify(album.Name)
+	}
+	res, err := s.db.Exec("UPDATE albums SET name = ?, slug = ?, desc = ?, cover = ?, position = ? WHERE id = ?",
+		album.Name, album.Slug, album.Desc, album.Cover, album.Position, album.Ident)
+	if err != nil {
+		return uniqueErr(err)
+	}
+	return expectRow(res)
+}
+
+/*
+Delete an album, the images in it are left alone
+
+	:param id: the Identifier of the album
+*/
+func (s *SQLiteRepo) DeleteAlbum(id Identifier) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM album_images WHERE album = ?", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM albums WHERE id = ?", id)
+	if err == nil {
+		err = expectRow(res)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Replace the images in an album, they are shown in the order given
+
+	:param id: the Identifier of the album
+	:param images: the identifiers of the images, every one of them has to exist
+*/
+func (s *SQLiteRepo) SetAlbumImages(id Identifier, images []Identifier) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	exists, err := rowExists(tx, "SELECT COUNT(*) FROM albums WHERE id = ?", id)
+	if err == nil && !exists {
+		err = ErrNotExists
+	}
+	if err == nil {
+		err = setMembers(tx, id, images)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Put the albums in the order given, any not listed keep their position after them
+
+	:param ids: the identifiers of the albums, first to last
+*/
+func (s *SQLiteRepo) ReorderAlbums(ids []Identifier) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		res, err := tx.Exec("UPDATE albums SET position = ? WHERE id = ?", i, id)
+		if err == nil {
+			err = expectRow(res)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the identifiers of the images in an album, in order
+func (s *SQLiteRepo) albumMembers(id Identifier) ([]Identifier, error) {
+	rows, err := s.db.Query("SELECT image FROM album_images WHERE album = ? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []Identifier{}
+	for rows.Next() {
+		var img Identifier
+		if err := rows.Scan(&img); err != nil {
+			return nil, err
+		}
+		ids = append(ids, img)
+	}
+	return ids, rows.Err()
+}
+
+// replace the images in an album inside of the callers transaction
+func setMembers(tx *sql.Tx, id Identifier, images []Identifier) error {
+	if _, err := tx.Exec("DELETE FROM album_images WHERE album = ?", id); err != nil {
+		return err
+	}
+	seen := map[Identifier]bool{}
+	for _, img := range images {
+		if seen[img] {
+			continue
+		}
+		seen[img] = true
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM images WHERE id = ?", img)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotExists
+		}
+		if _, err = tx.Exec("INSERT INTO album_images (album, image, position) VALUES (?,?,?)", id, img, len(seen)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return ErrNotExists if a statement didnt touch any rows
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotExists
+	}
+	return nil
+}
+
+// turn a unique constraint violation into ErrDuplicate
+func uniqueErr(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrDuplicate
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlugify(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+	}
+	for _, tc := range []testcase{
+		{input: "Sketches", want: "sketches"},
+		{input: "Ink & Paper, 2024", want: "ink-paper-2024"},
+		{input: "  --leading and trailing--  ", want: "leading-and-trailing"},
+		{input: "日本 の 絵", want: "日本-の-絵"},
+		{input: "!!!", want: ""},
+	} {
+		assert.Equal(t, tc.want, Slugify(tc.input), tc.input)
+	}
+}
+
+func TestAlbums(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	var imgs []Identifier
+	for _, title := range []string{"one", "two", "three"} {
+		id, err := testDb.AddImage(testPng, title, "desc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs = append(imgs, id)
+	}
+
+	first, err := testDb.AddAlbum(Album{Name: "Ink & Paper", Images: []Identifier{imgs[2], imgs[0]}})
+	assert.NoError(t, err)
+	second, err := testDb.AddAlbum(Album{Name: "Pixels", Slug: "pixels", Position: 1})
+	assert.NoError(t, err)
+	_, err = testDb.AddAlbum(Album{Name: "Pixels again", Slug: "pixels"})
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = testDb.AddAlbum(Album{Name: "missing image", Images: []Identifier{"nope"}})
+	assert.Equal(t, ErrNotExists, err)
+
+	album, err := testDb.GetAlbumBySlug("ink-paper")
+	assert.NoError(t, err)
+	assert.Equal(t, first, album.Ident)
+	assert.Equal(t, []Identifier{imgs[2], imgs[0]}, album.Images)
+	_, err = testDb.GetAlbumBySlug("")
+	assert.Equal(t, ErrNotExists, err)
+
+	assert.NoError(t, testDb.SetAlbumImages(first, []Identifier{imgs[1], imgs[2], imgs[1]}))
+	members, err := testDb.GetAlbumImages(first)
+	assert.NoError(t, err)
+	assert.Len(t, members, 2)
+	assert.Equal(t, "two", members[0].Title)
+	assert.Equal(t, "three", members[1].Title)
+	assert.Nil(t, members[0].Data)
+	assert.Equal(t, ErrNotExists, testDb.SetAlbumImages("nope", imgs))
+	_, err = testDb.GetAlbumImages("nope")
+	assert.Equal(t, ErrNotExists, err)
+
+	album.Cover = imgs[1]
+	album.Desc = "drawings"
+	assert.NoError(t, testDb.UpdateAlbum(album))
+	assert.Equal(t, ErrNotExists, testDb.UpdateAlbum(Album{Ident: "nope", Name: "nope"}))
+	assert.Equal(t, ErrDuplicate, testDb.UpdateAlbum(Album{Ident: second, Name: "Pixels", Slug: "ink-paper"}))
+
+	assert.NoError(t, testDb.ReorderAlbums([]Identifier{second, first}))
+	albums, err := testDb.GetAlbums()
+	assert.NoError(t, err)
+	assert.Len(t, albums, 2)
+	assert.Equal(t, second, albums[0].Ident)
+	assert.Equal(t, first, albums[1].Ident)
+	assert.Equal(t, "drawings", albums[1].Desc)
+	assert.Equal(t, ErrNotExists, testDb.ReorderAlbums([]Identifier{"nope"}))
+
+	// deleting an image takes it out of its albums, and off of the cover
+	assert.NoError(t, testDb.DeleteImage(imgs[1]))
+	album, err = testDb.GetAlbum(first)
+	assert.NoError(t, err)
+	assert.Equal(t, []Identifier{imgs[2]}, album.Images)
+	assert.Equal(t, Identifier(""), album.Cover)
+
+	assert.NoError(t, testDb.DeleteAlbum(first))
+	_, err = testDb.GetAlbum(first)
+	assert.Equal(t, ErrNotExists, err)
+	assert.Equal(t, ErrNotExists, testDb.DeleteAlbum(first))
+	_, err = testDb.GetImage(imgs[2])
+	assert.NoError(t, err)
+}
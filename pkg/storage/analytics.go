@@ -0,0 +1,110 @@
+package storage
+
+/*
+How many times a page was viewed on a day, from one referring site with one kind of browser.
+Views are only kept rolled up like this, nothing that could tell readers apart is stored
+*/
+type PageView struct {
+	Day      string `json:"day"`
+	Path     string `json:"path"`
+	Referrer string `json:"referrer"`
+	Agent    string `json:"agent"`
+	Views    int    `json:"views"`
+}
+
+/*
+A count of views for the analytics dashboard, of a day, a page, a referrer or a browser.
+Title is only filled in by GetTopPages, for pages that are posts
+*/
+type ViewCount struct {
+	Key   string `json:"key"`
+	Title string `json:"title,omitempty"`
+	Views int    `json:"views"`
+}
+
+/*
+Add page views to the daily rollups, adding to the counts that are already there
+
+	:param views: the views to add, i.e. the ones recorded since the last time they were added
+*/
+func (s *SQLiteRepo) AddPageViews(views []PageView) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, view := range views {
+		_, err := tx.Exec(`INSERT INTO page_views(day, path, referrer, agent, views) VALUES (?,?,?,?,?)
+			ON CONFLICT(day, path, referrer, agent) DO UPDATE SET views = views + excluded.views`,
+			view.Day, view.Path, view.Referrer, view.Agent, view.Views)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+Get the views of every day between two days that had any, oldest first
+
+	:param from: the first day, as YYYY-MM-DD
+	:param to: the last day, as YYYY-MM-DD
+*/
+func (s *SQLiteRepo) GetDailyViews(from, to string) ([]ViewCount, error) {
+	return s.countViews("SELECT day, '', SUM(views) FROM page_views WHERE day BETWEEN ? AND ? GROUP BY day ORDER BY day", from, to)
+}
+
+/*
+Get the most viewed pages between two days, with the titles of the ones that are posts
+
+	:param from: the first day, as YYYY-MM-DD
+	:param to: the last day, as YYYY-MM-DD
+	:param limit: how many to get
+*/
+func (s *SQLiteRepo) GetTopPages(from, to string, limit int) ([]ViewCount, error) {
+	return s.countViews(`SELECT page_views.path, COALESCE(MAX(posts.title), ''), SUM(page_views.views) AS total FROM page_views
+		LEFT JOIN posts ON page_views.path = '/writing/' || posts.id
+		WHERE page_views.day BETWEEN ? AND ? GROUP BY page_views.path ORDER BY total DESC, page_views.path LIMIT ?`, from, to, limit)
+}
+
+/*
+Get the sites that sent the most readers between two days, views without a referrer left out
+
+	:param from: the first day, as YYYY-MM-DD
+	:param to: the last day, as YYYY-MM-DD
+	:param limit: how many to get
+*/
+func (s *SQLiteRepo) GetTopReferrers(from, to string, limit int) ([]ViewCount, error) {
+	return s.countViews(`SELECT referrer, '', SUM(views) AS total FROM page_views
+		WHERE day BETWEEN ? AND ? AND referrer != '' GROUP BY referrer ORDER BY total DESC, referrer LIMIT ?`, from, to, limit)
+}
+
+/*
+Get the browsers readers used most between two days
+
+	:param from: the first day, as YYYY-MM-DD
+	:param to: the last day, as YYYY-MM-DD
+	:param limit: how many to get
+*/
+func (s *SQLiteRepo) GetTopAgents(from, to string, limit int) ([]ViewCount, error) {
+	return s.countViews(`SELECT agent, '', SUM(views) AS total FROM page_views
+		WHERE day BETWEEN ? AND ? GROUP BY agent ORDER BY total DESC, agent LIMIT ?`, from, to, limit)
+}
+
+// run a query selecting the key, title and views of ViewCounts
+func (s *SQLiteRepo) countViews(query string, args ...any) ([]ViewCount, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []ViewCount{}
+	for rows.Next() {
+		var count ViewCount
+		if err := rows.Scan(&count.Key, &count.Title, &count.Views); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
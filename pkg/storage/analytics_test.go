@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageViews(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	post, err := testDb.AddDocument(Document{Title: "a post", Body: "body", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postPath := "/writing/" + string(post)
+	assert.NoError(t, testDb.AddPageViews([]PageView{
+		{Day: "2025-01-01", Path: "/", Agent: "Firefox", Views: 3},
+		{Day: "2025-01-01", Path: postPath, Referrer: "news.example", Agent: "Firefox", Views: 2},
+		{Day: "2025-01-02", Path: postPath, Referrer: "news.example", Agent: "Chrome mobile", Views: 4},
+		{Day: "2025-01-02", Path: "/blog", Referrer: "search.example", Agent: "Chrome mobile", Views: 1},
+		{Day: "2025-02-01", Path: "/blog", Agent: "Safari", Views: 10},
+	}))
+	// adding to a rollup that is already there adds to its count
+	assert.NoError(t, testDb.AddPageViews([]PageView{{Day: "2025-01-01", Path: "/", Agent: "Firefox", Views: 1}}))
+
+	daily, err := testDb.GetDailyViews("2025-01-01", "2025-01-31")
+	assert.NoError(t, err)
+	assert.Equal(t, []ViewCount{{Key: "2025-01-01", Views: 6}, {Key: "2025-01-02", Views: 5}}, daily)
+
+	pages, err := testDb.GetTopPages("2025-01-01", "2025-01-31", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []ViewCount{{Key: postPath, Title: "a post", Views: 6}, {Key: "/", Views: 4}, {Key: "/blog", Views: 1}}, pages)
+	pages, err = testDb.GetTopPages("2025-01-01", "2025-01-31", 1)
+	assert.NoError(t, err)
+	assert.Len(t, pages, 1)
+
+	referrers, err := testDb.GetTopReferrers("2025-01-01", "2025-01-31", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []ViewCount{{Key: "news.example", Views: 6}, {Key: "search.example", Views: 1}}, referrers)
+
+	agents, err := testDb.GetTopAgents("2025-01-01", "2025-12-31", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []ViewCount{{Key: "Safari", Views: 10}, {Key: "Firefox", Views: 6}, {Key: "Chrome mobile", Views: 5}}, agents)
+
+	none, err := testDb.GetDailyViews("2024-01-01", "2024-12-31")
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Where a comment is in moderation, only approved comments are shown on the site
+type CommentStatus string
+
+const (
+	COMMENT_PENDING  = CommentStatus("pending")
+	COMMENT_APPROVED = CommentStatus("approved")
+	COMMENT_REJECTED = CommentStatus("rejected")
+	COMMENT_SPAM     = CommentStatus("spam")
+)
+
+// every status, in the order the moderation queue offers them
+var CommentStatuses = []CommentStatus{COMMENT_PENDING, COMMENT_APPROVED, COMMENT_REJECTED, COMMENT_SPAM}
+
+/*
+A readers comment on a post. The body is markdown, and is rendered with the comment
+renderer rather than the one posts use. A reply names the comment it answers as its Parent
+*/
+type Comment struct {
+	Ident     Identifier    `json:"id"`
+	Post      Identifier    `json:"post"`
+	Parent    Identifier    `json:"parent" form:"parent"`
+	Name      string        `json:"name" form:"name"`
+	Email     string        `json:"email" form:"email"`
+	URL       string        `json:"url" form:"url"`
+	Body      string        `json:"body" form:"body"`
+	Status    CommentStatus `json:"status"`
+	Created   string        `json:"created"`
+	PostTitle string        `json:"post_title,omitempty"` // only filled in by GetCommentQueue
+}
+
+/*
+Add a comment to a post. The post has to exist and be open for comments, and a reply has
+to answer a comment on the same post, ErrNotExists is returned otherwise
+
+	:param comment: the comment to add, its Status defaults to COMMENT_PENDING
+*/
+func (s *SQLiteRepo) AddComment(comment Comment) (Identifier, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	open, err := rowExists(tx, "SELECT COUNT(*) FROM posts WHERE id = ? AND comments_closed = 0", comment.Post)
+	if err != nil {
+		return "", err
+	}
+	if !open {
+		return "", ErrNotExists
+	}
+	if comment.Parent != "" {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM comments WHERE id = ? AND post = ?", comment.Parent, comment.Post)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", ErrNotExists
+		}
+	}
+	if comment.Status == "" {
+		comment.Status = COMMENT_PENDING
+	}
+	comment.Ident = newIdentifier()
+	_, err = tx.Exec("INSERT INTO comments("+commentColumns+") VALUES (?,?,?,?,?,?,?,?,?)",
+		comment.Ident, comment.Post, comment.Parent, comment.Name, comment.Email, comment.URL, comment.Body, comment.Status,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return "", err
+	}
+	return comment.Ident, tx.Commit()
+}
+
+/*
+Get a single comment
+
+	:param id: the Identifier of the comment
+*/
+func (s *SQLiteRepo) GetComment(id Identifier) (Comment, error) {
+	comment, err := scanComment(s.db.QueryRow("SELECT "+commentColumns+" FROM comments WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Comment{}, ErrNotExists
+	}
+	return comment, err
+}
+
+/*
+Get the comments on a post with a status, oldest first
+
+	:param post: the Identifier of the post
+	:param status: the status of the comments to get
+*/
+func (s *SQLiteRepo) GetComments(post Identifier, status CommentStatus) ([]Comment, error) {
+	rows, err := s.db.Query("SELECT "+commentColumns+" FROM comments WHERE post = ? AND status = ? ORDER BY row", post, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+/*
+Get the comments on every post with a status, oldest first, along with the title of the
+post each is on
+
+	:param status: the status of the comments to get, i.e. COMMENT_PENDING for the moderation queue
+*/
+func (s *SQLiteRepo) GetCommentQueue(status CommentStatus) ([]Comment, error) {
+	rows, err := s.db.Query(`SELECT `+prefixColumns("comments", commentColumns)+`, posts.title FROM comments
+		JOIN posts ON posts.id = comments.post WHERE comments.status = ? ORDER BY comments.row`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []Comment{}
+	for rows.Next() {
+		var comment Comment
+		err := rows.Scan(&comment.Ident, &comment.Post, &comment.Parent, &comment.Name, &comment.Email, &comment.URL,
+			&comment.Body, &comment.Status, &comment.Created, &comment.PostTitle)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+/*
+Moderate a comment
+
+	:param id: the Identifier of the comment
+	:param status: the status to move it to
+*/
+func (s *SQLiteRepo) SetCommentStatus(id Identifier, status CommentStatus) error {
+	res, err := s.db.Exec("UPDATE comments SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+/*
+Open or close a post for new comments, the comments it already has stay
+
+	:param post: the Identifier of the post
+	:param closed: whether new comments are turned away
+*/
+func (s *SQLiteRepo) SetCommentsClosed(post Identifier, closed bool) error {
+	res, err := s.db.Exec("UPDATE posts SET comments_closed = ? WHERE id = ?", closed, post)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
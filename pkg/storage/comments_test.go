@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComments(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	post, err := testDb.AddDocument(Document{Title: "post", Body: "body", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := testDb.AddDocument(Document{Title: "other", Body: "body", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := testDb.AddComment(Comment{Post: post, Name: "a", Email: "a@example.com", Body: "first"})
+	assert.NoError(t, err)
+	reply, err := testDb.AddComment(Comment{Post: post, Parent: first, Name: "b", Body: "a reply"})
+	assert.NoError(t, err)
+	spam, err := testDb.AddComment(Comment{Post: post, Name: "c", Body: "buy things", Status: COMMENT_SPAM})
+	assert.NoError(t, err)
+
+	// replies have to be to a comment on the same post, and the post has to exist
+	_, err = testDb.AddComment(Comment{Post: other, Parent: first, Name: "d", Body: "wrong post"})
+	assert.Equal(t, ErrNotExists, err)
+	_, err = testDb.AddComment(Comment{Post: "missing", Name: "d", Body: "no post"})
+	assert.Equal(t, ErrNotExists, err)
+
+	got, err := testDb.GetComment(first)
+	assert.NoError(t, err)
+	assert.Equal(t, COMMENT_PENDING, got.Status)
+	assert.Equal(t, "a@example.com", got.Email)
+	assert.NotEmpty(t, got.Created)
+	_, err = testDb.GetComment("missing")
+	assert.Equal(t, ErrNotExists, err)
+
+	queue, err := testDb.GetCommentQueue(COMMENT_PENDING)
+	assert.NoError(t, err)
+	if assert.Len(t, queue, 2) {
+		assert.Equal(t, []Identifier{first, reply}, []Identifier{queue[0].Ident, queue[1].Ident})
+		assert.Equal(t, "post", queue[0].PostTitle)
+	}
+	queue, err = testDb.GetCommentQueue(COMMENT_SPAM)
+	assert.NoError(t, err)
+	assert.Len(t, queue, 1)
+
+	approved, err := testDb.GetComments(post, COMMENT_APPROVED)
+	assert.NoError(t, err)
+	assert.Empty(t, approved)
+	assert.NoError(t, testDb.SetCommentStatus(first, COMMENT_APPROVED))
+	assert.NoError(t, testDb.SetCommentStatus(reply, COMMENT_APPROVED))
+	assert.Equal(t, ErrNotExists, testDb.SetCommentStatus("missing", COMMENT_APPROVED))
+	approved, err = testDb.GetComments(post, COMMENT_APPROVED)
+	assert.NoError(t, err)
+	if assert.Len(t, approved, 2) {
+		assert.Equal(t, first, approved[0].Ident)
+		assert.Equal(t, first, approved[1].Parent)
+	}
+
+	// a closed post keeps its comments but takes no new ones
+	assert.NoError(t, testDb.SetCommentsClosed(post, true))
+	doc, err := testDb.GetDocument(post)
+	assert.NoError(t, err)
+	assert.True(t, doc.CommentsClosed)
+	_, err = testDb.AddComment(Comment{Post: post, Name: "e", Body: "too late"})
+	assert.Equal(t, ErrNotExists, err)
+	approved, err = testDb.GetComments(post, COMMENT_APPROVED)
+	assert.NoError(t, err)
+	assert.Len(t, approved, 2)
+	assert.NoError(t, testDb.SetCommentsClosed(post, false))
+	assert.Equal(t, ErrNotExists, testDb.SetCommentsClosed("missing", true))
+
+	// deleting the post deletes its comments
+	assert.NoError(t, testDb.DeleteDocument(post))
+	_, err = testDb.GetComment(spam)
+	assert.Equal(t, ErrNotExists, err)
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+/*
+The version of a post, bumped every time it is updated. It unmarshals from a json string
+as well as a number, since that is how the editors form sends it
+*/
+type Version int
+
+// Unmarshal a version from a json number or a string holding one, an empty string is version 0
+func (v *Version) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*v = Version(n)
+		return nil
+	}
+	if s == "" {
+		*v = 0
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = Version(n)
+	return nil
+}
+
+/*
+The unsaved state of a post in the editor, saved periodically so that closing the tab
+doesnt lose it. A post has at most one draft, which is discarded when the post is saved.
+The draft of a post that hasnt been created yet is kept under a token the editor was given
+instead, since the id in the form can be edited
+*/
+type Draft struct {
+	Post     Identifier `json:"draft"` // the post, or the token of the editor for a new post
+	Title    string     `json:"title"`
+	Body     string     `json:"body"`
+	Category string     `json:"category"`
+	Slug     string     `json:"slug"`
+	Tags     string     `json:"tags"`
+	Version  Version    `json:"version"` // the version of the post the draft was started from
+	Saved    string     `json:"saved"`
+}
+
+/*
+Get the draft of a post
+
+	:param post: the Identifier of the post, or the token of the editor for a new post
+*/
+func (s *SQLiteRepo) GetDraft(post Identifier) (Draft, error) {
+	draft, err := scanDraft(s.db.QueryRow("SELECT "+draftColumns+" FROM drafts WHERE post = ?", post))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Draft{}, ErrNotExists
+	}
+	return draft, err
+}
+
+/*
+Save the draft of a post, replacing the one it had
+
+	:param draft: the draft to save, its Saved time is set to now
+*/
+func (s *SQLiteRepo) SaveDraft(draft Draft) error {
+	_, err := s.db.Exec(`INSERT INTO drafts(`+draftColumns+`) VALUES (?,?,?,?,?,?,?,?)
+		ON CONFLICT(post) DO UPDATE SET title = excluded.title, body = excluded.body, category = excluded.category,
+		slug = excluded.slug, tags = excluded.tags, version = excluded.version, saved = excluded.saved`,
+		draft.Post, draft.Title, draft.Body, draft.Category, draft.Slug, draft.Tags, draft.Version, updatedNow())
+	return err
+}
+
+/*
+Discard the draft of a post, discarding one that doesnt exist is not an error
+
+	:param post: the Identifier of the post, or the token of the editor for a new post
+*/
+func (s *SQLiteRepo) DeleteDraft(post Identifier) error {
+	_, err := s.db.Exec("DELETE FROM drafts WHERE post = ?", post)
+	return err
+}
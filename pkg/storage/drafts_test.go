@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionUnmarshal(t *testing.T) {
+	type testcase struct {
+		input   string
+		want    Version
+		wantErr bool
+	}
+	for _, tc := range []testcase{
+		{input: `{"version": 3}`, want: 3},
+		{input: `{"version": "3"}`, want: 3},
+		{input: `{"version": ""}`, want: 0},
+		{input: `{}`, want: 0},
+		{input: `{"version": "three"}`, wantErr: true},
+		{input: `{"version": true}`, wantErr: true},
+	} {
+		var doc Document
+		err := json.Unmarshal([]byte(tc.input), &doc)
+		if tc.wantErr {
+			assert.Error(t, err, tc.input)
+			continue
+		}
+		assert.NoError(t, err, tc.input)
+		assert.Equal(t, tc.want, doc.Version, tc.input)
+	}
+}
+
+func TestUpdateDocumentVersion(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	id, err := testDb.AddDocument(Document{Title: "post", Body: "first", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := testDb.GetDocument(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Version(1), doc.Version)
+
+	// two editors open the post, the second one to save conflicts
+	first, second := doc, doc
+	first.Body = "from the first editor"
+	second.Body = "from the second editor"
+	assert.NoError(t, testDb.UpdateDocument(first))
+	assert.Equal(t, ErrConflict, testDb.UpdateDocument(second))
+	doc, err = testDb.GetDocument(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "from the first editor", doc.Body)
+	assert.Equal(t, Version(2), doc.Version)
+
+	// saving against the current version goes through, and so does not sending one
+	second.Version = 2
+	assert.NoError(t, testDb.UpdateDocument(second))
+	second.Version = 0
+	second.Body = "without a version"
+	assert.NoError(t, testDb.UpdateDocument(second))
+	doc, err = testDb.GetDocument(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "without a version", doc.Body)
+	assert.Equal(t, Version(4), doc.Version)
+
+	assert.Equal(t, ErrNotExists, testDb.UpdateDocument(Document{Ident: "missing", Version: 1}))
+}
+
+func TestDrafts(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	id, err := testDb.AddDocument(Document{Title: "post", Body: "saved", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testDb.GetDraft(id)
+	assert.Equal(t, ErrNotExists, err)
+
+	assert.NoError(t, testDb.SaveDraft(Draft{Post: id, Title: "post", Body: "typing", Category: BLOG, Version: 1}))
+	assert.NoError(t, testDb.SaveDraft(Draft{Post: id, Title: "post", Body: "typing more", Category: BLOG, Version: 1}))
+	assert.NoError(t, testDb.SaveDraft(Draft{Post: "new:token", Title: "new", Body: "not created yet"}))
+	draft, err := testDb.GetDraft(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "typing more", draft.Body)
+	assert.Equal(t, Version(1), draft.Version)
+	assert.NotEmpty(t, draft.Saved)
+	draft, err = testDb.GetDraft("new:token")
+	assert.NoError(t, err)
+	assert.Equal(t, "not created yet", draft.Body)
+
+	// a failed save keeps the draft, a successful one discards it
+	assert.Equal(t, ErrConflict, testDb.UpdateDocument(Document{Ident: id, Body: "typing more", Version: 7}))
+	_, err = testDb.GetDraft(id)
+	assert.NoError(t, err)
+	assert.NoError(t, testDb.UpdateDocument(Document{Ident: id, Body: "typing more", Version: 1}))
+	_, err = testDb.GetDraft(id)
+	assert.Equal(t, ErrNotExists, err)
+
+	assert.NoError(t, testDb.SaveDraft(Draft{Post: id, Body: "again", Version: 2}))
+	assert.NoError(t, testDb.DeleteDocument(id))
+	_, err = testDb.GetDraft(id)
+	assert.Equal(t, ErrNotExists, err)
+	assert.NoError(t, testDb.DeleteDraft("new:token"))
+	assert.NoError(t, testDb.DeleteDraft("new:token"))
+	_, err = testDb.GetDraft("new:token")
+	assert.Equal(t, ErrNotExists, err)
+
+	// the editor sends the post id it can edit as well as the draft key it cant, only the key is used
+	var sent Draft
+	assert.NoError(t, json.Unmarshal([]byte(`{"id": "renamed", "draft": "new:token", "version": "1"}`), &sent))
+	assert.Equal(t, Identifier("new:token"), sent.Post)
+}
@@ -0,0 +1,806 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/exif"
+)
+
+// Bump this whenever the layout of the archive changes in a way older readers cant handle
+const ArchiveVersion = 1
+
+const (
+	manifestFile = "manifest.json"
+	siteFile     = "site.json"
+	imageDir     = "images"
+)
+
+type ImportMode string
+
+const (
+	// Upsert everything in the archive, leaving rows that arent in the archive alone
+	IMPORT_MERGE ImportMode = "merge"
+	// Wipe the site tables before loading the archive. Followers, subscribers, webhooks, signing
+	// keys and page views arent part of the archive, so they are left alone
+	IMPORT_REPLACE ImportMode = "replace"
+)
+
+var ErrInvalidArchive = errors.New("archive is missing required files")
+
+type UnsupportedArchiveVersion struct{ Version int }
+
+func (u *UnsupportedArchiveVersion) Error() string {
+	return fmt.Sprintf("Archive version %v is not supported, newest supported version is %v", u.Version, ArchiveVersion)
+}
+
+type InvalidImportMode struct{ Mode ImportMode }
+
+func (i *InvalidImportMode) Error() string {
+	return fmt.Sprintf("Invalid import mode was passed: '%s'", i.Mode)
+}
+
+/*
+Describes the contents of an export archive, always the first file in the tarball
+*/
+type Manifest struct {
+	Version int            `json:"version"`
+	Created string         `json:"created"`
+	Counts  map[string]int `json:"counts"`
+}
+
+/*
+Tally of what an import did, keyed by table name
+*/
+type ImportSummary struct {
+	Created map[string]int `json:"created"`
+	Updated map[string]int `json:"updated"`
+	// the images whose files were written or removed, any variants made of them are stale
+	Images []Identifier `json:"-"`
+}
+
+func newImportSummary() ImportSummary {
+	return ImportSummary{Created: map[string]int{}, Updated: map[string]int{}}
+}
+
+// image metadata as its written to the archive, the blob lives in its own file
+type archivedImage struct {
+	Ident   Identifier `json:"identifier"`
+	Title   string     `json:"title"`
+	Desc    string     `json:"description"`
+	Created string     `json:"created"`
+	Mime    string     `json:"mime,omitempty"`
+	Width   int        `json:"width,omitempty"`
+	Height  int        `json:"height,omitempty"`
+	Camera  string     `json:"camera,omitempty"`
+	Taken   string     `json:"taken,omitempty"`
+}
+
+// the json document holding everything but the image blobs
+type archivedSite struct {
+	Posts    []Document      `json:"posts"`
+	Images   []archivedImage `json:"images"`
+	Assets   []Asset         `json:"assets"`
+	Menu     []LinkPair      `json:"menu"`
+	Navbar   []NavBarItem    `json:"navbar"`
+	Admin    AdminPage       `json:"admin"`
+	Albums   []Album         `json:"albums,omitempty"`
+	Comments []Comment       `json:"comments,omitempty"`
+	Mentions []Mention       `json:"mentions,omitempty"`
+	Drafts   []Draft         `json:"drafts,omitempty"`
+}
+
+/*
+Pull every row (and every image blob) out of the database
+*/
+func (s *SQLiteRepo) ExtractAll() (DatabaseSchema, error) {
+	schema := DatabaseSchema{Admin: AdminPage{Tables: map[string][]TableData{}}}
+
+	rows, err := s.db.Query("SELECT " + postColumns + " FROM posts")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Posts = append(schema.Posts, doc)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT " + imageColumns + " FROM images")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Images = append(schema.Images, img)
+	}
+	rows.Close()
+	for i := range schema.Images {
+		b, err := s.imageIO.Get(schema.Images[i].Ident)
+		if err != nil {
+			return schema, err
+		}
+		schema.Images[i].Data = b
+	}
+
+	rows, err = s.db.Query("SELECT name, data FROM assets")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		var item Asset
+		if err := rows.Scan(&item.Name, &item.Data); err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Assets = append(schema.Assets, item)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT link, text FROM menu")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		var item LinkPair
+		if err := rows.Scan(&item.Link, &item.Text); err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Menu = append(schema.Menu, item)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT png, link, redirect FROM navbar")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		var item NavBarItem
+		if err := rows.Scan(&item.Png, &item.Link, &item.Redirect); err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Navbar = append(schema.Navbar, item)
+	}
+	rows.Close()
+
+	albums, err := s.GetAlbums()
+	if err != nil {
+		return schema, err
+	}
+	schema.Albums = append(schema.Albums, albums...)
+
+	rows, err = s.db.Query("SELECT " + commentColumns + " FROM comments ORDER BY row")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Comments = append(schema.Comments, comment)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT " + mentionColumns + " FROM mentions ORDER BY row")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		mention, err := scanMention(rows)
+		if err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Mentions = append(schema.Mentions, mention)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT " + draftColumns + " FROM drafts ORDER BY post")
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		draft, err := scanDraft(rows)
+		if err != nil {
+			rows.Close()
+			return schema, err
+		}
+		schema.Drafts = append(schema.Drafts, draft)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT display_name, link, category FROM admin")
+	if err != nil {
+		return schema, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item TableData
+		var category string
+		if err := rows.Scan(&item.DisplayName, &item.Link, &category); err != nil {
+			return schema, err
+		}
+		schema.Admin.Tables[category] = append(schema.Admin.Tables[category], item)
+	}
+	return schema, rows.Err()
+}
+
+/*
+Load a DatabaseSchema into the database. Importing the same schema twice leaves the
+database in the same state as importing it once.
+
+	:param schema: the site data to load
+	:param mode: IMPORT_MERGE to upsert on top of the existing data, IMPORT_REPLACE to wipe the site tables first
+*/
+func (s *SQLiteRepo) ImportAll(schema DatabaseSchema, mode ImportMode) (ImportSummary, error) {
+	if mode != IMPORT_MERGE && mode != IMPORT_REPLACE {
+		return newImportSummary(), &InvalidImportMode{Mode: mode}
+	}
+	staged := map[Identifier]StagedImage{}
+	defer discardStaged(staged)
+	// filling in the metadata of an image shouldnt change the callers schema
+	schema.Images = append([]Image(nil), schema.Images...)
+	for i := range schema.Images {
+		fillImageInfo(&schema.Images[i], schema.Images[i].Data)
+		if err := stageImage(s.imageIO, staged, schema.Images[i].Ident, bytes.NewReader(schema.Images[i].Data)); err != nil {
+			return newImportSummary(), err
+		}
+	}
+	return s.importStaged(schema, staged, mode)
+}
+
+/*
+Load an archive created by WriteArchive into the database, the same as ImportAll. The image
+blobs are written to the image store as they are read rather than kept in memory, and only
+replace the stored images once the rows are committed
+
+	:param r: the reader containing the gzipped tarball
+	:param mode: IMPORT_MERGE to upsert on top of the existing data, IMPORT_REPLACE to wipe the site tables first
+*/
+func (s *SQLiteRepo) ImportArchive(r io.Reader, mode ImportMode) (ImportSummary, error) {
+	if mode != IMPORT_MERGE && mode != IMPORT_REPLACE {
+		return newImportSummary(), &InvalidImportMode{Mode: mode}
+	}
+	staged := map[Identifier]StagedImage{}
+	defer discardStaged(staged)
+	_, schema, err := ReadArchive(r, func(id Identifier, blob io.Reader) error {
+		return stageImage(s.imageIO, staged, id, blob)
+	})
+	if err != nil {
+		return newImportSummary(), err
+	}
+	return s.importStaged(schema, staged, mode)
+}
+
+// load the rows of a schema whose image blobs are staged, putting the blobs in place once the rows are committed
+func (s *SQLiteRepo) importStaged(schema DatabaseSchema, staged map[Identifier]StagedImage, mode ImportMode) (ImportSummary, error) {
+	summary := newImportSummary()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return summary, err
+	}
+	// replacing the site drops images the archive doesnt have, their files go with them
+	var replaced []Identifier
+	if mode == IMPORT_REPLACE {
+		replaced, err = imageIDs(tx)
+		if err != nil {
+			tx.Rollback()
+			return summary, err
+		}
+	}
+	err = importTables(tx, schema, mode, &summary)
+	if err != nil {
+		tx.Rollback()
+		return newImportSummary(), err
+	}
+	if err = tx.Commit(); err != nil {
+		return newImportSummary(), err
+	}
+	// only once the import is committed, so a failed one leaves the old images usable
+	kept := map[Identifier]bool{}
+	for _, img := range schema.Images {
+		if kept[img.Ident] {
+			continue
+		}
+		if err = staged[img.Ident].Commit(); err != nil {
+			return summary, fmt.Errorf("the site was imported, but writing the file of image %s failed: %w", img.Ident, err)
+		}
+		kept[img.Ident] = true
+		summary.Images = append(summary.Images, img.Ident)
+	}
+	for _, id := range replaced {
+		if kept[id] {
+			continue
+		}
+		if err = s.imageIO.Delete(id); err != nil {
+			return summary, fmt.Errorf("the site was imported, but removing the file of replaced image %s failed: %w", id, err)
+		}
+		summary.Images = append(summary.Images, id)
+	}
+	return summary, nil
+}
+
+// stage the blob of an image, replacing one already staged for it
+func stageImage(store ImageIO, staged map[Identifier]StagedImage, id Identifier, blob io.Reader) error {
+	st, err := store.Stage(blob, id)
+	if err != nil {
+		return err
+	}
+	if prev, ok := staged[id]; ok {
+		prev.Discard()
+	}
+	staged[id] = st
+	return nil
+}
+
+// throw away the staged blobs that were never committed
+func discardStaged(staged map[Identifier]StagedImage) {
+	for _, st := range staged {
+		st.Discard()
+	}
+}
+
+// archives from before an images type and metadata were stored dont have them
+func fillImageInfo(img *Image, data []byte) {
+	if img.Mime == "" {
+		img.Mime, _ = DetectImageType(data)
+	}
+	if img.Width == 0 {
+		info := exif.Read(data)
+		img.Width, img.Height, img.Camera, img.Taken = info.Width, info.Height, info.Camera, info.Taken
+	}
+}
+
+// the identifiers of every image in the database
+func imageIDs(tx *sql.Tx) ([]Identifier, error) {
+	rows, err := tx.Query("SELECT id FROM images")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []Identifier
+	for rows.Next() {
+		var id Identifier
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// does the row level work for ImportAll inside of the callers transaction
+func importTables(tx *sql.Tx, schema DatabaseSchema, mode ImportMode, summary *ImportSummary) error {
+	if mode == IMPORT_REPLACE {
+		for _, table := range []string{"posts", "images", "assets", "menu", "navbar", "admin", "albums", "album_images", "drafts", "comments", "mentions"} {
+			if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, doc := range schema.Posts {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM posts WHERE id = ?", doc.Ident)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE posts SET title = ?, created = ?, body = ?, category = ?, sample = ?, slug = ?, tags = ?, updated = ?, rendered_key = '', rendered_html = '', version = version + 1, comments_closed = ? WHERE id = ?",
+				doc.Title, doc.Created, doc.Body, doc.Category, doc.MakeSample(), doc.Slug, doc.Tags, doc.Updated, doc.CommentsClosed, doc.Ident)
+			summary.Updated["posts"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO posts(id, title, created, body, category, sample, slug, tags, updated, comments_closed) VALUES (?,?,?,?,?,?,?,?,?,?)",
+				doc.Ident, doc.Title, doc.Created, doc.Body, doc.Category, doc.MakeSample(), doc.Slug, doc.Tags, doc.Updated, doc.CommentsClosed)
+			summary.Created["posts"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, img := range schema.Images {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM images WHERE id = ?", img.Ident)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE images SET title = ?, desc = ?, created = ?, mime = ?, width = ?, height = ?, camera = ?, taken = ? WHERE id = ?",
+				img.Title, img.Desc, img.Created, img.Mime, img.Width, img.Height, img.Camera, img.Taken, img.Ident)
+			summary.Updated["images"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO images (id, title, desc, created, mime, width, height, camera, taken) VALUES (?,?,?,?,?,?,?,?,?)",
+				img.Ident, img.Title, img.Desc, img.Created, img.Mime, img.Width, img.Height, img.Camera, img.Taken)
+			summary.Created["images"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, item := range schema.Assets {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM assets WHERE name = ?", item.Name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE assets SET data = ? WHERE name = ?", item.Data, item.Name)
+			summary.Updated["assets"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO assets(name, data) VALUES (?,?)", item.Name, item.Data)
+			summary.Created["assets"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, item := range schema.Navbar {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM navbar WHERE link = ?", item.Link)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE navbar SET png = ?, redirect = ? WHERE link = ?", item.Png, item.Redirect, item.Link)
+			summary.Updated["navbar"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO navbar(png, link, redirect) VALUES (?,?,?)", item.Png, item.Link, item.Redirect)
+			summary.Created["navbar"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// after the images, so every image an album lists is already there
+	for _, album := range schema.Albums {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM albums WHERE id = ?", album.Ident)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE albums SET name = ?, slug = ?, desc = ?, cover = ?, position = ?, created = ? WHERE id = ?",
+				album.Name, album.Slug, album.Desc, album.Cover, album.Position, album.Created, album.Ident)
+			summary.Updated["albums"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO albums (id, name, slug, desc, cover, position, created) VALUES (?,?,?,?,?,?,?)",
+				album.Ident, album.Name, album.Slug, album.Desc, album.Cover, album.Position, album.Created)
+			summary.Created["albums"]++
+		}
+		if err != nil {
+			return uniqueErr(err)
+		}
+		if err = setMembers(tx, album.Ident, album.Images); err != nil {
+			return err
+		}
+	}
+
+	// after the posts, so every comment is on a post that is already there
+	for _, comment := range schema.Comments {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM comments WHERE id = ?", comment.Ident)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE comments SET post = ?, parent = ?, name = ?, email = ?, url = ?, body = ?, status = ?, created = ? WHERE id = ?",
+				comment.Post, comment.Parent, comment.Name, comment.Email, comment.URL, comment.Body, comment.Status, comment.Created, comment.Ident)
+			summary.Updated["comments"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO comments("+commentColumns+") VALUES (?,?,?,?,?,?,?,?,?)",
+				comment.Ident, comment.Post, comment.Parent, comment.Name, comment.Email, comment.URL, comment.Body, comment.Status, comment.Created)
+			summary.Created["comments"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a mention is keyed by its source and target as well as its id, so match on either
+	for _, mention := range schema.Mentions {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM mentions WHERE id = ? OR (source = ? AND target = ?)",
+			mention.Ident, mention.Source, mention.Target)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE mentions SET id = ?, post = ?, source = ?, target = ?, title = ?, status = ?, created = ? WHERE id = ? OR (source = ? AND target = ?)",
+				mention.Ident, mention.Post, mention.Source, mention.Target, mention.Title, mention.Status, mention.Created,
+				mention.Ident, mention.Source, mention.Target)
+			summary.Updated["mentions"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO mentions("+mentionColumns+") VALUES (?,?,?,?,?,?,?)",
+				mention.Ident, mention.Post, mention.Source, mention.Target, mention.Title, mention.Status, mention.Created)
+			summary.Created["mentions"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a draft is keyed by its post, or by the token of the editor it was started in
+	for _, draft := range schema.Drafts {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM drafts WHERE post = ?", draft.Post)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_, err = tx.Exec("UPDATE drafts SET title = ?, body = ?, category = ?, slug = ?, tags = ?, version = ?, saved = ? WHERE post = ?",
+				draft.Title, draft.Body, draft.Category, draft.Slug, draft.Tags, draft.Version, draft.Saved, draft.Post)
+			summary.Updated["drafts"]++
+		} else {
+			_, err = tx.Exec("INSERT INTO drafts("+draftColumns+") VALUES (?,?,?,?,?,?,?,?)",
+				draft.Post, draft.Title, draft.Body, draft.Category, draft.Slug, draft.Tags, draft.Version, draft.Saved)
+			summary.Created["drafts"]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// menu and admin rows have no natural key, so an identical row counts as already imported
+	for _, item := range schema.Menu {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM menu WHERE link = ? AND text = ?", item.Link, item.Text)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err = tx.Exec("INSERT INTO menu(link, text) VALUES (?,?)", item.Link, item.Text); err != nil {
+			return err
+		}
+		summary.Created["menu"]++
+	}
+
+	for category, table := range schema.Admin.Tables {
+		for _, item := range table {
+			exists, err := rowExists(tx, "SELECT COUNT(*) FROM admin WHERE display_name = ? AND link = ? AND category = ?",
+				item.DisplayName, item.Link, category)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			_, err = tx.Exec("INSERT INTO admin (display_name, link, category) VALUES (?,?,?)", item.DisplayName, item.Link, category)
+			if err != nil {
+				return err
+			}
+			summary.Created["admin"]++
+		}
+	}
+	return nil
+}
+
+// the part of *sql.DB and *sql.Tx that rowExists needs
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// the part of *sql.DB and *sql.Tx that runs statements
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// run a SELECT COUNT(*) query and report if it found anything
+func rowExists(tx querier, query string, args ...any) (bool, error) {
+	var count int
+	if err := tx.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+/*
+Write a DatabaseSchema out as a gzipped tarball. The archive holds a manifest, a json
+document with all of the rows, and one file per image blob under images/, in that order
+
+	:param w: the writer to send the archive to
+	:param schema: the site data to archive
+*/
+func WriteArchive(w io.Writer, schema DatabaseSchema) error {
+	site := archivedSite{
+		Posts:    schema.Posts,
+		Assets:   schema.Assets,
+		Menu:     schema.Menu,
+		Navbar:   schema.Navbar,
+		Admin:    schema.Admin,
+		Albums:   schema.Albums,
+		Comments: schema.Comments,
+		Mentions: schema.Mentions,
+		Drafts:   schema.Drafts,
+	}
+	for _, img := range schema.Images {
+		site.Images = append(site.Images, archivedImage{
+			Ident: img.Ident, Title: img.Title, Desc: img.Desc, Created: img.Created,
+			Mime: img.Mime, Width: img.Width, Height: img.Height, Camera: img.Camera, Taken: img.Taken,
+		})
+	}
+	manifest := Manifest{
+		Version: ArchiveVersion,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Counts: map[string]int{
+			"posts":    len(schema.Posts),
+			"images":   len(schema.Images),
+			"assets":   len(schema.Assets),
+			"menu":     len(schema.Menu),
+			"navbar":   len(schema.Navbar),
+			"albums":   len(schema.Albums),
+			"comments": len(schema.Comments),
+			"mentions": len(schema.Mentions),
+			"drafts":   len(schema.Drafts),
+		},
+	}
+	for _, table := range schema.Admin.Tables {
+		manifest.Counts["admin"] += len(table)
+	}
+	mb, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	sb, err := json.MarshalIndent(site, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err = writeTarFile(tw, manifestFile, mb); err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, siteFile, sb); err != nil {
+		return err
+	}
+	for _, img := range schema.Images {
+		if err = writeTarFile(tw, path.Join(imageDir, string(img.Ident)), img.Data); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+/*
+Read an archive created by WriteArchive back into a DatabaseSchema. The image blobs are
+handed to stage as they are read instead of being kept in the schema, other than those of
+images archived without their metadata, which are read to fill it in
+
+	:param r: the reader containing the gzipped tarball
+	:param stage: called with the identifier and the contents of every image blob
+*/
+func ReadArchive(r io.Reader, stage func(Identifier, io.Reader) error) (Manifest, DatabaseSchema, error) {
+	var manifest Manifest
+	var site archivedSite
+	var schema DatabaseSchema
+	staged := map[Identifier]bool{}
+	var sawManifest, sawSite bool
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, schema, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, schema, err
+		}
+		switch {
+		case hdr.Name == manifestFile:
+			if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, schema, err
+			}
+			if manifest.Version > ArchiveVersion || manifest.Version < 1 {
+				return manifest, schema, &UnsupportedArchiveVersion{Version: manifest.Version}
+			}
+			sawManifest = true
+		case hdr.Name == siteFile:
+			if err = json.NewDecoder(tr).Decode(&site); err != nil {
+				return manifest, schema, err
+			}
+			sawSite = true
+		case path.Dir(hdr.Name) == imageDir:
+			id := Identifier(path.Base(hdr.Name))
+			// the images are written after the site, which says which of them need their metadata filled in
+			if !sawSite || strings.HasPrefix(string(id), ".") {
+				return manifest, schema, fmt.Errorf("%w: unexpected image file '%s'", ErrInvalidArchive, hdr.Name)
+			}
+			var blob io.Reader = tr
+			for i := range site.Images {
+				if site.Images[i].Ident != id || (site.Images[i].Mime != "" && site.Images[i].Width != 0) {
+					continue
+				}
+				b, err := io.ReadAll(tr)
+				if err != nil {
+					return manifest, schema, err
+				}
+				fillArchivedInfo(&site.Images[i], b)
+				blob = bytes.NewReader(b)
+				break
+			}
+			if err = stage(id, blob); err != nil {
+				return manifest, schema, err
+			}
+			staged[id] = true
+		}
+	}
+	// the tarball can end before the gzip stream does, reading the rest checks it wasnt cut off
+	if _, err = io.Copy(io.Discard, gz); err != nil {
+		return manifest, schema, err
+	}
+	if !sawManifest || !sawSite {
+		return manifest, schema, ErrInvalidArchive
+	}
+
+	schema = DatabaseSchema{
+		Posts:    site.Posts,
+		Assets:   site.Assets,
+		Menu:     site.Menu,
+		Navbar:   site.Navbar,
+		Admin:    site.Admin,
+		Albums:   site.Albums,
+		Comments: site.Comments,
+		Mentions: site.Mentions,
+		Drafts:   site.Drafts,
+	}
+	if schema.Admin.Tables == nil {
+		schema.Admin.Tables = map[string][]TableData{}
+	}
+	for _, img := range site.Images {
+		if !staged[img.Ident] {
+			return manifest, schema, fmt.Errorf("%w: no image data for '%s'", ErrInvalidArchive, img.Ident)
+		}
+		schema.Images = append(schema.Images, Image{
+			Ident: img.Ident, Title: img.Title, Desc: img.Desc, Created: img.Created,
+			Mime: img.Mime, Width: img.Width, Height: img.Height, Camera: img.Camera, Taken: img.Taken,
+		})
+	}
+	return manifest, schema, nil
+}
+
+// fill in the metadata of an archived image the same way fillImageInfo does
+func fillArchivedInfo(img *archivedImage, data []byte) {
+	info := Image{Mime: img.Mime, Width: img.Width, Height: img.Height, Camera: img.Camera, Taken: img.Taken}
+	fillImageInfo(&info, data)
+	img.Mime, img.Width, img.Height, img.Camera, img.Taken = info.Mime, info.Width, info.Height, info.Camera, info.Taken
+}
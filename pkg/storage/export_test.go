@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func seedSchema() DatabaseSchema {
+	return DatabaseSchema{
+		Posts: []Document{
+			{
+				Ident:    Identifier("qwerty"),
+				Title:    "abc 123",
+				Created:  "2024-12-31",
+				Body:     "blog post body etc",
+				Category: BLOG,
+				Sample:   "blog post body etc",
+			},
+		},
+		Images: []Image{
+			{
+				Ident:   Identifier("abc123"),
+				Title:   "xyz098",
+				Desc:    "description",
+				Created: "2024-12-31",
+				Mime:    "image/png",
+				Data:    testPng,
+			},
+		},
+		Assets: []Asset{{Name: "menu.png", Data: []byte("pngdata")}},
+		Menu:   []LinkPair{{Link: "/blog", Text: "//Black Box"}},
+		Navbar: []NavBarItem{{Png: []byte("pngdata"), Link: "git.png", Redirect: "https://git.aetherial.dev"}},
+		Admin: AdminPage{Tables: map[string][]TableData{
+			"new": {{DisplayName: "blog post", Link: "/admin/posts"}},
+		}},
+		Albums: []Album{
+			{
+				Ident:   Identifier("zxcvb"),
+				Name:    "sketches",
+				Slug:    "sketches",
+				Cover:   Identifier("abc123"),
+				Created: "2024-12-31",
+				Images:  []Identifier{"abc123"},
+			},
+		},
+		Comments: []Comment{
+			{
+				Ident:   Identifier("asdfg"),
+				Post:    Identifier("qwerty"),
+				Name:    "reader",
+				Body:    "nice post",
+				Status:  COMMENT_APPROVED,
+				Created: "2024-12-31",
+			},
+		},
+		Mentions: []Mention{
+			{
+				Ident:   Identifier("hjkl"),
+				Post:    Identifier("qwerty"),
+				Source:  "https://example.com/reply",
+				Target:  "https://aetherial.dev/writing/qwerty",
+				Title:   "a reply",
+				Status:  COMMENT_APPROVED,
+				Created: "2024-12-31",
+			},
+		},
+		Drafts: []Draft{
+			{
+				Post:     Identifier("qwerty"),
+				Title:    "abc 1234",
+				Body:     "blog post body etc, unsaved",
+				Category: BLOG,
+				Version:  1,
+				Saved:    "2025-01-01",
+			},
+		},
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	want := seedSchema()
+	var buf bytes.Buffer
+	err := WriteArchive(&buf, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := map[Identifier][]byte{}
+	manifest, got, err := ReadArchive(&buf, func(id Identifier, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		blobs[id] = b
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got.Images {
+		got.Images[i].Data = blobs[got.Images[i].Ident]
+	}
+	assert.Equal(t, ArchiveVersion, manifest.Version)
+	assert.Equal(t, 1, manifest.Counts["posts"])
+	assert.Equal(t, 1, manifest.Counts["admin"])
+	assert.Equal(t, want, got)
+}
+
+func TestReadArchiveInvalid(t *testing.T) {
+	_, _, err := ReadArchive(bytes.NewReader([]byte("not an archive")), func(Identifier, io.Reader) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestImportAll(t *testing.T) {
+	type testcase struct {
+		mode        ImportMode
+		runs        int
+		wantCreated map[string]int
+		wantUpdated map[string]int
+		err         error
+	}
+	for _, tc := range []testcase{
+		{
+			mode:        IMPORT_MERGE,
+			runs:        1,
+			wantCreated: map[string]int{"posts": 1, "images": 1, "assets": 1, "menu": 1, "navbar": 1, "admin": 1, "albums": 1, "comments": 1, "mentions": 1, "drafts": 1},
+			wantUpdated: map[string]int{},
+		},
+		{
+			mode:        IMPORT_MERGE,
+			runs:        2,
+			wantCreated: map[string]int{},
+			wantUpdated: map[string]int{"posts": 1, "images": 1, "assets": 1, "navbar": 1, "albums": 1, "comments": 1, "mentions": 1, "drafts": 1},
+		},
+		{
+			mode:        IMPORT_REPLACE,
+			runs:        2,
+			wantCreated: map[string]int{"posts": 1, "images": 1, "assets": 1, "menu": 1, "navbar": 1, "admin": 1, "albums": 1, "comments": 1, "mentions": 1, "drafts": 1},
+			wantUpdated: map[string]int{},
+		},
+		{
+			mode: ImportMode("overwrite"),
+			runs: 1,
+			err:  &InvalidImportMode{Mode: ImportMode("overwrite")},
+		},
+	} {
+		testDb, _ := newTestDb(t.TempDir(), true)
+		seed := seedSchema()
+		var summary ImportSummary
+		var err error
+		for i := 0; i < tc.runs; i++ {
+			summary, err = testDb.ImportAll(seed, tc.mode)
+		}
+		if tc.err != nil {
+			assert.Equal(t, tc.err, err)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.wantCreated, summary.Created)
+		assert.Equal(t, tc.wantUpdated, summary.Updated)
+
+		got, err := testDb.ExtractAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// versions count the saves made to this database, they arent carried over by an import
+		for i := range got.Posts {
+			got.Posts[i].Row, got.Posts[i].Version = 0, 0
+		}
+		assert.Equal(t, seed, got)
+	}
+}
+
+func TestImportReplaceRemovesImageFiles(t *testing.T) {
+	dir := t.TempDir()
+	testDb, _ := newTestDb(dir, true)
+	old, err := testDb.AddImage(testPng, "old", "replaced by the import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testDb.ImportAll(seedSchema(), IMPORT_REPLACE); err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(path.Join(dir, string(old)))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = os.Stat(path.Join(dir, "abc123"))
+	assert.NoError(t, err)
+}
+
+func TestImportArchive(t *testing.T) {
+	dir := t.TempDir()
+	testDb, _ := newTestDb(dir, true)
+	if err := testDb.imageIO.Put([]byte("the old file"), "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, seedSchema()); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	// an archive cut off partway leaves the images as they were
+	_, err := testDb.ImportArchive(bytes.NewReader(archive[:len(archive)-10]), IMPORT_MERGE)
+	assert.Error(t, err)
+	b, _ := testDb.imageIO.Get("abc123")
+	assert.Equal(t, []byte("the old file"), b)
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1, "staged files are removed")
+
+	summary, err := testDb.ImportArchive(bytes.NewReader(archive), IMPORT_MERGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Identifier{"abc123"}, summary.Images)
+	b, _ = testDb.imageIO.Get("abc123")
+	assert.Equal(t, testPng, b)
+	draft, err := testDb.GetDraft("qwerty")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc 1234", draft.Title)
+
+	_, err = testDb.ImportArchive(bytes.NewReader(archive), ImportMode("overwrite"))
+	assert.Equal(t, &InvalidImportMode{Mode: ImportMode("overwrite")}, err)
+}
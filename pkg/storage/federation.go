@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+/*
+Somebody on another ActivityPub server following the site. Posts are delivered to their
+shared inbox when their server has one, so a server with many followers gets each post once
+*/
+type Follower struct {
+	Actor       string `json:"actor"`
+	Inbox       string `json:"inbox"`
+	SharedInbox string `json:"shared_inbox"`
+	Created     string `json:"created"`
+}
+
+/*
+An activity the site published, i.e. the Create for a new post. Payload is the activity as
+it was delivered, so the outbox serves exactly what followers were sent
+*/
+type Activity struct {
+	Ident     Identifier `json:"id"`
+	Type      string     `json:"type"`
+	Object    Identifier `json:"object"`
+	Published string     `json:"published"`
+	Payload   string     `json:"payload"`
+}
+
+/*
+Add a follower, or update the inboxes of one that follows again
+
+	:param follower: the follower to add
+*/
+func (s *SQLiteRepo) AddFollower(follower Follower) error {
+	_, err := s.db.Exec(`INSERT INTO followers(`+followerColumns+`) VALUES (?,?,?,?)
+		ON CONFLICT(actor) DO UPDATE SET inbox = excluded.inbox, shared_inbox = excluded.shared_inbox`,
+		follower.Actor, follower.Inbox, follower.SharedInbox, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+/*
+Remove a follower, after they unfollowed or were removed by the admin
+
+	:param actor: the id of the followers actor
+*/
+func (s *SQLiteRepo) RemoveFollower(actor string) error {
+	res, err := s.db.Exec("DELETE FROM followers WHERE actor = ?", actor)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// Get every follower, oldest first
+func (s *SQLiteRepo) GetFollowers() ([]Follower, error) {
+	rows, err := s.db.Query("SELECT " + followerColumns + " FROM followers ORDER BY row")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	followers := []Follower{}
+	for rows.Next() {
+		var follower Follower
+		if err := rows.Scan(&follower.Actor, &follower.Inbox, &follower.SharedInbox, &follower.Created); err != nil {
+			return nil, err
+		}
+		followers = append(followers, follower)
+	}
+	return followers, rows.Err()
+}
+
+/*
+Save an activity the site published to its outbox
+
+	:param activity: the activity, its Ident has to be set since it is part of the payload
+*/
+func (s *SQLiteRepo) AddActivity(activity Activity) error {
+	_, err := s.db.Exec("INSERT INTO activities("+activityColumns+") VALUES (?,?,?,?,?)",
+		activity.Ident, activity.Type, activity.Object, activity.Published, activity.Payload)
+	return uniqueErr(err)
+}
+
+/*
+Get a single published activity
+
+	:param id: the Identifier of the activity
+*/
+func (s *SQLiteRepo) GetActivity(id Identifier) (Activity, error) {
+	var activity Activity
+	err := s.db.QueryRow("SELECT "+activityColumns+" FROM activities WHERE id = ?", id).Scan(
+		&activity.Ident, &activity.Type, &activity.Object, &activity.Published, &activity.Payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return activity, ErrNotExists
+	}
+	return activity, err
+}
+
+/*
+Get a page of the published activities newest first, along with how many there are in all
+
+	:param limit: how many to get
+	:param offset: how many of the newest to skip
+*/
+func (s *SQLiteRepo) GetActivities(limit, offset int) ([]Activity, int, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM activities").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query("SELECT "+activityColumns+" FROM activities ORDER BY row DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	activities := []Activity{}
+	for rows.Next() {
+		var activity Activity
+		if err := rows.Scan(&activity.Ident, &activity.Type, &activity.Object, &activity.Published, &activity.Payload); err != nil {
+			return nil, 0, err
+		}
+		activities = append(activities, activity)
+	}
+	return activities, total, rows.Err()
+}
+
+/*
+Get a private key the site signs with, stored PEM encoded
+
+	:param name: the name of the key, i.e. 'activitypub'
+*/
+func (s *SQLiteRepo) GetSigningKey(name string) (string, error) {
+	var pem string
+	err := s.db.QueryRow("SELECT pem FROM signing_keys WHERE name = ?", name).Scan(&pem)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotExists
+	}
+	return pem, err
+}
+
+/*
+Store a private key the site signs with. Keys arent part of an export, a restored site
+makes a new one
+
+	:param name: the name of the key
+	:param pem: the PEM encoded key
+*/
+func (s *SQLiteRepo) SaveSigningKey(name, pem string) error {
+	_, err := s.db.Exec("INSERT INTO signing_keys(name, pem) VALUES (?,?) ON CONFLICT(name) DO UPDATE SET pem = excluded.pem", name, pem)
+	return err
+}
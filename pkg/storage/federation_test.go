@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollowers(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	assert.NoError(t, testDb.AddFollower(Follower{Actor: "https://a.example/users/a", Inbox: "https://a.example/users/a/inbox"}))
+	assert.NoError(t, testDb.AddFollower(Follower{Actor: "https://b.example/users/b", Inbox: "https://b.example/users/b/inbox"}))
+	// following again updates the inboxes
+	assert.NoError(t, testDb.AddFollower(Follower{Actor: "https://a.example/users/a", Inbox: "https://a.example/users/a/inbox", SharedInbox: "https://a.example/inbox"}))
+
+	followers, err := testDb.GetFollowers()
+	assert.NoError(t, err)
+	if assert.Len(t, followers, 2) {
+		assert.Equal(t, "https://a.example/inbox", followers[0].SharedInbox)
+		assert.NotEmpty(t, followers[0].Created)
+	}
+
+	assert.NoError(t, testDb.RemoveFollower("https://a.example/users/a"))
+	assert.Equal(t, ErrNotExists, testDb.RemoveFollower("https://a.example/users/a"))
+	followers, err = testDb.GetFollowers()
+	assert.NoError(t, err)
+	assert.Len(t, followers, 1)
+}
+
+func TestActivities(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	for _, activity := range []Activity{
+		{Ident: "one", Type: "Create", Object: "post", Published: "2024-12-31T00:00:00Z", Payload: `{"type":"Create"}`},
+		{Ident: "two", Type: "Update", Object: "post", Published: "2025-01-01T00:00:00Z", Payload: `{"type":"Update"}`},
+		{Ident: "three", Type: "Delete", Object: "post", Published: "2025-01-02T00:00:00Z", Payload: `{"type":"Delete"}`},
+	} {
+		assert.NoError(t, testDb.AddActivity(activity))
+	}
+	assert.Equal(t, ErrDuplicate, testDb.AddActivity(Activity{Ident: "one", Type: "Create", Object: "post"}))
+
+	page, total, err := testDb.GetActivities(2, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+	if assert.Len(t, page, 2) {
+		assert.Equal(t, Identifier("three"), page[0].Ident)
+		assert.Equal(t, Identifier("two"), page[1].Ident)
+	}
+	page, _, err = testDb.GetActivities(2, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, page, 1) {
+		assert.Equal(t, `{"type":"Create"}`, page[0].Payload)
+	}
+
+	got, err := testDb.GetActivity("two")
+	assert.NoError(t, err)
+	assert.Equal(t, "Update", got.Type)
+	_, err = testDb.GetActivity("missing")
+	assert.Equal(t, ErrNotExists, err)
+}
+
+func TestSigningKeys(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	_, err := testDb.GetSigningKey("activitypub")
+	assert.Equal(t, ErrNotExists, err)
+	assert.NoError(t, testDb.SaveSigningKey("activitypub", "first"))
+	assert.NoError(t, testDb.SaveSigningKey("activitypub", "second"))
+	pem, err := testDb.GetSigningKey("activitypub")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", pem)
+}
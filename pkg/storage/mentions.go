@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"time"
+)
+
+/*
+A webmention another site sent for one of the posts, saying that the Source page links to
+the Target. It is only saved once the source was fetched and checked, and goes through the
+same moderation as comments
+*/
+type Mention struct {
+	Ident     Identifier    `json:"id"`
+	Post      Identifier    `json:"post"`
+	Source    string        `json:"source"`
+	Target    string        `json:"target"`
+	Title     string        `json:"title"`
+	Status    CommentStatus `json:"status"`
+	Created   string        `json:"created"`
+	PostTitle string        `json:"post_title,omitempty"` // only filled in by GetMentionQueue
+}
+
+/*
+Save a verified webmention. A source can mention the same target again after it was edited,
+which only updates the title, so a moderated mention keeps its status. The post has to exist,
+ErrNotExists is returned otherwise
+
+	:param mention: the mention to save, its Status defaults to COMMENT_PENDING
+*/
+func (s *SQLiteRepo) SaveMention(mention Mention) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exists, err := rowExists(tx, "SELECT COUNT(*) FROM posts WHERE id = ?", mention.Post)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotExists
+	}
+	if mention.Status == "" {
+		mention.Status = COMMENT_PENDING
+	}
+	_, err = tx.Exec(`INSERT INTO mentions(`+mentionColumns+`) VALUES (?,?,?,?,?,?,?)
+		ON CONFLICT(source, target) DO UPDATE SET title = excluded.title`,
+		newIdentifier(), mention.Post, mention.Source, mention.Target, mention.Title, mention.Status,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Remove a webmention, for when its source was deleted or no longer links to the target.
+Removing one that was never saved isnt an error
+
+	:param source: the url of the page that mentioned the post
+	:param target: the url of the post it mentioned
+*/
+func (s *SQLiteRepo) DeleteMention(source, target string) error {
+	_, err := s.db.Exec("DELETE FROM mentions WHERE source = ? AND target = ?", source, target)
+	return err
+}
+
+/*
+Get the webmentions of a post with a status, oldest first
+
+	:param post: the Identifier of the post
+	:param status: the status of the mentions to get
+*/
+func (s *SQLiteRepo) GetMentions(post Identifier, status CommentStatus) ([]Mention, error) {
+	rows, err := s.db.Query("SELECT "+mentionColumns+" FROM mentions WHERE post = ? AND status = ? ORDER BY row", post, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mentions := []Mention{}
+	for rows.Next() {
+		mention, err := scanMention(rows)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+/*
+Get the webmentions of every post with a status, oldest first, along with the title of the
+post each mentions
+
+	:param status: the status of the mentions to get, i.e. COMMENT_PENDING for the moderation queue
+*/
+func (s *SQLiteRepo) GetMentionQueue(status CommentStatus) ([]Mention, error) {
+	rows, err := s.db.Query(`SELECT `+prefixColumns("mentions", mentionColumns)+`, posts.title FROM mentions
+		JOIN posts ON posts.id = mentions.post WHERE mentions.status = ? ORDER BY mentions.row`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mentions := []Mention{}
+	for rows.Next() {
+		var mention Mention
+		err := rows.Scan(&mention.Ident, &mention.Post, &mention.Source, &mention.Target, &mention.Title, &mention.Status,
+			&mention.Created, &mention.PostTitle)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+/*
+Moderate a webmention
+
+	:param id: the Identifier of the mention
+	:param status: the status to move it to
+*/
+func (s *SQLiteRepo) SetMentionStatus(id Identifier, status CommentStatus) error {
+	res, err := s.db.Exec("UPDATE mentions SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
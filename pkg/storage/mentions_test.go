@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMentions(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	post, err := testDb.AddDocument(Document{Title: "post", Body: "body", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "https://aetherial.dev/writing/" + string(post)
+
+	assert.NoError(t, testDb.SaveMention(Mention{Post: post, Source: "https://a.example/reply", Target: target, Title: "a reply"}))
+	assert.NoError(t, testDb.SaveMention(Mention{Post: post, Source: "https://b.example/like", Target: target}))
+	assert.Equal(t, ErrNotExists, testDb.SaveMention(Mention{Post: "missing", Source: "https://a.example/reply", Target: target}))
+
+	queue, err := testDb.GetMentionQueue(COMMENT_PENDING)
+	assert.NoError(t, err)
+	if !assert.Len(t, queue, 2) {
+		return
+	}
+	assert.Equal(t, "https://a.example/reply", queue[0].Source)
+	assert.Equal(t, "a reply", queue[0].Title)
+	assert.Equal(t, "post", queue[0].PostTitle)
+	assert.NotEmpty(t, queue[0].Created)
+
+	// sending the same mention again updates it, and keeps how it was moderated
+	assert.NoError(t, testDb.SetMentionStatus(queue[0].Ident, COMMENT_APPROVED))
+	assert.Equal(t, ErrNotExists, testDb.SetMentionStatus("missing", COMMENT_APPROVED))
+	assert.NoError(t, testDb.SaveMention(Mention{Post: post, Source: "https://a.example/reply", Target: target, Title: "an edited reply"}))
+	approved, err := testDb.GetMentions(post, COMMENT_APPROVED)
+	assert.NoError(t, err)
+	if assert.Len(t, approved, 1) {
+		assert.Equal(t, queue[0].Ident, approved[0].Ident)
+		assert.Equal(t, "an edited reply", approved[0].Title)
+	}
+
+	// a source that stops linking to the post is removed
+	assert.NoError(t, testDb.DeleteMention("https://a.example/reply", target))
+	assert.NoError(t, testDb.DeleteMention("https://a.example/reply", target))
+	approved, err = testDb.GetMentions(post, COMMENT_APPROVED)
+	assert.NoError(t, err)
+	assert.Empty(t, approved)
+
+	// deleting the post deletes its mentions
+	assert.NoError(t, testDb.DeleteDocument(post))
+	queue, err = testDb.GetMentionQueue(COMMENT_PENDING)
+	assert.NoError(t, err)
+	assert.Empty(t, queue)
+	pending, err := testDb.GetMentions(post, COMMENT_PENDING)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
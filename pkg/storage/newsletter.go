@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"time"
+)
+
+/*
+A reader subscribed to new posts by email. They only get posts once they confirmed the
+address by following the link in the email they were sent, and the Token in that link is
+also the one in the unsubscribe link of every post they get
+*/
+type Subscriber struct {
+	Email     string `json:"email"`
+	Token     string `json:"token"`
+	Confirmed bool   `json:"confirmed"`
+	Created   string `json:"created"`
+}
+
+// Where an email is in the outbox queue
+type EmailStatus string
+
+const (
+	EMAIL_QUEUED = EmailStatus("queued")
+	EMAIL_SENT   = EmailStatus("sent")
+	EMAIL_FAILED = EmailStatus("failed")
+)
+
+/*
+An email waiting in the outbox queue, already rendered. Queued emails are sent once their
+NextAttempt comes around, and are pushed back after every attempt that fails until they
+are given up on
+*/
+type Email struct {
+	Ident       Identifier  `json:"id"`
+	Recipient   string      `json:"recipient"`
+	Subject     string      `json:"subject"`
+	Body        string      `json:"body"`
+	Unsubscribe string      `json:"unsubscribe"`
+	Status      EmailStatus `json:"status"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt string      `json:"next_attempt"`
+	LastError   string      `json:"last_error"`
+	Created     string      `json:"created"`
+}
+
+/*
+Add a subscriber that still has to confirm their address. Subscribing again doesnt change
+anything, the subscriber that is already there is returned so they can be sent their
+confirmation again
+
+	:param email: the address to subscribe
+*/
+func (s *SQLiteRepo) AddSubscriber(email string) (Subscriber, error) {
+	_, err := s.db.Exec("INSERT INTO subscribers("+subscriberColumns+") VALUES (?,?,0,?) ON CONFLICT(email) DO NOTHING",
+		email, newIdentifier(), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return Subscriber{}, err
+	}
+	return scanSubscriber(s.db.QueryRow("SELECT "+subscriberColumns+" FROM subscribers WHERE email = ?", email))
+}
+
+/*
+Record that a confirmation email is being sent to a subscriber that hasnt confirmed yet,
+unless one was already sent within the cooldown. It returns whether to send it, so that
+subscribing an address over and over cant be used to flood its inbox
+
+	:param email: the address of the subscriber
+	:param now: the time it is being sent at
+	:param cooldown: how long after the last one another can be sent
+*/
+func (s *SQLiteRepo) MarkConfirmationSent(email string, now time.Time, cooldown time.Duration) (bool, error) {
+	// RFC3339 times in UTC sort as strings, and one that was never sent is empty
+	res, err := s.db.Exec("UPDATE subscribers SET last_sent = ? WHERE email = ? AND confirmed = 0 AND last_sent <= ?",
+		now.UTC().Format(time.RFC3339), email, now.Add(-cooldown).UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+/*
+Confirm the address of a subscriber, so they start getting new posts
+
+	:param token: the token from the confirmation link
+*/
+func (s *SQLiteRepo) ConfirmSubscriber(token string) error {
+	res, err := s.db.Exec("UPDATE subscribers SET confirmed = 1 WHERE token = ?", token)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+/*
+Remove a subscriber, after they followed the unsubscribe link in an email
+
+	:param token: the token from the unsubscribe link
+*/
+func (s *SQLiteRepo) RemoveSubscriber(token string) error {
+	res, err := s.db.Exec("DELETE FROM subscribers WHERE token = ?", token)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+/*
+Get the subscribers, oldest first
+
+	:param confirmed: true for the ones that confirmed their address, false for the ones that havent yet
+*/
+func (s *SQLiteRepo) GetSubscribers(confirmed bool) ([]Subscriber, error) {
+	rows, err := s.db.Query("SELECT "+subscriberColumns+" FROM subscribers WHERE confirmed = ? ORDER BY row", confirmed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subscribers := []Subscriber{}
+	for rows.Next() {
+		sub, err := scanSubscriber(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers, rows.Err()
+}
+
+/*
+Put an email in the outbox queue, to be sent as soon as the queue is next processed
+
+	:param email: the email to queue, its status, attempts and next attempt are set here
+*/
+func (s *SQLiteRepo) QueueEmail(email Email) (Identifier, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	email.Ident = newIdentifier()
+	_, err := s.db.Exec("INSERT INTO emails("+emailColumns+") VALUES (?,?,?,?,?,?,0,?,'',?)",
+		email.Ident, email.Recipient, email.Subject, email.Body, email.Unsubscribe, EMAIL_QUEUED, now, now)
+	if err != nil {
+		return "", err
+	}
+	return email.Ident, nil
+}
+
+/*
+Get the queued emails that are due to be sent, the ones that have waited longest first
+
+	:param now: the time to compare their next attempt against
+	:param limit: the most to get
+*/
+func (s *SQLiteRepo) GetDueEmails(now time.Time, limit int) ([]Email, error) {
+	rows, err := s.db.Query("SELECT "+emailColumns+" FROM emails WHERE status = ? AND next_attempt <= ? ORDER BY next_attempt, row LIMIT ?",
+		EMAIL_QUEUED, now.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := []Email{}
+	for rows.Next() {
+		email, err := scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+/*
+Record an attempt at sending an email
+
+	:param email: the email, with its new status, attempts, next attempt and last error
+*/
+func (s *SQLiteRepo) UpdateEmail(email Email) error {
+	res, err := s.db.Exec("UPDATE emails SET status = ?, attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?",
+		email.Status, email.Attempts, email.NextAttempt, email.LastError, email.Ident)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribers(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	first, err := testDb.AddSubscriber("a@aetherial.dev")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, first.Token)
+	assert.False(t, first.Confirmed)
+	// subscribing again gets the same subscriber back
+	again, err := testDb.AddSubscriber("a@aetherial.dev")
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+	second, err := testDb.AddSubscriber("b@aetherial.dev")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Token, second.Token)
+
+	assert.NoError(t, testDb.ConfirmSubscriber(second.Token))
+	assert.Equal(t, ErrNotExists, testDb.ConfirmSubscriber("missing"))
+	confirmed, err := testDb.GetSubscribers(true)
+	assert.NoError(t, err)
+	if assert.Len(t, confirmed, 1) {
+		assert.Equal(t, "b@aetherial.dev", confirmed[0].Email)
+		assert.True(t, confirmed[0].Confirmed)
+	}
+	unconfirmed, err := testDb.GetSubscribers(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Subscriber{first}, unconfirmed)
+
+	// a confirmation is only sent again once the cooldown is over, and never once confirmed
+	now := time.Now()
+	for _, tc := range []struct {
+		email string
+		at    time.Time
+		want  bool
+	}{
+		{email: "a@aetherial.dev", at: now, want: true},
+		{email: "a@aetherial.dev", at: now.Add(time.Minute), want: false},
+		{email: "a@aetherial.dev", at: now.Add(2 * time.Hour), want: true},
+		{email: "b@aetherial.dev", at: now, want: false},
+		{email: "missing@aetherial.dev", at: now, want: false},
+	} {
+		send, err := testDb.MarkConfirmationSent(tc.email, tc.at, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, send, "%s at %v", tc.email, tc.at)
+	}
+
+	assert.NoError(t, testDb.RemoveSubscriber(second.Token))
+	assert.Equal(t, ErrNotExists, testDb.RemoveSubscriber(second.Token))
+	confirmed, err = testDb.GetSubscribers(true)
+	assert.NoError(t, err)
+	assert.Empty(t, confirmed)
+}
+
+func TestEmails(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	first, err := testDb.QueueEmail(Email{Recipient: "a@aetherial.dev", Subject: "hello", Body: "<p>hello</p>", Unsubscribe: "https://aetherial.dev/unsubscribe?token=a"})
+	assert.NoError(t, err)
+	_, err = testDb.QueueEmail(Email{Recipient: "b@aetherial.dev", Subject: "hello", Body: "<p>hello</p>"})
+	assert.NoError(t, err)
+
+	due, err := testDb.GetDueEmails(time.Now(), 10)
+	assert.NoError(t, err)
+	if !assert.Len(t, due, 2) {
+		return
+	}
+	assert.Equal(t, first, due[0].Ident)
+	assert.Equal(t, EMAIL_QUEUED, due[0].Status)
+	assert.Equal(t, "https://aetherial.dev/unsubscribe?token=a", due[0].Unsubscribe)
+	limited, err := testDb.GetDueEmails(time.Now(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, limited, 1)
+
+	// a failed attempt pushes the email back, a sent one leaves the queue
+	retry := due[0]
+	retry.Attempts, retry.LastError = 1, "421 try again later"
+	retry.NextAttempt = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	assert.NoError(t, testDb.UpdateEmail(retry))
+	sent := due[1]
+	sent.Status, sent.Attempts = EMAIL_SENT, 1
+	assert.NoError(t, testDb.UpdateEmail(sent))
+	assert.Equal(t, ErrNotExists, testDb.UpdateEmail(Email{Ident: "missing"}))
+
+	due, err = testDb.GetDueEmails(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = testDb.GetDueEmails(time.Now().Add(2*time.Hour), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, 1, due[0].Attempts)
+		assert.Equal(t, "421 try again later", due[0].LastError)
+	}
+}
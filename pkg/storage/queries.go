@@ -1,5 +1,7 @@
 package storage
 
+import "strings"
+
 const postsTable = `
     CREATE TABLE IF NOT EXISTS posts(
         row INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -8,7 +10,14 @@ const postsTable = `
         created TEXT NOT NULL,
         body TEXT NOT NULL,
         category TEXT NOT NULL,
-		sample TEXT NOT NULL
+		sample TEXT NOT NULL,
+		slug TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '',
+		updated TEXT NOT NULL DEFAULT '',
+		rendered_key TEXT NOT NULL DEFAULT '',
+		rendered_html TEXT NOT NULL DEFAULT '',
+		version INTEGER NOT NULL DEFAULT 1,
+		comments_closed INTEGER NOT NULL DEFAULT 0
     );
     `
 const imagesTable = `
@@ -17,7 +26,12 @@ const imagesTable = `
 		id TEXT NOT NULL,
 		title TEXT NOT NULL,
 		desc TEXT NOT NULL,
-		created TEXT NOT NULL
+		created TEXT NOT NULL,
+		mime TEXT NOT NULL DEFAULT '',
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		camera TEXT NOT NULL DEFAULT '',
+		taken TEXT NOT NULL DEFAULT ''
 	);
 	`
 const menuItemsTable = `
@@ -49,5 +63,311 @@ const adminTable = `
 		category TEXT NOT NULL
 	);
 	`
+const albumsTable = `
+	CREATE TABLE IF NOT EXISTS albums(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		slug TEXT NOT NULL UNIQUE,
+		desc TEXT NOT NULL DEFAULT '',
+		cover TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0,
+		created TEXT NOT NULL
+	);
+	`
+const albumImagesTable = `
+	CREATE TABLE IF NOT EXISTS album_images(
+		album TEXT NOT NULL,
+		image TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (album, image)
+	);
+	`
+
+const draftsTable = `
+	CREATE TABLE IF NOT EXISTS drafts(
+		post TEXT NOT NULL PRIMARY KEY,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		category TEXT NOT NULL,
+		slug TEXT NOT NULL,
+		tags TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		saved TEXT NOT NULL
+	);
+	`
+
+const commentsTable = `
+	CREATE TABLE IF NOT EXISTS comments(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		post TEXT NOT NULL,
+		parent TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		url TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created TEXT NOT NULL
+	);
+	`
+
+const mentionsTable = `
+	CREATE TABLE IF NOT EXISTS mentions(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		post TEXT NOT NULL,
+		source TEXT NOT NULL,
+		target TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		created TEXT NOT NULL,
+		UNIQUE(source, target)
+	);
+	`
+
+const followersTable = `
+	CREATE TABLE IF NOT EXISTS followers(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL UNIQUE,
+		inbox TEXT NOT NULL,
+		shared_inbox TEXT NOT NULL DEFAULT '',
+		created TEXT NOT NULL
+	);
+	`
+
+const activitiesTable = `
+	CREATE TABLE IF NOT EXISTS activities(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		type TEXT NOT NULL,
+		object TEXT NOT NULL,
+		published TEXT NOT NULL,
+		payload TEXT NOT NULL
+	);
+	`
+
+const signingKeysTable = `
+	CREATE TABLE IF NOT EXISTS signing_keys(
+		name TEXT PRIMARY KEY,
+		pem TEXT NOT NULL
+	);
+	`
+
+const subscribersTable = `
+	CREATE TABLE IF NOT EXISTS subscribers(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL UNIQUE,
+		token TEXT NOT NULL UNIQUE,
+		confirmed INTEGER NOT NULL DEFAULT 0,
+		created TEXT NOT NULL,
+		last_sent TEXT NOT NULL DEFAULT ''
+	);
+	`
+
+const emailsTable = `
+	CREATE TABLE IF NOT EXISTS emails(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		unsubscribe TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt TEXT NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created TEXT NOT NULL
+	);
+	`
+
+const webhooksTable = `
+	CREATE TABLE IF NOT EXISTS webhooks(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		created TEXT NOT NULL
+	);
+	`
+
+const deliveriesTable = `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries(
+		row INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		webhook TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt TEXT NOT NULL,
+		response_code INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created TEXT NOT NULL
+	);
+	`
+
+const pageViewsTable = `
+	CREATE TABLE IF NOT EXISTS page_views(
+		day TEXT NOT NULL,
+		path TEXT NOT NULL,
+		referrer TEXT NOT NULL DEFAULT '',
+		agent TEXT NOT NULL DEFAULT '',
+		views INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(day, path, referrer, agent)
+	);
+	`
+
+var RequiredTables = []string{postsTable, imagesTable, menuItemsTable, navbarItemsTable, assetTable, adminTable, albumsTable, albumImagesTable, draftsTable, commentsTable, mentionsTable,
+	followersTable, activitiesTable, signingKeysTable, subscribersTable, emailsTable, webhooksTable, deliveriesTable, pageViewsTable}
+
+/*
+A column that was added to a table after it was first released. CREATE TABLE IF NOT EXISTS
+leaves existing tables alone, so MigrateColumns adds these to older databases
+*/
+type Column struct {
+	Table string
+	Name  string
+	Def   string
+}
+
+var RequiredColumns = []Column{
+	{Table: "posts", Name: "slug", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "posts", Name: "tags", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "posts", Name: "updated", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "posts", Name: "rendered_key", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "posts", Name: "rendered_html", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "posts", Name: "version", Def: "INTEGER NOT NULL DEFAULT 1"},
+	{Table: "posts", Name: "comments_closed", Def: "INTEGER NOT NULL DEFAULT 0"},
+	{Table: "images", Name: "mime", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "images", Name: "width", Def: "INTEGER NOT NULL DEFAULT 0"},
+	{Table: "images", Name: "height", Def: "INTEGER NOT NULL DEFAULT 0"},
+	{Table: "images", Name: "camera", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "images", Name: "taken", Def: "TEXT NOT NULL DEFAULT ''"},
+	{Table: "subscribers", Name: "last_sent", Def: "TEXT NOT NULL DEFAULT ''"},
+}
+
+// the columns of the posts table, in the order scanDocument expects them
+const postColumns = "row, id, title, created, body, category, sample, slug, tags, updated, version, comments_closed"
+
+// the columns of the images table, in the order scanImage expects them
+const imageColumns = "id, title, desc, created, mime, width, height, camera, taken"
+
+// the columns of the drafts table, in the order scanDraft expects them
+const draftColumns = "post, title, body, category, slug, tags, version, saved"
+
+// the columns of the comments table, in the order scanComment expects them
+const commentColumns = "id, post, parent, name, email, url, body, status, created"
+
+// the columns of the mentions table, in the order scanMention expects them
+const mentionColumns = "id, post, source, target, title, status, created"
+
+// the columns of the followers table, in the order GetFollowers scans them
+const followerColumns = "actor, inbox, shared_inbox, created"
+
+// the columns of the activities table, in the order GetActivities scans them
+const activityColumns = "id, type, object, published, payload"
+
+// the columns of the subscribers table, in the order scanSubscriber expects them
+const subscriberColumns = "email, token, confirmed, created"
+
+// the columns of the emails table, in the order scanEmail expects them
+const emailColumns = "id, recipient, subject, body, unsubscribe, status, attempts, next_attempt, last_error, created"
+
+// the columns of the webhooks table, in the order scanWebhook expects them
+const webhookColumns = "id, url, secret, events, created"
+
+// the columns of the webhook_deliveries table, in the order scanDelivery expects them
+const deliveryColumns = "id, webhook, event, payload, status, attempts, next_attempt, response_code, last_error, created"
+
+// the columns of the albums table, in the order scanAlbum expects them
+const albumColumns = "id, name, slug, desc, cover, position, created"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scan a row selected with postColumns into a Document
+func scanDocument(row scanner) (Document, error) {
+	var doc Document
+	err := row.Scan(&doc.Row, &doc.Ident, &doc.Title, &doc.Created, &doc.Body, &doc.Category, &doc.Sample, &doc.Slug, &doc.Tags, &doc.Updated, &doc.Version, &doc.CommentsClosed)
+	return doc, err
+}
+
+// scan a row selected with imageColumns into an Image, without its data
+func scanImage(row scanner) (Image, error) {
+	var img Image
+	err := row.Scan(&img.Ident, &img.Title, &img.Desc, &img.Created, &img.Mime, &img.Width, &img.Height, &img.Camera, &img.Taken)
+	return img, err
+}
+
+// scan a row selected with albumColumns into an Album, without its images
+func scanAlbum(row scanner) (Album, error) {
+	var album Album
+	err := row.Scan(&album.Ident, &album.Name, &album.Slug, &album.Desc, &album.Cover, &album.Position, &album.Created)
+	return album, err
+}
+
+// scan a row selected with draftColumns into a Draft
+func scanDraft(row scanner) (Draft, error) {
+	var draft Draft
+	err := row.Scan(&draft.Post, &draft.Title, &draft.Body, &draft.Category, &draft.Slug, &draft.Tags, &draft.Version, &draft.Saved)
+	return draft, err
+}
+
+// scan a row selected with commentColumns into a Comment
+func scanComment(row scanner) (Comment, error) {
+	var comment Comment
+	err := row.Scan(&comment.Ident, &comment.Post, &comment.Parent, &comment.Name, &comment.Email, &comment.URL, &comment.Body, &comment.Status, &comment.Created)
+	return comment, err
+}
+
+// scan a row selected with mentionColumns into a Mention
+func scanMention(row scanner) (Mention, error) {
+	var mention Mention
+	err := row.Scan(&mention.Ident, &mention.Post, &mention.Source, &mention.Target, &mention.Title, &mention.Status, &mention.Created)
+	return mention, err
+}
+
+// scan a row selected with subscriberColumns into a Subscriber
+func scanSubscriber(row scanner) (Subscriber, error) {
+	var sub Subscriber
+	err := row.Scan(&sub.Email, &sub.Token, &sub.Confirmed, &sub.Created)
+	return sub, err
+}
+
+// scan a row selected with emailColumns into an Email
+func scanEmail(row scanner) (Email, error) {
+	var email Email
+	err := row.Scan(&email.Ident, &email.Recipient, &email.Subject, &email.Body, &email.Unsubscribe, &email.Status, &email.Attempts,
+		&email.NextAttempt, &email.LastError, &email.Created)
+	return email, err
+}
+
+// scan a row selected with webhookColumns into a Webhook
+func scanWebhook(row scanner) (Webhook, error) {
+	var hook Webhook
+	var events string
+	err := row.Scan(&hook.Ident, &hook.URL, &hook.Secret, &events, &hook.Created)
+	if events != "" {
+		hook.Events = strings.Split(events, ",")
+	}
+	return hook, err
+}
+
+// scan a row selected with deliveryColumns into a Delivery
+func scanDelivery(row scanner) (Delivery, error) {
+	var d Delivery
+	err := row.Scan(&d.Ident, &d.Webhook, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.ResponseCode, &d.LastError, &d.Created)
+	return d, err
+}
 
-var RequiredTables = []string{postsTable, imagesTable, menuItemsTable, navbarItemsTable, assetTable, adminTable}
+// qualify a column list with a table name, for queries that join tables sharing column names
+func prefixColumns(table, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i := range cols {
+		cols[i] = table + "." + cols[i]
+	}
+	return strings.Join(cols, ", ")
+}
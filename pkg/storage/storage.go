@@ -1,19 +1,27 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"mime/multipart"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"git.aetherial.dev/aeth/keiji/pkg/env"
+	"git.aetherial.dev/aeth/keiji/pkg/exif"
+	"git.aetherial.dev/aeth/keiji/pkg/shortcode"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
 )
 
 const TECHNICAL = "technical"
@@ -30,11 +38,21 @@ var Topics = []string{
 	HOMEPAGE,
 }
 
+/*
+Everything the site needs to be rebuilt from scratch. Populated by ExtractAll()
+and consumed by ImportAll()
+*/
 type DatabaseSchema struct {
-	// Gotta figure out what this looks like
-	// so that the ExtractAll() function gets
-	// all of the data from the database
-
+	Posts    []Document   `json:"posts"`
+	Images   []Image      `json:"images"`
+	Assets   []Asset      `json:"assets"`
+	Menu     []LinkPair   `json:"menu"`
+	Navbar   []NavBarItem `json:"navbar"`
+	Admin    AdminPage    `json:"admin"`
+	Albums   []Album      `json:"albums"`
+	Comments []Comment    `json:"comments"`
+	Mentions []Mention    `json:"mentions"`
+	Drafts   []Draft      `json:"drafts"`
 }
 
 type MenuElement struct {
@@ -77,6 +95,12 @@ type Document struct {
 	Body     string     `json:"body"`
 	Category string     `json:"category"`
 	Sample   string     `json:"sample"`
+	Slug     string     `json:"slug"`
+	Tags     string     `json:"tags"`
+	Updated  string     `json:"updated"`
+	Version  Version    `json:"version"`
+	// new comments are turned away, set with SetCommentsClosed rather than UpdateDocument
+	CommentsClosed bool `json:"comments_closed"`
 }
 
 /*
@@ -104,27 +128,136 @@ type Image struct {
 	Desc     string                `json:"description" form:"description"`
 	Created  string
 	Category string
+	Mime     string `json:"mime"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Camera   string `json:"camera"`
+	Taken    string `json:"taken"`
 	Data     []byte
 }
 
+// A post that references an image from the image store with a shortcode
+type ImageReference struct {
+	Post  Identifier `json:"post"`
+	Title string     `json:"title"`
+	Image Identifier `json:"image"`
+}
+
+/*
+Everything the site keeps in its database. Each feature only depends on its own part of it,
+SQLiteRepo implements all of them
+*/
+type SiteIO interface {
+	DocumentIO
+	CommentIO
+	FederationIO
+	NewsletterIO
+	WebhookIO
+	AnalyticsIO
+}
+
+// The posts, images, albums and the rest of what the pages of the site are made out of
 type DocumentIO interface {
 	GetDocument(id Identifier) (Document, error)
+	GetDocumentBySlug(slug string) (Document, error)
 	GetImage(id Identifier) (Image, error)
-	GetAllImages() []Image
+	GetImageInfo(id Identifier) (Image, error)
+	GetAllImages() ([]Image, error)
+	ListImages() ([]Image, error)
 	UpdateDocument(doc Document) error
 	DeleteDocument(id Identifier) error
 	AddDocument(doc Document) (Identifier, error)
 	AddImage(data []byte, title, desc string) (Identifier, error)
+	UpdateImage(img Image) error
+	DeleteImage(id Identifier) error
+	GetRenderedHTML(id Identifier) (string, string, error)
+	SetRenderedHTML(id Identifier, key, html string) error
+	GetDraft(post Identifier) (Draft, error)
+	SaveDraft(draft Draft) error
+	DeleteDraft(post Identifier) error
+	GetImageReferences(id Identifier) ([]ImageReference, error)
+	GetBrokenImageReferences() ([]ImageReference, error)
+	GetAlbums() ([]Album, error)
+	GetAlbum(id Identifier) (Album, error)
+	GetAlbumBySlug(slug string) (Album, error)
+	GetAlbumImages(id Identifier) ([]Image, error)
+	AddAlbum(album Album) (Identifier, error)
+	UpdateAlbum(album Album) error
+	DeleteAlbum(id Identifier) error
+	SetAlbumImages(id Identifier, images []Identifier) error
+	ReorderAlbums(ids []Identifier) error
 	AddAsset(name string, data []byte) error
 	AddAdminTableEntry(TableData, string) error
 	AddNavbarItem(NavBarItem) error
 	AddMenuItem(LinkPair) error
-	GetByCategory(category string) []Document
-	AllDocuments() []Document
-	GetDropdownElements() []LinkPair
-	GetNavBarLinks() []NavBarItem
-	GetAssets() []Asset
-	GetAdminTables() AdminPage
+	GetByCategory(category string) ([]Document, error)
+	AllDocuments() ([]Document, error)
+	GetDropdownElements() ([]LinkPair, error)
+	GetNavBarLinks() ([]NavBarItem, error)
+	GetAssets() ([]Asset, error)
+	GetAdminTables() (AdminPage, error)
+	ExtractAll() (DatabaseSchema, error)
+	ImportArchive(io.Reader, ImportMode) (ImportSummary, error)
+}
+
+// The comments readers leave on posts and the webmentions other sites send about them
+type CommentIO interface {
+	AddComment(comment Comment) (Identifier, error)
+	GetComment(id Identifier) (Comment, error)
+	GetComments(post Identifier, status CommentStatus) ([]Comment, error)
+	GetCommentQueue(status CommentStatus) ([]Comment, error)
+	SetCommentStatus(id Identifier, status CommentStatus) error
+	SetCommentsClosed(post Identifier, closed bool) error
+	SaveMention(mention Mention) error
+	DeleteMention(source, target string) error
+	GetMentions(post Identifier, status CommentStatus) ([]Mention, error)
+	GetMentionQueue(status CommentStatus) ([]Mention, error)
+	SetMentionStatus(id Identifier, status CommentStatus) error
+}
+
+// The followers of the ActivityPub actor, the activities it published and its signing key
+type FederationIO interface {
+	AddFollower(follower Follower) error
+	RemoveFollower(actor string) error
+	GetFollowers() ([]Follower, error)
+	AddActivity(activity Activity) error
+	GetActivity(id Identifier) (Activity, error)
+	GetActivities(limit, offset int) ([]Activity, int, error)
+	GetSigningKey(name string) (string, error)
+	SaveSigningKey(name, pem string) error
+}
+
+// The email subscribers and the queue of emails waiting to be sent to them
+type NewsletterIO interface {
+	AddSubscriber(email string) (Subscriber, error)
+	ConfirmSubscriber(token string) error
+	MarkConfirmationSent(email string, now time.Time, cooldown time.Duration) (bool, error)
+	RemoveSubscriber(token string) error
+	GetSubscribers(confirmed bool) ([]Subscriber, error)
+	QueueEmail(email Email) (Identifier, error)
+	GetDueEmails(now time.Time, limit int) ([]Email, error)
+	UpdateEmail(email Email) error
+}
+
+// The webhooks and the deliveries of events queued for them
+type WebhookIO interface {
+	AddWebhook(hook Webhook) (Identifier, error)
+	GetWebhook(id Identifier) (Webhook, error)
+	GetWebhooks() ([]Webhook, error)
+	DeleteWebhook(id Identifier) error
+	QueueDelivery(delivery Delivery) (Identifier, error)
+	GetDueDeliveries(now time.Time, limit int) ([]Delivery, error)
+	UpdateDelivery(delivery Delivery) error
+	GetDeliveries(limit int) ([]Delivery, error)
+}
+
+// The daily page view counts and the reports made from them
+type AnalyticsIO interface {
+	AddPageViews(views []PageView) error
+	GetDailyViews(from, to string) ([]ViewCount, error)
+	GetTopPages(from, to string, limit int) ([]ViewCount, error)
+	GetTopReferrers(from, to string, limit int) ([]ViewCount, error)
+	GetTopAgents(from, to string, limit int) ([]ViewCount, error)
 }
 
 var (
@@ -132,8 +265,31 @@ var (
 	ErrNotExists    = errors.New("row not exists")
 	ErrUpdateFailed = errors.New("update failed")
 	ErrDeleteFailed = errors.New("delete failed")
+	ErrNotSQLite    = errors.New("connection is not backed by sqlite3")
+	ErrNotAnImage   = errors.New("file is not an image")
+	ErrConflict     = errors.New("the post was changed since it was read")
 )
 
+// the largest image that can be uploaded when IMAGE_MAX_BYTES isnt set, 20MiB
+const DefaultMaxImageBytes = 20 << 20
+
+// the largest archive that can be imported when IMPORT_MAX_BYTES isnt set, 1GiB
+const DefaultMaxImportBytes = 1 << 30
+
+/*
+Work out the MIME type of an image from its contents, returning ErrNotAnImage (along with
+the type that was detected) for anything that isnt an image
+
+	:param data: the file to check
+*/
+func DetectImageType(data []byte) (string, error) {
+	mime := mimetype.Detect(data).String()
+	if !strings.HasPrefix(mime, "image/") {
+		return mime, fmt.Errorf("%w: detected %s", ErrNotAnImage, mime)
+	}
+	return mime, nil
+}
+
 type SQLiteRepo struct {
 	db      *sql.DB
 	imageIO ImageIO
@@ -142,6 +298,19 @@ type SQLiteRepo struct {
 type ImageIO interface {
 	Put([]byte, Identifier) error
 	Get(Identifier) ([]byte, error)
+	Delete(Identifier) error
+	Stage(io.Reader, Identifier) (StagedImage, error)
+}
+
+/*
+A blob written to an image store that doesnt replace what is stored under its identifier
+until it is committed
+*/
+type StagedImage interface {
+	// put the blob in place under its identifier
+	Commit() error
+	// throw the blob away, it does nothing once the blob is committed
+	Discard() error
 }
 
 type FilesystemImageIO struct {
@@ -149,21 +318,64 @@ type FilesystemImageIO struct {
 }
 
 /*
-Put a data blob on the filesystem
+Put a data blob on the filesystem. It is written under a temporary name and renamed into
+place, so a reader never sees half of it, only the old file or the new one
 
-	:param b: the
+	:param b: the data to write
+	:param id: the identifier to store it under
 */
 func (f FilesystemImageIO) Put(b []byte, id Identifier) error {
-	fh, err := os.OpenFile(path.Join(f.RootDir, string(id)), os.O_CREATE|os.O_RDWR, os.ModePerm)
+	staged, err := f.Stage(bytes.NewReader(b), id)
 	if err != nil {
 		return err
 	}
-	defer fh.Close()
-	_, err = fh.Write(b)
+	defer staged.Discard()
+	return staged.Commit()
+}
+
+/*
+Write a data blob to the filesystem under a temporary name, it is renamed into place when
+it is committed
+
+	:param r: the data to write
+	:param id: the identifier to store it under
+*/
+func (f FilesystemImageIO) Stage(r io.Reader, id Identifier) (StagedImage, error) {
+	// hidden until it is renamed, the image routes dont serve names starting with a dot
+	fh, err := os.CreateTemp(f.RootDir, "."+string(id)+".*")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	_, err = io.Copy(fh, r)
+	if err == nil {
+		err = fh.Chmod(0o644)
+	}
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return nil, err
+	}
+	return stagedFile{tmp: fh.Name(), dst: path.Join(f.RootDir, string(id))}, nil
+}
+
+// a blob FilesystemImageIO has written under a temporary name
+type stagedFile struct {
+	tmp string
+	dst string
+}
+
+func (s stagedFile) Commit() error {
+	return os.Rename(s.tmp, s.dst)
+}
+
+func (s stagedFile) Discard() error {
+	err := os.Remove(s.tmp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
 }
 
 /*
@@ -183,6 +395,19 @@ func (f FilesystemImageIO) Get(id Identifier) ([]byte, error) {
 	return b, nil
 }
 
+/*
+Remove a data blob from the filesystem, removing one that isnt there is not an error
+
+	:param id: the identifier of the image to remove
+*/
+func (f FilesystemImageIO) Delete(id Identifier) error {
+	err := os.Remove(path.Join(f.RootDir, string(id)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
 // Instantiate a new SQLiteRepo struct
 func NewSQLiteRepo(db *sql.DB, imgIo ImageIO) *SQLiteRepo {
 	return &SQLiteRepo{
@@ -192,6 +417,11 @@ func NewSQLiteRepo(db *sql.DB, imgIo ImageIO) *SQLiteRepo {
 
 }
 
+// The image store the repo keeps the files of its images in
+func (s *SQLiteRepo) ImageStore() ImageIO {
+	return s.imageIO
+}
+
 // Creates a new SQL table for text posts
 func (r *SQLiteRepo) Migrate(seedQueries []string) error {
 	for i := range seedQueries {
@@ -203,11 +433,97 @@ func (r *SQLiteRepo) Migrate(seedQueries []string) error {
 	return nil
 }
 
+/*
+Add any of the columns that are missing from the database, for databases created
+before the column existed
+
+	:param cols: the columns that need to exist
+*/
+func (r *SQLiteRepo) MigrateColumns(cols []Column) error {
+	for _, col := range cols {
+		rows, err := r.db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", col.Table))
+		if err != nil {
+			return err
+		}
+		found := false
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			if name == col.Name {
+				found = true
+			}
+		}
+		rows.Close()
+		if found {
+			continue
+		}
+		_, err = r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.Table, col.Name, col.Def))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Copy the live database into a new sqlite file using SQLite's online backup API. The copy
+is taken in a single step, so writers wait on it while it runs and it is consistent.
+
+	:param dest: the path of the sqlite file to write the copy to
+*/
+func (s *SQLiteRepo) BackupTo(dest string) error {
+	ctx := context.Background()
+	destDb, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return err
+	}
+	defer destDb.Close()
+	destConn, err := destDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw any) error {
+		return srcConn.Raw(func(srcRaw any) error {
+			destSqlite, ok := destRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return ErrNotSQLite
+			}
+			srcSqlite, ok := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok {
+				return ErrNotSQLite
+			}
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return err
+			}
+			_, err = backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
 /*
 Get all dropdown menu elements. Returns a list of LinkPair structs with the text and redirect location
 */
-func (s *SQLiteRepo) GetDropdownElements() []LinkPair {
+func (s *SQLiteRepo) GetDropdownElements() ([]LinkPair, error) {
 	rows, err := s.db.Query("SELECT * FROM menu")
+	if err != nil {
+		return nil, err
+	}
 	var menuItems []LinkPair
 	defer rows.Close()
 	for rows.Next() {
@@ -215,20 +531,23 @@ func (s *SQLiteRepo) GetDropdownElements() []LinkPair {
 		var item LinkPair
 		err = rows.Scan(&id, &item.Link, &item.Text)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		menuItems = append(menuItems, item)
 	}
-	return menuItems
+	return menuItems, rows.Err()
 
 }
 
 /*
 Get all nav bar items. Returns a list of NavBarItem structs with the png data, the file name, and the redirect location of the icon
 */
-func (s *SQLiteRepo) GetNavBarLinks() []NavBarItem {
+func (s *SQLiteRepo) GetNavBarLinks() ([]NavBarItem, error) {
 
 	rows, err := s.db.Query("SELECT * FROM navbar")
+	if err != nil {
+		return nil, err
+	}
 	var navbarItems []NavBarItem
 	defer rows.Close()
 	for rows.Next() {
@@ -236,19 +555,22 @@ func (s *SQLiteRepo) GetNavBarLinks() []NavBarItem {
 		var id int
 		err = rows.Scan(&id, &item.Png, &item.Link, &item.Redirect)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		navbarItems = append(navbarItems, item)
 	}
-	return navbarItems
+	return navbarItems, rows.Err()
 
 }
 
 /*
 get all assets from the asset table
 */
-func (s *SQLiteRepo) GetAssets() []Asset {
+func (s *SQLiteRepo) GetAssets() ([]Asset, error) {
 	rows, err := s.db.Query("SELECT * FROM assets")
+	if err != nil {
+		return nil, err
+	}
 	var assets []Asset
 	defer rows.Close()
 	for rows.Next() {
@@ -256,20 +578,23 @@ func (s *SQLiteRepo) GetAssets() []Asset {
 		var id int
 		err = rows.Scan(&id, &item.Name, &item.Data)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		assets = append(assets, item)
 	}
-	return assets
+	return assets, rows.Err()
 
 }
 
 /*
 get all assets from the asset table
 */
-func (s *SQLiteRepo) GetAdminTables() AdminPage {
-	rows, err := s.db.Query("SELECT * FROM admin")
+func (s *SQLiteRepo) GetAdminTables() (AdminPage, error) {
 	adminPage := AdminPage{Tables: map[string][]TableData{}}
+	rows, err := s.db.Query("SELECT * FROM admin")
+	if err != nil {
+		return adminPage, err
+	}
 	defer rows.Close()
 	for rows.Next() {
 		var item TableData
@@ -277,11 +602,11 @@ func (s *SQLiteRepo) GetAdminTables() AdminPage {
 		var category string
 		err = rows.Scan(&id, &item.DisplayName, &item.Link, &category)
 		if err != nil {
-			log.Fatal(err)
+			return adminPage, err
 		}
 		adminPage.Tables[category] = append(adminPage.Tables[category], item)
 	}
-	return adminPage
+	return adminPage, rows.Err()
 
 }
 
@@ -291,45 +616,60 @@ Retrieve a document from the sqlite db
 	:param id: the Identifier of the post
 */
 func (s *SQLiteRepo) GetDocument(id Identifier) (Document, error) {
-	row := s.db.QueryRow("SELECT * FROM posts WHERE id = ?", id)
-
-	var post Document
-	var rowNum int
-	if err := row.Scan(&rowNum, &post.Ident, &post.Title, &post.Created, &post.Body, &post.Category, &post.Sample); err != nil {
+	row := s.db.QueryRow("SELECT "+postColumns+" FROM posts WHERE id = ?", id)
+	post, err := scanDocument(row)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return post, ErrNotExists
+			return Document{}, ErrNotExists
 		}
-		return post, err
+		return Document{}, err
 	}
+	post.Row = 0
 	return post, nil
 
 }
 
+/*
+Retrieve a document from the sqlite db by its slug
+
+	:param slug: the slug of the post
+*/
+func (s *SQLiteRepo) GetDocumentBySlug(slug string) (Document, error) {
+	if slug == "" {
+		return Document{}, ErrNotExists
+	}
+	row := s.db.QueryRow("SELECT "+postColumns+" FROM posts WHERE slug = ? ORDER BY row LIMIT 1", slug)
+	post, err := scanDocument(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Document{}, ErrNotExists
+		}
+		return Document{}, err
+	}
+	post.Row = 0
+	return post, nil
+}
+
 /*
 Get all documents by category
 
 	:param category: the category to retrieve all docs from
 */
-func (s *SQLiteRepo) GetByCategory(category string) []Document {
-	rows, err := s.db.Query("SELECT * FROM posts WHERE category = ?", category)
+func (s *SQLiteRepo) GetByCategory(category string) ([]Document, error) {
+	rows, err := s.db.Query("SELECT "+postColumns+" FROM posts WHERE category = ?", category)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	var docs []Document
 	defer rows.Close()
 	for rows.Next() {
-		var doc Document
-		err := rows.Scan(&doc.Row, &doc.Ident, &doc.Title, &doc.Created, &doc.Body, &doc.Category, &doc.Sample)
+		doc, err := scanDocument(rows)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		docs = append(docs, doc)
 	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return docs
+	return docs, rows.Err()
 
 }
 
@@ -339,53 +679,82 @@ get image data from the images table
 	:param id: the serial identifier of the post
 */
 func (s *SQLiteRepo) GetImage(id Identifier) (Image, error) {
-	row := s.db.QueryRow("SELECT * FROM images WHERE id = ?", id)
-	var rowNum int
-	var title, desc, created string
-	if err := row.Scan(&rowNum, &id, &title, &desc, &created); err != nil {
+	img, err := scanImage(s.db.QueryRow("SELECT "+imageColumns+" FROM images WHERE id = ?", id))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotExists
 		}
 		return Image{}, err
 	}
-	data, err := s.imageIO.Get(id)
+	img.Data, err = s.imageIO.Get(id)
 	if err != nil {
 		return Image{}, err
 	}
-	return Image{Ident: id, Title: title, Desc: desc, Data: data, Created: created}, nil
+	return img, nil
+}
+
+/*
+Get the metadata of an image without reading its file
+
+	:param id: the identifier of the image
+*/
+func (s *SQLiteRepo) GetImageInfo(id Identifier) (Image, error) {
+	img, err := scanImage(s.db.QueryRow("SELECT "+imageColumns+" FROM images WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Image{}, ErrNotExists
+	}
+	return img, err
 }
 
 /*
-Get all of the images from the datastore
+Get the metadata of every image without reading their files, for listing them
 */
-func (s *SQLiteRepo) GetAllImages() []Image {
-	rows, err := s.db.Query("SELECT * FROM images")
+func (s *SQLiteRepo) ListImages() ([]Image, error) {
+	rows, err := s.db.Query("SELECT " + imageColumns + " FROM images")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 	imgs := []Image{}
 	for rows.Next() {
-		var img Image
-		var rowNum int
-		err := rows.Scan(&rowNum, &img.Ident, &img.Title, &img.Desc, &img.Created)
-		if err != nil {
-			log.Fatal(err)
-		}
-		b, err := s.imageIO.Get(img.Ident)
+		img, err := scanImage(rows)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		imgs = append(imgs, Image{Ident: img.Ident, Title: img.Title, Desc: img.Desc, Data: b, Created: img.Created})
+		imgs = append(imgs, img)
 	}
-	err = rows.Err()
+	return imgs, rows.Err()
+}
+
+/*
+Get all of the images from the datastore. An image whose file cant be read is logged and
+left out, rather than failing every page that lists the images
+*/
+func (s *SQLiteRepo) GetAllImages() ([]Image, error) {
+	rows, err := s.db.Query("SELECT " + imageColumns + " FROM images")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return imgs
+	defer rows.Close()
+	imgs := []Image{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		img.Data, err = s.imageIO.Get(img.Ident)
+		if err != nil {
+			slog.Warn("skipping an image whose file cant be read", "image", img.Ident, "err", err)
+			continue
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
 }
 
 /*
-Add an image to the database
+Add an image to the database, with its metadata stripped as EXIF_STRIP says. Returns
+exif.ErrUnsupported for a format that can carry a location but cant be stripped
 
 	:param title: the title of the image
 	:param location: the location to save the image to
@@ -393,12 +762,23 @@ Add an image to the database
 	:param data: the binary data for the image
 */
 func (s *SQLiteRepo) AddImage(data []byte, title string, desc string) (Identifier, error) {
+	mime, err := DetectImageType(data)
+	if err != nil {
+		return Identifier(""), err
+	}
+	// read before stripping, the camera and date are kept in the database either way
+	info := exif.Read(data)
+	data, err = exif.Strip(data, GetExifStrip())
+	if err != nil {
+		return Identifier(""), err
+	}
 	id := newIdentifier()
-	err := s.imageIO.Put(data, id)
+	err = s.imageIO.Put(data, id)
 	if err != nil {
 		return Identifier(""), err
 	}
-	_, err = s.db.Exec("INSERT INTO images (id, title, desc, created) VALUES (?,?,?,?)", string(id), title, desc, time.Now().String())
+	_, err = s.db.Exec("INSERT INTO images (id, title, desc, created, mime, width, height, camera, taken) VALUES (?,?,?,?,?,?,?,?,?)",
+		string(id), title, desc, time.Now().String(), mime, info.Width, info.Height, info.Camera, info.Taken)
 	if err != nil {
 		return Identifier(""), err
 	}
@@ -406,7 +786,178 @@ func (s *SQLiteRepo) AddImage(data []byte, title string, desc string) (Identifie
 }
 
 /*
-Updates a document in the database with the supplied. Only changes the title, the body, category. Keys off of the documents Identifier
+Update the title and description of an image, keyed off of its Identifier
+
+	:param img: the Image to update
+*/
+func (s *SQLiteRepo) UpdateImage(img Image) error {
+	res, err := s.db.Exec("UPDATE images SET title = ?, desc = ? WHERE id = ?", img.Title, img.Desc, string(img.Ident))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotExists
+	}
+	// the title is the alt text of the image in posts that dont set their own
+	return clearRendered(s.db, img.Ident)
+}
+
+/*
+Delete an image from the images table and the image store
+
+	:param id: the identifier of the image to remove
+*/
+func (s *SQLiteRepo) DeleteImage(id Identifier) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM images WHERE id = ?", string(id))
+	if err == nil {
+		err = expectRow(res)
+	}
+	// take it out of every album it was in too
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM album_images WHERE image = ?", string(id))
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE albums SET cover = '' WHERE cover = ?", string(id))
+	}
+	if err == nil {
+		err = clearRendered(tx, id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return s.imageIO.Delete(id)
+}
+
+/*
+Get the posts that reference an image with a shortcode, i.e. to warn that deleting it
+will leave them with a missing image
+
+	:param id: the Identifier of the image
+*/
+func (s *SQLiteRepo) GetImageReferences(id Identifier) ([]ImageReference, error) {
+	refs, err := s.imageReferences("%" + string(id) + "%")
+	if err != nil {
+		return nil, err
+	}
+	found := []ImageReference{}
+	for _, ref := range refs {
+		if ref.Image == id {
+			found = append(found, ref)
+		}
+	}
+	return found, nil
+}
+
+/*
+Get every shortcode in every post that references an image that doesnt exist
+*/
+func (s *SQLiteRepo) GetBrokenImageReferences() ([]ImageReference, error) {
+	refs, err := s.imageReferences("%{{<%image%")
+	if err != nil {
+		return nil, err
+	}
+	broken := []ImageReference{}
+	for _, ref := range refs {
+		exists, err := rowExists(s.db, "SELECT COUNT(*) FROM images WHERE id = ?", ref.Image)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			broken = append(broken, ref)
+		}
+	}
+	return broken, nil
+}
+
+/*
+Find the image shortcodes in the posts whose body matches a LIKE pattern, the pattern
+only narrows down which posts are parsed
+
+	:param pattern: the LIKE pattern to match the post bodies against
+*/
+func (s *SQLiteRepo) imageReferences(pattern string) ([]ImageReference, error) {
+	rows, err := s.db.Query("SELECT id, title, body FROM posts WHERE body LIKE ? ORDER BY row", pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []ImageReference
+	for rows.Next() {
+		var id Identifier
+		var title, body string
+		if err = rows.Scan(&id, &title, &body); err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, img := range shortcode.Find([]byte(body)) {
+			if seen[img.ID] {
+				continue
+			}
+			seen[img.ID] = true
+			refs = append(refs, ImageReference{Post: id, Title: title, Image: Identifier(img.ID)})
+		}
+	}
+	return refs, rows.Err()
+}
+
+/*
+Get the html a post was last rendered to and the key it was rendered under, both are empty
+if it hasnt been rendered since it last changed
+
+	:param id: the Identifier of the post
+*/
+func (s *SQLiteRepo) GetRenderedHTML(id Identifier) (string, string, error) {
+	var key, html string
+	err := s.db.QueryRow("SELECT rendered_key, rendered_html FROM posts WHERE id = ?", id).Scan(&key, &html)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrNotExists
+	}
+	return key, html, err
+}
+
+/*
+Keep the html a post was rendered to, so it doesnt have to be rendered again after a restart
+
+	:param id: the Identifier of the post
+	:param key: identifies what the html was rendered from, i.e. the posts updated time and the renderer
+	:param html: the rendered html
+*/
+func (s *SQLiteRepo) SetRenderedHTML(id Identifier, key, html string) error {
+	res, err := s.db.Exec("UPDATE posts SET rendered_key = ?, rendered_html = ? WHERE id = ?", key, html, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// clear the rendered html of the posts that embed an image, since it was rendered from the old one
+func clearRendered(db execer, id Identifier) error {
+	_, err := db.Exec("UPDATE posts SET rendered_key = '', rendered_html = '' WHERE body LIKE ?", "%"+string(id)+"%")
+	return err
+}
+
+// the time a post was last changed, precise enough that two saves in a row dont share it
+func updatedNow() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+/*
+Updates a document in the database with the supplied. Only changes the title, the body, category. Keys off of the documents Identifier.
+The update only goes through when the documents Version is still the one in the database, returning ErrConflict otherwise so that
+two editors dont overwrite each other. A Version of 0 skips the check, for clients that dont keep track of it. Saving a post
+discards its draft
 
 	:param doc: the Document to upload into the database
 */
@@ -415,24 +966,37 @@ func (s *SQLiteRepo) UpdateDocument(doc Document) error {
 	if err != nil {
 		return err
 	}
-	stmt, err := tx.Prepare("UPDATE posts SET title = ?, body = ?, category = ?, sample = ? WHERE id = ?;")
+	// the rendered html is cleared too, it was rendered from the old body
+	stmt, err := tx.Prepare("UPDATE posts SET title = ?, body = ?, category = ?, sample = ?, slug = ?, tags = ?, updated = ?, rendered_key = '', rendered_html = '', version = version + 1 WHERE id = ? AND (? = 0 OR version = ?);")
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	res, err := stmt.Exec(doc.Title, doc.Body, doc.Category, doc.MakeSample(), doc.Ident)
+	res, err := stmt.Exec(doc.Title, doc.Body, doc.Category, doc.MakeSample(), doc.Slug, doc.Tags, updatedNow(), doc.Ident, doc.Version, doc.Version)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 	affected, _ := res.RowsAffected()
 	if affected != 1 {
+		exists, err := rowExists(tx, "SELECT COUNT(*) FROM posts WHERE id = ?", doc.Ident)
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrConflict
+		}
 		return ErrNotExists
 	}
+	_, err = tx.Exec("DELETE FROM drafts WHERE post = ?", doc.Ident)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	tx.Commit()
-	return nil
+	return tx.Commit()
 }
 
 /*
@@ -445,14 +1009,12 @@ func (s *SQLiteRepo) AddMenuItem(item LinkPair) error {
 	if err != nil {
 		return err
 	}
-	stmt, _ := tx.Prepare("INSERT INTO menu(link, text) VALUES (?,?)")
-	_, err = stmt.Exec(item.Link, item.Text)
+	_, err = tx.Exec("INSERT INTO menu(link, text) VALUES (?,?)", item.Link, item.Text)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
-	return nil
+	return tx.Commit()
 
 }
 
@@ -476,8 +1038,7 @@ func (s *SQLiteRepo) AddNavbarItem(item NavBarItem) error {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
-	return nil
+	return tx.Commit()
 
 }
 
@@ -492,14 +1053,12 @@ func (s *SQLiteRepo) AddAsset(name string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	stmt, _ := tx.Prepare("INSERT INTO assets(name, data) VALUES (?,?)")
-	_, err = stmt.Exec(name, data)
+	_, err = tx.Exec("INSERT INTO assets(name, data) VALUES (?,?)", name, data)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
-	return nil
+	return tx.Commit()
 }
 
 /*
@@ -513,13 +1072,14 @@ func (s *SQLiteRepo) AddDocument(doc Document) (Identifier, error) {
 	if err != nil {
 		return Identifier(""), err
 	}
-	stmt, _ := tx.Prepare("INSERT INTO posts(id, title, created, body, category, sample) VALUES (?,?,?,?,?,?)")
-	_, err = stmt.Exec(id, doc.Title, doc.Created, doc.Body, doc.Category, doc.MakeSample())
+	_, err = tx.Exec("INSERT INTO posts(id, title, created, body, category, sample, slug, tags, updated) VALUES (?,?,?,?,?,?,?,?,?)", id, doc.Title, doc.Created, doc.Body, doc.Category, doc.MakeSample(), doc.Slug, doc.Tags, updatedNow())
 	if err != nil {
 		tx.Rollback()
 		return Identifier(""), err
 	}
-	tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return Identifier(""), err
+	}
 	return id, nil
 
 }
@@ -535,15 +1095,12 @@ func (s *SQLiteRepo) AddAdminTableEntry(item TableData, category string) error {
 	if err != nil {
 		return err
 	}
-	stmt, _ := tx.Prepare("INSERT INTO admin (display_name, link, category) VALUES (?,?,?)")
-	_, err = stmt.Exec(item.DisplayName, item.Link, category)
+	_, err = tx.Exec("INSERT INTO admin (display_name, link, category) VALUES (?,?,?)", item.DisplayName, item.Link, category)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
-
-	return nil
+	return tx.Commit()
 }
 
 /*
@@ -556,36 +1113,39 @@ func (s *SQLiteRepo) DeleteDocument(id Identifier) error {
 	if err != nil {
 		return err
 	}
-	stmt, _ := tx.Prepare("DELETE FROM posts WHERE id=?")
-	_, err = stmt.Exec(id)
+	_, err = tx.Exec("DELETE FROM posts WHERE id=?", id)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
-	return nil
+	for _, table := range []string{"drafts", "comments", "mentions"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE post = ?", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 
 }
 
-// Get all Hosts from the host table
-func (s *SQLiteRepo) AllDocuments() []Document {
-	rows, err := s.db.Query("SELECT * FROM posts")
+// Get every post in the posts table
+func (s *SQLiteRepo) AllDocuments() ([]Document, error) {
+	rows, err := s.db.Query("SELECT " + postColumns + " FROM posts")
 	if err != nil {
-		fmt.Printf("There was an issue getting all posts. %s", err.Error())
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
 
 	all := []Document{}
 	for rows.Next() {
-		var post Document
-		if err := rows.Scan(&post.Row, &post.Ident, &post.Title, &post.Created, &post.Body, &post.Category, &post.Sample); err != nil {
-			fmt.Printf("There was an error getting all documents. %s", err.Error())
-			return nil
+		post, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
 		}
 		all = append(all, post)
 	}
-	return all
+	return all, rows.Err()
 }
 
 type InvalidSkipArg struct{ Skip int }
@@ -613,6 +1173,43 @@ func GetImageStore() string {
 	return os.Getenv(env.IMAGE_STORE)
 }
 
+/*
+Get the largest image that can be uploaded in bytes, from IMAGE_MAX_BYTES or
+DefaultMaxImageBytes if it isnt set to a positive number
+*/
+func GetMaxImageBytes() int64 {
+	n, err := strconv.ParseInt(os.Getenv(env.IMAGE_MAX_BYTES), 10, 64)
+	if err != nil || n < 1 {
+		return DefaultMaxImageBytes
+	}
+	return n
+}
+
+/*
+Get the largest archive that can be imported in bytes, from IMPORT_MAX_BYTES or
+DefaultMaxImportBytes if it isnt set to a positive number
+*/
+func GetMaxImportBytes() int64 {
+	n, err := strconv.ParseInt(os.Getenv(env.IMPORT_MAX_BYTES), 10, 64)
+	if err != nil || n < 1 {
+		return DefaultMaxImportBytes
+	}
+	return n
+}
+
+/*
+Get how much metadata to strip from uploaded images, from EXIF_STRIP. Anything other
+than 'all' or 'none' strips the location, so a typo doesnt leak one
+*/
+func GetExifStrip() exif.StripMode {
+	switch mode := exif.StripMode(os.Getenv(env.EXIF_STRIP)); mode {
+	case exif.STRIP_ALL, exif.STRIP_NONE:
+		return mode
+	default:
+		return exif.STRIP_GPS
+	}
+}
+
 // Wrapping the new id call in a function to make refactoring easier
 func newIdentifier() Identifier {
 	return Identifier(uuid.NewString())
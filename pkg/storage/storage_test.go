@@ -3,8 +3,12 @@ package storage
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -40,6 +44,9 @@ const badAdminTable = `
 	);
 	`
 
+// just enough of a png for its type to be detected
+var testPng = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
 var unpopulatedTables = []string{badPostsTable, badImagesTable, badMenuItemsTable, badMenuItemsTable, badAssetTable, badAdminTable}
 
 /*
@@ -98,6 +105,99 @@ func TestMigrate(t *testing.T) {
 
 }
 
+func TestMigrateColumns(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testDb := &SQLiteRepo{db: db, imageIO: FilesystemImageIO{RootDir: t.TempDir()}}
+	// the posts table as it was before slugs and tags existed
+	_, err = db.Exec(`CREATE TABLE posts(row INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL UNIQUE, title TEXT NOT NULL,
+		created TEXT NOT NULL, body TEXT NOT NULL, category TEXT NOT NULL, sample TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and the images table before the mime type was stored
+	_, err = db.Exec(`CREATE TABLE images(row INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL, title TEXT NOT NULL,
+		desc TEXT NOT NULL, created TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and the subscribers table before it kept when a confirmation was last sent
+	_, err = db.Exec(`CREATE TABLE subscribers(row INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL UNIQUE,
+		token TEXT NOT NULL UNIQUE, confirmed INTEGER NOT NULL DEFAULT 0, created TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = testDb.MigrateColumns(RequiredColumns)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = testDb.AddDocument(Document{Title: "abc 123", Body: "body", Created: "2024-12-31", Category: BLOG, Slug: "abc-123"})
+	assert.NoError(t, err)
+	_, err = testDb.AddImage(testPng, "abc", "123")
+	assert.NoError(t, err)
+	_, err = testDb.AddSubscriber("a@aetherial.dev")
+	assert.NoError(t, err)
+	send, err := testDb.MarkConfirmationSent("a@aetherial.dev", time.Now(), time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, send)
+}
+
+func TestGetDocumentBySlug(t *testing.T) {
+	type testcase struct {
+		input string
+		want  string
+		err   error
+	}
+	testDb, _ := newTestDb(t.TempDir(), true)
+	testDb.AddDocument(Document{Title: "first", Body: "body", Created: "2024-12-31", Category: BLOG, Slug: "hello-world", Tags: "go,htmx"})
+	testDb.AddDocument(Document{Title: "second", Body: "body", Created: "2024-12-31", Category: BLOG})
+	for _, tc := range []testcase{
+		{input: "hello-world", want: "first"},
+		{input: "not-a-slug", err: ErrNotExists},
+		{input: "", err: ErrNotExists},
+	} {
+		got, err := testDb.GetDocumentBySlug(tc.input)
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.want, got.Title)
+	}
+}
+
+func TestBackupTo(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", path.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDb := NewSQLiteRepo(db, FilesystemImageIO{RootDir: dir})
+	err = testDb.Migrate(RequiredTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := testDb.AddDocument(Document{Title: "abc 123", Body: "blog post body etc", Created: "2024-12-31", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := path.Join(dir, "copy.db")
+	err = testDb.BackupTo(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyDb, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copyDb.Close()
+	got, err := NewSQLiteRepo(copyDb, FilesystemImageIO{RootDir: dir}).GetDocument(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "abc 123", got.Title)
+}
+
 func TestGetDropdownElements(t *testing.T) {
 	type testcase struct {
 		seed []LinkPair
@@ -120,7 +220,8 @@ func TestGetDropdownElements(t *testing.T) {
 				t.Errorf("failed to seed: %s", err)
 			}
 		}
-		got := testDb.GetDropdownElements()
+		got, err := testDb.GetDropdownElements()
+		assert.NoError(t, err)
 		assert.Equal(t, got, tc.seed)
 
 	}
@@ -149,7 +250,8 @@ func TestGetNavBarLinks(t *testing.T) {
 				t.Errorf("failed to seed: %s", err)
 			}
 		}
-		got := testDb.GetNavBarLinks()
+		got, err := testDb.GetNavBarLinks()
+		assert.NoError(t, err)
 		assert.Equal(t, tc.seed, got)
 
 	}
@@ -176,7 +278,8 @@ func TestGetAssets(t *testing.T) {
 				t.Error(err)
 			}
 		}
-		got := testDb.GetAssets()
+		got, err := testDb.GetAssets()
+		assert.NoError(t, err)
 		assert.Equal(t, tc.seed, got)
 
 	}
@@ -212,7 +315,8 @@ func TestGetAdminTables(t *testing.T) {
 
 			}
 		}
-		got := testDb.GetAdminTables()
+		got, err := testDb.GetAdminTables()
+		assert.NoError(t, err)
 		assert.Equal(t, tc.seed, got)
 
 	}
@@ -232,6 +336,7 @@ func TestGetDocument(t *testing.T) {
 				Body:     "blog post body etc",
 				Category: BLOG,
 				Sample:   "this is a sample",
+				Version:  1,
 			},
 		},
 	} {
@@ -262,6 +367,7 @@ func TestGetByCategory(t *testing.T) {
 					Body:     "blog post body etc",
 					Category: BLOG,
 					Sample:   "this is a sample",
+					Version:  1,
 				},
 				{
 					Row:      2,
@@ -271,6 +377,7 @@ func TestGetByCategory(t *testing.T) {
 					Body:     "blog post body etc",
 					Category: BLOG,
 					Sample:   "this is a sample",
+					Version:  1,
 				},
 			},
 		},
@@ -282,7 +389,8 @@ func TestGetByCategory(t *testing.T) {
 				t.Error(err)
 			}
 		}
-		got := testDb.GetByCategory(BLOG)
+		got, err := testDb.GetByCategory(BLOG)
+		assert.NoError(t, err)
 		assert.Equal(t, tc.seed, got)
 	}
 
@@ -363,7 +471,8 @@ func TestGetAllImages(t *testing.T) {
 			}
 			testDb.imageIO.Put(tc.seed[i].Data, tc.seed[i].Ident)
 		}
-		got := testDb.GetAllImages()
+		got, err := testDb.GetAllImages()
+		assert.NoError(t, err)
 		assert.Equal(t, tc.seed, got)
 	}
 
@@ -386,6 +495,7 @@ func TestAllDocuments(t *testing.T) {
 					Body:     "blog post body etc",
 					Category: BLOG,
 					Sample:   "this is a sample",
+					Version:  1,
 				},
 				{
 					Row:      2,
@@ -395,6 +505,7 @@ func TestAllDocuments(t *testing.T) {
 					Body:     "blog post body etc",
 					Category: BLOG,
 					Sample:   "this is a sample",
+					Version:  1,
 				},
 			},
 		},
@@ -406,7 +517,8 @@ func TestAllDocuments(t *testing.T) {
 				t.Error(err)
 			}
 		}
-		got := testDb.AllDocuments()
+		got, err := testDb.AllDocuments()
+		assert.NoError(t, err)
 		assert.Equal(t, tc.seed, got)
 	}
 
@@ -501,7 +613,7 @@ func TestUpdateDocument(t *testing.T) {
 			assert.Equal(t, tc.err.Error(), err.Error())
 		} else {
 
-			row := db.QueryRow("SELECT * FROM posts WHERE id = ?", tc.seed.Ident)
+			row := db.QueryRow("SELECT row, id, title, created, body, category, sample FROM posts WHERE id = ?", tc.seed.Ident)
 			var got Document
 			if err := row.Scan(&got.Row, &got.Ident, &got.Title, &got.Created, &got.Body, &got.Category, &got.Sample); err != nil {
 				assert.Equal(t, tc.err, err)
@@ -523,20 +635,27 @@ func TestAddImage(t *testing.T) {
 	testDb, _ := newTestDb(t.TempDir(), true)
 	for _, tc := range []testcase{
 		{
-			data:  []byte("abc123xyz098"),
+			data:  testPng,
 			title: "dont matter",
 			desc:  "also dont matter",
 		},
+		{
+			data:  []byte("abc123xyz098"),
+			title: "not an image",
+			err:   ErrNotAnImage,
+		},
 	} {
 		id, err := testDb.AddImage(tc.data, tc.title, tc.desc)
 		if err != nil {
-			assert.Equal(t, tc.err, err)
+			assert.ErrorIs(t, err, tc.err)
 		} else {
 			b, err := testDb.imageIO.Get(id)
 			if err != nil {
 				t.Error(err)
 			}
 			assert.Equal(t, tc.data, b)
+			img, _ := testDb.GetImage(id)
+			assert.Equal(t, "image/png", img.Mime)
 		}
 
 	}
@@ -681,7 +800,7 @@ func TestAddDocument(t *testing.T) {
 		if err != nil {
 			assert.Equal(t, tc.err, err)
 		}
-		row := db.QueryRow("SELECT * FROM posts WHERE id = ?", id)
+		row := db.QueryRow("SELECT row, id, title, created, body, category, sample FROM posts WHERE id = ?", id)
 		var got Document
 		var rowNum int
 		if err := row.Scan(&rowNum, &got.Ident, &got.Title, &got.Created, &got.Body, &got.Category, &got.Sample); err != nil {
@@ -780,6 +899,163 @@ func TestDeleteDocument(t *testing.T) {
 	}
 }
 
+func TestUpdateImage(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	id, err := testDb.AddImage(testPng, "old title", "old desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testcase struct {
+		desc  string
+		input Image
+		err   error
+	}
+	for _, tc := range []testcase{
+		{
+			desc:  "existing image",
+			input: Image{Ident: id, Title: "new title", Desc: "new desc"},
+		},
+		{
+			desc:  "missing image",
+			input: Image{Ident: Identifier("missing"), Title: "new title"},
+			err:   ErrNotExists,
+		},
+	} {
+		err := testDb.UpdateImage(tc.input)
+		assert.Equal(t, tc.err, err, tc.desc)
+	}
+	img, err := testDb.GetImage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "new title", img.Title)
+	assert.Equal(t, "new desc", img.Desc)
+	assert.Equal(t, testPng, img.Data)
+}
+
+func TestDeleteImage(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	id, err := testDb.AddImage(testPng, "title", "desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, testDb.DeleteImage(id))
+	_, err = testDb.GetImage(id)
+	assert.Equal(t, ErrNotExists, err)
+	_, err = testDb.imageIO.Get(id)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrNotExists, testDb.DeleteImage(id))
+}
+
+func TestImageReferences(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	kept, err := testDb.AddImage(testPng, "kept", "desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := testDb.AddImage(testPng, "deleted", "desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf("{{< image id=\"%s\" >}}\n{{< image id=\"%s\" >}}\n{{< image id=\"%s\" >}}", kept, deleted, kept)
+	first, err := testDb.AddDocument(Document{Title: "first", Body: body, Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only mentions the image in a code block, which isnt a reference
+	_, err = testDb.AddDocument(Document{Title: "second", Body: fmt.Sprintf("`{{< image id=\"%s\" >}}`", deleted), Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := testDb.GetImageReferences(kept)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageReference{{Post: first, Title: "first", Image: kept}}, refs)
+	refs, err = testDb.GetImageReferences(deleted)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageReference{{Post: first, Title: "first", Image: deleted}}, refs)
+
+	broken, err := testDb.GetBrokenImageReferences()
+	assert.NoError(t, err)
+	assert.Empty(t, broken)
+	assert.NoError(t, testDb.DeleteImage(deleted))
+	broken, err = testDb.GetBrokenImageReferences()
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageReference{{Post: first, Title: "first", Image: deleted}}, broken)
+}
+
+func TestRenderedHTML(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	img, err := testDb.AddImage(testPng, "cat", "desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := testDb.AddDocument(Document{Title: "post", Body: fmt.Sprintf("{{< image id=\"%s\" >}}", img), Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := testDb.AddDocument(Document{Title: "other", Body: "no images", Category: BLOG})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, html, err := testDb.GetRenderedHTML(post)
+	assert.NoError(t, err)
+	assert.Equal(t, "", key)
+	assert.Equal(t, "", html)
+	assert.NoError(t, testDb.SetRenderedHTML(post, "k1", "<p>post</p>"))
+	assert.NoError(t, testDb.SetRenderedHTML(other, "k1", "<p>other</p>"))
+	key, html, err = testDb.GetRenderedHTML(post)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", key)
+	assert.Equal(t, "<p>post</p>", html)
+
+	// changing an image clears the posts that embed it, and only those
+	assert.NoError(t, testDb.UpdateImage(Image{Ident: img, Title: "dog", Desc: "desc"}))
+	key, _, err = testDb.GetRenderedHTML(post)
+	assert.NoError(t, err)
+	assert.Equal(t, "", key)
+	key, _, err = testDb.GetRenderedHTML(other)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", key)
+
+	doc, err := testDb.GetDocument(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := doc.Updated
+	assert.NotEmpty(t, updated)
+	doc.Body = "still no images"
+	assert.NoError(t, testDb.UpdateDocument(doc))
+	key, _, err = testDb.GetRenderedHTML(other)
+	assert.NoError(t, err)
+	assert.Equal(t, "", key)
+	doc, err = testDb.GetDocument(other)
+	assert.NoError(t, err)
+	assert.NotEqual(t, updated, doc.Updated)
+
+	_, _, err = testDb.GetRenderedHTML(Identifier("missing"))
+	assert.True(t, errors.Is(err, ErrNotExists))
+	assert.True(t, errors.Is(testDb.SetRenderedHTML(Identifier("missing"), "k1", ""), ErrNotExists))
+}
+
+func TestFilesystemImageIOPut(t *testing.T) {
+	dir := t.TempDir()
+	store := FilesystemImageIO{RootDir: dir}
+	assert.NoError(t, store.Put([]byte("first"), "abc"))
+	assert.NoError(t, store.Put([]byte("second"), "abc"))
+	b, err := store.Get("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), b)
+	// the temporary file was renamed into place
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "abc", entries[0].Name())
+	}
+	assert.Error(t, FilesystemImageIO{RootDir: path.Join(dir, "missing")}.Put([]byte("x"), "abc"))
+}
+
 func TestGetImageStore(t *testing.T) {
 
 	// testDb, db := newTestDb(t.TempDir(), true)
@@ -788,3 +1064,73 @@ func TestNewIdentifier(t *testing.T) {
 
 	// testDb, db := newTestDb(t.TempDir(), true)
 }
+
+func TestGetErrors(t *testing.T) {
+	testDb, db := newTestDb(t.TempDir(), true)
+	for _, table := range []string{"menu", "navbar", "assets", "admin", "posts", "images"} {
+		if _, err := db.Exec("DROP TABLE " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := testDb.GetDropdownElements()
+	assert.Error(t, err)
+	_, err = testDb.GetNavBarLinks()
+	assert.Error(t, err)
+	_, err = testDb.GetAssets()
+	assert.Error(t, err)
+	_, err = testDb.GetAdminTables()
+	assert.Error(t, err)
+	_, err = testDb.GetByCategory(BLOG)
+	assert.Error(t, err)
+	_, err = testDb.AllDocuments()
+	assert.Error(t, err)
+	_, err = testDb.GetAllImages()
+	assert.Error(t, err)
+}
+
+func TestGetAllImagesMissingFile(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	id, err := testDb.AddImage(testPng, "gone", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := testDb.AddImage(testPng, "kept", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(testDb.imageIO.(FilesystemImageIO).RootDir, string(id))); err != nil {
+		t.Fatal(err)
+	}
+	// one missing file shouldnt take every listing of the images down with it
+	imgs, err := testDb.GetAllImages()
+	assert.NoError(t, err)
+	if assert.Len(t, imgs, 1) {
+		assert.Equal(t, kept, imgs[0].Ident)
+	}
+}
+
+func TestListImages(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	id, err := testDb.AddImage(testPng, "gone", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(testDb.imageIO.(FilesystemImageIO).RootDir, string(id))); err != nil {
+		t.Fatal(err)
+	}
+	// the files arent read, so one thats missing is still listed
+	imgs, err := testDb.ListImages()
+	assert.NoError(t, err)
+	if assert.Len(t, imgs, 1) {
+		assert.Equal(t, id, imgs[0].Ident)
+		assert.Equal(t, "image/png", imgs[0].Mime)
+		assert.Nil(t, imgs[0].Data)
+	}
+
+	img, err := testDb.GetImageInfo(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "gone", img.Title)
+	assert.Nil(t, img.Data)
+	_, err = testDb.GetImageInfo("nope")
+	assert.Equal(t, ErrNotExists, err)
+}
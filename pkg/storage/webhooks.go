@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+/*
+An outside service that is told about changes to the site. Every event it subscribed to is
+POSTed to its URL as JSON, signed with the Secret so it can check the request came from the
+site. A webhook without any Events gets all of them
+*/
+type Webhook struct {
+	Ident   Identifier `json:"id"`
+	URL     string     `json:"url"`
+	Secret  string     `json:"secret"`
+	Events  []string   `json:"events"`
+	Created string     `json:"created"`
+}
+
+// Where a delivery to a webhook is
+type DeliveryStatus string
+
+const (
+	DELIVERY_PENDING   = DeliveryStatus("pending")
+	DELIVERY_DELIVERED = DeliveryStatus("delivered")
+	DELIVERY_FAILED    = DeliveryStatus("failed")
+)
+
+/*
+An event being sent to a webhook. Pending deliveries are attempted once their NextAttempt
+comes around, and are kept after they are delivered or given up on as the delivery log
+*/
+type Delivery struct {
+	Ident        Identifier     `json:"id"`
+	Webhook      Identifier     `json:"webhook"`
+	Event        string         `json:"event"`
+	Payload      string         `json:"payload"`
+	Status       DeliveryStatus `json:"status"`
+	Attempts     int            `json:"attempts"`
+	NextAttempt  string         `json:"next_attempt"`
+	ResponseCode int            `json:"response_code"`
+	LastError    string         `json:"last_error"`
+	Created      string         `json:"created"`
+	URL          string         `json:"url,omitempty"` // only filled in by GetDeliveries
+}
+
+/*
+Add a webhook
+
+	:param hook: the webhook to add, its Ident and Created are set here
+*/
+func (s *SQLiteRepo) AddWebhook(hook Webhook) (Identifier, error) {
+	hook.Ident = newIdentifier()
+	_, err := s.db.Exec("INSERT INTO webhooks("+webhookColumns+") VALUES (?,?,?,?,?)",
+		hook.Ident, hook.URL, hook.Secret, strings.Join(hook.Events, ","), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return "", err
+	}
+	return hook.Ident, nil
+}
+
+/*
+Get a single webhook
+
+	:param id: the Identifier of the webhook
+*/
+func (s *SQLiteRepo) GetWebhook(id Identifier) (Webhook, error) {
+	hook, err := scanWebhook(s.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return hook, ErrNotExists
+	}
+	return hook, err
+}
+
+// Get every webhook, oldest first
+func (s *SQLiteRepo) GetWebhooks() ([]Webhook, error) {
+	rows, err := s.db.Query("SELECT " + webhookColumns + " FROM webhooks ORDER BY row")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+/*
+Delete a webhook along with its deliveries, so nothing still pending is sent to it
+
+	:param id: the Identifier of the webhook
+*/
+func (s *SQLiteRepo) DeleteWebhook(id Identifier) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if err := expectRow(res); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+Queue an event to be delivered to a webhook as soon as the deliveries are next processed
+
+	:param delivery: the delivery to queue, its status, attempts and next attempt are set here
+*/
+func (s *SQLiteRepo) QueueDelivery(delivery Delivery) (Identifier, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	delivery.Ident = newIdentifier()
+	_, err := s.db.Exec("INSERT INTO webhook_deliveries("+deliveryColumns+") VALUES (?,?,?,?,?,0,?,0,'',?)",
+		delivery.Ident, delivery.Webhook, delivery.Event, delivery.Payload, DELIVERY_PENDING, now, now)
+	if err != nil {
+		return "", err
+	}
+	return delivery.Ident, nil
+}
+
+/*
+Get the pending deliveries that are due to be attempted, the ones that have waited longest first
+
+	:param now: the time to compare their next attempt against
+	:param limit: the most to get
+*/
+func (s *SQLiteRepo) GetDueDeliveries(now time.Time, limit int) ([]Delivery, error) {
+	rows, err := s.db.Query("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE status = ? AND next_attempt <= ? ORDER BY next_attempt, row LIMIT ?",
+		DELIVERY_PENDING, now.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+/*
+Record an attempt at a delivery
+
+	:param delivery: the delivery, with its new status, attempts, next attempt, response code and last error
+*/
+func (s *SQLiteRepo) UpdateDelivery(delivery Delivery) error {
+	res, err := s.db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt = ?, response_code = ?, last_error = ? WHERE id = ?",
+		delivery.Status, delivery.Attempts, delivery.NextAttempt, delivery.ResponseCode, delivery.LastError, delivery.Ident)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+/*
+Get the delivery log, newest first, with the URL of the webhook each went to
+
+	:param limit: how many of the newest to get
+*/
+func (s *SQLiteRepo) GetDeliveries(limit int) ([]Delivery, error) {
+	rows, err := s.db.Query("SELECT "+prefixColumns("webhook_deliveries", deliveryColumns)+`, webhooks.url FROM webhook_deliveries
+		JOIN webhooks ON webhooks.id = webhook_deliveries.webhook ORDER BY webhook_deliveries.row DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		err := rows.Scan(&d.Ident, &d.Webhook, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.ResponseCode, &d.LastError, &d.Created, &d.URL)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	all, err := testDb.AddWebhook(Webhook{URL: "https://a.example/hook", Secret: "a"})
+	assert.NoError(t, err)
+	posts, err := testDb.AddWebhook(Webhook{URL: "https://b.example/hook", Secret: "b", Events: []string{"document.created", "document.deleted"}})
+	assert.NoError(t, err)
+
+	hooks, err := testDb.GetWebhooks()
+	assert.NoError(t, err)
+	if assert.Len(t, hooks, 2) {
+		assert.Nil(t, hooks[0].Events)
+		assert.Equal(t, []string{"document.created", "document.deleted"}, hooks[1].Events)
+		assert.NotEmpty(t, hooks[1].Created)
+	}
+	hook, err := testDb.GetWebhook(posts)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", hook.Secret)
+	_, err = testDb.GetWebhook("missing")
+	assert.Equal(t, ErrNotExists, err)
+
+	_, err = testDb.QueueDelivery(Delivery{Webhook: all, Event: "image.created", Payload: `{}`})
+	assert.NoError(t, err)
+	_, err = testDb.QueueDelivery(Delivery{Webhook: posts, Event: "document.created", Payload: `{}`})
+	assert.NoError(t, err)
+
+	// deleting a webhook takes its deliveries with it
+	assert.NoError(t, testDb.DeleteWebhook(all))
+	assert.Equal(t, ErrNotExists, testDb.DeleteWebhook(all))
+	history, err := testDb.GetDeliveries(10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "https://b.example/hook", history[0].URL)
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	testDb, _ := newTestDb(t.TempDir(), true)
+	hook, err := testDb.AddWebhook(Webhook{URL: "https://a.example/hook", Secret: "a"})
+	assert.NoError(t, err)
+	first, err := testDb.QueueDelivery(Delivery{Webhook: hook, Event: "document.created", Payload: `{"type":"document.created"}`})
+	assert.NoError(t, err)
+	_, err = testDb.QueueDelivery(Delivery{Webhook: hook, Event: "document.updated", Payload: `{"type":"document.updated"}`})
+	assert.NoError(t, err)
+
+	due, err := testDb.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	if !assert.Len(t, due, 2) {
+		return
+	}
+	assert.Equal(t, first, due[0].Ident)
+	assert.Equal(t, DELIVERY_PENDING, due[0].Status)
+
+	// a failed attempt pushes the delivery back, a delivered one leaves the queue
+	retry := due[0]
+	retry.Attempts, retry.ResponseCode, retry.LastError = 1, 503, "503 Service Unavailable"
+	retry.NextAttempt = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	assert.NoError(t, testDb.UpdateDelivery(retry))
+	delivered := due[1]
+	delivered.Status, delivered.Attempts, delivered.ResponseCode = DELIVERY_DELIVERED, 1, 204
+	assert.NoError(t, testDb.UpdateDelivery(delivered))
+	assert.Equal(t, ErrNotExists, testDb.UpdateDelivery(Delivery{Ident: "missing"}))
+
+	due, err = testDb.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = testDb.GetDueDeliveries(time.Now().Add(2*time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	// the log keeps all of them, newest first
+	history, err := testDb.GetDeliveries(10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, DELIVERY_DELIVERED, history[0].Status)
+		assert.Equal(t, 204, history[0].ResponseCode)
+		assert.Equal(t, 503, history[1].ResponseCode)
+		assert.Equal(t, "https://a.example/hook", history[1].URL)
+	}
+	history, err = testDb.GetDeliveries(1)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+}
@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/events"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+)
+
+// the headers every delivery is sent with
+const (
+	EVENT_HEADER     = "X-Keiji-Event"
+	DELIVERY_HEADER  = "X-Keiji-Delivery"
+	SIGNATURE_HEADER = "X-Keiji-Signature"
+)
+
+const (
+	// how many times a delivery is attempted before it is given up on
+	DefaultMaxAttempts = 6
+	// how long to wait after the first failed attempt, it doubles after every one after that
+	DefaultBackoff = 30 * time.Second
+	// how many due deliveries are attempted each time they are processed
+	batchSize = 50
+)
+
+var ErrInvalidURL = errors.New("webhooks have to be http or https urls")
+
+// Where the webhooks and their deliveries are kept, storage.WebhookIO satisfies it
+type Store interface {
+	GetWebhook(id storage.Identifier) (storage.Webhook, error)
+	GetWebhooks() ([]storage.Webhook, error)
+	QueueDelivery(delivery storage.Delivery) (storage.Identifier, error)
+	GetDueDeliveries(now time.Time, limit int) ([]storage.Delivery, error)
+	UpdateDelivery(delivery storage.Delivery) error
+}
+
+/*
+Make a random secret for a new webhook
+*/
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+Check the URL of a new webhook
+
+	:param raw: the URL the admin gave
+*/
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+/*
+Sign a payload the way deliveries are signed, an HMAC-SHA256 of the body keyed with the
+webhooks secret. Receivers compute the same over the body they got and compare it to the
+X-Keiji-Signature header
+
+	:param secret: the secret of the webhook
+	:param payload: the body of the delivery
+*/
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Whether a webhook wants an event, one that didnt pick any gets every event
+
+	:param hook: the webhook
+	:param kind: the event
+*/
+func Subscribed(hook storage.Webhook, kind events.Type) bool {
+	return len(hook.Events) == 0 || slices.Contains(hook.Events, string(kind))
+}
+
+/*
+Delivers the events the site emits to the webhooks that subscribed to them. Events are
+queued as they happen and sent in the background by Run, which retries the ones that
+fail with a backoff. Every attempt is recorded, so the deliveries double as a log
+*/
+type Dispatcher struct {
+	HTTP        *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+	store       Store
+	now         func() time.Time
+	wake        chan struct{}
+}
+
+/*
+Create a dispatcher
+
+	:param store: where the webhooks and deliveries are kept
+	:param timeout: how long a webhook gets to answer a delivery
+*/
+func NewDispatcher(store Store, timeout time.Duration) *Dispatcher {
+	return &Dispatcher{
+		HTTP:        &http.Client{Timeout: timeout},
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		store:       store,
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+/*
+Queue an event for every webhook that subscribed to it, and have Run send them right away
+rather than on its next tick. Meant to be subscribed to the event bus, so failures are
+logged rather than returned
+
+	:param event: the event that happened
+*/
+func (d *Dispatcher) Handle(event events.Event) {
+	hooks, err := d.store.GetWebhooks()
+	if err != nil {
+		slog.Error("getting the webhooks for an event failed", "event", event.Type, "err", err)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("encoding an event failed", "event", event.Type, "err", err)
+		return
+	}
+	queued := false
+	for _, hook := range hooks {
+		if !Subscribed(hook, event.Type) {
+			continue
+		}
+		_, err := d.store.QueueDelivery(storage.Delivery{Webhook: hook.Ident, Event: string(event.Type), Payload: string(payload)})
+		if err != nil {
+			slog.Error("queueing an event for a webhook failed", "event", event.Type, "webhook", hook.URL, "err", err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+Attempt the deliveries that are due, returning how many were delivered along with why the
+others werent. Anything but a 2xx answer counts as a failure, and the delivery is tried
+again after the backoff, which doubles each time, until it has been tried MaxAttempts times
+*/
+func (d *Dispatcher) Process() (int, error) {
+	now := d.now()
+	due, err := d.store.GetDueDeliveries(now, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	var failures []error
+	for _, delivery := range due {
+		hook, err := d.store.GetWebhook(delivery.Webhook)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		delivery.Attempts++
+		code, sendErr := d.send(hook, delivery)
+		delivery.ResponseCode = code
+		switch {
+		case sendErr == nil:
+			delivery.Status, delivery.LastError = storage.DELIVERY_DELIVERED, ""
+			delivered++
+		case delivery.Attempts >= d.MaxAttempts:
+			delivery.Status, delivery.LastError = storage.DELIVERY_FAILED, sendErr.Error()
+		default:
+			delivery.LastError = sendErr.Error()
+			delivery.NextAttempt = now.Add(d.Backoff << (delivery.Attempts - 1)).UTC().Format(time.RFC3339)
+		}
+		if sendErr != nil {
+			failures = append(failures, fmt.Errorf("delivering %s to %s: %w", delivery.Event, hook.URL, sendErr))
+		}
+		if err := d.store.UpdateDelivery(delivery); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return delivered, errors.Join(failures...)
+}
+
+// POST a delivery to its webhook, returning the status code it answered with
+func (d *Dispatcher) send(hook storage.Webhook, delivery storage.Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "keiji")
+	req.Header.Set(EVENT_HEADER, delivery.Event)
+	req.Header.Set(DELIVERY_HEADER, string(delivery.Ident))
+	req.Header.Set(SIGNATURE_HEADER, Sign(hook.Secret, body))
+	resp, err := d.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+/*
+Process the deliveries every interval, and as soon as new ones are queued, until stop is closed
+
+	:param interval: how often to check for deliveries that are due to be tried again
+	:param stop: close it to stop delivering
+*/
+func (d *Dispatcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		if _, err := d.Process(); err != nil {
+			slog.Warn("delivering webhooks failed", "err", err)
+		}
+	}
+}
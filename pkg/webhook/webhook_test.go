@@ -0,0 +1,218 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"git.aetherial.dev/aeth/keiji/pkg/events"
+	"git.aetherial.dev/aeth/keiji/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// Implementing the Store interface in memory
+type memStore struct {
+	mu         sync.Mutex
+	hooks      []storage.Webhook
+	deliveries []storage.Delivery
+}
+
+func (m *memStore) GetWebhook(id storage.Identifier) (storage.Webhook, error) {
+	for _, hook := range m.hooks {
+		if hook.Ident == id {
+			return hook, nil
+		}
+	}
+	return storage.Webhook{}, storage.ErrNotExists
+}
+
+func (m *memStore) GetWebhooks() ([]storage.Webhook, error) { return m.hooks, nil }
+
+func (m *memStore) QueueDelivery(delivery storage.Delivery) (storage.Identifier, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delivery.Ident = storage.Identifier(uuid.NewString())
+	delivery.Status = storage.DELIVERY_PENDING
+	delivery.NextAttempt = time.Now().UTC().Format(time.RFC3339)
+	m.deliveries = append(m.deliveries, delivery)
+	return delivery.Ident, nil
+}
+
+func (m *memStore) GetDueDeliveries(now time.Time, limit int) ([]storage.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	due := []storage.Delivery{}
+	for _, d := range m.deliveries {
+		if d.Status == storage.DELIVERY_PENDING && d.NextAttempt <= now.UTC().Format(time.RFC3339) && len(due) < limit {
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
+
+func (m *memStore) UpdateDelivery(delivery storage.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.deliveries, func(d storage.Delivery) bool { return d.Ident == delivery.Ident })
+	if i < 0 {
+		return storage.ErrNotExists
+	}
+	m.deliveries[i] = delivery
+	return nil
+}
+
+func (m *memStore) delivery(i int) storage.Delivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deliveries[i]
+}
+
+// a request a webhook received
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+/*
+A webhook that answers with status, recording what it was sent
+*/
+func newReceiver(t *testing.T, status *int) (string, chan received) {
+	got := make(chan received, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{header: r.Header, body: body}
+		w.WriteHeader(*status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, got
+}
+
+func TestSign(t *testing.T) {
+	// the example from the HMAC-SHA256 test vectors in RFC 4231, test case 2
+	assert.Equal(t, "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843", Sign("Jefe", []byte("what do ya want for nothing?")))
+	secret, err := NewSecret()
+	assert.NoError(t, err)
+	another, _ := NewSecret()
+	assert.Len(t, secret, 64)
+	assert.NotEqual(t, secret, another)
+}
+
+func TestValidateURL(t *testing.T) {
+	assert.NoError(t, ValidateURL("https://hooks.example/keiji"))
+	assert.NoError(t, ValidateURL("http://localhost:8080/hook"))
+	for _, bad := range []string{"", "ftp://hooks.example", "hooks.example/keiji", "https://"} {
+		assert.Equal(t, ErrInvalidURL, ValidateURL(bad), bad)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	status := http.StatusNoContent
+	target, got := newReceiver(t, &status)
+	store := &memStore{hooks: []storage.Webhook{
+		{Ident: "all", URL: target, Secret: "a"},
+		{Ident: "deletes", URL: target, Secret: "b", Events: []string{string(events.DOCUMENT_DELETED)}},
+	}}
+	dispatcher := NewDispatcher(store, time.Second)
+	bus := events.NewBus()
+	bus.Subscribe(dispatcher.Handle)
+
+	created := bus.Publish(events.DOCUMENT_CREATED, storage.Document{Ident: "abc", Title: "hello"})
+	if !assert.Len(t, store.deliveries, 1) {
+		return
+	}
+	bus.Publish(events.DOCUMENT_DELETED, map[string]string{"id": "abc"})
+	assert.Len(t, store.deliveries, 3)
+
+	sent, err := dispatcher.Process()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	first := <-got
+	assert.Equal(t, "application/json", first.header.Get("Content-Type"))
+	assert.Equal(t, string(events.DOCUMENT_CREATED), first.header.Get(EVENT_HEADER))
+	assert.Equal(t, string(store.deliveries[0].Ident), first.header.Get(DELIVERY_HEADER))
+	assert.Equal(t, Sign("a", first.body), first.header.Get(SIGNATURE_HEADER))
+	var event struct {
+		ID   string           `json:"id"`
+		Type events.Type      `json:"type"`
+		Data storage.Document `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(first.body, &event))
+	assert.Equal(t, created.ID, event.ID)
+	assert.Equal(t, "hello", event.Data.Title)
+
+	// each webhook signs with its own secret
+	<-got
+	third := <-got
+	assert.Equal(t, Sign("b", third.body), third.header.Get(SIGNATURE_HEADER))
+	assert.Equal(t, storage.DELIVERY_DELIVERED, store.delivery(2).Status)
+	assert.Equal(t, 204, store.delivery(2).ResponseCode)
+}
+
+func TestRetry(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	target, got := newReceiver(t, &status)
+	store := &memStore{hooks: []storage.Webhook{{Ident: "hook", URL: target, Secret: "a"}}}
+	dispatcher := NewDispatcher(store, time.Second)
+	dispatcher.MaxAttempts = 3
+	clock := time.Now()
+	dispatcher.now = func() time.Time { return clock }
+	dispatcher.Handle(events.Event{ID: "1", Type: events.IMAGE_CREATED})
+
+	// the webhook is down, so the delivery waits 30 seconds, then a minute
+	for i, wait := range []time.Duration{30 * time.Second, time.Minute} {
+		sent, err := dispatcher.Process()
+		assert.Error(t, err)
+		assert.Equal(t, 0, sent)
+		<-got
+		delivery := store.delivery(0)
+		assert.Equal(t, storage.DELIVERY_PENDING, delivery.Status)
+		assert.Equal(t, i+1, delivery.Attempts)
+		assert.Equal(t, 503, delivery.ResponseCode)
+		assert.Equal(t, "the webhook answered 503 Service Unavailable", delivery.LastError)
+		assert.Equal(t, clock.Add(wait).UTC().Format(time.RFC3339), delivery.NextAttempt)
+
+		// it isnt tried again before then
+		sent, err = dispatcher.Process()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, sent)
+		clock = clock.Add(wait)
+	}
+	// the third attempt is the last
+	dispatcher.Process()
+	<-got
+	assert.Equal(t, storage.DELIVERY_FAILED, store.delivery(0).Status)
+	assert.Equal(t, 3, store.delivery(0).Attempts)
+
+	// a webhook that isnt there at all has no response code
+	store.hooks[0].URL = "http://127.0.0.1:1/hook"
+	dispatcher.Handle(events.Event{ID: "2", Type: events.IMAGE_CREATED})
+	_, err := dispatcher.Process()
+	assert.Error(t, err)
+	assert.Equal(t, 0, store.delivery(1).ResponseCode)
+	assert.NotEmpty(t, store.delivery(1).LastError)
+}
+
+func TestRun(t *testing.T) {
+	status := http.StatusOK
+	target, got := newReceiver(t, &status)
+	store := &memStore{hooks: []storage.Webhook{{Ident: "hook", URL: target, Secret: "a"}}}
+	dispatcher := NewDispatcher(store, time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+	go dispatcher.Run(time.Hour, stop)
+
+	// queueing a delivery sends it without waiting for the next tick
+	dispatcher.Handle(events.Event{ID: "1", Type: events.ASSET_CREATED})
+	select {
+	case r := <-got:
+		assert.Equal(t, string(events.ASSET_CREATED), r.header.Get(EVENT_HEADER))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the delivery wasnt sent")
+	}
+}
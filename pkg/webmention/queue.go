@@ -0,0 +1,90 @@
+package webmention
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// A received webmention waiting for its source to be verified
+type Received struct {
+	Source string
+	Target string
+	// the logger of the request that received it
+	Logger *slog.Logger
+}
+
+// the source and target a webmention is told apart by
+type mentionKey struct{ source, target string }
+
+/*
+Holds received webmentions until a fixed number of workers verify them, so that however many
+are sent only that many sources are being fetched at once. A source and target that are
+already waiting are only verified once
+*/
+type Queue struct {
+	queue   chan Received
+	mu      sync.Mutex
+	pending map[mentionKey]bool
+}
+
+/*
+Create a queue for received webmentions
+
+	:param size: how many can wait to be verified before more are turned away
+*/
+func NewQueue(size int) *Queue {
+	return &Queue{queue: make(chan Received, size), pending: map[mentionKey]bool{}}
+}
+
+/*
+Queue a received webmention to be verified by Run. One with the same source and target as
+one that is already waiting is collapsed into it. Returns false when the queue is full
+
+	:param mention: the webmention that was received
+*/
+func (q *Queue) Enqueue(mention Received) bool {
+	key := mentionKey{mention.Source, mention.Target}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[key] {
+		return true
+	}
+	select {
+	case q.queue <- mention:
+		q.pending[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Verify the queued webmentions with a fixed number of workers until stop is closed, returning
+once they all stopped
+
+	:param workers: how many webmentions are verified at once
+	:param verify: verifies a webmention and saves or removes it
+	:param stop: closing it stops the workers, whatever is still queued is dropped
+*/
+func (q *Queue) Run(workers int, verify func(Received), stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case mention := <-q.queue:
+					// let the same mention be queued again while it is fetched, the source may have changed since
+					q.mu.Lock()
+					delete(q.pending, mentionKey{mention.Source, mention.Target})
+					q.mu.Unlock()
+					verify(mention)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,56 @@
+package webmention
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(2)
+	first := Received{Source: "https://example.com/a", Target: "https://aetherial.dev/writing/abc"}
+	assert.True(t, q.Enqueue(first))
+	// sending the same mention again while it waits doesnt queue it twice
+	assert.True(t, q.Enqueue(first))
+	assert.True(t, q.Enqueue(Received{Source: "https://example.com/b", Target: first.Target}))
+	assert.False(t, q.Enqueue(Received{Source: "https://example.com/c", Target: first.Target}), "the queue is full")
+
+	var mu sync.Mutex
+	verified := []string{}
+	var running, most atomic.Int32
+	release := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		q.Run(1, func(m Received) {
+			n := running.Add(1)
+			if n > most.Load() {
+				most.Store(n)
+			}
+			<-release
+			mu.Lock()
+			verified = append(verified, m.Source)
+			mu.Unlock()
+			running.Add(-1)
+		}, stop)
+		close(done)
+	}()
+	release <- struct{}{}
+	release <- struct{}{}
+	// once a mention is taken off the queue it can be sent again
+	assert.True(t, q.Enqueue(first))
+	release <- struct{}{}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(verified) == 3
+	}, time.Second, time.Millisecond)
+	close(stop)
+	<-done
+
+	assert.Equal(t, []string{"https://example.com/a", "https://example.com/b", "https://example.com/a"}, verified)
+	assert.Equal(t, int32(1), most.Load(), "only as many are verified at once as there are workers")
+}
@@ -0,0 +1,295 @@
+package webmention
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	ErrNoEndpoint     = errors.New("the target doesnt advertise a webmention endpoint")
+	ErrNoLink         = errors.New("the source doesnt link to the target")
+	ErrGone           = errors.New("the source is gone")
+	ErrPrivateAddress = errors.New("refusing to connect to a private address")
+)
+
+// the most of a page that is read when discovering an endpoint or verifying a source
+const maxPage = 1 << 20
+
+// the longest title kept from a source, in characters
+const maxTitle = 200
+
+/*
+Sends webmentions and verifies the ones that are received. Both mean fetching urls that
+somebody else picked, so by default it wont connect to loopback, private or link local
+addresses, the addresses are checked after they are resolved so a hostname cant get around it
+*/
+type Client struct {
+	HTTP *http.Client
+}
+
+/*
+Create a client for sending and verifying webmentions
+
+	:param timeout: how long a single request gets, including redirects
+	:param allowPrivate: allow connecting to private addresses, only for testing against a local server
+*/
+func NewClient(timeout time.Duration, allowPrivate bool) *Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+	return &Client{HTTP: &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+	}}
+}
+
+// the dialers Control hook, which sees the address after it was resolved
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+/*
+Find the webmention endpoint a page advertises, in its Link header or else in the first
+<link> or <a> element with the webmention rel. The endpoint is resolved against the url the
+page was served from after any redirects
+
+	:param target: the url of the page
+*/
+func (c *Client) Discover(target string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("fetching %s: %s", target, resp.Status)
+	}
+	base := resp.Request.URL
+	for _, header := range resp.Header.Values("Link") {
+		if endpoint, ok := linkHeaderEndpoint(header); ok {
+			return resolve(base, endpoint)
+		}
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return "", ErrNoEndpoint
+	}
+	z := html.NewTokenizer(io.LimitReader(resp.Body, maxPage))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return "", ErrNoEndpoint
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.DataAtom != atom.Link && tok.DataAtom != atom.A {
+				continue
+			}
+			href, hasHref := attr(tok, "href")
+			rel, _ := attr(tok, "rel")
+			if hasHref && hasRel(rel, "webmention") {
+				return resolve(base, href)
+			}
+		}
+	}
+}
+
+// pick the url with the webmention rel out of a Link header, i.e. '<https://example.com/wm>; rel="webmention"'
+func linkHeaderEndpoint(header string) (string, bool) {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		ref := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(ref, "<") || !strings.HasSuffix(ref, ">") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(key), "rel") && hasRel(strings.Trim(value, `"`), "webmention") {
+				return ref[1 : len(ref)-1], true
+			}
+		}
+	}
+	return "", false
+}
+
+/*
+Send a webmention, telling the target that the source links to it. Returns ErrNoEndpoint
+when the target doesnt take webmentions
+
+	:param source: the url of the page with the link
+	:param target: the url it links to
+*/
+func (c *Client) Send(source, target string) error {
+	endpoint, err := c.Discover(target)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTP.PostForm(endpoint, url.Values{"source": {source}, "target": {target}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending a webmention to %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// What was found on the source of a verified webmention
+type Source struct {
+	Title string
+}
+
+/*
+Check that a received webmention is real, that the source exists and links to the target.
+Returns ErrGone when the source was deleted and ErrNoLink when it doesnt link to the target,
+either means a mention that was verified before should be removed
+
+	:param source: the url of the page that says it links to the target
+	:param target: the url of the page on this site
+*/
+func (c *Client) Verify(source, target string) (Source, error) {
+	var found Source
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return found, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return found, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return found, ErrGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return found, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	base := resp.Request.URL
+	linked, inTitle := false, false
+	z := html.NewTokenizer(io.LimitReader(resp.Body, maxPage))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if !linked {
+				return found, ErrNoLink
+			}
+			found.Title = strings.Join(strings.Fields(found.Title), " ")
+			if runes := []rune(found.Title); len(runes) > maxTitle {
+				found.Title = string(runes[:maxTitle])
+			}
+			return found, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			inTitle = tok.DataAtom == atom.Title && found.Title == ""
+			for _, key := range []string{"href", "src"} {
+				if ref, ok := attr(tok, key); ok {
+					if u, err := resolve(base, ref); err == nil && u == target {
+						linked = true
+					}
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				found.Title += string(z.Text())
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+}
+
+/*
+Find the links on a page to other sites, the ones to send webmentions to. Each link is
+only listed once
+
+	:param page: the html of the page
+	:param base: the url of the page, links relative to it are resolved against it
+*/
+func Links(page []byte, base string) []string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	links := []string{}
+	z := html.NewTokenizer(strings.NewReader(string(page)))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.DataAtom != atom.A {
+				continue
+			}
+			href, ok := attr(tok, "href")
+			if !ok {
+				continue
+			}
+			link, err := resolve(baseURL, href)
+			if err != nil || seen[link] {
+				continue
+			}
+			u, _ := url.Parse(link)
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == baseURL.Host {
+				continue
+			}
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+}
+
+// resolve a reference against the url of the page it was found on, dropping the fragment
+func resolve(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+func attr(tok html.Token, key string) (string, bool) {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// rel attributes are space separated lists, i.e. 'nofollow webmention'
+func hasRel(rel, want string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package webmention
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a site with pages to discover endpoints on, and an endpoint that records what it was sent
+func newTarget(t *testing.T, received chan<- url.Values) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `<https://example.com/other>; rel="other", </endpoint?from=header>; rel="webmention"`)
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/link", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"><link rel="webmention" href="endpoint"></head></html>`))
+	})
+	mux.HandleFunc("/anchor", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><a rel="nofollow webmention" href="/endpoint">mentions</a></body></html>`))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/nested/page", http.StatusFound)
+	})
+	mux.HandleFunc("/nested/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><link rel="webmention" href="relative"></head></html>`))
+	})
+	mux.HandleFunc("/none", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><a href="/endpoint">not advertised</a></body></html>`))
+	})
+	mux.HandleFunc("/endpoint", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received <- r.PostForm
+		w.WriteHeader(http.StatusAccepted)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDiscover(t *testing.T) {
+	srv := newTarget(t, make(chan url.Values, 1))
+	client := NewClient(time.Second, true)
+	type testcase struct {
+		page string
+		want string
+		err  error
+	}
+	for _, tc := range []testcase{
+		{page: "/header", want: srv.URL + "/endpoint?from=header"},
+		{page: "/link", want: srv.URL + "/endpoint"},
+		{page: "/anchor", want: srv.URL + "/endpoint"},
+		{page: "/redirect", want: srv.URL + "/nested/relative"},
+		{page: "/none", err: ErrNoEndpoint},
+	} {
+		got, err := client.Discover(srv.URL + tc.page)
+		assert.Equal(t, tc.err, err, tc.page)
+		assert.Equal(t, tc.want, got, tc.page)
+	}
+}
+
+func TestSend(t *testing.T) {
+	received := make(chan url.Values, 1)
+	srv := newTarget(t, received)
+	client := NewClient(time.Second, true)
+
+	assert.NoError(t, client.Send("https://aetherial.dev/writing/abc", srv.URL+"/link"))
+	got := <-received
+	assert.Equal(t, "https://aetherial.dev/writing/abc", got.Get("source"))
+	assert.Equal(t, srv.URL+"/link", got.Get("target"))
+
+	assert.Equal(t, ErrNoEndpoint, client.Send("https://aetherial.dev/writing/abc", srv.URL+"/none"))
+}
+
+func TestVerify(t *testing.T) {
+	target := "https://aetherial.dev/writing/abc"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reply", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><head><title>  A
+			reply </title></head><body><a href="%s#comments">re</a></body></html>`, target)
+	})
+	mux.HandleFunc("/unrelated", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><a href="https://aetherial.dev/writing/abcd">close</a></body></html>`))
+	})
+	mux.HandleFunc("/deleted", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/long", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<title>%s</title><img src="%s">`, strings.Repeat("a", 300), target)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := NewClient(time.Second, true)
+
+	found, err := client.Verify(srv.URL+"/reply", target)
+	assert.NoError(t, err)
+	assert.Equal(t, "A reply", found.Title)
+	_, err = client.Verify(srv.URL+"/unrelated", target)
+	assert.Equal(t, ErrNoLink, err)
+	_, err = client.Verify(srv.URL+"/deleted", target)
+	assert.Equal(t, ErrGone, err)
+	_, err = client.Verify(srv.URL+"/missing", target)
+	assert.Error(t, err)
+	found, err = client.Verify(srv.URL+"/long", target)
+	assert.NoError(t, err)
+	assert.Len(t, found.Title, maxTitle)
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	srv := newTarget(t, make(chan url.Values, 1))
+	_, err := NewClient(time.Second, false).Discover(srv.URL + "/link")
+	assert.True(t, errors.Is(err, ErrPrivateAddress), err)
+}
+
+func TestLinks(t *testing.T) {
+	page := []byte(`<p><a href="https://example.com/a">a</a> <a href="/writing/other">internal</a>
+		<a href="https://example.com/a#again">again</a> <a href="mailto:me@example.com">mail</a>
+		<a href="http://other.example/b?c=d">b</a> <a>no href</a></p>`)
+	assert.Equal(t, []string{"https://example.com/a", "http://other.example/b?c=d"},
+		Links(page, "https://aetherial.dev/writing/abc"))
+}
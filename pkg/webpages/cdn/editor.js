@@ -0,0 +1,15 @@
+/* The post editor. htmx doesnt swap in error responses, which would hide the message a
+   save responds with when somebody else saved the post first */
+(function () {
+  if (window.keijiEditor) {
+    return;
+  }
+  window.keijiEditor = true;
+
+  document.addEventListener("htmx:beforeSwap", function (e) {
+    if (e.detail.xhr.status === 409 && e.detail.target.id === "response") {
+      e.detail.shouldSwap = true;
+      e.detail.isError = false;
+    }
+  });
+})();
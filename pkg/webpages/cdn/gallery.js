@@ -0,0 +1,64 @@
+/* Opens the images on the digital art pages in a full screen viewer, with next/previous
+   buttons and the arrow keys to move through them and escape to close it. The listeners
+   are only added once, pages swapped in by htmx include this script again */
+(function () {
+  if (window.keijiLightbox) {
+    return;
+  }
+  window.keijiLightbox = true;
+  var items = [];
+  var index = 0;
+
+  function lightbox() {
+    return document.getElementById("lightbox");
+  }
+
+  function show(i) {
+    var box = lightbox();
+    index = (i + items.length) % items.length;
+    var item = items[index];
+    box.querySelector(".lightbox-img").src = item.getAttribute("href");
+    box.querySelector(".lightbox-title").textContent = item.dataset.title || "";
+    box.querySelector(".lightbox-desc").textContent = item.dataset.desc || "";
+    box.querySelector(".lightbox-count").textContent = (index + 1) + " / " + items.length;
+    box.hidden = false;
+  }
+
+  function close() {
+    var box = lightbox();
+    box.hidden = true;
+    box.querySelector(".lightbox-img").removeAttribute("src");
+  }
+
+  document.addEventListener("click", function (e) {
+    if (!e.target.closest || !lightbox()) {
+      return;
+    }
+    var item = e.target.closest(".lightbox-item");
+    if (item) {
+      e.preventDefault();
+      items = Array.prototype.slice.call(document.querySelectorAll(".lightbox-item"));
+      show(items.indexOf(item));
+    } else if (e.target.closest(".lightbox-next")) {
+      show(index + 1);
+    } else if (e.target.closest(".lightbox-prev")) {
+      show(index - 1);
+    } else if (e.target.closest(".lightbox-close") || e.target === lightbox()) {
+      close();
+    }
+  });
+
+  document.addEventListener("keydown", function (e) {
+    var box = lightbox();
+    if (!box || box.hidden) {
+      return;
+    }
+    if (e.key === "ArrowRight") {
+      show(index + 1);
+    } else if (e.key === "ArrowLeft") {
+      show(index - 1);
+    } else if (e.key === "Escape") {
+      close();
+    }
+  });
+})();
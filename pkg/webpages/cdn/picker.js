@@ -0,0 +1,33 @@
+/* The image picker in the post editor. Clicking an image in the picker puts its
+   shortcode into the post body at the cursor, on a line of its own */
+(function () {
+  if (window.keijiPicker) {
+    return;
+  }
+  window.keijiPicker = true;
+
+  document.addEventListener("click", function (e) {
+    var pick = e.target.closest ? e.target.closest("[data-shortcode]") : null;
+    if (!pick) {
+      return;
+    }
+    var body = document.querySelector("textarea[name=body]");
+    if (!body) {
+      return;
+    }
+    var start = body.selectionStart, end = body.selectionEnd;
+    var before = body.value.slice(0, start), after = body.value.slice(end);
+    var text = pick.dataset.shortcode;
+    if (before && !before.endsWith("\n")) {
+      text = "\n" + text;
+    }
+    if (!after.startsWith("\n")) {
+      text = text + "\n";
+    }
+    body.value = before + text + after;
+    body.selectionStart = body.selectionEnd = before.length + text.length;
+    // setting the value doesnt fire input, which the preview refreshes on
+    body.dispatchEvent(new Event("input", { bubbles: true }));
+    body.focus();
+  });
+})();
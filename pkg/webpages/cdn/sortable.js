@@ -0,0 +1,88 @@
+/* Drag and drop ordering for the admin album pages. The children of a [data-sortable]
+   element that have a data-id can be dragged around inside of it, or into any other
+   list with the same data-sortable group. A [data-save-order] button PUTs the ids of
+   the list it points at as JSON, i.e. {"images": ["id1", "id2"]} for data-key="images" */
+(function () {
+  if (window.keijiSortable) {
+    return;
+  }
+  window.keijiSortable = true;
+  var dragged = null;
+
+  function sortableItem(el) {
+    return el.closest ? el.closest("[data-sortable] > [data-id]") : null;
+  }
+
+  document.addEventListener("dragstart", function (e) {
+    var item = sortableItem(e.target);
+    if (!item) {
+      return;
+    }
+    dragged = item;
+    e.dataTransfer.effectAllowed = "move";
+    e.dataTransfer.setData("text/plain", item.dataset.id);
+    item.classList.add("dragging");
+  });
+
+  document.addEventListener("dragend", function () {
+    if (dragged) {
+      dragged.classList.remove("dragging");
+    }
+    dragged = null;
+  });
+
+  document.addEventListener("dragover", function (e) {
+    if (!dragged || !e.target.closest) {
+      return;
+    }
+    var list = e.target.closest("[data-sortable]");
+    if (!list || list.dataset.sortable !== dragged.parentElement.dataset.sortable) {
+      return;
+    }
+    e.preventDefault();
+    var over = sortableItem(e.target);
+    if (!over) {
+      list.appendChild(dragged);
+    } else if (over !== dragged) {
+      // moving forwards drops after the item under the cursor, moving backwards before it
+      var forwards = over.parentElement === dragged.parentElement &&
+        (dragged.compareDocumentPosition(over) & Node.DOCUMENT_POSITION_FOLLOWING);
+      list.insertBefore(dragged, forwards ? over.nextSibling : over);
+    }
+  });
+
+  document.addEventListener("drop", function (e) {
+    if (dragged) {
+      e.preventDefault();
+    }
+  });
+
+  document.addEventListener("click", function (e) {
+    var button = e.target.closest ? e.target.closest("[data-save-order]") : null;
+    if (!button) {
+      return;
+    }
+    var list = document.querySelector(button.dataset.saveOrder);
+    var status = document.querySelector(button.dataset.status);
+    var ids = [];
+    for (var i = 0; i < list.children.length; i++) {
+      if (list.children[i].dataset.id) {
+        ids.push(list.children[i].dataset.id);
+      }
+    }
+    var body = {};
+    body[button.dataset.key] = ids;
+    fetch(button.dataset.url, {
+      method: "PUT",
+      headers: {"Content-Type": "application/json"},
+      credentials: "same-origin",
+      body: JSON.stringify(body)
+    }).then(function (resp) {
+      status.style.color = resp.ok ? "green" : "red";
+      status.textContent = resp.ok ? "Saved!" : "Saving failed with status " + resp.status;
+    }).catch(function (err) {
+      status.style.color = "red";
+      status.textContent = "Saving failed: " + err;
+    });
+  });
+})();
@@ -4,9 +4,8 @@ import (
 	"embed"
 	_ "embed"
 	"fmt"
-	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 
@@ -26,18 +25,17 @@ Creates the new filesystem implementer for serving the webpages to the API
 
 	:param opt: the service option to
 */
-func NewContentLayer(opt ServiceOption) fs.FS {
+func NewContentLayer(opt ServiceOption) (fs.FS, error) {
 	if opt == EMBED {
-		fmt.Println("Using embed files to pull html templates")
-		return content
+		slog.Info("using embedded files to pull html templates")
+		return content, nil
 	}
 	if opt == FILESYSTEM {
-		fmt.Println("Using filesystem to pull html templates")
+		slog.Info("using the filesystem to pull html templates", "root", os.Getenv(env.WEB_ROOT))
 
-		return FilesystemWebpages{Webroot: path.Base(os.Getenv(env.WEB_ROOT))}
+		return FilesystemWebpages{Webroot: path.Base(os.Getenv(env.WEB_ROOT))}, nil
 	}
-	log.Fatal("Unknown option was passed: ", opt)
-	return content
+	return nil, fmt.Errorf("unknown content option: %q", opt)
 
 }
 
@@ -56,25 +54,20 @@ func (f FilesystemWebpages) Open(file string) (fs.File, error) {
 	filePath := path.Join(f.Webroot, file)
 	fh, err := os.Open(filePath)
 	if err != nil {
-		fmt.Printf("Error opening the file: %s because %s", filePath, err)
+		slog.Warn("opening a web file failed", "path", filePath, "err", err)
 		return nil, os.ErrNotExist
 	}
 	return fh, nil
 }
 
 /*
-Read content to a string for easy template ingestion. Will panic if the underlying os.Open call fails
+Read content to a string for easy template ingestion
 */
-func ReadToString(rdr fs.FS, name string) string {
-	fh, err := rdr.Open(name)
+func ReadToString(rdr fs.FS, name string) (string, error) {
+	b, err := fs.ReadFile(rdr, name)
 	if err != nil {
-		log.Fatal(err, "couldnt open the file: ", name)
+		return "", fmt.Errorf("couldnt read the file %s: %w", name, err)
 	}
-	b, err := io.ReadAll(fh)
-
-	if err != nil {
-		log.Fatal("Could not read the file: ", name)
-	}
-	return string(b)
+	return string(b), nil
 
 }
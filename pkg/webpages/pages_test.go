@@ -26,10 +26,13 @@ func TestNewContentLayer(t *testing.T) {
 			want:  FilesystemWebpages{Webroot: path.Base(os.Getenv(env.WEB_ROOT))},
 		},
 	} {
-		got := NewContentLayer(tc.input)
+		got, err := NewContentLayer(tc.input)
+		assert.NoError(t, err)
 		assert.Equal(t, tc.want, got)
 
 	}
+	_, err := NewContentLayer("nope")
+	assert.Error(t, err)
 }
 
 func TestOpen(t *testing.T) {
@@ -78,7 +81,10 @@ func TestReadToString(t *testing.T) {
 	testFile := path.Join(testFs.Webroot, filename)
 	data := []byte("abc123xyz098")
 	os.WriteFile(testFile, data, os.ModePerm)
-	got := ReadToString(testFs, filename)
+	got, err := ReadToString(testFs, filename)
+	assert.NoError(t, err)
 	assert.Equal(t, string(data), got)
+	_, err = ReadToString(testFs, "missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
 
 }